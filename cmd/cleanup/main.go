@@ -16,6 +16,8 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/alexflint/go-arg"
 	"github.com/jmoiron/sqlx"
@@ -23,6 +25,7 @@ import (
 	"jo-m.ch/go/trainbot/internal/pkg/db"
 	"jo-m.ch/go/trainbot/internal/pkg/logging"
 	"jo-m.ch/go/trainbot/internal/pkg/upload"
+	"jo-m.ch/go/trainbot/pkg/dzi"
 )
 
 type config struct {
@@ -81,9 +84,13 @@ func main() {
 		log.Panic().Err(err).Send()
 	}
 
-	// Add thumbs.
+	// Add thumbs, and collect the directories with tiles.
+	tileDirs := map[string]struct{}{}
 	for k := range dbBlobs {
 		dbBlobs[upload.GetThumbName(k)] = struct{}{}
+		if filepath.Ext(k) == dzi.DescriptorExt {
+			tileDirs[dzi.FilesDir(k)] = struct{}{}
+		}
 	}
 
 	// Load on disk file names.
@@ -92,6 +99,20 @@ func main() {
 	// Check.
 	missing := 0
 	for _, file := range files {
+		// Tiles are removed together with their directory.
+		top, _, inDir := strings.Cut(file, "/")
+		if _, ok := tileDirs[top]; ok {
+			continue
+		}
+		if inDir {
+			continue
+		}
+		if strings.HasSuffix(file, dzi.FilesDirSuffix) {
+			fmt.Printf("rm -rf %s\n", file)
+			missing++
+			continue
+		}
+
 		_, inDB := dbBlobs[file]
 		if !inDB {
 			fmt.Printf("rm -f %s\n", file)
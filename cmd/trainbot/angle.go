@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/rs/zerolog/log"
+	"jo-m.ch/go/trainbot/internal/pkg/stitch"
+	"jo-m.ch/go/trainbot/pkg/imutil"
+)
+
+type angleCmd struct {
+	MaxTrains int `arg:"--max-trains" default:"0" help:"Stop after this many trains (0: process the whole video)" placeholder:"N"`
+}
+
+// stitchTrains detects and stitches the trains passing in a recording (with the --rect-.. region), and calls handle
+// for each of them. Stops after maxTrains trains (0: process the whole video).
+func stitchTrains(c config, maxTrains int, handle func(*stitch.Train)) {
+	if c.InputFile == "" {
+		log.Panic().Msg("no camera device or video file passed")
+	}
+	rect := c.getRect()
+	if rect.Empty() {
+		log.Panic().Msg("no rect set (use --rect-.. parameters to set crop region)")
+	}
+
+	remapParams, err := loadRemap(c.RemapFile)
+	if err != nil {
+		log.Panic().Err(err).Msg("failed to load remap parameters")
+	}
+	remapper := mustNewRemap(remapParams, rect)
+
+	src, err := openSrc(c, rect)
+	if err != nil {
+		log.Panic().Err(err).Str("path", c.InputFile).Msg("failed to open video source")
+	}
+	defer src.Close()
+	if c.InputFile == inputFilePiCam3 {
+		// PiCam output is already cropped.
+		rect = rect.Sub(rect.Min)
+	}
+
+	stitcher := stitch.NewAutoStitcher(c.stitchConfig(mustLoadStitchMask(c.RectMask, remapper)))
+	defer stitcher.Close()
+
+	n := 0
+	addTrains := func(trains []*stitch.Train) {
+		for _, t := range trains {
+			handle(t)
+			n++
+		}
+	}
+
+	for maxTrains == 0 || n < maxTrains {
+		frame, ts, err := src.GetFrame()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			log.Panic().Err(err).Msg("failed to get frame")
+		}
+
+		if frame.Bounds() != rect {
+			frame, err = imutil.Sub(frame, rect)
+			if err != nil {
+				log.Panic().Err(err).Msg("failed to crop frame")
+			}
+		}
+		frame = imutil.Copy(frame)
+		if remapper != nil {
+			frame, err = remapper.Apply(frame)
+			if err != nil {
+				log.Panic().Err(err).Msg("failed to remap frame")
+			}
+		}
+		addTrains(stitcher.Frame(frame, *ts))
+	}
+	addTrains(stitcher.TryStitchAndReset())
+}
+
+// runAngle measures the angle of the track from the trains passing in a recording.
+func runAngle(c config) {
+	var angles []float64
+	stitchTrains(c, c.Angle.MaxTrains, func(t *stitch.Train) {
+		log.Info().Time("ts", t.StartTS).Float64("trackAngleDeg", t.TrackAngleDeg).Msg("measured train")
+		angles = append(angles, t.TrackAngleDeg)
+	})
+
+	if len(angles) == 0 {
+		log.Panic().Msg("no trains found, cannot measure the track angle")
+	}
+
+	// The median is robust against trains on which the angle could not be measured.
+	slices.Sort(angles)
+	angle := angles[len(angles)/2]
+	log.Info().Int("trains", len(angles)).Float64("trackAngleDeg", angle).Msg("measured track angle")
+	fmt.Printf("TRACK_ANGLE_DEG=%.2f\n", angle)
+}
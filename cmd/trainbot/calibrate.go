@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/rs/zerolog/log"
+	"jo-m.ch/go/trainbot/internal/pkg/calib"
+	"jo-m.ch/go/trainbot/pkg/imutil"
+)
+
+type calibrateCmd struct {
+	Image    string  `arg:"--image" help:"Image to calibrate from, e.g. a stitched train (default: first frame from --input, cropped to --rect-..)" placeholder:"FILE"`
+	SpacingM float64 `arg:"--spacing-m" default:"0.6" help:"Distance between sleepers (or any other repeating pattern in the image) [m]" placeholder:"M"`
+}
+
+// mustGetCalibrationFrame returns the first frame from the video source, cropped to the configured rect.
+func mustGetCalibrationFrame(c config) image.Image {
+	rect := c.getRect()
+	if rect.Empty() {
+		log.Panic().Msg("no rect set (use --rect-.. parameters to set crop region, or pass --image)")
+	}
+
+	src, err := openSrc(c, rect)
+	if err != nil {
+		log.Panic().Err(err).Str("path", c.InputFile).Msg("failed to open video source")
+	}
+	defer src.Close()
+
+	frame, _, err := src.GetFrame()
+	if err != nil {
+		log.Panic().Err(err).Msg("failed to get frame")
+	}
+	if c.InputFile == inputFilePiCam3 {
+		// PiCam output is already cropped.
+		return imutil.Copy(frame)
+	}
+
+	cropped, err := imutil.Sub(frame, rect)
+	if err != nil {
+		log.Panic().Err(err).Msg("failed to crop frame")
+	}
+	return imutil.Copy(cropped)
+}
+
+// runCalibrate estimates --px-per-m from the spacing of the sleepers.
+func runCalibrate(c config) {
+	var img image.Image
+	var err error
+	if c.Calibrate.Image != "" {
+		img, err = imutil.Load(c.Calibrate.Image)
+		if err != nil {
+			log.Panic().Err(err).Str("image", c.Calibrate.Image).Msg("failed to load image")
+		}
+	} else {
+		if c.InputFile == "" {
+			log.Panic().Msg("pass either --image or --input")
+		}
+		img = mustGetCalibrationFrame(c)
+	}
+
+	res, err := calib.Calibrate(img, calib.Config{SpacingM: c.Calibrate.SpacingM})
+	if err != nil {
+		log.Panic().Err(err).Float64("confidence", res.Confidence).Msg("calibration failed")
+	}
+
+	log.Info().
+		Float64("periodPx", res.PeriodPx).
+		Float64("pxPerM", res.PixelsPerM).
+		Float64("confidence", res.Confidence).
+		Msg("calibrated")
+	fmt.Printf("PX_PER_M=%.1f\n", res.PixelsPerM)
+}
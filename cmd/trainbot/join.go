@@ -0,0 +1,77 @@
+package main
+
+import (
+	"image"
+	"math"
+
+	"github.com/nfnt/resize"
+	"github.com/rs/zerolog/log"
+	"jo-m.ch/go/trainbot/internal/pkg/db"
+	"jo-m.ch/go/trainbot/internal/pkg/stitch"
+	"jo-m.ch/go/trainbot/pkg/imutil"
+)
+
+// Maximum difference of the scales (see db.Train.ImgScale) of the parts of a train which are joined.
+const joinMaxScaleDiff = 0.001
+
+type joinCmd struct {
+	GroupID int64  `arg:"--group-id,required" help:"Group id of the train (i.e. database id of the first part)" placeholder:"ID"`
+	Output  string `arg:"--output,required" help:"Output image file (.jpg or .png)" placeholder:"FILE"`
+}
+
+// runJoin joins the images of all parts of a train into a single image.
+func runJoin(c config) {
+	dbx := c.mustOpenDB()
+	defer dbx.Close()
+
+	parts, err := db.GetTrainParts(dbx, c.Join.GroupID)
+	if err != nil {
+		log.Panic().Err(err).Msg("failed to query train parts")
+	}
+	if len(parts) == 0 {
+		log.Panic().Int64("groupID", c.Join.GroupID).Msg("no parts found")
+	}
+
+	// Join the unenhanced images if possible, as enhancement is not the same for all parts.
+	useOrig := true
+	for _, part := range parts {
+		useOrig = useOrig && part.OrigImg
+		if (part.ImgScale == nil) != (parts[0].ImgScale == nil) ||
+			part.ImgScale != nil && math.Abs(*part.ImgScale-*parts[0].ImgScale) > joinMaxScaleDiff {
+			log.Panic().Int("part", part.Part).Msg("parts were stored at different scales, cannot join them")
+		}
+	}
+
+	imgs := make([]image.Image, len(parts))
+	for i, part := range parts {
+		fileName := part.ImgFileName()
+		if useOrig {
+			fileName = part.OrigImgFileName()
+		}
+		log.Info().Int64("id", part.ID).Int("part", part.Part).Str("img", fileName).Msg("loading part")
+		imgs[i], err = imutil.Load(c.GetBlobPath(fileName))
+		if err != nil {
+			log.Panic().Err(err).Msg("failed to load part image")
+		}
+
+		// Crop off the caption.
+		if part.ImgH != nil {
+			b := imgs[i].Bounds()
+			imgs[i], err = imutil.Sub(imgs[i], image.Rect(b.Min.X, b.Min.Y, b.Max.X, b.Min.Y+*part.ImgH))
+			if err != nil {
+				log.Panic().Err(err).Msg("failed to crop part image")
+			}
+		}
+	}
+
+	joined, err := stitch.JoinParts(&log.Logger, imgs, parts[0].SpeedPxS > 0)
+	if err != nil {
+		log.Panic().Err(err).Msg("failed to join parts")
+	}
+
+	err = imutil.Dump(c.Join.Output, resize.Thumbnail(maxJpgDimension, maxJpgDimension, joined, resize.Bilinear))
+	if err != nil {
+		log.Panic().Err(err).Msg("failed to write joined image")
+	}
+	log.Info().Str("output", c.Join.Output).Int("nParts", len(parts)).Msg("wrote joined image")
+}
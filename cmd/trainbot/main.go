@@ -13,6 +13,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime/pprof"
+	"slices"
 	"sync"
 	"time"
 
@@ -25,7 +26,11 @@ import (
 	"jo-m.ch/go/trainbot/internal/pkg/prometheus"
 	"jo-m.ch/go/trainbot/internal/pkg/stitch"
 	"jo-m.ch/go/trainbot/internal/pkg/upload"
+	"jo-m.ch/go/trainbot/pkg/dzi"
+	"jo-m.ch/go/trainbot/pkg/enhance"
 	"jo-m.ch/go/trainbot/pkg/imutil"
+	"jo-m.ch/go/trainbot/pkg/privacy"
+	"jo-m.ch/go/trainbot/pkg/remap"
 	"jo-m.ch/go/trainbot/pkg/vid"
 )
 
@@ -43,13 +48,53 @@ type config struct {
 	RectH    uint    `arg:"-H,--rect-h,env:RECT_H" help:"Rect to look at, height" placeholder:"N"`
 	RectMask *string `arg:"--mask,env:RECT_MASK" help:"When stitching, only take pixels from the white areas in the mask." placeholder:"FILE"`
 
+	RemapFile *string `arg:"--remap,env:REMAP" help:"JSON file with parameters to correct lens distortion and perspective of the cropped frames (see the remap command). The mask applies to the corrected frames" placeholder:"FILE"`
+
+	PrivacyBands   []string `arg:"--privacy-band,separate,env:PRIVACY_BANDS" help:"Range of rows 'Y0-Y1' (relative to the top of the rect, e.g. the windows of passing trains) to pixelate or blur in all stored images. Can be passed multiple times" placeholder:"Y0-Y1"`
+	PrivacyRects   []string `arg:"--privacy-rect,separate,env:PRIVACY_RECTS" help:"Area 'x,y,w,h' (relative to the top left of the rect) to pixelate or blur in all stored images. Can be passed multiple times" placeholder:"X,Y,W,H"`
+	PrivacyMode    string   `arg:"--privacy-mode,env:PRIVACY_MODE" default:"pixelate" help:"How --privacy-band and --privacy-rect areas are hidden: pixelate or blur" placeholder:"M"`
+	PrivacyBlockPx int      `arg:"--privacy-block-px,env:PRIVACY_BLOCK_PX" default:"12" help:"Size of the pixelation blocks, or radius of the blur" placeholder:"N"`
+	// Set by parseCheckArgs(), nil if nothing is hidden.
+	privacy *privacy.Config
+
+	RegionsFile string `arg:"--regions,env:REGIONS" help:"JSON file with multiple named regions (e.g. tracks) to look at, instead of --rect-.. (see README)" placeholder:"FILE"`
+	// Set by parseCheckArgs().
+	regions []region
+
 	Rotate180 bool `arg:"--rotate-180,env:ROTATE_180" help:"Rotate camera picture 180 degrees (only picam3)"`
 
 	PixelsPerM          float64 `arg:"--px-per-m,env:PX_PER_M" default:"45" help:"Pixels per meter, can be reconstructed from sleepers: they are usually 0.6m apart (in Europe)" placeholder:"K"`
 	MinSpeedKPH         float64 `arg:"--min-speed-kph,env:MIN_SPEED_KPH" default:"25" help:"Assumed train min speed, km/h" placeholder:"K"`
 	MaxSpeedKPH         float64 `arg:"--max-speed-kph,env:MAX_SPEED_KPH" default:"160" help:"Assumed train max speed, km/h" placeholder:"K"`
 	MinLengthM          float64 `arg:"--min-len-m,env:MIN_LEN_M" default:"5" help:"Minimum length of trains" placeholder:"K"`
-	MaxFrameCountPerSeq int     `arg:"--max-frame-count-per-seq,env:MAX_FRAME_COUNT_PER_SEQ" default:"1500" help:"How many frames to accept max. before force-ending a train sequence. If you have high fps videos/long trains, you can increase it from the default, but the program will use more memory." placeholder:"N"`
+	MaxFrameCountPerSeq int     `arg:"--max-frame-count-per-seq,env:MAX_FRAME_COUNT_PER_SEQ" default:"1500" help:"How many frames to accept max. before stitching a train sequence, longer trains are split into multiple parts. If you have high fps videos/long trains, you can increase it from the default, but the program will use more memory (see also --low-memory)." placeholder:"N"`
+	LowMemory           bool    `arg:"--low-memory,env:LOW_MEMORY" help:"Only keep the central strip of each frame while a train is passing, and write it to a temporary file in the data dir instead of keeping it in memory. Allows to stitch much longer trains, but the GIF will only show the beginning of the train."`
+	MaxImageMB          int     `arg:"--max-image-mb,env:MAX_IMAGE_MB" default:"50" help:"Maximum size of a stitched image in memory, in MiB. Longer trains are discarded." placeholder:"N"`
+	MotionModel         string  `arg:"--motion-model,env:MOTION_MODEL" default:"constant_accel" help:"Motion model used to smooth train speed: constant_speed, constant_accel, constant_jerk, spline, or auto to select the best one for each train" placeholder:"M"`
+	MinQuality          float64 `arg:"--min-quality,env:MIN_QUALITY" default:"0" help:"Trains with a fit quality score (0..1) below this are marked as low confidence" placeholder:"Q"`
+	TrackAngleDeg       float64 `arg:"--track-angle-deg,env:TRACK_ANGLE_DEG" default:"0" help:"Angle of the track in the picture, in degrees clockwise from horizontal. Frames are rotated so trains move horizontally (see the angle command to measure it)" placeholder:"DEG"`
+	LineReadoutUS       float64 `arg:"--line-readout-us,env:LINE_READOUT_US" default:"0" help:"Time between the readout of two rows of the camera sensor (rolling shutter), in microseconds. Frames are sheared back so fast trains do not lean (see the shutter command to measure it). Negative if rows are read out from the bottom" placeholder:"US"`
+	Fusion              string  `arg:"--fusion,env:FUSION" default:"last" help:"How overlapping frames are combined when stitching: last (take each pixel from the last frame), mean (less noise at night) or median (also removes rain and snow). mean and median are slower" placeholder:"F"`
+	CarCrops            bool    `arg:"--car-crops,env:CAR_CROPS" help:"Store an image of each car (wagon, locomotive) of a train as a separate file"`
+	EnhanceDenoise      bool    `arg:"--enhance-denoise,env:ENHANCE_DENOISE" help:"Remove noise from the stored train images (3x3 median filter)"`
+	EnhanceWhiteBalance bool    `arg:"--enhance-white-balance,env:ENHANCE_WHITE_BALANCE" help:"Correct the colors of the stored train images, so that they are gray on average"`
+	EnhanceAutoLevels   bool    `arg:"--enhance-auto-levels,env:ENHANCE_AUTO_LEVELS" help:"Stretch the brightness of the stored train images to the full range, helps with dull images at night or in the rain"`
+	EnhanceSharpen      float64 `arg:"--enhance-sharpen,env:ENHANCE_SHARPEN" default:"0" help:"Sharpen the stored train images (unsharp mask) by this amount, e.g. 0.5. 0 to disable" placeholder:"X"`
+	KeepOriginal        bool    `arg:"--keep-original,env:KEEP_ORIGINAL" help:"If train images are enhanced (--enhance-..), also store the original image as a separate file"`
+	Tiles               bool    `arg:"--tiles,env:TILES" help:"Also store each train image at full resolution as a zoomable tile pyramid (Deep Zoom, for e.g. OpenSeadragon). The JPEG is still stored, but might be downscaled for very long trains"`
+	SiteName            string  `arg:"--site-name,env:SITE_NAME" help:"Name of the place the camera looks at (e.g. the station), written into the metadata of the stored images" placeholder:"NAME"`
+	Caption             bool    `arg:"--caption,env:CAPTION" help:"Add a strip with the time, speed, length and direction below the stored train images"`
+	SaveSequences       bool    `arg:"--save-sequences,env:SAVE_SEQUENCES" help:"Save the frames of each train to the sequences/ directory, so it can be stitched again later (see the restitch command). Uses a lot of disk space."`
+	KeepSequencesDays   int     `arg:"--keep-sequences-days,env:KEEP_SEQUENCES_DAYS" default:"7" help:"Saved sequences (see --save-sequences) older than this are deleted. 0 to keep them forever" placeholder:"N"`
+	DebugBundles        bool    `arg:"--debug-bundles,env:DEBUG_BUNDLES" help:"Write a diagnostic bundle (HTML report, measurements, motion model plots, images) for each sequence to the debug/ directory, including rejected ones"`
+	KeepRejected        int     `arg:"--keep-rejected,env:KEEP_REJECTED" default:"1000" help:"Number of rejected sequences (which did not result in a train) to keep in the database, see the rejected command. 0 to not store them" placeholder:"N"`
+	StitchQueueSize     int     `arg:"--stitch-queue-size,env:STITCH_QUEUE_SIZE" default:"2" help:"Number of trains which may wait to be stitched in the background (trains ending while the queue is full are dropped), 0 to stitch synchronously" placeholder:"N"`
+
+	GoodCosScoreNoMove float64 `arg:"--good-cos-no-move,env:GOOD_COS_NO_MOVE" default:"0.99" help:"Minimum similarity (0..1) between consecutive frames to consider the scene idle" placeholder:"X"`
+	GoodCosScoreMove   float64 `arg:"--good-cos-move,env:GOOD_COS_MOVE" default:"0.925" help:"Minimum similarity (0..1) between consecutive frames to start a new sequence" placeholder:"X"`
+	DxLowPassFactor    float64 `arg:"--dx-low-pass,env:DX_LOW_PASS" default:"0.95" help:"Low pass filter factor (0..1) for detecting the end of a sequence, higher means the sequence ends later" placeholder:"X"`
+	MinContrastAvgDev  float64 `arg:"--min-contrast,env:MIN_CONTRAST" default:"0.01" help:"Minimum contrast (average deviation of pixel values, 0..1), frames with less contrast are ignored" placeholder:"X"`
+	MinFramePeriodS    float64 `arg:"--min-frame-period-s,env:MIN_FRAME_PERIOD_S" default:"0.01" help:"Minimum time between frames, faster frames are ignored" placeholder:"S"`
 
 	CPUProfile  bool `arg:"--cpu-profile,env:CPU_PROFILE" help:"Write CPU profile"`
 	HeapProfile bool `arg:"--heap-profile,env:HEAP_PROFILE" help:"Write memory heap profiles"`
@@ -61,12 +106,82 @@ type config struct {
 
 	Prometheus       bool   `arg:"--prometheus,env:PROMETHEUS" default:"false" help:"Expose Prometheus-compatible metrics endpoint."`
 	PrometheusListen string `arg:"--prometheus-listen,env:PROMETHEUS_LISTEN" default:":18963" help:"Which host and port to bind prometheus endpoint to."`
+
+	Join     *joinCmd     `arg:"subcommand:join" help:"Join the parts of a train which was too long to be stitched at once into a single image"`
+	Tune     *tuneCmd     `arg:"subcommand:tune" help:"Replay a labeled video with different detection thresholds, and report the settings which work best"`
+	Similar  *similarCmd  `arg:"subcommand:similar" help:"List the trains with the most similar colors (livery) to a given train"`
+	Restitch *restitchCmd `arg:"subcommand:restitch" help:"Stitch a train again from its saved sequence (see --save-sequences) with the current settings"`
+	Rejected *rejectedCmd `arg:"subcommand:rejected" help:"List recently rejected sequences, i.e. movement which did not result in a train"`
+
+	Calibrate *calibrateCmd `arg:"subcommand:calibrate" help:"Estimate --px-per-m from the spacing of the sleepers"`
+	ROI       *roiCmd       `arg:"subcommand:roi" help:"Suggest a region of interest (--rect-..) from a video with passing trains"`
+	Angle     *angleCmd     `arg:"subcommand:angle" help:"Measure the angle of the track (--track-angle-deg) from a video with passing trains"`
+	Shutter   *shutterCmd   `arg:"subcommand:shutter" help:"Measure the rolling shutter line readout time (--line-readout-us) from a video with passing trains"`
+	Remap     *remapCmd     `arg:"subcommand:remap" help:"Compute the parameters to correct lens distortion and perspective (--remap) from points marked in a camera picture"`
 }
 
 func (c *config) getRect() image.Rectangle {
 	return image.Rect(0, 0, int(c.RectW), int(c.RectH)).Add(image.Pt(int(c.RectX), int(c.RectY)))
 }
 
+func mustLoadMask(path *string) image.Image {
+	if path == nil {
+		return nil
+	}
+
+	fMask, err := os.Open(*path)
+	if err != nil {
+		log.Panic().Err(err).Msg("failed to open mask")
+	}
+	defer fMask.Close()
+	mask, err := png.Decode(fMask)
+	if err != nil {
+		log.Panic().Err(err).Msg("failed to decode mask")
+	}
+
+	return mask
+}
+
+func (c *config) stitchConfig(mask image.Image) stitch.Config {
+	var sequenceDir string
+	if c.SaveSequences {
+		sequenceDir = c.GetDataPath(sequencesDir)
+	}
+	var debugDir string
+	if c.DebugBundles {
+		debugDir = c.GetDataPath(debugBundlesDir)
+	}
+
+	conf := stitch.Config{
+		PixelsPerM:          c.PixelsPerM,
+		MinSpeedKPH:         c.MinSpeedKPH,
+		MaxSpeedKPH:         c.MaxSpeedKPH,
+		MinLengthM:          c.MinLengthM,
+		MaxFrameCountPerSeq: c.MaxFrameCountPerSeq,
+		Mask:                mask,
+		LowMemory:           c.LowMemory,
+		SpillDir:            c.GetDataPath(spillDir),
+		MaxImageMB:          c.MaxImageMB,
+		MotionModel:         c.MotionModel,
+		MinQuality:          c.MinQuality,
+		TrackAngleDeg:       c.TrackAngleDeg,
+		LineReadoutS:        c.LineReadoutUS / 1e6,
+		Fusion:              c.Fusion,
+		StitchQueueSize:     c.StitchQueueSize,
+		GoodCosScoreNoMove:  c.GoodCosScoreNoMove,
+		GoodCosScoreMove:    c.GoodCosScoreMove,
+		DxLowPassFactor:     c.DxLowPassFactor,
+		MinContrastAvgDev:   c.MinContrastAvgDev,
+		MinFramePeriodS:     c.MinFramePeriodS,
+		SequenceDir:         sequenceDir,
+		DebugDir:            debugDir,
+	}
+	if c.privacy != nil {
+		conf.Privacy = *c.privacy
+	}
+	return conf
+}
+
 func (c *config) mustOpenDB() *sqlx.DB {
 	dbx, err := db.Open(c.GetDBPath())
 	if err != nil {
@@ -80,10 +195,23 @@ const (
 	rectSizeMin = 100
 	rectSizeMax = 500
 
+	// Reduce resolution to avoid JPEG/browser limits.
+	maxJpgDimension = uint(1<<15 - 1)
+
 	failedFramesMax = 50
 
+	// Number of rejected sequences which may wait to be stored in the database.
+	rejectedQueueSize = 10
+
 	inputFilePiCam3 = "picam3"
 
+	// Subdirectory of the data dir for saved sequences.
+	sequencesDir = "sequences"
+	// Subdirectory of the data dir for diagnostic bundles.
+	debugBundlesDir = "debug"
+	// Subdirectory of the data dir for temporary files in low memory mode.
+	spillDir = "spill"
+
 	profCPUFile  = "prof-cpu.gz"
 	profHeapFile = "prof-heap-%05d.gz"
 )
@@ -96,29 +224,64 @@ func parseCheckArgs() config {
 		prometheus.Init(c.PrometheusListen)
 	}
 
-	if c.InputFile == "" {
-		p.Fail("no camera device or video file passed")
+	// Flags which are shared with the subcommands (e.g. restitch and tune also stitch trains).
+	for _, v := range []float64{c.GoodCosScoreNoMove, c.GoodCosScoreMove, c.DxLowPassFactor, c.MinContrastAvgDev} {
+		if v <= 0 || v >= 1 {
+			p.Fail("--good-cos-no-move, --good-cos-move, --dx-low-pass and --min-contrast must be between 0 and 1")
+		}
+	}
+	if c.MinQuality < 0 || c.MinQuality > 1 {
+		p.Fail("--min-quality must be between 0 and 1")
+	}
+	if c.StitchQueueSize < 0 {
+		p.Fail("--stitch-queue-size must not be negative")
+	}
+	if c.EnhanceSharpen < 0 {
+		p.Fail("--enhance-sharpen must not be negative")
+	}
+	if c.KeepRejected < 0 {
+		p.Fail("--keep-rejected must not be negative")
+	}
+	if c.KeepSequencesDays < 0 {
+		p.Fail("--keep-sequences-days must not be negative")
+	}
+	if !slices.Contains(stitch.MotionModelNames, c.MotionModel) {
+		p.Fail(fmt.Sprintf("invalid motion model '%s'", c.MotionModel))
+	}
+	if !slices.Contains(stitch.FusionNames, c.Fusion) {
+		p.Fail(fmt.Sprintf("invalid fusion mode '%s'", c.Fusion))
 	}
 
-	r := c.getRect()
-	if r.Size().X == 0 && r.Size().Y == 0 {
-		p.Fail("no rect set (use --rect-.. parameters to set crop region)")
+	pc, err := c.parsePrivacy()
+	if err != nil {
+		p.Fail(err.Error())
 	}
-	if r.Size().X < rectSizeMin || r.Size().Y < rectSizeMin {
-		p.Fail(fmt.Sprintf("rect is too small (minimum width and height is %d px)", rectSizeMin))
+	c.privacy = pc
+
+	if p.Subcommand() != nil {
+		// Subcommands check their own flags, and load the regions if they need them.
+		return c
 	}
-	if r.Size().X > rectSizeMax || r.Size().Y > rectSizeMax {
-		p.Fail(fmt.Sprintf("rect is too large (maximum width and height is %d px)", rectSizeMax))
+
+	if c.InputFile == "" {
+		p.Fail("no camera device or video file passed")
 	}
 
+	regions, err := c.loadRegions()
+	if err != nil {
+		p.Fail(err.Error())
+	}
+	c.regions = regions
+
 	return c
 }
 
-func openSrc(c config) (vid.Src, error) {
+// openSrc opens the video source, rect is the part of the picture which is needed.
+func openSrc(c config, rect image.Rectangle) (vid.Src, error) {
 	// Pi cam.
 	if c.InputFile == inputFilePiCam3 {
 		return vid.NewPiCam3Src(vid.PiCam3Config{
-			Rect:      c.getRect(),
+			Rect:      rect,
 			Focus:     0,
 			Rotate180: c.Rotate180,
 			Format:    vid.FourCCFromString(c.CameraFormatFourCC),
@@ -143,39 +306,95 @@ func openSrc(c config) (vid.Src, error) {
 	})
 }
 
-func detectTrainsForever(c config, trainsOut chan<- *stitch.Train) {
-	rect := c.getRect()
+// handleStitchEvent logs sequence lifecycle events and exposes them as metrics.
+func handleStitchEvent(conf stitch.Config, e stitch.Event) {
+	prometheus.RecordStitchEvent(conf.Region, e.Type.String())
+	speedKPH := e.SpeedPxS / conf.PixelsPerM * 3.6
+
+	l := log.Info()
+	switch e.Type {
+	case stitch.EventSequenceStarted, stitch.EventSequenceProgress:
+		prometheus.RecordTrainPassing(conf.Region, true, speedKPH)
+		if e.Type == stitch.EventSequenceProgress {
+			l = log.Debug()
+		}
+		l = l.Float64("speedKmh", speedKPH)
+	case stitch.EventSequenceEnded:
+		prometheus.RecordTrainPassing(conf.Region, false, 0)
+		l = l.Int("nTrains", e.NTrains)
+	case stitch.EventSequenceRejected:
+		l = l.Str("reason", string(e.Err.Reason)).AnErr("err", e.Err.Err)
+	}
+
+	l.Str("region", conf.Region).
+		Str("event", e.Type.String()).
+		Time("startTs", e.StartTS).
+		Time("ts", e.TS).
+		Int("nFrames", e.NFrames).
+		Msg("sequence event")
+}
 
-	src, err := openSrc(c)
+// rejectedSequence is a sequence which did not result in a train, to be stored in the database.
+type rejectedSequence struct {
+	region string
+	err    *stitch.RejectError
+}
+
+// queueRejected hands over a rejected sequence to processRejected(), without blocking.
+func queueRejected(rejectedOut chan<- rejectedSequence, region string, e stitch.Event) {
+	if rejectedOut == nil || e.Type != stitch.EventSequenceRejected {
+		return
+	}
+
+	select {
+	case rejectedOut <- rejectedSequence{region: region, err: e.Err}:
+	default:
+		log.Warn().Str("region", region).Time("startTs", e.StartTS).Msg("rejected sequences queue full, not storing")
+	}
+}
+
+// regionStitcher detects trains in one region.
+type regionStitcher struct {
+	// Rect to crop from the source frames.
+	rect     image.Rectangle
+	stitcher *stitch.AutoStitcher
+	// Nil if frames are not corrected.
+	remap *remap.Map
+}
+
+// rejectedOut may be nil.
+func detectTrainsForever(c config, trainsOut chan<- *stitch.Train, rejectedOut chan<- rejectedSequence) {
+	srcRect := regionsRect(c.regions)
+	src, err := openSrc(c, srcRect)
 	if err != nil {
 		log.Panic().Err(err).Str("path", c.InputFile).Msg("failed to open video source")
 	}
 	defer src.Close()
 	srcBuf := vid.NewSrcBuf(src, failedFramesMax)
 
-	var mask image.Image
-	if c.RectMask != nil {
-		fMask, err := os.Open(*c.RectMask)
-		if err != nil {
-			log.Panic().Err(err)
-		}
-		mask, err = png.Decode(fMask)
-		if err != nil {
-			log.Panic().Err(err)
+	stitchers := make([]regionStitcher, len(c.regions))
+	for i, r := range c.regions {
+		conf := c.regionStitchConfig(r)
+		rect := r.getRect()
+		if c.InputFile == inputFilePiCam3 {
+			// PiCam output is already cropped to srcRect.
+			rect = rect.Sub(srcRect.Min)
 		}
+
+		stitcher := stitch.NewAutoStitcher(conf)
+		stitcher.SetEventHandler(func(e stitch.Event) {
+			handleStitchEvent(conf, e)
+			queueRejected(rejectedOut, conf.Region, e)
+		})
+		stitchers[i] = regionStitcher{rect: rect, stitcher: stitcher, remap: mustNewRemap(r.Remap, r.getRect())}
+		log.Info().Str("region", r.Name).Interface("rect", r.getRect()).Float64("pxPerM", r.PixelsPerM).Msg("detecting trains in region")
 	}
-	stitcher := stitch.NewAutoStitcher(stitch.Config{
-		PixelsPerM:          c.PixelsPerM,
-		MinSpeedKPH:         c.MinSpeedKPH,
-		MaxSpeedKPH:         c.MaxSpeedKPH,
-		MinLengthM:          c.MinLengthM,
-		MaxFrameCountPerSeq: c.MaxFrameCountPerSeq,
-		Mask:                mask,
-	})
 	defer func() {
-		train := stitcher.TryStitchAndReset()
-		if train != nil {
-			trainsOut <- train
+		for _, s := range stitchers {
+			for _, train := range s.stitcher.TryStitchAndReset() {
+				trainsOut <- train
+			}
+			s.stitcher.Close()
 		}
 	}()
 
@@ -186,29 +405,35 @@ func detectTrainsForever(c config, trainsOut chan<- *stitch.Train) {
 			break
 		}
 
-		var cropped image.Image
-		if c.InputFile == inputFilePiCam3 {
-			// PiCam output is already cropped.
-			cropped = frame
-		} else {
-			cropped, err = imutil.Sub(frame, rect)
-			if err != nil {
-				log.Panic().Err(err).Msg("failed to crop frame")
+		for _, s := range stitchers {
+			var cropped image.Image
+			if frame.Bounds() == s.rect {
+				cropped = frame
+			} else {
+				cropped, err = imutil.Sub(frame, s.rect)
+				if err != nil {
+					log.Panic().Err(err).Msg("failed to crop frame")
+				}
+
+				// Create a new image with only the cropped pixels,
+				// so we can gc the potentially large area from the
+				// original image.
+				cropped = imutil.Copy(cropped)
 			}
 
-			// Create a new image with only the cropped pixels,
-			// so we can gc the potentially large area from the
-			// original image.
-			cropped = imutil.Copy(cropped)
-		}
-
-		if cropped.Bounds().Size() != rect.Size() {
-			log.Panic().Interface("cam", cropped.Bounds().Size()).Interface("conf", rect.Size()).Msg("rect size mismatch")
-		}
+			if cropped.Bounds().Size() != s.rect.Size() {
+				log.Panic().Interface("cam", cropped.Bounds().Size()).Interface("conf", s.rect.Size()).Msg("rect size mismatch")
+			}
+			if s.remap != nil {
+				cropped, err = s.remap.Apply(cropped)
+				if err != nil {
+					log.Panic().Err(err).Msg("failed to remap frame")
+				}
+			}
 
-		train := stitcher.Frame(cropped, *ts)
-		if train != nil {
-			trainsOut <- train
+			for _, train := range s.stitcher.Frame(cropped, *ts) {
+				trainsOut <- train
+			}
 		}
 
 		if c.HeapProfile && i%1000 == 0 {
@@ -234,53 +459,215 @@ func detectTrainsForever(c config, trainsOut chan<- *stitch.Train) {
 	}
 }
 
-func processTrains(store upload.DataStore, dbx *sqlx.DB, trainsIn <-chan *stitch.Train, wg *sync.WaitGroup) {
+// blobConfig describes how the blobs of each train are stored.
+type blobConfig struct {
+	carCrops bool
+	enhance  enhance.Config
+	// keepOriginal stores the original image as well, if it was enhanced.
+	keepOriginal bool
+	// tiles stores the image as Deep Zoom tiles at full resolution as well.
+	tiles bool
+	// siteName is written into the metadata of the images.
+	siteName string
+	// caption adds a strip with a description below the train image (and the original image).
+	caption bool
+}
+
+func (c *config) blobConfig() blobConfig {
+	return blobConfig{
+		carCrops: c.CarCrops,
+		enhance: enhance.Config{
+			Denoise:      c.EnhanceDenoise,
+			WhiteBalance: c.EnhanceWhiteBalance,
+			AutoLevels:   c.EnhanceAutoLevels,
+			Sharpen:      c.EnhanceSharpen,
+		},
+		keepOriginal: c.KeepOriginal,
+		tiles:        c.Tiles,
+		siteName:     c.SiteName,
+		caption:      c.Caption,
+	}
+}
+
+// origImg returns true if the original image is stored as a separate blob.
+func (b blobConfig) origImg() bool {
+	return b.keepOriginal && b.enhance.Enabled()
+}
+
+// setTiles sets the tiles size of dbTrain if tiles are stored for train. Must be called before train.Image is resized.
+func (b blobConfig) setTiles(dbTrain *db.Train, train *stitch.Train) {
+	dbTrain.TilesW, dbTrain.TilesH = nil, nil
+	if b.tiles {
+		w, h := train.Image.Rect.Dx(), train.Image.Rect.Dy()
+		dbTrain.TilesW, dbTrain.TilesH = &w, &h
+	}
+}
+
+func processTrains(store upload.DataStore, dbx *sqlx.DB, trainsIn <-chan *stitch.Train, blobs blobConfig, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	for train := range trainsIn {
 		log.Info().
+			Str("region", train.Conf.Region).
 			Time("ts", train.StartTS).
 			Float64("speedMpS", train.SpeedMpS()).
 			Float64("speedKmh", train.SpeedMpS()*3.6).
 			Float64("accelMpS2", train.AccelMpS2()).
 			Str("direction", train.DirectionS()).
+			Int("part", train.Part).
+			Str("model", train.Model).
+			Float64("quality", train.Quality.Score).
+			Float64("trackAngleDeg", train.TrackAngleDeg).
+			Bool("lowConfidence", train.Quality.LowConfidence).
+			Int("nCars", len(train.Cars)).
+			Int("nAxles", len(train.AxlesM)).
 			Msg("found train")
 
-		// reduce resolution to avoid JPEG/browser limits
-		maxJpgDimension := uint(1<<15 - 1)
-		train.Image = resize.Thumbnail(maxJpgDimension, maxJpgDimension, train.Image, resize.Bilinear).(*image.RGBA)
-
-		// Dump stitched image.
-		dbTrain := db.Train{StartTS: train.StartTS}
-		err := imutil.Dump(store.GetBlobPath(dbTrain.ImgFileName()), train.Image)
+		id, err := insertTrainWithBlobs(store, dbx, train, blobs)
 		if err != nil {
 			log.Err(err).Send()
 			continue
 		}
-		log.Debug().Str("imgFileName", dbTrain.ImgFileName()).Msg("wrote JPEG")
+		log.Info().Int64("id", id).Msg("added train to db")
+	}
+}
+
+// insertTrainWithBlobs inserts a train into the database and stores its blobs.
+// The row is inserted first because the blobs contain its id, it is only uploaded after they were written.
+func insertTrainWithBlobs(store upload.DataStore, dbx *sqlx.DB, train *stitch.Train, blobs blobConfig) (int64, error) {
+	id, err := db.InsertPendingTrain(dbx, *train)
+	if err != nil {
+		return 0, err
+	}
+
+	dbTrain := db.Train{
+		ID:       id,
+		StartTS:  train.StartTS,
+		Region:   train.Conf.Region,
+		CarCrops: blobs.carCrops && train.Cars != nil,
+		OrigImg:  blobs.origImg(),
+	}
+	blobs.setTiles(&dbTrain, train)
+	err = dumpBlobs(store, &dbTrain, train, blobs)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, db.SetTrainBlobs(dbx, dbTrain)
+}
 
-		// Dump thumbnail.
-		thumb := resize.Thumbnail(maxJpgDimension, 64, train.Image, resize.Bilinear)
-		err = imutil.DumpJPEG(store.GetBlobThumbPath(dbTrain.ImgFileName()), thumb, 75)
+func processRejected(dbx *sqlx.DB, rejectedIn <-chan rejectedSequence, keep int, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for r := range rejectedIn {
+		id, err := db.InsertRejectedSequence(dbx, r.region, r.err, keep)
 		if err != nil {
 			log.Err(err).Send()
 			continue
 		}
+		log.Debug().Int64("id", id).Str("reason", string(r.err.Reason)).Msg("added rejected sequence to db")
+	}
+}
+
+// dumpBlobs stores the image, thumbnail, GIF and optionally the car crops, the original image and the tiles (if
+// dbTrain.TilesW is set) of a train, under the names of dbTrain. The JPEGs (except the thumbnail and tiles) contain
+// metadata, including dbTrain.ID. The size of the stored image is recorded in dbTrain.
+// If the car crops cannot be stored, the train is kept and dbTrain.CarCrops is cleared.
+// train.Image is enhanced and resized.
+func dumpBlobs(store upload.DataStore, dbTrain *db.Train, train *stitch.Train, blobs blobConfig) error {
+	meta := trainMetadata(dbTrain.ID, train, blobs.siteName)
+	withCaption := func(img image.Image) image.Image {
+		if !blobs.caption {
+			return img
+		}
+		return imutil.Caption(img, meta.Description)
+	}
+
+	if blobs.enhance.Enabled() {
+		if blobs.origImg() {
+			orig := resize.Thumbnail(maxJpgDimension, maxJpgDimension, train.Image, resize.Bilinear)
+			err := imutil.DumpJPEGMeta(store.GetBlobPath(dbTrain.OrigImgFileName()), withCaption(orig), imutil.DefaultJPEGQuality, meta)
+			if err != nil {
+				return err
+			}
+			log.Debug().Str("origImgFileName", dbTrain.OrigImgFileName()).Msg("wrote original JPEG")
+		}
+		train.Image = enhance.Apply(train.Image, blobs.enhance)
+	}
 
-		// Dump GIF.
-		err = imutil.DumpGIF(store.GetBlobPath(dbTrain.GIFFileName()), train.GIF)
+	if dbTrain.CarCrops {
+		err := dumpCarCrops(store, *dbTrain, train, meta)
 		if err != nil {
-			log.Err(err).Send()
-			continue
+			log.Err(err).Msg("failed to write car crops")
+			dbTrain.CarCrops = false
 		}
-		log.Debug().Str("gifFileName", dbTrain.GIFFileName()).Msg("wrote GIF")
+	}
 
-		id, err := db.InsertTrain(dbx, *train)
+	if dbTrain.TilesW != nil {
+		err := dzi.Write(store.GetBlobPath(dbTrain.DZIFileName()), store.GetBlobPath(dbTrain.TilesDirName()), train.Image, imutil.DefaultJPEGQuality)
 		if err != nil {
-			log.Err(err).Send()
+			return err
 		}
-		log.Info().Int64("id", id).Msg("added train to db")
+		log.Debug().Str("dziFileName", dbTrain.DZIFileName()).Msg("wrote tiles")
 	}
+
+	w := train.Image.Rect.Dx()
+	train.Image = resize.Thumbnail(maxJpgDimension, maxJpgDimension, train.Image, resize.Bilinear).(*image.RGBA)
+	imgH, imgScale := train.Image.Rect.Dy(), float64(train.Image.Rect.Dx())/float64(w)
+	dbTrain.ImgH, dbTrain.ImgScale = &imgH, &imgScale
+
+	// Dump stitched image.
+	err := imutil.DumpJPEGMeta(store.GetBlobPath(dbTrain.ImgFileName()), withCaption(train.Image), imutil.DefaultJPEGQuality, meta)
+	if err != nil {
+		return err
+	}
+	log.Debug().Str("imgFileName", dbTrain.ImgFileName()).Msg("wrote JPEG")
+
+	// Dump thumbnail.
+	thumb := resize.Thumbnail(maxJpgDimension, 64, train.Image, resize.Bilinear)
+	err = imutil.DumpJPEG(store.GetBlobThumbPath(dbTrain.ImgFileName()), thumb, 75)
+	if err != nil {
+		return err
+	}
+
+	// Dump GIF.
+	err = imutil.DumpGIF(store.GetBlobPath(dbTrain.GIFFileName()), train.GIF)
+	if err != nil {
+		return err
+	}
+	log.Debug().Str("gifFileName", dbTrain.GIFFileName()).Msg("wrote GIF")
+
+	return nil
+}
+
+// dumpCarCrops stores an image of each car of a train.
+// If one of them fails, the ones already written are removed again.
+// Must be called before train.Image is resized.
+func dumpCarCrops(store upload.DataStore, dbTrain db.Train, train *stitch.Train, meta *imutil.Metadata) error {
+	for i, car := range train.Cars {
+		err := dumpCarCrop(store.GetBlobPath(dbTrain.CarFileName(i)), train, car, meta)
+		if err != nil {
+			for j := range i {
+				rmErr := os.Remove(store.GetBlobPath(dbTrain.CarFileName(j)))
+				if rmErr != nil {
+					log.Err(rmErr).Str("file", dbTrain.CarFileName(j)).Msg("failed to delete car crop")
+				}
+			}
+			return err
+		}
+	}
+	log.Debug().Int("n", len(train.Cars)).Msg("wrote car crops")
+	return nil
+}
+
+func dumpCarCrop(path string, train *stitch.Train, car stitch.Car, meta *imutil.Metadata) error {
+	rect := image.Rect(car.StartPx, 0, car.EndPx, train.Image.Rect.Dy()).Add(train.Image.Rect.Min)
+	crop, err := imutil.Sub(train.Image, rect)
+	if err != nil {
+		return err
+	}
+	crop = resize.Thumbnail(maxJpgDimension, maxJpgDimension, crop, resize.Bilinear)
+	return imutil.DumpJPEGMeta(path, crop, imutil.DefaultJPEGQuality, meta)
 }
 
 func uploadOnce(store upload.DataStore, dbx *sqlx.DB, c upload.FTPConfig) {
@@ -352,31 +739,26 @@ func deleteOldLocalBlobsOnce(store upload.DataStore, dbx *sqlx.DB) error {
 			return err
 		}
 
-		err = os.Remove(store.GetBlobPath(toCleanup.ImgFileName()))
-		if err != nil {
-			if errors.Is(err, fs.ErrNotExist) {
-				log.Debug().Str("path", toCleanup.ImgFileName()).Msg("tried removing but file does not exist")
-			} else {
-				log.Err(err).Send()
-				return err
-			}
+		paths := []string{store.GetBlobThumbPath(toCleanup.ImgFileName())}
+		for _, blob := range toCleanup.Blobs() {
+			paths = append(paths, store.GetBlobPath(blob))
 		}
 
-		err = os.Remove(store.GetBlobThumbPath(toCleanup.ImgFileName()))
-		if err != nil {
-			if errors.Is(err, fs.ErrNotExist) {
-				log.Debug().Str("path", toCleanup.ImgFileName()).Msg("tried removing but file does not exist")
-			} else {
-				log.Err(err).Send()
-				return err
+		for _, path := range paths {
+			err = os.Remove(path)
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					log.Debug().Str("path", path).Msg("tried removing but file does not exist")
+				} else {
+					log.Err(err).Send()
+					return err
+				}
 			}
 		}
-
-		err = os.Remove(store.GetBlobPath(toCleanup.GIFFileName()))
-		if err != nil {
-			if errors.Is(err, fs.ErrNotExist) {
-				log.Debug().Str("path", toCleanup.GIFFileName()).Msg("tried removing but file does not exist")
-			} else {
+		if toCleanup.TilesW != nil {
+			// The tiles were removed above, this removes their (now empty) directories.
+			err = os.RemoveAll(store.GetBlobPath(toCleanup.TilesDirName()))
+			if err != nil {
 				log.Err(err).Send()
 				return err
 			}
@@ -400,15 +782,101 @@ func deleteOldLocalBlobsForever(store upload.DataStore, dbx *sqlx.DB) {
 	}
 }
 
+// deleteOldSequencesOnce deletes the saved sequences in dir which were saved more than maxAge ago.
+func deleteOldSequencesOnce(dir string, maxAge time.Duration) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		if !e.IsDir() || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+
+		log.Debug().Str("sequence", e.Name()).Msg("deleting old sequence")
+		err = os.RemoveAll(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteOldSequencesForever(dir string, maxAge time.Duration) {
+	for {
+		err := deleteOldSequencesOnce(dir, maxAge)
+		if err != nil {
+			log.Err(err).Msg("failed to clean up sequences")
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
 func main() {
 	c := parseCheckArgs()
 
+	if c.Join != nil {
+		runJoin(c)
+		return
+	}
+	if c.Tune != nil {
+		runTune(c)
+		return
+	}
+	if c.Similar != nil {
+		runSimilar(c)
+		return
+	}
+	if c.Restitch != nil {
+		runRestitch(c)
+		return
+	}
+	if c.Rejected != nil {
+		runRejected(c)
+		return
+	}
+	if c.Calibrate != nil {
+		runCalibrate(c)
+		return
+	}
+	if c.ROI != nil {
+		runROI(c)
+		return
+	}
+	if c.Angle != nil {
+		runAngle(c)
+		return
+	}
+	if c.Shutter != nil {
+		runShutter(c)
+		return
+	}
+
+	if c.Remap != nil {
+		runRemap(c)
+		return
+	}
+
 	// Try to create output directory.
 	err := os.MkdirAll(c.DataDir, 0750)
 	if err != nil {
 		log.Panic().Err(err).Msg("could not create output directory")
 	}
 
+	// Left over if the process was stopped while a train was passing.
+	err = os.RemoveAll(c.GetDataPath(spillDir))
+	if err != nil {
+		log.Panic().Err(err).Msg("could not remove temporary files")
+	}
+
 	log.Info().Interface("config", c).Msg("starting")
 
 	if c.CPUProfile {
@@ -436,15 +904,28 @@ func main() {
 	trains := make(chan *stitch.Train)
 	done := sync.WaitGroup{}
 	done.Add(1)
-	go processTrains(c.DataStore, c.mustOpenDB(), trains, &done)
+	go processTrains(c.DataStore, c.mustOpenDB(), trains, c.blobConfig(), &done)
 	if c.EnableUpload {
 		go uploadForever(c.DataStore, c.mustOpenDB(), c.FTPConfig)
 		go deleteOldLocalBlobsForever(c.DataStore, c.mustOpenDB())
 		go cleanupOrphanedRemoteBlobsForever(c.mustOpenDB(), c.FTPConfig)
 	}
+	if c.SaveSequences && c.KeepSequencesDays > 0 {
+		go deleteOldSequencesForever(c.GetDataPath(sequencesDir), time.Duration(c.KeepSequencesDays)*24*time.Hour)
+	}
 
-	detectTrainsForever(c, trains)
+	var rejected chan rejectedSequence
+	if c.KeepRejected > 0 {
+		rejected = make(chan rejectedSequence, rejectedQueueSize)
+		done.Add(1)
+		go processRejected(c.mustOpenDB(), rejected, c.KeepRejected, &done)
+	}
+
+	detectTrainsForever(c, trains, rejected)
 
 	close(trains)
+	if rejected != nil {
+		close(rejected)
+	}
 	done.Wait()
 }
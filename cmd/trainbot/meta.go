@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"jo-m.ch/go/trainbot/internal/pkg/stitch"
+	"jo-m.ch/go/trainbot/pkg/imutil"
+)
+
+const (
+	// Namespace and prefix of the trainbot specific XMP properties in stored images.
+	xmpNamespace = "http://jo-m.ch/go/trainbot/xmp/1.0/"
+	xmpPrefix    = "trainbot"
+
+	captionTimeFormat = "2006-01-02 15:04:05 -07:00"
+)
+
+// trainDescription returns a short human readable description of a train, for the metadata and caption of its images.
+func trainDescription(train *stitch.Train, siteName string) string {
+	parts := []string{}
+	if siteName != "" {
+		parts = append(parts, siteName)
+	}
+	if train.Conf.Region != "" {
+		parts = append(parts, train.Conf.Region)
+	}
+	parts = append(parts,
+		train.StartTS.Format(captionTimeFormat),
+		fmt.Sprintf("%.0f km/h", train.SpeedMpS()*3.6),
+		fmt.Sprintf("%.0f m", train.LengthM()),
+		"moving "+train.DirectionS(),
+	)
+	return strings.Join(parts, " | ")
+}
+
+// trainMetadata returns the metadata embedded into the JPEGs of a train with database id id.
+func trainMetadata(id int64, train *stitch.Train, siteName string) *imutil.Metadata {
+	f := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', 2, 64)
+	}
+
+	return &imutil.Metadata{
+		Time:         train.StartTS,
+		Description:  trainDescription(train, siteName),
+		Software:     "trainbot",
+		XMPNamespace: xmpNamespace,
+		XMPPrefix:    xmpPrefix,
+		Properties: []imutil.Property{
+			{Name: "id", Value: strconv.FormatInt(id, 10)},
+			{Name: "site", Value: siteName},
+			{Name: "region", Value: train.Conf.Region},
+			{Name: "start_ts", Value: train.StartTS.Format("2006-01-02T15:04:05.000Z07:00")},
+			{Name: "speed_kph", Value: f(train.SpeedMpS() * 3.6)},
+			{Name: "length_m", Value: f(train.LengthM())},
+			{Name: "direction", Value: train.DirectionS()},
+			{Name: "px_per_m", Value: f(train.Conf.PixelsPerM)},
+		},
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"jo-m.ch/go/trainbot/internal/pkg/stitch"
+	"jo-m.ch/go/trainbot/pkg/privacy"
+	"jo-m.ch/go/trainbot/pkg/remap"
+)
+
+// Steeper tracks should rather be fixed by rotating the camera.
+const maxTrackAngleDeg = 30
+
+// Region names end up in file names, so keep them simple.
+var regionNameRe = regexp.MustCompile(`^[a-zA-Z0-9-]+$`)
+
+// region is a part of the camera picture in which trains are detected, e.g. one track.
+// Zero values are replaced by the corresponding global flags.
+type region struct {
+	Name string `json:"name"`
+
+	RectX    uint    `json:"rect_x"`
+	RectY    uint    `json:"rect_y"`
+	RectW    uint    `json:"rect_w"`
+	RectH    uint    `json:"rect_h"`
+	RectMask *string `json:"mask"`
+
+	PixelsPerM  float64 `json:"px_per_m"`
+	MinSpeedKPH float64 `json:"min_speed_kph"`
+	MaxSpeedKPH float64 `json:"max_speed_kph"`
+
+	TrackAngleDeg float64 `json:"track_angle_deg"`
+
+	// Remap corrects lens distortion and perspective, in the coordinates of the full camera picture.
+	Remap *remap.Params `json:"remap"`
+	// Privacy selects parts of the (cropped and corrected) frames to pixelate or blur.
+	Privacy *privacy.Config `json:"privacy"`
+}
+
+func (r *region) getRect() image.Rectangle {
+	return image.Rect(0, 0, int(r.RectW), int(r.RectH)).Add(image.Pt(int(r.RectX), int(r.RectY)))
+}
+
+func (r *region) check() error {
+	s := r.getRect().Size()
+	if s.X == 0 && s.Y == 0 {
+		return errors.New("no rect set")
+	}
+	if s.X < rectSizeMin || s.Y < rectSizeMin {
+		return fmt.Errorf("rect is too small (minimum width and height is %d px)", rectSizeMin)
+	}
+	if s.X > rectSizeMax || s.Y > rectSizeMax {
+		return fmt.Errorf("rect is too large (maximum width and height is %d px)", rectSizeMax)
+	}
+	if r.PixelsPerM <= 0 || r.MaxSpeedKPH <= 0 || r.MinSpeedKPH < 0 {
+		return errors.New("px_per_m and max_speed_kph must be > 0, min_speed_kph must be >= 0")
+	}
+	if math.Abs(r.TrackAngleDeg) > maxTrackAngleDeg {
+		return fmt.Errorf("track angle must be between -%d and %d degrees", maxTrackAngleDeg, maxTrackAngleDeg)
+	}
+	if r.Remap != nil {
+		err := r.Remap.Check()
+		if err != nil {
+			return fmt.Errorf("invalid remap parameters: %w", err)
+		}
+	}
+	if r.Privacy != nil {
+		err := r.Privacy.Check()
+		if err != nil {
+			return fmt.Errorf("invalid privacy settings: %w", err)
+		}
+	}
+	return nil
+}
+
+// parsePrivacy returns the parts of the frames to hide from the --privacy-.. flags, or nil if there are none.
+func (c *config) parsePrivacy() (*privacy.Config, error) {
+	if len(c.PrivacyBands) == 0 && len(c.PrivacyRects) == 0 {
+		return nil, nil
+	}
+
+	ret := privacy.Config{Mode: c.PrivacyMode, BlockPx: c.PrivacyBlockPx}
+	for _, s := range c.PrivacyBands {
+		y0, y1, ok := strings.Cut(s, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid privacy band '%s', expected 'Y0-Y1'", s)
+		}
+		var b privacy.Band
+		var err0, err1 error
+		b.Y0, err0 = strconv.Atoi(y0)
+		b.Y1, err1 = strconv.Atoi(y1)
+		if err0 != nil || err1 != nil {
+			return nil, fmt.Errorf("invalid privacy band '%s', expected 'Y0-Y1'", s)
+		}
+		ret.Bands = append(ret.Bands, b)
+	}
+	for _, s := range c.PrivacyRects {
+		fields := strings.Split(s, ",")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("invalid privacy rect '%s', expected 'x,y,w,h'", s)
+		}
+		var v [4]int
+		for i, f := range fields {
+			var err error
+			v[i], err = strconv.Atoi(strings.TrimSpace(f))
+			if err != nil {
+				return nil, fmt.Errorf("invalid privacy rect '%s', expected 'x,y,w,h'", s)
+			}
+		}
+		ret.Rects = append(ret.Rects, privacy.Rect{X: v[0], Y: v[1], W: v[2], H: v[3]})
+	}
+
+	err := ret.Check()
+	if err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// loadRemap loads the parameters to correct frames from a JSON file (see the remap command). Returns nil if path is nil.
+func loadRemap(path *string) (*remap.Params, error) {
+	if path == nil {
+		return nil, nil
+	}
+
+	// #nosec G304
+	buf, err := os.ReadFile(*path)
+	if err != nil {
+		return nil, err
+	}
+	var p remap.Params
+	err = json.Unmarshal(buf, &p)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", *path, err)
+	}
+	return &p, nil
+}
+
+// mustNewRemap precomputes the lookup table to correct frames cropped to rect (in the coordinates of the full camera
+// picture). Returns nil if p is nil.
+func mustNewRemap(p *remap.Params, rect image.Rectangle) *remap.Map {
+	if p == nil {
+		return nil
+	}
+
+	m, err := remap.New(rect, *p)
+	if err != nil {
+		log.Panic().Err(err).Msg("invalid remap parameters")
+	}
+	return m
+}
+
+// mustLoadStitchMask loads the mask from path (see mustLoadMask()). If frames are corrected by m, the mask is restricted
+// to the pixels which come from inside of the frame. The others are left transparent, and must not be drawn over
+// other frames when stitching.
+func mustLoadStitchMask(path *string, m *remap.Map) image.Image {
+	mask := mustLoadMask(path)
+	if m == nil {
+		return mask
+	}
+
+	ret, err := m.Mask(mask)
+	if err != nil {
+		log.Panic().Err(err).Msg("mask does not match the frames")
+	}
+	return ret
+}
+
+// mustLoadFlagsStitchMask loads the mask for the rect and remap parameters given by the flags (see
+// mustLoadStitchMask()).
+func (c *config) mustLoadFlagsStitchMask() image.Image {
+	p, err := loadRemap(c.RemapFile)
+	if err != nil {
+		log.Panic().Err(err).Msg("failed to load remap parameters")
+	}
+	return mustLoadStitchMask(c.RectMask, mustNewRemap(p, c.getRect()))
+}
+
+// regionStitchConfig creates the stitcher configuration for a region.
+func (c *config) regionStitchConfig(r region) stitch.Config {
+	conf := c.stitchConfig(mustLoadStitchMask(r.RectMask, mustNewRemap(r.Remap, r.getRect())))
+	conf.Region = r.Name
+	conf.PixelsPerM = r.PixelsPerM
+	conf.MinSpeedKPH = r.MinSpeedKPH
+	conf.MaxSpeedKPH = r.MaxSpeedKPH
+	conf.TrackAngleDeg = r.TrackAngleDeg
+	conf.Privacy = privacy.Config{}
+	if r.Privacy != nil {
+		conf.Privacy = *r.Privacy
+	}
+	return conf
+}
+
+// loadRegions returns the configured regions.
+// If no regions file was passed, a single unnamed region is created from the --rect-* etc. flags.
+func (c *config) loadRegions() ([]region, error) {
+	globalRemap, err := loadRemap(c.RemapFile)
+	if err != nil {
+		return nil, err
+	}
+	global := region{
+		RectX:       c.RectX,
+		RectY:       c.RectY,
+		RectW:       c.RectW,
+		RectH:       c.RectH,
+		RectMask:    c.RectMask,
+		PixelsPerM:  c.PixelsPerM,
+		MinSpeedKPH: c.MinSpeedKPH,
+		MaxSpeedKPH: c.MaxSpeedKPH,
+
+		TrackAngleDeg: c.TrackAngleDeg,
+		Remap:         globalRemap,
+		Privacy:       c.privacy,
+	}
+
+	if c.RegionsFile == "" {
+		err := global.check()
+		if err != nil {
+			return nil, fmt.Errorf("%w (use --rect-.. parameters or --regions to set crop region)", err)
+		}
+		return []region{global}, nil
+	}
+
+	// #nosec G304
+	buf, err := os.ReadFile(c.RegionsFile)
+	if err != nil {
+		return nil, err
+	}
+	var regions []region
+	err = json.Unmarshal(buf, &regions)
+	if err != nil {
+		return nil, err
+	}
+	if len(regions) == 0 {
+		return nil, errors.New("no regions defined")
+	}
+
+	names := map[string]struct{}{}
+	for i := range regions {
+		r := &regions[i]
+		if !regionNameRe.MatchString(r.Name) {
+			return nil, fmt.Errorf("invalid region name '%s' (only letters, digits and '-' allowed)", r.Name)
+		}
+		if _, ok := names[r.Name]; ok {
+			return nil, fmt.Errorf("duplicate region name '%s'", r.Name)
+		}
+		names[r.Name] = struct{}{}
+
+		if r.RectMask == nil {
+			r.RectMask = global.RectMask
+		}
+		if r.PixelsPerM == 0 {
+			r.PixelsPerM = global.PixelsPerM
+		}
+		if r.MinSpeedKPH == 0 {
+			r.MinSpeedKPH = global.MinSpeedKPH
+		}
+		if r.MaxSpeedKPH == 0 {
+			r.MaxSpeedKPH = global.MaxSpeedKPH
+		}
+		if r.TrackAngleDeg == 0 {
+			r.TrackAngleDeg = global.TrackAngleDeg
+		}
+		if r.Remap == nil {
+			r.Remap = global.Remap
+		}
+		if r.Privacy == nil {
+			r.Privacy = global.Privacy
+		}
+
+		err := r.check()
+		if err != nil {
+			return nil, fmt.Errorf("region '%s': %w", r.Name, err)
+		}
+	}
+
+	return regions, nil
+}
+
+// regionsRect returns the smallest rect containing all regions.
+func regionsRect(regions []region) image.Rectangle {
+	var ret image.Rectangle
+	for _, r := range regions {
+		ret = ret.Union(r.getRect())
+	}
+	return ret
+}
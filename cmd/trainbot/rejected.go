@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"jo-m.ch/go/trainbot/internal/pkg/db"
+	"jo-m.ch/go/trainbot/internal/pkg/stitch"
+)
+
+type rejectedCmd struct {
+	Limit      int    `arg:"--limit" default:"50" help:"Maximum number of sequences to list, most recent first (0: all)" placeholder:"N"`
+	Reason     string `arg:"--reason" help:"Only list sequences rejected for this reason (unable_to_fit, too_short, too_slow, unable_to_assemble_image, queue_full)" placeholder:"R"`
+	PreviewDir string `arg:"--preview-dir" help:"Write the preview image of each listed sequence to this directory" placeholder:"DIR"`
+}
+
+// runRejected lists recently rejected sequences (see --keep-rejected), and counts them by reason.
+func runRejected(c config) {
+	dbx := c.mustOpenDB()
+	defer dbx.Close()
+
+	rejected, err := db.GetRejectedSequences(dbx, c.Rejected.Limit, stitch.RejectReason(c.Rejected.Reason))
+	if err != nil {
+		log.Panic().Err(err).Msg("failed to get rejected sequences")
+	}
+	log.Info().Int("n", len(rejected)).Msg("found rejected sequences")
+
+	if c.Rejected.PreviewDir != "" {
+		err := os.MkdirAll(c.Rejected.PreviewDir, 0750)
+		if err != nil {
+			log.Panic().Err(err).Msg("could not create preview directory")
+		}
+	}
+
+	counts := map[stitch.RejectReason]int{}
+	fmt.Printf("%-8s %-29s %-12s %-24s %7s %7s %18s %s\n", "ID", "START_TS", "REGION", "REASON", "FRAMES", "DUR_S", "DX_MIN/MEAN/MAX", "ERROR")
+	for _, r := range rejected {
+		counts[r.Reason]++
+		dx := fmt.Sprintf("%d/%.1f/%d", r.Dx.Min, r.Dx.Mean, r.Dx.Max)
+		fmt.Printf("%-8d %-29s %-12s %-24s %7d %7.1f %18s %s\n",
+			r.ID, r.StartTS.Format(time.RFC3339Nano), r.Region, r.Reason, r.NFrames, r.EndTS.Sub(r.StartTS).Seconds(), dx, r.Error)
+
+		if c.Rejected.PreviewDir == "" || r.Preview == nil {
+			continue
+		}
+		path := filepath.Join(c.Rejected.PreviewDir, fmt.Sprintf("rejected_%d.jpg", r.ID))
+		err := os.WriteFile(path, r.Preview, 0600)
+		if err != nil {
+			log.Panic().Err(err).Str("path", path).Msg("failed to write preview")
+		}
+	}
+
+	fmt.Println()
+	for _, reason := range slices.Sorted(maps.Keys(counts)) {
+		fmt.Printf("%-24s %d\n", reason, counts[reason])
+	}
+}
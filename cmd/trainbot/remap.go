@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"jo-m.ch/go/trainbot/pkg/imutil"
+	"jo-m.ch/go/trainbot/pkg/remap"
+)
+
+type remapCmd struct {
+	Image  string   `arg:"--image,required" help:"Full (not cropped) camera picture in which the points were marked" placeholder:"FILE"`
+	Lines  []string `arg:"--line,separate" help:"At least 3 points along a line which is straight in reality (e.g. a rail or the roof edge of a car), as 'x,y x,y ..'. Can be passed multiple times, to correct lens distortion" placeholder:"POINTS"`
+	Quad   string   `arg:"--quad" help:"The 4 corners of something which is rectangular in reality (e.g. the side of a car), clockwise from the top left, as 'x,y x,y x,y x,y', to correct perspective" placeholder:"POINTS"`
+	Output string   `arg:"--output" help:"Write the corrected camera picture to this file, to check the result" placeholder:"FILE"`
+}
+
+// parsePoints parses points formatted as 'x,y x,y ..'.
+func parsePoints(s string) ([]remap.Point, error) {
+	var ret []remap.Point
+	for _, f := range strings.Fields(s) {
+		xs, ys, ok := strings.Cut(f, ",")
+		if !ok {
+			return nil, fmt.Errorf("invalid point '%s', expected 'x,y'", f)
+		}
+		x, err := strconv.ParseFloat(xs, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid point '%s': %w", f, err)
+		}
+		y, err := strconv.ParseFloat(ys, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid point '%s': %w", f, err)
+		}
+		ret = append(ret, remap.Point{X: x, Y: y})
+	}
+	return ret, nil
+}
+
+// runRemap computes the parameters to correct lens distortion and perspective from points marked in a camera picture,
+// and prints them as JSON (for --remap, or the remap field of a region).
+func runRemap(c config) {
+	img, err := imutil.Load(c.Remap.Image)
+	if err != nil {
+		log.Panic().Err(err).Str("image", c.Remap.Image).Msg("failed to load image")
+	}
+
+	var lines [][]remap.Point
+	for _, l := range c.Remap.Lines {
+		pts, err := parsePoints(l)
+		if err != nil {
+			log.Panic().Err(err).Msg("failed to parse line")
+		}
+		lines = append(lines, pts)
+	}
+
+	var quad *[4]remap.Point
+	if c.Remap.Quad != "" {
+		pts, err := parsePoints(c.Remap.Quad)
+		if err != nil {
+			log.Panic().Err(err).Msg("failed to parse quad")
+		}
+		if len(pts) != 4 {
+			log.Panic().Int("n", len(pts)).Msg("quad needs exactly 4 points")
+		}
+		quad = (*[4]remap.Point)(pts)
+	}
+
+	params, err := remap.Fit(img.Bounds(), lines, quad)
+	if err != nil {
+		log.Panic().Err(err).Msg("failed to compute remap parameters")
+	}
+	if params.Distortion != nil {
+		log.Info().Float64("k1", params.Distortion.K1).Msg("estimated lens distortion")
+	}
+
+	if c.Remap.Output != "" {
+		m, err := remap.New(img.Bounds(), params)
+		if err != nil {
+			log.Panic().Err(err).Msg("failed to create remap lookup table")
+		}
+		corrected, err := m.Apply(img)
+		if err != nil {
+			log.Panic().Err(err).Msg("failed to correct image")
+		}
+		err = imutil.Dump(c.Remap.Output, corrected)
+		if err != nil {
+			log.Panic().Err(err).Str("path", c.Remap.Output).Msg("failed to write corrected image")
+		}
+		log.Info().Str("path", c.Remap.Output).Msg("wrote corrected image")
+	}
+
+	buf, err := json.MarshalIndent(params, "", "  ")
+	if err != nil {
+		log.Panic().Err(err).Msg("failed to encode remap parameters")
+	}
+	fmt.Println(string(buf))
+}
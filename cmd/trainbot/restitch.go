@@ -0,0 +1,151 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"jo-m.ch/go/trainbot/internal/pkg/db"
+	"jo-m.ch/go/trainbot/internal/pkg/stitch"
+	"jo-m.ch/go/trainbot/internal/pkg/upload"
+)
+
+type restitchCmd struct {
+	ID int64 `arg:"--id,required" help:"Database id of the train to stitch again (its sequence must have been saved with --save-sequences)" placeholder:"ID"`
+}
+
+// restitchConfig returns the stitcher configuration for a region, from the current flags (or regions file).
+func (c *config) restitchConfig(regionName string) stitch.Config {
+	if c.RegionsFile == "" {
+		return c.stitchConfig(c.mustLoadFlagsStitchMask())
+	}
+
+	regions, err := c.loadRegions()
+	if err != nil {
+		log.Panic().Err(err).Msg("failed to load regions")
+	}
+	for _, r := range regions {
+		if r.Name == regionName {
+			return c.regionStitchConfig(r)
+		}
+	}
+	log.Panic().Str("region", regionName).Msg("region not found")
+	return stitch.Config{}
+}
+
+// runRestitch stitches a train again from its saved sequence with the current settings,
+// and replaces its blobs and database row.
+func runRestitch(c config) {
+	dbx := c.mustOpenDB()
+	defer dbx.Close()
+
+	dbTrain, seqName, err := db.GetTrainSequence(dbx, c.Restitch.ID)
+	if err != nil {
+		log.Panic().Err(err).Int64("id", c.Restitch.ID).Msg("failed to get train")
+	}
+
+	seq, err := stitch.LoadSequence(c.GetDataPath(filepath.Join(sequencesDir, seqName)))
+	if err != nil {
+		log.Panic().Err(err).Str("sequence", seqName).Msg("failed to load sequence")
+	}
+
+	conf := c.restitchConfig(dbTrain.Region)
+	conf.SequenceDir = ""
+	trains, err := seq.Restitch(conf)
+	if err != nil {
+		log.Err(err).Msg("some parts of the sequence could not be stitched")
+	}
+	if len(trains) == 0 {
+		log.Panic().Msg("no train found in sequence")
+	}
+
+	// The sequence might contain multiple trains, take the one which matches best.
+	train := slices.MinFunc(trains, func(a, b *stitch.Train) int {
+		return cmp.Compare(
+			math.Abs(a.StartTS.Sub(dbTrain.StartTS).Seconds()),
+			math.Abs(b.StartTS.Sub(dbTrain.StartTS).Seconds()),
+		)
+	})
+
+	// Blob names are kept, car crops might change.
+	newDBTrain := *dbTrain
+	newDBTrain.NCars = nil
+	if train.Cars != nil {
+		n := len(train.Cars)
+		newDBTrain.NCars = &n
+	}
+	newDBTrain.CarCrops = c.CarCrops && train.Cars != nil
+	blobs := c.blobConfig()
+	newDBTrain.OrigImg = blobs.origImg()
+	blobs.setTiles(&newDBTrain, train)
+
+	err = dumpBlobs(c.DataStore, &newDBTrain, train, blobs)
+	if err != nil {
+		log.Panic().Err(err).Msg("failed to write blobs")
+	}
+	err = db.UpdateTrain(dbx, dbTrain.ID, *train)
+	if err != nil {
+		log.Panic().Err(err).Msg("failed to update train")
+	}
+	err = db.SetTrainBlobs(dbx, newDBTrain)
+	if err != nil {
+		log.Panic().Err(err).Msg("failed to update train blobs")
+	}
+
+	// Blobs the train no longer has. If it has no tiles any more, their whole directory is removed instead.
+	dropTiles := dbTrain.TilesW != nil && newDBTrain.TilesW == nil
+	var stale []string
+	newBlobs := newDBTrain.Blobs()
+	for _, blob := range dbTrain.Blobs() {
+		if slices.Contains(newBlobs, blob) || dropTiles && strings.HasPrefix(blob, dbTrain.TilesDirName()+"/") {
+			continue
+		}
+		stale = append(stale, blob)
+	}
+	for _, blob := range stale {
+		err := os.Remove(c.GetBlobPath(blob))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Err(err).Str("blob", blob).Msg("failed to delete stale blob")
+		}
+	}
+	if dropTiles {
+		err := os.RemoveAll(c.GetBlobPath(dbTrain.TilesDirName()))
+		if err != nil {
+			log.Err(err).Msg("failed to delete stale tiles")
+		}
+	}
+	if c.EnableUpload && len(stale) > 0 {
+		deleteRemoteBlobs(c.FTPConfig, stale)
+	}
+
+	log.Info().
+		Int64("id", dbTrain.ID).
+		Str("sequence", seqName).
+		Float64("lengthM", train.LengthM()).
+		Float64("speedKmh", train.SpeedMpS()*3.6).
+		Float64("quality", train.Quality.Score).
+		Int("nCars", len(train.Cars)).
+		Int("nAxles", len(train.AxlesM)).
+		Msg("stitched train again")
+}
+
+// deleteRemoteBlobs deletes blobs which were already uploaded, see upload.DeleteBlobs().
+func deleteRemoteBlobs(c upload.FTPConfig, blobs []string) {
+	ctx := context.Background()
+	uploader, err := upload.NewFTP(ctx, c)
+	if err != nil {
+		log.Err(err).Msg("could not create uploader, stale blobs were not deleted remotely")
+		return
+	}
+	defer uploader.Close()
+
+	n := upload.DeleteBlobs(ctx, uploader, blobs)
+	log.Info().Int("n", n).Msg("deleted stale remote blobs")
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+
+	"github.com/rs/zerolog/log"
+	"jo-m.ch/go/trainbot/internal/pkg/calib"
+	"jo-m.ch/go/trainbot/pkg/imutil"
+)
+
+type roiCmd struct {
+	Preview   string `arg:"--preview" default:"roi.png" help:"Where to write the preview image with the activity map and the suggested rect" placeholder:"FILE"`
+	Every     int    `arg:"--every" default:"1" help:"Only analyze every Nth pair of frames, to speed things up on long videos" placeholder:"N"`
+	MaxFrames int    `arg:"--max-frames" default:"0" help:"Stop after this many frames (0: process the whole video)" placeholder:"N"`
+}
+
+// runROI analyzes a video with passing trains and suggests a region of interest.
+func runROI(c config) {
+	if c.InputFile == "" {
+		log.Panic().Msg("no camera device or video file passed")
+	}
+	if c.ROI.Every < 1 {
+		log.Panic().Msg("--every must be at least 1")
+	}
+
+	src, err := openSrc(c, image.Rectangle{})
+	if err != nil {
+		log.Panic().Err(err).Str("path", c.InputFile).Msg("failed to open video source")
+	}
+	defer src.Close()
+
+	// Maximum motion between two frames, in pixels.
+	maxDx := int(math.Ceil(c.MaxSpeedKPH / 3.6 * c.PixelsPerM / src.GetFPS()))
+
+	var activity *calib.ActivityMap
+	var prev image.Image
+	for i := 0; c.ROI.MaxFrames == 0 || i < c.ROI.MaxFrames; i++ {
+		frame, _, err := src.GetFrame()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			log.Panic().Err(err).Msg("failed to get frame")
+		}
+
+		if activity == nil {
+			activity = calib.NewActivityMap(frame.Bounds(), maxDx)
+			log.Info().Interface("bounds", frame.Bounds()).Int("maxDx", maxDx).Msg("analyzing video")
+		}
+		if prev != nil && i%c.ROI.Every == 0 {
+			err = activity.AddPair(prev, frame)
+			if err != nil {
+				log.Panic().Err(err).Int("frame", i).Msg("failed to analyze frame")
+			}
+		}
+		// The frame buffer is owned by the source.
+		prev = imutil.Copy(frame)
+
+		if i > 0 && i%1000 == 0 {
+			log.Info().Int("frames", i).Msg("progress")
+		}
+	}
+	if activity == nil {
+		log.Panic().Msg("video contains no frames")
+	}
+
+	// The stitcher needs a rect at least 3*maxDx wide to measure the maximum speed.
+	minSize := max(rectSizeMin, 3*maxDx)
+	rect, score, err := activity.Suggest(minSize, rectSizeMax)
+	if errors.Is(err, calib.ErrSizeRange) {
+		log.Panic().Int("minSize", minSize).Int("maxSize", rectSizeMax).Int("maxDx", maxDx).Msg("the rect would need to be at least 3*maxDx wide to measure the maximum speed, which is too large, reduce --max-speed-kph or --px-per-m")
+	}
+	if err != nil {
+		log.Panic().Err(err).Msg("failed to suggest a region of interest, does the video contain passing trains?")
+	}
+	log.Info().Interface("rect", rect).Float64("score", score).Msg("suggested region of interest")
+
+	err = imutil.Dump(c.ROI.Preview, activity.Preview(rect))
+	if err != nil {
+		log.Panic().Err(err).Str("path", c.ROI.Preview).Msg("failed to write preview")
+	}
+
+	fmt.Printf("RECT_X=%d\nRECT_Y=%d\nRECT_W=%d\nRECT_H=%d\n", rect.Min.X, rect.Min.Y, rect.Dx(), rect.Dy())
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/rs/zerolog/log"
+	"jo-m.ch/go/trainbot/internal/pkg/calib"
+	"jo-m.ch/go/trainbot/internal/pkg/stitch"
+)
+
+type shutterCmd struct {
+	MaxTrains int `arg:"--max-trains" default:"0" help:"Stop after this many trains (0: process the whole video)" placeholder:"N"`
+}
+
+// runShutter measures the line readout time of a rolling shutter camera from the lean of the trains passing in a
+// recording. The track angle (--track-angle-deg) should be set, otherwise trains lean because of it as well.
+func runShutter(c config) {
+	var readouts []float64
+	stitchTrains(c, c.Shutter.MaxTrains, func(t *stitch.Train) {
+		// Frames were already corrected with the configured readout time, this measures what is left.
+		residual, err := calib.LineReadoutS(t.Image, t.SpeedPxS)
+		if err != nil {
+			log.Warn().Err(err).Time("ts", t.StartTS).Msg("could not measure train")
+			return
+		}
+		readout := t.Conf.LineReadoutS + residual
+		log.Info().Time("ts", t.StartTS).Float64("speedKmh", t.SpeedMpS()*3.6).Float64("lineReadoutUs", readout*1e6).Msg("measured train")
+		readouts = append(readouts, readout)
+	})
+
+	if len(readouts) == 0 {
+		log.Panic().Msg("no trains found, cannot measure the line readout time")
+	}
+
+	slices.Sort(readouts)
+	readout := readouts[len(readouts)/2]
+	log.Info().Int("trains", len(readouts)).Float64("lineReadoutUs", readout*1e6).Msg("measured line readout time")
+	fmt.Printf("LINE_READOUT_US=%.1f\n", readout*1e6)
+}
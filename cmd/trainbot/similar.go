@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"jo-m.ch/go/trainbot/internal/pkg/db"
+)
+
+type similarCmd struct {
+	ID          int64   `arg:"--id,required" help:"Database id of the train to compare to" placeholder:"ID"`
+	Limit       int     `arg:"--limit" default:"10" help:"Maximum number of trains to list (0: all)" placeholder:"N"`
+	MaxDistance float64 `arg:"--max-distance" default:"0.3" help:"Only list trains up to this fingerprint distance, 0..1" placeholder:"D"`
+}
+
+// runSimilar lists the trains whose colors (livery) are most similar to the given train.
+func runSimilar(c config) {
+	dbx := c.mustOpenDB()
+	defer dbx.Close()
+
+	similar, err := db.GetSimilarTrains(dbx, c.Similar.ID, c.Similar.Limit, c.Similar.MaxDistance)
+	if err != nil {
+		log.Panic().Err(err).Int64("id", c.Similar.ID).Msg("failed to find similar trains")
+	}
+	log.Info().Int64("id", c.Similar.ID).Int("n", len(similar)).Msg("found similar trains")
+
+	fmt.Printf("%-8s %-29s %-12s %s\n", "ID", "START_TS", "REGION", "DISTANCE")
+	for _, t := range similar {
+		fmt.Printf("%-8d %-29s %-12s %.3f\n", t.ID, t.StartTS.Format(time.RFC3339Nano), t.Region, t.Distance)
+	}
+}
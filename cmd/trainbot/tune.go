@@ -0,0 +1,347 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"jo-m.ch/go/trainbot/internal/pkg/stitch"
+	"jo-m.ch/go/trainbot/pkg/imutil"
+	"jo-m.ch/go/trainbot/pkg/vid"
+)
+
+// Tolerance when matching detected trains to labels.
+const tuneMatchToleranceS = 2
+
+type tuneCmd struct {
+	Labels string `arg:"--labels,required" help:"JSON file with the labeled trains in the video passed via --input (see README)" placeholder:"FILE"`
+
+	GoodCosScoreNoMove []float64 `arg:"--grid-good-cos-no-move" help:"Values to try for --good-cos-no-move" placeholder:"X"`
+	GoodCosScoreMove   []float64 `arg:"--grid-good-cos-move" help:"Values to try for --good-cos-move" placeholder:"X"`
+	DxLowPassFactor    []float64 `arg:"--grid-dx-low-pass" help:"Values to try for --dx-low-pass" placeholder:"X"`
+	MinContrastAvgDev  []float64 `arg:"--grid-min-contrast" help:"Values to try for --min-contrast" placeholder:"X"`
+	MinFramePeriodS    []float64 `arg:"--grid-min-frame-period-s" help:"Values to try for --min-frame-period-s (default: only the configured value)" placeholder:"S"`
+
+	Top int `arg:"--top" default:"10" help:"Number of best settings to report" placeholder:"N"`
+}
+
+// tuneLabel is a train which is known to be in the video.
+type tuneLabel struct {
+	// Time since the start of the video when the train enters and leaves the picture [s].
+	StartS float64 `json:"start_s"`
+	EndS   float64 `json:"end_s"`
+	// Length of the train [m], 0 if unknown.
+	LengthM float64 `json:"length_m"`
+}
+
+// tuneResult is the outcome of replaying the video with one set of thresholds.
+type tuneResult struct {
+	conf stitch.Config
+
+	// Number of labels for which a train was detected.
+	detected int
+	// Number of detected trains which do not match any label.
+	falseTrains int
+	// Number of sequences which did not result in a labeled train.
+	falseSequences int
+	// Mean absolute length error of the detected trains with known length [m].
+	lengthErrM float64
+}
+
+func (r tuneResult) compare(o tuneResult) int {
+	return cmp.Or(
+		-cmp.Compare(r.detected, o.detected),
+		cmp.Compare(r.falseTrains, o.falseTrains),
+		cmp.Compare(r.falseSequences, o.falseSequences),
+		cmp.Compare(r.lengthErrM, o.lengthErrM),
+	)
+}
+
+// check validates the grid values.
+func (t *tuneCmd) check() error {
+	for _, values := range [][]float64{t.GoodCosScoreNoMove, t.GoodCosScoreMove, t.DxLowPassFactor, t.MinContrastAvgDev} {
+		for _, v := range values {
+			if v <= 0 || v >= 1 {
+				return errors.New("--grid-good-cos-no-move, --grid-good-cos-move, --grid-dx-low-pass and --grid-min-contrast must be between 0 and 1")
+			}
+		}
+	}
+	for _, v := range t.MinFramePeriodS {
+		if v < 0 {
+			return errors.New("--grid-min-frame-period-s must not be negative")
+		}
+	}
+	if t.Top < 1 {
+		return errors.New("--top must be at least 1")
+	}
+	return nil
+}
+
+func valuesOrDefault(values []float64, def ...float64) []float64 {
+	if len(values) > 0 {
+		return values
+	}
+	return def
+}
+
+// grid creates all combinations of the thresholds to try.
+func (t *tuneCmd) grid(base stitch.Config) []stitch.Config {
+	var ret []stitch.Config
+	for _, noMove := range valuesOrDefault(t.GoodCosScoreNoMove, 0.98, 0.99, 0.995) {
+		for _, move := range valuesOrDefault(t.GoodCosScoreMove, 0.9, 0.925, 0.95) {
+			for _, lp := range valuesOrDefault(t.DxLowPassFactor, 0.9, 0.95, 0.98) {
+				for _, contrast := range valuesOrDefault(t.MinContrastAvgDev, 0.005, 0.01, 0.02) {
+					for _, period := range valuesOrDefault(t.MinFramePeriodS, base.MinFramePeriodS) {
+						c := base
+						c.GoodCosScoreNoMove = noMove
+						c.GoodCosScoreMove = move
+						c.DxLowPassFactor = lp
+						c.MinContrastAvgDev = contrast
+						c.MinFramePeriodS = period
+						ret = append(ret, c)
+					}
+				}
+			}
+		}
+	}
+	return ret
+}
+
+func loadTuneLabels(path string) ([]tuneLabel, error) {
+	// #nosec G304
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var labels []tuneLabel
+	err = json.Unmarshal(buf, &labels)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range labels {
+		if l.EndS < l.StartS {
+			return nil, fmt.Errorf("invalid label, end_s < start_s: %+v", l)
+		}
+	}
+	return labels, nil
+}
+
+// tuneFrames are the cropped (and remapped) frames of a video, cached in a temporary file,
+// so that the video only needs to be decoded once, and not for each setting which is tried.
+type tuneFrames struct {
+	f      *os.File
+	bounds image.Rectangle
+	ts     []time.Time
+}
+
+// decodeTuneFrames decodes the video and writes its frames to a temporary file.
+func decodeTuneFrames(c config) (*tuneFrames, error) {
+	src, err := vid.NewFileSrc(c.InputFile, false)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	rect := c.getRect()
+	remapParams, err := loadRemap(c.RemapFile)
+	if err != nil {
+		return nil, err
+	}
+	remapper := mustNewRemap(remapParams, rect)
+
+	f, err := os.CreateTemp("", "trainbot-tune-*.rgba")
+	if err != nil {
+		return nil, err
+	}
+	ret := &tuneFrames{f: f}
+	for {
+		frame, ts, err := src.GetFrame()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			ret.close()
+			return nil, err
+		}
+
+		cropped, err := imutil.Sub(frame, rect)
+		if err != nil {
+			ret.close()
+			return nil, err
+		}
+		if remapper != nil {
+			cropped, err = remapper.Apply(imutil.Copy(cropped))
+			if err != nil {
+				ret.close()
+				return nil, err
+			}
+		}
+		rgba := imutil.CopyRect(cropped, cropped.Bounds())
+		if len(ret.ts) == 0 {
+			ret.bounds = rgba.Rect
+		} else if rgba.Rect != ret.bounds {
+			ret.close()
+			return nil, errors.New("inconsistent frame size")
+		}
+
+		_, err = f.Write(rgba.Pix)
+		if err != nil {
+			ret.close()
+			return nil, err
+		}
+		ret.ts = append(ret.ts, *ts)
+	}
+	if len(ret.ts) == 0 {
+		ret.close()
+		return nil, fmt.Errorf("no frames in %s", c.InputFile)
+	}
+
+	return ret, nil
+}
+
+// frame reads the i-th frame back.
+func (t *tuneFrames) frame(i int) (*image.RGBA, error) {
+	ret := image.NewRGBA(t.bounds)
+	_, err := t.f.ReadAt(ret.Pix, int64(i)*int64(len(ret.Pix)))
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// close closes and removes the temporary file.
+func (t *tuneFrames) close() {
+	err := t.f.Close()
+	if err != nil {
+		log.Err(err).Str("path", t.f.Name()).Msg("failed to close frame cache")
+	}
+	err = os.Remove(t.f.Name())
+	if err != nil {
+		log.Err(err).Str("path", t.f.Name()).Msg("failed to remove frame cache")
+	}
+}
+
+// replay runs the cached frames of the video through an AutoStitcher and matches the detected trains to the labels.
+func replay(frames *tuneFrames, conf stitch.Config, labels []tuneLabel) (tuneResult, error) {
+	stitcher := stitch.NewAutoStitcher(conf)
+	defer stitcher.Close()
+	var trains []*stitch.Train
+	for i, ts := range frames.ts {
+		frame, err := frames.frame(i)
+		if err != nil {
+			return tuneResult{}, err
+		}
+		trains = append(trains, stitcher.Frame(frame, ts)...)
+	}
+	trains = append(trains, stitcher.TryStitchAndReset()...)
+	t0 := frames.ts[0]
+
+	res := tuneResult{conf: conf}
+	matched := make([]bool, len(labels))
+	nLengths := 0
+	for _, train := range trains {
+		if train.Part > 1 {
+			// Continuation of a train which is already counted.
+			continue
+		}
+
+		startS := train.StartTS.Sub(t0).Seconds()
+		i := slices.IndexFunc(labels, func(l tuneLabel) bool {
+			return startS >= l.StartS-tuneMatchToleranceS && startS <= l.EndS
+		})
+		if i < 0 || matched[i] {
+			res.falseTrains++
+			continue
+		}
+
+		matched[i] = true
+		res.detected++
+		if labels[i].LengthM > 0 {
+			res.lengthErrM += math.Abs(train.LengthM() - labels[i].LengthM)
+			nLengths++
+		}
+	}
+	if nLengths > 0 {
+		res.lengthErrM /= float64(nLengths)
+	}
+	res.falseSequences = max(stitcher.Sequences()-res.detected, 0)
+
+	return res, nil
+}
+
+// runTune replays a labeled video with a grid of detection thresholds, and reports the best settings.
+func runTune(c config) {
+	stat, err := os.Stat(c.InputFile)
+	if err != nil || !stat.Mode().IsRegular() {
+		log.Panic().Err(err).Str("input", c.InputFile).Msg("tune needs a video file as --input")
+	}
+	if c.getRect().Empty() {
+		log.Panic().Msg("no rect set (use --rect-.. parameters to set crop region)")
+	}
+
+	err = c.Tune.check()
+	if err != nil {
+		log.Panic().Err(err).Msg("invalid tune parameters")
+	}
+
+	labels, err := loadTuneLabels(c.Tune.Labels)
+	if err != nil {
+		log.Panic().Err(err).Str("labels", c.Tune.Labels).Msg("failed to load labels")
+	}
+
+	frames, err := decodeTuneFrames(c)
+	if err != nil {
+		log.Panic().Err(err).Msg("failed to decode video")
+	}
+	defer frames.close()
+
+	// The stitcher is very chatty, only keep its warnings while replaying.
+	stitchLog := log.Logger.Level(zerolog.WarnLevel)
+	base := c.stitchConfig(c.mustLoadFlagsStitchMask())
+	base.Logger = &stitchLog
+	grid := c.Tune.grid(base)
+	log.Info().Int("nLabels", len(labels)).Int("nFrames", len(frames.ts)).Int("nSettings", len(grid)).Msg("starting tuning")
+
+	var results []tuneResult
+	for i, conf := range grid {
+		res, err := replay(frames, conf, labels)
+		if err != nil {
+			log.Panic().Err(err).Msg("failed to replay video")
+		}
+
+		log.Info().Int("run", i+1).Int("of", len(grid)).Int("detected", res.detected).Int("falseTrains", res.falseTrains).Int("falseSequences", res.falseSequences).Msg("replayed video")
+		results = append(results, res)
+	}
+
+	slices.SortStableFunc(results, tuneResult.compare)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "--good-cos-no-move\t--good-cos-move\t--dx-low-pass\t--min-contrast\t--min-frame-period-s\tdetected\tfalse trains\tfalse sequences\tlength error [m]")
+	for _, res := range results[:min(c.Tune.Top, len(results))] {
+		fmt.Fprintf(w, "%g\t%g\t%g\t%g\t%g\t%d/%d\t%d\t%d\t%.1f\n",
+			res.conf.GoodCosScoreNoMove,
+			res.conf.GoodCosScoreMove,
+			res.conf.DxLowPassFactor,
+			res.conf.MinContrastAvgDev,
+			res.conf.MinFramePeriodS,
+			res.detected, len(labels),
+			res.falseTrains,
+			res.falseSequences,
+			res.lengthErrM)
+	}
+	err = w.Flush()
+	if err != nil {
+		log.Panic().Err(err).Msg("failed to write results")
+	}
+}
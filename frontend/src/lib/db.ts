@@ -27,6 +27,8 @@ export async function loadDB(): Promise<SqlJs.Database> {
 
 export interface Train {
   id: number
+  // Empty for the default region, missing in old databases.
+  region?: string
   start_ts: DateTime
   n_frames: number
   length_px: number
@@ -35,6 +37,23 @@ export interface Train {
   px_per_m: number
   uploaded: boolean
   cleaned_up: boolean
+  // Missing in old databases.
+  blobs_ready?: boolean
+  // Fit quality, null (or missing in old databases) for old trains.
+  quality?: number | null
+  length_ci_px?: number | null
+  speed_ci_px_s?: number | null
+  low_confidence?: number
+  // Angle of the track [deg], null (or missing in old databases) for old trains.
+  track_angle_deg?: number | null
+  // Car segmentation, null (or missing in old databases) if not available.
+  n_cars?: number | null
+  // JSON array of {start_px, end_px}.
+  cars?: string | null
+  // Axle detection, null (or missing in old databases) if not available.
+  n_axles?: number | null
+  // JSON array of the distances between consecutive axles in m.
+  axle_spacing_m?: string | null
 }
 
 function convertValue(colname: string, value: any): any {
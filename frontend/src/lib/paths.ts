@@ -11,12 +11,20 @@ function formatFileTs(ts: DateTime): string {
   return `${base}${frac}_${zone}`
 }
 
-export function imgFileName(ts: DateTime): string {
-  return `train_${formatFileTs(ts)}.jpg`
+// This matches db.Train.fileNameBase() from Go, region is empty (or missing in old databases) for the default region.
+function fileNameBase(ts: DateTime, region?: string): string {
+  if (!region) {
+    return `train_${formatFileTs(ts)}`
+  }
+  return `train_${formatFileTs(ts)}_${region}`
 }
 
-export function gifFileName(ts: DateTime): string {
-  return `train_${formatFileTs(ts)}.gif`
+export function imgFileName(ts: DateTime, region?: string): string {
+  return `${fileNameBase(ts, region)}.jpg`
+}
+
+export function gifFileName(ts: DateTime, region?: string): string {
+  return `${fileNameBase(ts, region)}.gif`
 }
 
 export function getBlobURL(blobName: string): string {
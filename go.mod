@@ -22,6 +22,7 @@ require (
 	github.com/u2takey/ffmpeg-go v0.5.0
 	github.com/vladimirvivien/go4vl v0.3.0
 	go-hep.org/x/hep v0.40.0
+	golang.org/x/image v0.43.0
 	gonum.org/v1/gonum v0.17.0
 	gonum.org/v1/plot v0.17.0
 	modernc.org/sqlite v1.53.0
@@ -92,7 +93,6 @@ require (
 	go.opentelemetry.io/otel/trace v1.35.0 // indirect
 	golang.org/x/crypto v0.53.0 // indirect
 	golang.org/x/exp/typeparams v0.0.0-20231108232855-2478ac86f678 // indirect
-	golang.org/x/image v0.43.0 // indirect
 	golang.org/x/mod v0.37.0 // indirect
 	golang.org/x/net v0.56.0 // indirect
 	golang.org/x/oauth2 v0.36.0 // indirect
@@ -0,0 +1,187 @@
+// Package calib estimates the image scale (pixels per meter) from periodic patterns along the track, such as sleepers.
+package calib
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"slices"
+
+	"gonum.org/v1/gonum/dsp/fourier"
+)
+
+// DefaultSleeperSpacingM is the usual distance between sleepers in Europe [m].
+const DefaultSleeperSpacingM = 0.6
+
+const (
+	// Rows are zero padded to at least this many times their length, for a finer frequency resolution.
+	zeroPadFactor = 8
+	// The pattern must repeat at least this many times in the image.
+	minRepetitions = 4
+	// Shortest period which can be detected [px].
+	minPeriodPx = 4
+	// A subharmonic must have at least this fraction of the power of the strongest peak to be picked instead.
+	subharmonicMinPower = 0.3
+	// Minimum peak power relative to the median power in the search range.
+	minConfidence = 8
+)
+
+// ErrNoPattern is returned when no periodic pattern was found.
+var ErrNoPattern = errors.New("no periodic pattern found")
+
+// Config configures the calibration.
+type Config struct {
+	// SpacingM is the distance between the repeating elements (e.g. sleepers) [m].
+	// Defaults to DefaultSleeperSpacingM if 0.
+	SpacingM float64
+	// MinPeriodPx and MaxPeriodPx limit the search range [px], 0 for automatic.
+	MinPeriodPx float64
+	MaxPeriodPx float64
+}
+
+// Result is the result of a calibration.
+type Result struct {
+	// PeriodPx is the detected period of the pattern along the x axis [px].
+	PeriodPx float64
+	// PixelsPerM is the image scale derived from PeriodPx and Config.SpacingM.
+	PixelsPerM float64
+	// Confidence is the power of the detected peak relative to the median power in the search range.
+	Confidence float64
+}
+
+func luminance(img image.Image, x, y int) float64 {
+	r, g, b, _ := img.At(x, y).RGBA()
+	return (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 0xffff
+}
+
+// powerSpectrum computes the power spectrum of each row, summed over all rows.
+// Summing the power instead of the rows themselves makes this insensitive to the phase of the pattern in
+// each row (e.g. slightly tilted sleepers), and to rows which do not contain the pattern at all.
+// Each row is detrended by subtracting its moving average over detrendPx pixels, which suppresses the
+// large low frequency components of natural images.
+func powerSpectrum(img image.Image, n, detrendPx int) []float64 {
+	b := img.Bounds()
+	w := b.Dx()
+	fft := fourier.NewFFT(n)
+	lum := make([]float64, w)
+	cum := make([]float64, w+1)
+	row := make([]float64, n)
+	coeff := make([]complex128, n/2+1)
+	power := make([]float64, n/2+1)
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for i := range w {
+			lum[i] = luminance(img, b.Min.X+i, y)
+			cum[i+1] = cum[i] + lum[i]
+		}
+
+		clear(row)
+		for i := range w {
+			i0 := max(i-detrendPx/2, 0)
+			i1 := min(i+detrendPx/2+1, w)
+			mean := (cum[i1] - cum[i0]) / float64(i1-i0)
+			// Hann window.
+			win := 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(w-1))
+			row[i] = (lum[i] - mean) * win
+		}
+
+		fft.Coefficients(coeff, row)
+		for k, c := range coeff {
+			power[k] += real(c)*real(c) + imag(c)*imag(c)
+		}
+	}
+
+	return power
+}
+
+// localMax finds the bin with the highest power in [k0, k1].
+func localMax(power []float64, k0, k1 int) int {
+	k0 = max(k0, 1)
+	k1 = min(k1, len(power)-2)
+	best := k0
+	for k := k0; k <= k1; k++ {
+		if power[k] > power[best] {
+			best = k
+		}
+	}
+	return best
+}
+
+// refine interpolates the position of a peak at bin k with a parabola through the neighbouring (log) bins.
+func refine(power []float64, k int) float64 {
+	if k <= 0 || k >= len(power)-1 {
+		return float64(k)
+	}
+	a, b, c := math.Log(power[k-1]+1e-12), math.Log(power[k]+1e-12), math.Log(power[k+1]+1e-12)
+	den := a - 2*b + c
+	if den == 0 {
+		return float64(k)
+	}
+	return float64(k) + 0.5*(a-c)/den
+}
+
+// Calibrate finds a periodic pattern along the x axis of an image, and derives the pixels per meter from it.
+// The image should be cropped to the area in which the pattern (e.g. sleepers) is visible, with the track horizontal.
+// Works with idle frames as well as with stitched train images, as long as the spacing is known.
+func Calibrate(img image.Image, c Config) (Result, error) {
+	spacingM := c.SpacingM
+	if spacingM == 0 {
+		spacingM = DefaultSleeperSpacingM
+	}
+	if spacingM < 0 {
+		return Result{}, fmt.Errorf("invalid spacing %f", spacingM)
+	}
+
+	w := img.Bounds().Dx()
+	minPeriod := math.Max(c.MinPeriodPx, minPeriodPx)
+	maxPeriod := float64(w) / minRepetitions
+	if c.MaxPeriodPx > 0 {
+		maxPeriod = math.Min(maxPeriod, c.MaxPeriodPx)
+	}
+	if img.Bounds().Dy() < 1 || maxPeriod <= minPeriod {
+		return Result{}, fmt.Errorf("image too small (%dx%d)", w, img.Bounds().Dy())
+	}
+
+	n := 1
+	for n < w*zeroPadFactor {
+		n *= 2
+	}
+	power := powerSpectrum(img, n, int(math.Ceil(maxPeriod)))
+
+	// Frequency bin k corresponds to a period of n/k pixels.
+	k0 := int(math.Ceil(float64(n) / maxPeriod))
+	k1 := int(math.Floor(float64(n) / minPeriod))
+	k := localMax(power, k0, k1)
+
+	// Sharp patterns have strong harmonics, make sure we did not pick one of them.
+	// Prefer the lowest subharmonic with a significant peak.
+	for m := 4; m >= 2; m-- {
+		km := float64(k) / float64(m)
+		if km < float64(k0) {
+			continue
+		}
+		// Search around the expected position, the tolerance is 1/4 of the distance between subharmonics.
+		tol := int(math.Ceil(km / 4))
+		sub := localMax(power, int(km)-tol, int(km)+tol)
+		if sub > k0 && power[sub] >= subharmonicMinPower*power[k] && power[sub] > power[sub-1] && power[sub] > power[sub+1] {
+			k = sub
+			break
+		}
+	}
+
+	inRange := slices.Clone(power[k0 : k1+1])
+	slices.Sort(inRange)
+	median := inRange[len(inRange)/2]
+	confidence := power[k] / math.Max(median, 1e-12)
+	if confidence < minConfidence {
+		return Result{Confidence: confidence}, ErrNoPattern
+	}
+
+	period := float64(n) / refine(power, k)
+	return Result{
+		PeriodPx:   period,
+		PixelsPerM: period / spacingM,
+		Confidence: confidence,
+	}, nil
+}
@@ -0,0 +1,53 @@
+package calib
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sleepers generates an image with noise, and dark bars with the given period in the bottom part.
+func sleepers(seed int64, w, h int, periodPx float64) *image.Gray {
+	// #nosec G404
+	rnd := rand.New(rand.NewSource(seed))
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			v := 100 + 50*float64(x)/float64(w) + rnd.Float64()*60
+			if periodPx > 0 && y > h*6/10 && math.Mod(float64(x)+7.3, periodPx) < periodPx/4 {
+				v -= 70
+			}
+			img.SetGray(x, y, color.Gray{Y: uint8(v)})
+		}
+	}
+	return img
+}
+
+func Test_Calibrate(t *testing.T) {
+	for _, period := range []float64{6.5, 12, 23.7, 27, 60} {
+		res, err := Calibrate(sleepers(1, 400, 150, period), Config{})
+		require.NoError(t, err, period)
+		assert.InDelta(t, period, res.PeriodPx, period*0.01, period)
+		assert.InDelta(t, period/DefaultSleeperSpacingM, res.PixelsPerM, period/DefaultSleeperSpacingM*0.01)
+		assert.Greater(t, res.Confidence, float64(minConfidence))
+	}
+}
+
+func Test_Calibrate_Spacing(t *testing.T) {
+	res, err := Calibrate(sleepers(2, 400, 150, 30), Config{SpacingM: 0.65})
+	require.NoError(t, err)
+	assert.InDelta(t, 30/0.65, res.PixelsPerM, 0.5)
+}
+
+func Test_Calibrate_NoPattern(t *testing.T) {
+	_, err := Calibrate(sleepers(3, 400, 150, 0), Config{})
+	assert.ErrorIs(t, err, ErrNoPattern)
+
+	_, err = Calibrate(sleepers(3, 10, 10, 0), Config{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,329 @@
+package calib
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	"github.com/nfnt/resize"
+	"jo-m.ch/go/trainbot/pkg/avg"
+	"jo-m.ch/go/trainbot/pkg/imutil"
+	"jo-m.ch/go/trainbot/pkg/pmatch"
+)
+
+const (
+	// Frames are scaled down to at most this width for the activity map.
+	activityMaxWidth = 640
+	// Size of the cells of the activity map, in scaled down pixels.
+	activityCellPx = 16
+	// Maximum vertical offset which is still considered horizontal motion, in scaled down pixels.
+	activityMaxDy = 1
+	// Minimum horizontal offset which is considered motion, in scaled down pixels.
+	activityMinDx = 2
+	// Vertical search range, in scaled down pixels.
+	activitySearchDy = 3
+	// Minimum cosine similarity of a match to be considered.
+	activityGoodCos = 0.9
+	// Cells with less contrast (average deviation) are ignored, the match would be meaningless.
+	activityMinContrast = 0.02
+	// Minimum fraction of cells with horizontal motion for a frame to be considered active (i.e. a train is passing).
+	activityMinActiveFraction = 0.02
+	// Weight of changes not explained by horizontal motion (obstructions, flicker), relative to horizontal motion.
+	activityBadWeight = 2
+	// A cell must see horizontal motion in at least this fraction of active frames to be worth including.
+	activityMinGoodFraction = 0.5
+)
+
+// ErrNoMotion is returned when there was not enough horizontal motion to suggest a region of interest.
+var ErrNoMotion = errors.New("no horizontal motion found")
+
+// ErrSizeRange is returned when the minimum size of the region of interest is larger than the maximum size.
+var ErrSizeRange = errors.New("minimum size is larger than maximum size")
+
+// ActivityMap accumulates per-cell statistics on horizontal motion over a video, to find a good region of interest.
+// Use NewActivityMap() to create an instance.
+type ActivityMap struct {
+	bounds image.Rectangle
+	// Frames are scaled down by this factor.
+	scale int
+	maxDx int
+	cols  int
+	rows  int
+
+	// Number of frame pairs, and number of frames in which a train was passing.
+	nFrames int
+	nActive int
+	// Per cell (row major), number of frames with consistent horizontal motion, and with other changes.
+	good []int
+	bad  []int
+
+	// Frame with the most horizontal motion, for the preview.
+	bestFrame image.Image
+	bestNGood int
+
+	// Labels of the cells of the current frame, see classify().
+	cellLabels []int8
+	pm         pmatch.Instance
+}
+
+// NewActivityMap creates a new ActivityMap for frames with the given bounds.
+// maxDx is the maximum expected horizontal motion between two frames, in pixels.
+func NewActivityMap(bounds image.Rectangle, maxDx int) *ActivityMap {
+	scale := max(int(math.Ceil(float64(bounds.Dx())/activityMaxWidth)), 1)
+	cols := bounds.Dx() / scale / activityCellPx
+	rows := bounds.Dy() / scale / activityCellPx
+
+	return &ActivityMap{
+		bounds: bounds,
+		scale:  scale,
+		maxDx:  max(maxDx/scale, activityMinDx+1),
+		cols:   cols,
+		rows:   rows,
+
+		good: make([]int, cols*rows),
+		bad:  make([]int, cols*rows),
+
+		cellLabels: make([]int8, cols*rows),
+		pm:         pmatch.NewInstance(),
+	}
+}
+
+func (a *ActivityMap) cellRect(col, row int) image.Rectangle {
+	return image.Rect(0, 0, activityCellPx, activityCellPx).Add(image.Pt(col*activityCellPx, row*activityCellPx))
+}
+
+// Cell labels for a single frame pair.
+const (
+	cellNone  = 0
+	cellLeft  = -1
+	cellRight = 1
+	cellBad   = 2
+)
+
+// classify matches a cell of curr in prev.
+func (a *ActivityMap) classify(prev, curr *image.RGBA, col, row int) (int8, error) {
+	cell := a.cellRect(col, row)
+	pat, err := imutil.Sub(curr, cell)
+	if err != nil {
+		return 0, err
+	}
+	_, avgDev := avg.RGBAC(pat.(*image.RGBA))
+	if (avgDev[0]+avgDev[1]+avgDev[2])/3 < activityMinContrast {
+		return cellNone, nil
+	}
+
+	win := image.Rect(cell.Min.X-a.maxDx, cell.Min.Y-activitySearchDy, cell.Max.X+a.maxDx, cell.Max.Y+activitySearchDy).Intersect(prev.Rect)
+	search, err := imutil.Sub(prev, win)
+	if err != nil {
+		return 0, err
+	}
+
+	x, y, cos := a.pm.SearchRGBA(search.(*image.RGBA), pat.(*image.RGBA))
+	dx := win.Min.X + x - cell.Min.X
+	dy := win.Min.Y + y - cell.Min.Y
+
+	switch {
+	case cos >= activityGoodCos && abs(dx) < activityMinDx && abs(dy) <= activityMaxDy:
+		// Not moving.
+		return cellNone, nil
+	case cos >= activityGoodCos && abs(dy) <= activityMaxDy:
+		// Positive dx means the content moved to the left.
+		if dx > 0 {
+			return cellLeft, nil
+		}
+		return cellRight, nil
+	default:
+		return cellBad, nil
+	}
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
+
+func (a *ActivityMap) scaleDown(frame image.Image) (*image.RGBA, error) {
+	if frame.Bounds().Size() != a.bounds.Size() {
+		return nil, fmt.Errorf("inconsistent frame size %v, expected %v", frame.Bounds().Size(), a.bounds.Size())
+	}
+	return imutil.ToRGBA(resize.Resize(uint(a.bounds.Dx()/a.scale), uint(a.bounds.Dy()/a.scale), frame, resize.Bilinear)), nil
+}
+
+// AddPair adds a pair of consecutive frames.
+// To save time, not every pair of a video needs to be added.
+func (a *ActivityMap) AddPair(prevFrame, frame image.Image) error {
+	prev, err := a.scaleDown(prevFrame)
+	if err != nil {
+		return err
+	}
+	curr, err := a.scaleDown(frame)
+	if err != nil {
+		return err
+	}
+
+	// Classify all cells, and find the majority direction of motion.
+	dir := 0
+	nMoving := 0
+	for row := range a.rows {
+		for col := range a.cols {
+			l, err := a.classify(prev, curr, col, row)
+			if err != nil {
+				return err
+			}
+			a.cellLabels[row*a.cols+col] = l
+			if l == cellLeft || l == cellRight {
+				dir += int(l)
+				nMoving++
+			}
+		}
+	}
+
+	a.nFrames++
+	active := float64(nMoving) >= activityMinActiveFraction*float64(len(a.cellLabels))
+	if active {
+		a.nActive++
+	}
+
+	nGood := 0
+	for i, l := range a.cellLabels {
+		switch {
+		case l == cellBad:
+			a.bad[i]++
+		case l == cellNone:
+		case !active:
+			// Some isolated motion, e.g. a bird or a car.
+			a.bad[i]++
+		case (dir > 0) == (l > 0):
+			a.good[i]++
+			nGood++
+		default:
+			// Moving against the majority direction.
+			a.bad[i]++
+		}
+	}
+
+	if nGood > a.bestNGood {
+		a.bestNGood = nGood
+		a.bestFrame = imutil.Copy(frame)
+	}
+
+	return nil
+}
+
+// cellScores computes how suitable each cell is to be in the region of interest.
+// Positive values mean the cell consistently sees horizontal motion while a train is passing.
+func (a *ActivityMap) cellScores() []float64 {
+	ret := make([]float64, len(a.good))
+	if a.nActive == 0 {
+		return ret
+	}
+	for i := range ret {
+		ret[i] = float64(a.good[i])/float64(a.nActive) - activityMinGoodFraction -
+			activityBadWeight*float64(a.bad[i])/float64(a.nFrames)
+	}
+	return ret
+}
+
+// toFrame converts a rect in cell coordinates to frame coordinates.
+func (a *ActivityMap) toFrame(r image.Rectangle) image.Rectangle {
+	return image.Rectangle{
+		Min: r.Min.Mul(activityCellPx * a.scale),
+		Max: r.Max.Mul(activityCellPx * a.scale),
+	}.Add(a.bounds.Min)
+}
+
+// Suggest returns the rect (in frame coordinates) with width and height in [minSize, maxSize],
+// which sees the most consistent horizontal motion and the least other changes.
+// The corners are aligned to even coordinates. The score is the sum of the cell scores, higher is better.
+// Returns ErrSizeRange if minSize > maxSize, and ErrNoMotion if no rect sees enough horizontal motion.
+func (a *ActivityMap) Suggest(minSize, maxSize int) (image.Rectangle, float64, error) {
+	if minSize > maxSize {
+		return image.Rectangle{}, 0, ErrSizeRange
+	}
+	scores := a.cellScores()
+
+	// Integral image of the scores.
+	integral := make([]float64, (a.cols+1)*(a.rows+1))
+	at := func(col, row int) float64 { return integral[row*(a.cols+1)+col] }
+	for row := range a.rows {
+		for col := range a.cols {
+			integral[(row+1)*(a.cols+1)+col+1] = scores[row*a.cols+col] + at(col, row+1) + at(col+1, row) - at(col, row)
+		}
+	}
+
+	cellPx := activityCellPx * a.scale
+	minCells := int(math.Ceil(float64(minSize) / float64(cellPx)))
+	maxCells := maxSize / cellPx
+
+	var best image.Rectangle
+	bestScore := 0.
+	for h := minCells; h <= min(maxCells, a.rows); h++ {
+		for w := minCells; w <= min(maxCells, a.cols); w++ {
+			for row := 0; row+h <= a.rows; row++ {
+				for col := 0; col+w <= a.cols; col++ {
+					score := at(col+w, row+h) - at(col, row+h) - at(col+w, row) + at(col, row)
+					if score > bestScore {
+						bestScore = score
+						best = image.Rect(col, row, col+w, row+h)
+					}
+				}
+			}
+		}
+	}
+
+	if best.Empty() {
+		return image.Rectangle{}, 0, ErrNoMotion
+	}
+
+	r := a.toFrame(best)
+	// Align to even coordinates (required by some cameras).
+	r.Min.X &^= 1
+	r.Min.Y &^= 1
+	r.Max.X &^= 1
+	r.Max.Y &^= 1
+	return r, bestScore, nil
+}
+
+// Preview draws the activity map and the suggested rect onto the frame with the most horizontal motion.
+// Green cells consistently see horizontal motion, red cells see other changes.
+func (a *ActivityMap) Preview(rect image.Rectangle) *image.RGBA {
+	ret := image.NewRGBA(a.bounds)
+	if a.bestFrame != nil {
+		draw.Draw(ret, ret.Rect, a.bestFrame, a.bestFrame.Bounds().Min, draw.Src)
+	}
+
+	scores := a.cellScores()
+	for row := range a.rows {
+		for col := range a.cols {
+			s := scores[row*a.cols+col]
+			c := color.RGBA{G: 255, A: uint8(math.Min(s, 1) * 100)}
+			if s < 0 {
+				c = color.RGBA{R: 255, A: uint8(math.Min(-s, 1) * 100)}
+			}
+			// Colors are premultiplied.
+			c.R = uint8(int(c.R) * int(c.A) / 255)
+			c.G = uint8(int(c.G) * int(c.A) / 255)
+			draw.Draw(ret, a.toFrame(image.Rect(col, row, col+1, row+1)), image.NewUniform(c), image.Point{}, draw.Over)
+		}
+	}
+
+	border := color.RGBA{R: 255, G: 255, A: 255}
+	for i := range 3 {
+		r := rect.Inset(-i)
+		for x := r.Min.X; x < r.Max.X; x++ {
+			ret.Set(x, r.Min.Y, border)
+			ret.Set(x, r.Max.Y-1, border)
+		}
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			ret.Set(r.Min.X, y, border)
+			ret.Set(r.Max.X-1, y, border)
+		}
+	}
+
+	return ret
+}
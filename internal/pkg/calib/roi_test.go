@@ -0,0 +1,69 @@
+package calib
+
+import (
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"jo-m.ch/go/trainbot/pkg/imutil"
+)
+
+// roiVideo generates frames with a static background, a train moving to the left in rows 96..192,
+// and flickering noise (e.g. a bush in the wind) in front of the train at x < 80.
+func roiVideo(nFrames int) []image.Image {
+	const w, h = 320, 240
+	bg := imutil.RandRGBA(1, w, h)
+	train := imutil.RandRGBA(2, w*4, h)
+
+	var frames []image.Image
+	for k := range nFrames {
+		f := imutil.Copy(bg).(*image.RGBA)
+		noise := imutil.RandRGBA(int64(100+k), w, h)
+		for y := 96; y < 192; y++ {
+			for x := range w {
+				if k >= 10 && k < nFrames-10 {
+					f.SetRGBA(x, y, train.RGBAAt(x+6*k, y))
+				}
+				if x < 80 {
+					f.SetRGBA(x, y, noise.RGBAAt(x, y))
+				}
+			}
+		}
+		frames = append(frames, f)
+	}
+	return frames
+}
+
+func Test_ActivityMap_Suggest(t *testing.T) {
+	frames := roiVideo(40)
+	a := NewActivityMap(frames[0].Bounds(), 20)
+	for i := 1; i < len(frames); i++ {
+		require.NoError(t, a.AddPair(frames[i-1], frames[i]))
+	}
+
+	rect, score, err := a.Suggest(64, 160)
+	require.NoError(t, err)
+	assert.Greater(t, score, 0.)
+	assert.Equal(t, image.Pt(160, 96), rect.Size())
+	assert.True(t, rect.In(image.Rect(80, 96, 320, 192)), rect)
+
+	preview := a.Preview(rect)
+	assert.Equal(t, frames[0].Bounds(), preview.Bounds())
+
+	_, _, err = a.Suggest(200, 160)
+	assert.ErrorIs(t, err, ErrSizeRange)
+
+	assert.Error(t, a.AddPair(frames[0], imutil.RandRGBA(1, 100, 100)))
+}
+
+func Test_ActivityMap_NoMotion(t *testing.T) {
+	bg := imutil.RandRGBA(1, 320, 240)
+	a := NewActivityMap(bg.Rect, 20)
+	for range 5 {
+		require.NoError(t, a.AddPair(bg, bg))
+	}
+
+	_, _, err := a.Suggest(64, 160)
+	assert.ErrorIs(t, err, ErrNoMotion)
+}
@@ -0,0 +1,117 @@
+package calib
+
+import (
+	"errors"
+	"image"
+	"math"
+)
+
+const (
+	// Maximum shear which can be measured [px per row], about 11 degrees.
+	shearMax = 0.2
+	// Minimum normalized cross-correlation of the edges in the top and bottom half of the image.
+	shearMinCorrelation = 0.3
+)
+
+// ErrNoEdges is returned when no vertical edges were found to measure the shear.
+var ErrNoEdges = errors.New("no vertical edges found")
+
+// gradientProfile sums the horizontal luminance gradient of each column over the rows y0..y1 of img.
+// Transparent (masked) pixels have no gradient.
+func gradientProfile(img image.Image, y0, y1 int) []float64 {
+	b := img.Bounds()
+	ret := make([]float64, b.Dx())
+	for y := b.Min.Y + y0; y < b.Min.Y+y1; y++ {
+		prev, prevOpaque := 0., false
+		for x := range ret {
+			_, _, _, a := img.At(b.Min.X+x, y).RGBA()
+			l := luminance(img, b.Min.X+x, y)
+			opaque := a == 0xffff
+			if opaque && prevOpaque {
+				ret[x] += l - prev
+			}
+			prev, prevOpaque = l, opaque
+		}
+	}
+	return ret
+}
+
+// smooth convolves a profile with a binomial kernel (sigma 1px), with zero padding.
+func smooth(profile []float64) []float64 {
+	kernel := []float64{1. / 16, 4. / 16, 6. / 16, 4. / 16, 1. / 16}
+	ret := make([]float64, len(profile))
+	for x := range ret {
+		for k, v := range kernel {
+			if i := x + k - 2; i >= 0 && i < len(profile) {
+				ret[x] += v * profile[i]
+			}
+		}
+	}
+	return ret
+}
+
+// MeasureShear measures the lean of the vertical edges (e.g. doors, windows and the ends of cars) in a stitched train
+// image, as the horizontal shift per row [px]. Positive if lower rows are shifted to the right (see imutil.Shear()).
+// The track must be horizontal in the image (see stitch.Config.TrackAngleDeg), otherwise stitched trains are sheared
+// as well.
+func MeasureShear(img image.Image) (float64, error) {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	if h < 4 || w < 4 {
+		return 0, errors.New("image too small")
+	}
+
+	// The edges in the bottom half are shifted by shear*dist relative to the top half.
+	half := h / 2
+	dist := float64(h - half)
+	// Sharp peaks would bias the interpolation below towards whole pixels.
+	top := smooth(smooth(gradientProfile(img, 0, half)))
+	bottom := smooth(smooth(gradientProfile(img, h-half, h)))
+
+	maxShift := int(math.Ceil(shearMax * dist))
+	corr := make([]float64, 2*maxShift+1)
+	best := 0
+	for i := range corr {
+		d := i - maxShift
+		for x := max(d, 0); x < min(w+d, w); x++ {
+			corr[i] += top[x-d] * bottom[x]
+		}
+		if corr[i] > corr[best] {
+			best = i
+		}
+	}
+
+	var energyTop, energyBottom float64
+	for x := range top {
+		energyTop += top[x] * top[x]
+		energyBottom += bottom[x] * bottom[x]
+	}
+	if energyTop == 0 || energyBottom == 0 || corr[best]/math.Sqrt(energyTop*energyBottom) < shearMinCorrelation {
+		return 0, ErrNoEdges
+	}
+	if best == 0 || best == len(corr)-1 {
+		return 0, errors.New("shear is out of range")
+	}
+
+	// Interpolate the position of the peak with a parabola. Unlike refine(), the correlation might be negative.
+	peak := float64(best)
+	if den := corr[best-1] - 2*corr[best] + corr[best+1]; den != 0 {
+		peak += 0.5 * (corr[best-1] - corr[best+1]) / den
+	}
+	return (peak - float64(maxShift)) / dist, nil
+}
+
+// LineReadoutS estimates the line readout time [s] of a camera with a rolling shutter, from a stitched train image
+// and the speed of the train [px/s], see stitch.Train.SpeedPxS. If the frames were already corrected with a line
+// readout time (stitch.Config.LineReadoutS), the result is the remaining error, and has to be added to it.
+func LineReadoutS(img image.Image, speedPxS float64) (float64, error) {
+	if speedPxS == 0 {
+		return 0, errors.New("train is not moving")
+	}
+
+	shear, err := MeasureShear(img)
+	if err != nil {
+		return 0, err
+	}
+	// Lower rows were read out later, when the train had moved on further.
+	return shear / speedPxS, nil
+}
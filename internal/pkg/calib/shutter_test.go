@@ -0,0 +1,65 @@
+package calib
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"jo-m.ch/go/trainbot/pkg/imutil"
+)
+
+// cars generates an image with noise and vertical bars of random width and brightness, like doors and windows.
+func cars(seed int64, w, h int) *image.RGBA {
+	// #nosec G404
+	rnd := rand.New(rand.NewSource(seed))
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	v := 128.
+	for x := range w {
+		if rnd.Float64() < 0.05 {
+			v = 40 + rnd.Float64()*180
+		}
+		for y := range h {
+			l := uint8(v + rnd.Float64()*20)
+			img.SetRGBA(x, y, color.RGBA{l, l, l, 0xff})
+		}
+	}
+	return img
+}
+
+func Test_MeasureShear(t *testing.T) {
+	for _, shear := range []float64{0, 0.013, -0.04, 0.1} {
+		img := imutil.Shear(cars(1, 800, 100), shear)
+		measured, err := MeasureShear(img)
+		require.NoError(t, err, shear)
+		assert.InDelta(t, shear, measured, 0.001, shear)
+	}
+}
+
+func Test_MeasureShear_NoEdges(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 200, 50))
+	_, err := MeasureShear(img)
+	assert.ErrorIs(t, err, ErrNoEdges)
+
+	_, err = MeasureShear(image.NewRGBA(image.Rect(0, 0, 2, 2)))
+	assert.Error(t, err)
+}
+
+func Test_LineReadoutS(t *testing.T) {
+	// A train moving to the right at 1000px/s, with a line readout time of 20us.
+	img := imutil.Shear(cars(2, 800, 100), 1000*20e-6)
+	readout, err := LineReadoutS(img, 1000)
+	require.NoError(t, err)
+	assert.InDelta(t, 20e-6, readout, 1e-6)
+
+	// Moving to the left, the lower rows lean the other way.
+	img = imutil.Shear(cars(2, 800, 100), -1000*20e-6)
+	readout, err = LineReadoutS(img, -1000)
+	require.NoError(t, err)
+	assert.InDelta(t, 20e-6, readout, 1e-6)
+
+	_, err = LineReadoutS(img, 0)
+	assert.Error(t, err)
+}
@@ -3,12 +3,13 @@ package db
 import (
 	"context"
 	"database/sql"
-	_ "embed"
+	"embed"
 	"errors"
 	"fmt"
 	"io/fs"
 	"net/url"
 	"os"
+	"sort"
 
 	"github.com/jmoiron/sqlx"
 
@@ -18,6 +19,9 @@ import (
 //go:embed schema.sql
 var sqlSchema string
 
+//go:embed migrations/*.sql
+var sqlMigrations embed.FS
+
 const driver = "sqlite"
 
 func buildDSN(path string, readOnly bool) string {
@@ -56,9 +60,105 @@ func Open(path string) (*sqlx.DB, error) {
 		return nil, fmt.Errorf("failed to initialize schema: %w", err)
 	}
 
+	err = migrate(db)
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to migrate schema: %w", err)
+	}
+
 	return db, err
 }
 
+// columns returns the columns of all tables, as "table.column".
+func columns(q sqlx.Queryer) (map[string]bool, error) {
+	var tables []string
+	err := sqlx.Select(q, &tables, "SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%';")
+	if err != nil {
+		return nil, err
+	}
+
+	ret := map[string]bool{}
+	for _, table := range tables {
+		var cols []string
+		err = sqlx.Select(q, &cols, "SELECT name FROM pragma_table_info(?);", table)
+		if err != nil {
+			return nil, err
+		}
+		for _, col := range cols {
+			ret[table+"."+col] = true
+		}
+	}
+	return ret, nil
+}
+
+// migrate applies all migrations from migrations/ which have not yet been applied.
+// The number of applied migrations is tracked in the user_version pragma.
+// Some migrations have to rebuild a table (SQLite cannot drop constraints), and only copy the columns they know of.
+// A migration which would drop a column (e.g. one added manually) fails, so that no data is lost silently.
+func migrate(db *sqlx.DB) error {
+	names, err := fs.Glob(sqlMigrations, "migrations/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	var version int
+	err = db.Get(&version, "PRAGMA user_version;")
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < len(names); i++ {
+		migration, err := sqlMigrations.ReadFile(names[i])
+		if err != nil {
+			return err
+		}
+
+		tx, err := db.Beginx()
+		if err != nil {
+			return err
+		}
+
+		before, err := columns(tx)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		_, err = tx.Exec(string(migration))
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("%s: %w", names[i], err)
+		}
+
+		after, err := columns(tx)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		for col := range before {
+			if !after[col] {
+				_ = tx.Rollback()
+				return fmt.Errorf("%s: would drop column %s, copy its data and drop it manually before", names[i], col)
+			}
+		}
+
+		// Pragmas do not support parameters.
+		_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d;", i+1))
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // Backup safely backs up a SQLite database to a new file.
 func Backup(src *sqlx.DB, destPath string) error {
 	err := os.Remove(destPath)
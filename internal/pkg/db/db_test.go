@@ -4,6 +4,7 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"jo-m.ch/go/trainbot/internal/pkg/stitch"
@@ -18,6 +19,21 @@ func Test_Open_Schema(t *testing.T) {
 
 	err = db.Close()
 	assert.NoError(t, err)
+
+	// Opening again must not re-apply migrations.
+	db, err = Open(dbpath)
+	assert.NoError(t, err)
+	require.NotNil(t, db)
+
+	var version int
+	err = db.Get(&version, "PRAGMA user_version;")
+	assert.NoError(t, err)
+	migrations, err := sqlMigrations.ReadDir("migrations")
+	assert.NoError(t, err)
+	assert.Equal(t, len(migrations), version)
+
+	err = db.Close()
+	assert.NoError(t, err)
 }
 
 func Test_Backup(t *testing.T) {
@@ -55,3 +71,29 @@ func Test_Backup(t *testing.T) {
 	assert.Equal(t, id, next.ID)
 	assert.Equal(t, t0, next.StartTS)
 }
+
+func Test_migrate_KeepsColumns(t *testing.T) {
+	tmp := t.TempDir()
+	dbpath := filepath.Join(tmp, "test.db")
+	db, err := sqlx.Open(driver, buildDSN(dbpath, false))
+	require.NoError(t, err)
+	defer db.Close()
+
+	// A column which a migration rebuilding the table does not know of.
+	_, err = db.Exec(sqlSchema)
+	require.NoError(t, err)
+	_, err = db.Exec("ALTER TABLE trains_v2 ADD COLUMN note TEXT;")
+	require.NoError(t, err)
+
+	err = migrate(db)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "trains_v2.note")
+
+	// The failing migration was not applied.
+	cols, err := columns(db)
+	require.NoError(t, err)
+	assert.True(t, cols["trains_v2.note"])
+	var version int
+	require.NoError(t, db.Get(&version, "PRAGMA user_version;"))
+	assert.Equal(t, 2, version)
+}
@@ -0,0 +1,7 @@
+-- Trains which were too long to be stitched at once are split into multiple parts.
+-- 0 if the train was not split, otherwise the part number (starting at 1).
+ALTER TABLE trains_v2 ADD COLUMN part INT NOT NULL DEFAULT 0;
+-- For parts, the id of the first part of the train (which references itself). NULL if the train was not split.
+ALTER TABLE trains_v2 ADD COLUMN group_id INTEGER NULL DEFAULT NULL REFERENCES trains_v2(id);
+
+CREATE INDEX IF NOT EXISTS trains_v2_group_id ON trains_v2(group_id);
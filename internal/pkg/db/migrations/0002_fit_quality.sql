@@ -0,0 +1,13 @@
+-- How well the motion model fits the measurements, see stitch.Quality.
+-- NULL for trains recorded before this was introduced.
+ALTER TABLE trains_v2 ADD COLUMN quality DOUBLE NULL DEFAULT NULL;
+ALTER TABLE trains_v2 ADD COLUMN inlier_fraction DOUBLE NULL DEFAULT NULL;
+ALTER TABLE trains_v2 ADD COLUMN residual_rms_px_s DOUBLE NULL DEFAULT NULL;
+ALTER TABLE trains_v2 ADD COLUMN mean_cos DOUBLE NULL DEFAULT NULL;
+-- Half widths of the 95% confidence intervals of length_px and speed_px_s.
+ALTER TABLE trains_v2 ADD COLUMN length_ci_px DOUBLE NULL DEFAULT NULL;
+ALTER TABLE trains_v2 ADD COLUMN speed_ci_px_s DOUBLE NULL DEFAULT NULL;
+-- Set if quality was below the configured minimum.
+ALTER TABLE trains_v2 ADD COLUMN low_confidence BOOL NOT NULL DEFAULT FALSE;
+
+CREATE INDEX IF NOT EXISTS trains_v2_low_confidence ON trains_v2(low_confidence);
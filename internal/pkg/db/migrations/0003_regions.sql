@@ -0,0 +1,90 @@
+-- Multiple regions (e.g. tracks) can be configured per camera, trains are tagged with the region name.
+-- Trains from different regions may have the same start_ts, so the UNIQUE constraint is replaced by UNIQUE(region, start_ts).
+-- SQLite cannot drop constraints, so the table is rebuilt.
+-- Only the columns known at this point are copied, migrate() refuses to run this if the table has other columns.
+CREATE TABLE trains_v2_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+
+    -- Empty for the default region (i.e. if only a single region is configured via --rect-*).
+    region TEXT NOT NULL DEFAULT '',
+    start_ts DATETIME NOT NULL,
+
+    n_frames INT NOT NULL,
+    -- Always positive (absolute value).
+    length_px DOUBLE NOT NULL,
+    -- Positive sign means movement to the right, negative to the left.
+    speed_px_s DOUBLE NOT NULL,
+    -- Positive sign means increasing speed for trains going to the right, breaking for trains going to the left.
+    accel_px_s_2 DOUBLE NOT NULL,
+    px_per_m  DOUBLE NOT NULL,
+
+    -- Files from blob dir were uploaded.
+    uploaded BOOL NOT NULL DEFAULT FALSE,
+
+    -- Blobs we have deleted locally after upload.
+    cleaned_up BOOL NOT NULL DEFAULT FALSE,
+
+    -- See 0001_train_parts.sql.
+    part INT NOT NULL DEFAULT 0,
+    group_id INTEGER NULL DEFAULT NULL REFERENCES trains_v2_new(id),
+
+    -- See 0002_fit_quality.sql.
+    quality DOUBLE NULL DEFAULT NULL,
+    inlier_fraction DOUBLE NULL DEFAULT NULL,
+    residual_rms_px_s DOUBLE NULL DEFAULT NULL,
+    mean_cos DOUBLE NULL DEFAULT NULL,
+    length_ci_px DOUBLE NULL DEFAULT NULL,
+    speed_ci_px_s DOUBLE NULL DEFAULT NULL,
+    low_confidence BOOL NOT NULL DEFAULT FALSE,
+
+    UNIQUE(region, start_ts)
+);
+
+INSERT INTO trains_v2_new (
+    id,
+    start_ts,
+    n_frames,
+    length_px,
+    speed_px_s,
+    accel_px_s_2,
+    px_per_m,
+    uploaded,
+    cleaned_up,
+    part,
+    group_id,
+    quality,
+    inlier_fraction,
+    residual_rms_px_s,
+    mean_cos,
+    length_ci_px,
+    speed_ci_px_s,
+    low_confidence
+)
+SELECT
+    id,
+    start_ts,
+    n_frames,
+    length_px,
+    speed_px_s,
+    accel_px_s_2,
+    px_per_m,
+    uploaded,
+    cleaned_up,
+    part,
+    group_id,
+    quality,
+    inlier_fraction,
+    residual_rms_px_s,
+    mean_cos,
+    length_ci_px,
+    speed_ci_px_s,
+    low_confidence
+FROM trains_v2
+ORDER BY id ASC;
+
+DROP TABLE trains_v2;
+ALTER TABLE trains_v2_new RENAME TO trains_v2;
+
+CREATE INDEX IF NOT EXISTS trains_v2_group_id ON trains_v2(group_id);
+CREATE INDEX IF NOT EXISTS trains_v2_low_confidence ON trains_v2(low_confidence);
+CREATE INDEX IF NOT EXISTS trains_v2_start_ts ON trains_v2(start_ts);
@@ -0,0 +1,8 @@
+-- Cars (wagons, locomotives) found in the stitched image, see stitch.Car.
+-- NULL for trains recorded before this was introduced, or if the train could not be segmented.
+ALTER TABLE trains_v2 ADD COLUMN n_cars INT NULL DEFAULT NULL;
+-- JSON array of {"start_px": .., "end_px": ..}, in image order (left to right).
+-- In pixels of the stitched image, which might differ from the stored image if that had to be scaled down.
+ALTER TABLE trains_v2 ADD COLUMN cars TEXT NULL DEFAULT NULL;
+-- Set if an image of each car was stored as a separate blob.
+ALTER TABLE trains_v2 ADD COLUMN car_crops BOOL NOT NULL DEFAULT FALSE;
@@ -0,0 +1,5 @@
+-- Axles found in the stitched image.
+-- NULL for trains recorded before this was introduced, or if no axles were found.
+ALTER TABLE trains_v2 ADD COLUMN n_axles INT NULL DEFAULT NULL;
+-- JSON array of the distances between consecutive axles in m, in image order (left to right).
+ALTER TABLE trains_v2 ADD COLUMN axle_spacing_m TEXT NULL DEFAULT NULL;
@@ -0,0 +1,7 @@
+-- Color fingerprint (livery) of the train, see stitch.Fingerprint. JSON.
+-- NULL for trains recorded before this was introduced.
+ALTER TABLE trains_v2 ADD COLUMN fingerprint TEXT NULL DEFAULT NULL;
+-- Mean color of the fingerprint profile (see stitch.Fingerprint.MeanColor()), to pre-filter similar trains.
+ALTER TABLE trains_v2 ADD COLUMN fingerprint_r REAL NULL DEFAULT NULL;
+ALTER TABLE trains_v2 ADD COLUMN fingerprint_g REAL NULL DEFAULT NULL;
+ALTER TABLE trains_v2 ADD COLUMN fingerprint_b REAL NULL DEFAULT NULL;
@@ -0,0 +1,3 @@
+-- Name of the saved sequence the train was stitched from (see stitch.Config.SequenceDir).
+-- NULL if the sequence was not saved.
+ALTER TABLE trains_v2 ADD COLUMN sequence TEXT NULL DEFAULT NULL;
@@ -0,0 +1,23 @@
+-- Sequences (or parts of them) which did not result in a train, see stitch.RejectError.
+-- Only the most recent ones are kept (see InsertRejectedSequence()).
+CREATE TABLE rejected_sequences (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+
+    -- Empty for the default region.
+    region TEXT NOT NULL DEFAULT '',
+    -- Timestamps of the first and last frame.
+    start_ts DATETIME NOT NULL,
+    end_ts DATETIME NOT NULL,
+    n_frames INT NOT NULL,
+
+    -- See stitch.RejectReason.
+    reason TEXT NOT NULL,
+    error TEXT NOT NULL,
+    -- See stitch.DxSummary. JSON.
+    dx_summary TEXT NOT NULL,
+    -- Low resolution JPEG of a frame. NULL if there is none.
+    preview BLOB NULL DEFAULT NULL
+);
+
+CREATE INDEX IF NOT EXISTS rejected_sequences_start_ts ON rejected_sequences(start_ts);
+CREATE INDEX IF NOT EXISTS rejected_sequences_reason ON rejected_sequences(reason);
@@ -0,0 +1,2 @@
+-- Set if the image was enhanced, and the original (not enhanced) image was stored as a separate blob.
+ALTER TABLE trains_v2 ADD COLUMN orig_img BOOL NOT NULL DEFAULT FALSE;
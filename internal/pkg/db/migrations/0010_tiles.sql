@@ -0,0 +1,3 @@
+-- Size of the full resolution image, if a tiled image pyramid (Deep Zoom) was stored. The tile blobs are derived from it.
+ALTER TABLE trains_v2 ADD COLUMN tiles_w INTEGER;
+ALTER TABLE trains_v2 ADD COLUMN tiles_h INTEGER;
@@ -0,0 +1,3 @@
+-- Angle of the track in the picture, in degrees clockwise from horizontal (see stitch.Train.TrackAngleDeg).
+-- Measured from the train if possible, otherwise the configured angle.
+ALTER TABLE trains_v2 ADD COLUMN track_angle_deg DOUBLE NULL DEFAULT NULL;
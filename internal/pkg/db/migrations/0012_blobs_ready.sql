@@ -0,0 +1,3 @@
+-- Set once all blobs of a train were written (see SetTrainBlobs()), trains are only uploaded afterwards.
+-- Existing trains are complete.
+ALTER TABLE trains_v2 ADD COLUMN blobs_ready BOOL NOT NULL DEFAULT TRUE;
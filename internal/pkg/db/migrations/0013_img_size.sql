@@ -0,0 +1,4 @@
+-- Height of the stored image without the caption, and the factor by which it was downscaled from the stitched image.
+-- Used to join the parts of a train, unknown for existing trains.
+ALTER TABLE trains_v2 ADD COLUMN img_h INTEGER;
+ALTER TABLE trains_v2 ADD COLUMN img_scale REAL;
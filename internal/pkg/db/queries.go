@@ -1,43 +1,270 @@
 package db
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"image/jpeg"
+	"math"
+	"path"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 	"jo-m.ch/go/trainbot/internal/pkg/stitch"
+	"jo-m.ch/go/trainbot/pkg/dzi"
 )
 
-// InsertTrain inserts a new train sighting into the database.
-// Returns the db id of the new row.
-func InsertTrain(db *sqlx.DB, t stitch.Train) (int64, error) {
-	var id int64
-	const q = `
-	INSERT INTO trains_v2 (
-		start_ts,
-		n_frames,
-		length_px,
-		speed_px_s,
-		accel_px_s_2,
-		px_per_m
-	)
-	VALUES (?, ?, ?, ?, ?, ?)
-	RETURNING id;`
-	err := db.Get(&id, q,
-		t.StartTS,
+// marshalNullable marshals v to JSON, or returns nil if isNil.
+func marshalNullable(v any, isNil bool) (*string, error) {
+	if isNil {
+		return nil, nil
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	js := string(buf)
+	return &js, nil
+}
+
+// trainValues are the values of the nullable columns of a train.
+type trainValues struct {
+	// Confidence intervals, nil if unknown.
+	lengthCI    *float64
+	speedCI     *float64
+	nCars       *int
+	cars        *string
+	nAxles      *int
+	axleSpacing *string
+	fingerprint *string
+	// Mean color of the fingerprint, see stitch.Fingerprint.MeanColor().
+	fingerprintMean [3]*float64
+	sequence        *string
+}
+
+func newTrainValues(t stitch.Train) (trainValues, error) {
+	ret := trainValues{}
+	var err error
+	if !math.IsNaN(t.Quality.LengthCIPx) {
+		ret.lengthCI = &t.Quality.LengthCIPx
+	}
+	if !math.IsNaN(t.Quality.SpeedCIPxS) {
+		ret.speedCI = &t.Quality.SpeedCIPxS
+	}
+	if t.Cars != nil {
+		n := len(t.Cars)
+		ret.nCars = &n
+	}
+	ret.cars, err = marshalNullable(t.Cars, t.Cars == nil)
+	if err != nil {
+		return ret, err
+	}
+	if t.AxlesM != nil {
+		n := len(t.AxlesM)
+		ret.nAxles = &n
+	}
+	ret.axleSpacing, err = marshalNullable(t.AxleSpacingsM(), t.AxlesM == nil)
+	if err != nil {
+		return ret, err
+	}
+	ret.fingerprint, err = marshalNullable(t.Fingerprint, t.Fingerprint == nil)
+	if err != nil {
+		return ret, err
+	}
+	if t.Fingerprint != nil {
+		mean := t.Fingerprint.MeanColor()
+		for i := range mean {
+			ret.fingerprintMean[i] = &mean[i]
+		}
+	}
+	if t.Sequence != "" {
+		ret.sequence = &t.Sequence
+	}
+	return ret, nil
+}
+
+// trainColumns are the columns of trains_v2 which are measured when a train is stitched, in the order of
+// trainValues.args().
+var trainColumns = []string{
+	"n_frames",
+	"length_px",
+	"speed_px_s",
+	"accel_px_s_2",
+	"px_per_m",
+	"quality",
+	"inlier_fraction",
+	"residual_rms_px_s",
+	"mean_cos",
+	"length_ci_px",
+	"speed_ci_px_s",
+	"low_confidence",
+	"track_angle_deg",
+	"n_cars",
+	"cars",
+	"n_axles",
+	"axle_spacing_m",
+	"fingerprint",
+	"fingerprint_r",
+	"fingerprint_g",
+	"fingerprint_b",
+	"sequence",
+}
+
+// args returns the values of trainColumns for t.
+func (v trainValues) args(t stitch.Train) []any {
+	return []any{
 		t.NFrames,
 		t.LengthPx,
 		t.SpeedPxS,
 		t.AccelPxS2,
-		t.Conf.PixelsPerM)
+		t.Conf.PixelsPerM,
+		t.Quality.Score,
+		t.Quality.InlierFraction,
+		t.Quality.ResidualRMSPxS,
+		t.Quality.MeanCos,
+		v.lengthCI,
+		v.speedCI,
+		t.Quality.LowConfidence,
+		t.TrackAngleDeg,
+		v.nCars,
+		v.cars,
+		v.nAxles,
+		v.axleSpacing,
+		v.fingerprint,
+		v.fingerprintMean[0],
+		v.fingerprintMean[1],
+		v.fingerprintMean[2],
+		v.sequence,
+	}
+}
+
+var (
+	insertTrainQuery = fmt.Sprintf(`
+	INSERT INTO trains_v2 (region, start_ts, part, group_id, blobs_ready, %s)
+	VALUES (?, ?, ?, ?, ?%s)
+	RETURNING id;`, strings.Join(trainColumns, ", "), strings.Repeat(", ?", len(trainColumns)))
+
+	updateTrainQuery = fmt.Sprintf(`
+	UPDATE trains_v2
+	SET %s = ?, blobs_ready = FALSE, uploaded = FALSE, cleaned_up = FALSE
+	WHERE id = ?;`, strings.Join(trainColumns, " = ?, "))
+)
+
+// InsertTrain inserts a new train sighting into the database.
+// If the train is a part of a longer train, it is linked to the other parts via group_id (see stitch.Group).
+// For the first part of a group, the group id is set to the id of the new row, and stored in t.Group.ID.
+// Returns the db id of the new row.
+func InsertTrain(db *sqlx.DB, t stitch.Train) (int64, error) {
+	return insertTrain(db, t, true)
+}
+
+// InsertPendingTrain is like InsertTrain(), but the train is not uploaded until its blobs were written and recorded
+// with SetTrainBlobs().
+func InsertPendingTrain(db *sqlx.DB, t stitch.Train) (int64, error) {
+	return insertTrain(db, t, false)
+}
+
+func insertTrain(db *sqlx.DB, t stitch.Train, blobsReady bool) (int64, error) {
+	v, err := newTrainValues(t)
+	if err != nil {
+		return 0, err
+	}
+
+	var groupID *int64
+	if t.Group != nil && t.Group.ID != 0 {
+		groupID = &t.Group.ID
+	}
+
+	tx, err := db.Beginx()
 	if err != nil {
 		return 0, err
 	}
+	defer func() {
+		// No-op if the transaction was committed.
+		_ = tx.Rollback()
+	}()
+
+	var id int64
+	args := append([]any{t.Conf.Region, t.StartTS, t.Part, groupID, blobsReady}, v.args(t)...)
+	err = tx.Get(&id, insertTrainQuery, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	if t.Part > 0 && groupID == nil {
+		// The first part references itself.
+		const q = `
+		UPDATE trains_v2
+		SET group_id = id
+		WHERE id = ?;`
+		_, err = tx.Exec(q, id)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	if t.Part > 0 && groupID == nil && t.Group != nil {
+		t.Group.ID = id
+	}
 
 	return id, nil
 }
 
+// UpdateTrain updates the measurements of an existing train, after it was stitched again (see
+// stitch.SavedSequence). The start timestamp, region and part are kept, so that the blob names do not change.
+// The train is marked to be uploaded (and its blobs to be cleaned up) again, once SetTrainBlobs() was called.
+func UpdateTrain(db *sqlx.DB, id int64, t stitch.Train) error {
+	v, err := newTrainValues(t)
+	if err != nil {
+		return err
+	}
+
+	res, err := db.Exec(updateTrainQuery, append(v.args(t), id)...)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != 1 {
+		return ErrNoRowAffected
+	}
+	return nil
+}
+
+// SetTrainBlobs records that the blobs of a train were written, so that it can be uploaded, and which optional blobs
+// were stored: the car crops, the original image and the tiles (see Train.DZIFileName()), as well as the size of the
+// stored image. Only these fields of t are used, besides the ID. Car crops are only recorded if the train was segmented into cars.
+func SetTrainBlobs(db *sqlx.DB, t Train) error {
+	const q = `
+	UPDATE trains_v2
+	SET car_crops = ? AND n_cars IS NOT NULL, orig_img = ?, tiles_w = ?, tiles_h = ?, img_h = ?, img_scale = ?,
+		blobs_ready = TRUE
+	WHERE id = ?;`
+	res, err := db.Exec(q, t.CarCrops, t.OrigImg, t.TilesW, t.TilesH, t.ImgH, t.ImgScale, t.ID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != 1 {
+		return ErrNoRowAffected
+	}
+	return nil
+}
+
 // This should have been ".000_-07:00"... but it's too late now.
 const fileTSFormat = "20060102_150405.999_Z07:00"
 
@@ -45,27 +272,96 @@ const fileTSFormat = "20060102_150405.999_Z07:00"
 type Train struct {
 	ID      int64     `db:"id"`
 	StartTS time.Time `db:"start_ts"`
+	// Empty for the default region.
+	Region string `db:"region"`
+	// Number of cars, nil if the train was not segmented.
+	NCars    *int `db:"n_cars"`
+	CarCrops bool `db:"car_crops"`
+	OrigImg  bool `db:"orig_img"`
+	// Size of the full resolution image, nil if no tiles (see DZIFileName()) were stored.
+	TilesW *int `db:"tiles_w"`
+	TilesH *int `db:"tiles_h"`
+	// Height of the stored image (see ImgFileName()) without the caption, and the factor by which it was downscaled
+	// from the stitched image. Nil if unknown (trains stored before they were recorded).
+	ImgH     *int     `db:"img_h"`
+	ImgScale *float64 `db:"img_scale"`
 }
 
-// GIFFileName returns the GIF file name for this train (derived from timestamp).
-func (t *Train) GIFFileName() string {
+// fileNameBase returns the file name for this train without extension (derived from timestamp and region).
+func (t *Train) fileNameBase() string {
 	tsString := t.StartTS.Format(fileTSFormat)
-	return fmt.Sprintf("train_%s.gif", tsString)
+	if t.Region == "" {
+		return fmt.Sprintf("train_%s", tsString)
+	}
+	return fmt.Sprintf("train_%s_%s", tsString, t.Region)
 }
 
-// ImgFileName returns the image file name for this train (derived from timestamp).
+// GIFFileName returns the GIF file name for this train (derived from timestamp and region).
+func (t *Train) GIFFileName() string {
+	return t.fileNameBase() + ".gif"
+}
+
+// ImgFileName returns the image file name for this train (derived from timestamp and region).
 func (t *Train) ImgFileName() string {
-	tsString := t.StartTS.Format(fileTSFormat)
-	return fmt.Sprintf("train_%s.jpg", tsString)
+	return t.fileNameBase() + ".jpg"
+}
+
+// OrigImgFileName returns the file name of the original image of this train, if the stored image was enhanced.
+func (t *Train) OrigImgFileName() string {
+	return t.fileNameBase() + "_orig.jpg"
+}
+
+// DZIFileName returns the file name of the Deep Zoom descriptor of this train, if tiles were stored.
+func (t *Train) DZIFileName() string {
+	return t.fileNameBase() + dzi.DescriptorExt
+}
+
+// TilesDirName returns the name of the directory with the Deep Zoom tiles of this train.
+func (t *Train) TilesDirName() string {
+	return dzi.FilesDir(t.DZIFileName())
+}
+
+// CarFileName returns the image file name for the i-th car (starting at 0) of this train.
+func (t *Train) CarFileName(i int) string {
+	return fmt.Sprintf("%s_car%03d.jpg", t.fileNameBase(), i+1)
+}
+
+// Blobs returns the names of all blobs of this train, not including thumbnails.
+// Tiles are in subdirectories, their names contain "/".
+func (t *Train) Blobs() []string {
+	ret := t.topLevelBlobs()
+	if t.TilesW != nil && t.TilesH != nil {
+		for _, tile := range dzi.TileNames(*t.TilesW, *t.TilesH) {
+			ret = append(ret, path.Join(t.TilesDirName(), tile))
+		}
+	}
+	return ret
+}
+
+// topLevelBlobs returns the names of the blobs of this train which are not in a subdirectory.
+func (t *Train) topLevelBlobs() []string {
+	ret := []string{t.ImgFileName(), t.GIFFileName()}
+	if t.OrigImg {
+		ret = append(ret, t.OrigImgFileName())
+	}
+	if t.CarCrops && t.NCars != nil {
+		for i := range *t.NCars {
+			ret = append(ret, t.CarFileName(i))
+		}
+	}
+	if t.TilesW != nil {
+		ret = append(ret, t.DZIFileName())
+	}
+	return ret
 }
 
 // GetNextUpload returns the next train sighting to upload from the database.
 func GetNextUpload(db *sqlx.DB) (*Train, error) {
 	const q = `
 	SELECT
-		id, start_ts
+		id, start_ts, region, n_cars, car_crops, orig_img, tiles_w, tiles_h
 	FROM trains_v2
-	WHERE NOT uploaded
+	WHERE NOT uploaded AND blobs_ready
 	ORDER BY id ASC
 	LIMIT 1;
 	`
@@ -111,7 +407,7 @@ func GetNextCleanup(db *sqlx.DB) (*Train, error) {
 
 	const q = `
 	SELECT
-		id, start_ts
+		id, start_ts, region, n_cars, car_crops, orig_img, tiles_w, tiles_h
 	FROM trains_v2
 	WHERE
 		uploaded
@@ -155,11 +451,11 @@ func SetCleanedUp(db *sqlx.DB, id int64) error {
 }
 
 // GetAllBlobs lists all blobs which the database knows about.
-// Does not include thumbnails.
+// Does not include thumbnails and tiles (which are in subdirectories).
 func GetAllBlobs(db *sqlx.DB) (map[string]struct{}, error) {
 	const q = `
 	SELECT
-		id, start_ts
+		id, start_ts, region, n_cars, car_crops, orig_img, tiles_w, tiles_h
 	FROM trains_v2;`
 
 	rows, err := db.Queryx(q)
@@ -175,9 +471,297 @@ func GetAllBlobs(db *sqlx.DB) (map[string]struct{}, error) {
 		if err != nil {
 			return nil, err
 		}
-		ret[train.ImgFileName()] = struct{}{}
-		ret[train.GIFFileName()] = struct{}{}
+		for _, blob := range train.topLevelBlobs() {
+			ret[blob] = struct{}{}
+		}
+	}
+
+	return ret, nil
+}
+
+// TrainPart is a part of a train which was too long to be stitched at once.
+type TrainPart struct {
+	Train
+	Part     int     `db:"part"`
+	SpeedPxS float64 `db:"speed_px_s"`
+}
+
+// GetTrainParts returns all parts of a train, ordered by part number.
+// groupID is the id of the first part.
+func GetTrainParts(db *sqlx.DB, groupID int64) ([]TrainPart, error) {
+	const q = `
+	SELECT
+		id, start_ts, region, n_cars, car_crops, orig_img, tiles_w, tiles_h, img_h, img_scale, part, speed_px_s
+	FROM trains_v2
+	WHERE group_id = ?
+	ORDER BY part ASC;`
+
+	ret := []TrainPart{}
+	err := db.Select(&ret, q, groupID)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// ErrNoFingerprint means that a train has no color fingerprint (e.g. because it was recorded before they were
+// introduced).
+var ErrNoFingerprint = errors.New("train has no fingerprint")
+
+// SimilarTrain is a train found by GetSimilarTrains().
+type SimilarTrain struct {
+	Train
+	// Distance of the fingerprints, see stitch.Fingerprint.Distance().
+	Distance float64
+}
+
+type trainFingerprint struct {
+	Train
+	Fingerprint *string `db:"fingerprint"`
+	// Squared distance of the mean color to the one of the reference train, see stitch.MinDistance().
+	MeanColorSqDist float64 `db:"mean_color_sq_dist"`
+}
+
+func (t *trainFingerprint) parse() (*stitch.Fingerprint, error) {
+	if t.Fingerprint == nil {
+		return nil, ErrNoFingerprint
+	}
+	ret := stitch.Fingerprint{}
+	err := json.Unmarshal([]byte(*t.Fingerprint), &ret)
+	if err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// GetSimilarTrains returns the (at most limit, 0 means no limit) trains whose color fingerprints are most similar to
+// the one of the train with the given id, most similar first. The train itself is not included, nor are trains without
+// fingerprint, nor trains with a distance above maxDistance.
+func GetSimilarTrains(db *sqlx.DB, id int64, limit int, maxDistance float64) ([]SimilarTrain, error) {
+	const q0 = `
+	SELECT
+		id, start_ts, region, n_cars, car_crops, orig_img, tiles_w, tiles_h, fingerprint
+	FROM trains_v2
+	WHERE id = ?;`
+
+	var ref trainFingerprint
+	err := db.Get(&ref, q0, id)
+	if err != nil {
+		return nil, err
+	}
+	refFP, err := ref.parse()
+	if err != nil {
+		return nil, err
+	}
+	mean := refFP.MeanColor()
+
+	// Candidates are pre-filtered and sorted by a lower bound of their distance, so that only the relevant ones have
+	// to be compared.
+	const q = `
+	SELECT * FROM (
+		SELECT
+			id, start_ts, region, n_cars, car_crops, orig_img, tiles_w, tiles_h, fingerprint,
+			(fingerprint_r - ?) * (fingerprint_r - ?) +
+			(fingerprint_g - ?) * (fingerprint_g - ?) +
+			(fingerprint_b - ?) * (fingerprint_b - ?) AS mean_color_sq_dist
+		FROM trains_v2
+		WHERE id != ? AND fingerprint IS NOT NULL
+	)
+	WHERE mean_color_sq_dist <= ?
+	ORDER BY mean_color_sq_dist ASC;`
+
+	rows, err := db.Queryx(q, mean[0], mean[0], mean[1], mean[1], mean[2], mean[2], id,
+		stitch.MaxMeanColorSqDistance(maxDistance))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Sorted by distance.
+	ret := []SimilarTrain{}
+	for rows.Next() {
+		var train trainFingerprint
+		err := rows.StructScan(&train)
+		if err != nil {
+			return nil, err
+		}
+		if limit > 0 && len(ret) == limit && stitch.MinDistance(train.MeanColorSqDist) > ret[limit-1].Distance {
+			// All remaining trains are further away.
+			break
+		}
+		fp, err := train.parse()
+		if err != nil {
+			return nil, err
+		}
+		dist := refFP.Distance(fp)
+		if dist > maxDistance {
+			continue
+		}
+		i, _ := slices.BinarySearchFunc(ret, dist, func(t SimilarTrain, d float64) int {
+			// Keep the order of equal distances.
+			if t.Distance <= d {
+				return -1
+			}
+			return 1
+		})
+		ret = slices.Insert(ret, i, SimilarTrain{Train: train.Train, Distance: dist})
+		if limit > 0 && len(ret) > limit {
+			ret = ret[:limit]
+		}
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// ErrNoSequence means that the sequence of a train was not saved.
+var ErrNoSequence = errors.New("train has no saved sequence")
+
+// GetTrainSequence returns a train and the name of the saved sequence it was stitched from.
+func GetTrainSequence(db *sqlx.DB, id int64) (*Train, string, error) {
+	const q = `
+	SELECT
+		id, start_ts, region, n_cars, car_crops, orig_img, tiles_w, tiles_h, sequence
+	FROM trains_v2
+	WHERE id = ?;`
+
+	var ret struct {
+		Train
+		Sequence *string `db:"sequence"`
+	}
+	err := db.Get(&ret, q, id)
+	if err != nil {
+		return nil, "", err
+	}
+	if ret.Sequence == nil {
+		return nil, "", ErrNoSequence
+	}
+	return &ret.Train, *ret.Sequence, nil
+}
 
+// Quality of the preview JPEGs of rejected sequences.
+const previewJPEGQuality = 75
+
+// InsertRejectedSequence stores a sequence which did not result in a train.
+// e.Seq must be set. Afterwards, only the keep most recent rejected sequences are retained (0: all).
+// Returns the db id of the new row.
+func InsertRejectedSequence(db *sqlx.DB, region string, e *stitch.RejectError, keep int) (int64, error) {
+	if e.Seq == nil {
+		return 0, errors.New("rejected sequence has no summary")
+	}
+	dx, err := json.Marshal(e.Seq.Dx)
+	if err != nil {
+		return 0, err
+	}
+	var preview []byte
+	if e.Seq.Preview != nil {
+		buf := bytes.Buffer{}
+		err = jpeg.Encode(&buf, e.Seq.Preview, &jpeg.Options{Quality: previewJPEGQuality})
+		if err != nil {
+			return 0, err
+		}
+		preview = buf.Bytes()
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		// No-op if the transaction was committed.
+		_ = tx.Rollback()
+	}()
+
+	var id int64
+	const q = `
+	INSERT INTO rejected_sequences (
+		region,
+		start_ts,
+		end_ts,
+		n_frames,
+		reason,
+		error,
+		dx_summary,
+		preview
+	)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	RETURNING id;`
+	err = tx.Get(&id, q,
+		region,
+		e.Seq.StartTS,
+		e.Seq.EndTS,
+		e.Seq.NFrames,
+		e.Reason,
+		e.Err.Error(),
+		string(dx),
+		preview)
+	if err != nil {
+		return 0, err
+	}
+
+	if keep > 0 {
+		const qRetain = `
+		DELETE FROM rejected_sequences
+		WHERE id NOT IN (
+			SELECT id FROM rejected_sequences ORDER BY start_ts DESC, id DESC LIMIT ?
+		);`
+		_, err = tx.Exec(qRetain, keep)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return id, tx.Commit()
+}
+
+// RejectedSequence is a sequence which did not result in a train, see InsertRejectedSequence().
+type RejectedSequence struct {
+	ID      int64               `db:"id"`
+	Region  string              `db:"region"`
+	StartTS time.Time           `db:"start_ts"`
+	EndTS   time.Time           `db:"end_ts"`
+	NFrames int                 `db:"n_frames"`
+	Reason  stitch.RejectReason `db:"reason"`
+	Error   string              `db:"error"`
+	Dx      stitch.DxSummary    `db:"-"`
+	// JPEG, nil if there is none.
+	Preview []byte `db:"preview"`
+}
+
+type rejectedSequenceRow struct {
+	RejectedSequence
+	DxSummary string `db:"dx_summary"`
+}
+
+// GetRejectedSequences returns the (at most limit, 0: all) most recent rejected sequences, most recent first.
+// If reason is not empty, only sequences rejected for this reason are returned.
+func GetRejectedSequences(db *sqlx.DB, limit int, reason stitch.RejectReason) ([]RejectedSequence, error) {
+	const q = `
+	SELECT
+		id, region, start_ts, end_ts, n_frames, reason, error, dx_summary, preview
+	FROM rejected_sequences
+	WHERE ? = '' OR reason = ?
+	ORDER BY start_ts DESC, id DESC
+	LIMIT ?;`
+
+	if limit <= 0 {
+		limit = -1
+	}
+	rows := []rejectedSequenceRow{}
+	err := db.Select(&rows, q, reason, reason, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]RejectedSequence, len(rows))
+	for i, row := range rows {
+		ret[i] = row.RejectedSequence
+		err = json.Unmarshal([]byte(row.DxSummary), &ret[i].Dx)
+		if err != nil {
+			return nil, fmt.Errorf("rejected sequence %d: %w", row.ID, err)
+		}
+	}
 	return ret, nil
 }
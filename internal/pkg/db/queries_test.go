@@ -1,7 +1,12 @@
 package db
 
 import (
+	"bytes"
 	"database/sql"
+	"errors"
+	"image"
+	"image/jpeg"
+	"math"
 	"path/filepath"
 	"testing"
 	"time"
@@ -57,6 +62,13 @@ func Test_Train_Filenames(t *testing.T) {
 	}
 	assert.Equal(t, "train_20230328_063216.516_+01:00.jpg", tr.ImgFileName())
 	assert.Equal(t, "train_20230328_063216.516_+01:00.gif", tr.GIFFileName())
+
+	tr = Train{
+		StartTS: mustParseTime("2023-03-28T06:32:16.516941205+01:00"),
+		Region:  "north",
+	}
+	assert.Equal(t, "train_20230328_063216.516_+01:00_north.jpg", tr.ImgFileName())
+	assert.Equal(t, "train_20230328_063216.516_+01:00_north.gif", tr.GIFFileName())
 }
 
 func Test_Train_Queries(t *testing.T) {
@@ -162,3 +174,482 @@ func Test_Train_TimesstampDBSerialization(t *testing.T) {
 	assert.Len(t, results, 2)
 	assert.Equal(t, "2023-11-10T12:57:45.897+01:00", results[0].StartTS)
 }
+
+func Test_TrainParts(t *testing.T) {
+	tmp := t.TempDir()
+	dbpath := filepath.Join(tmp, "test.db")
+	db, err := Open(dbpath)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Not split.
+	_, err = InsertTrain(db, stitch.Train{StartTS: t0})
+	require.NoError(t, err)
+
+	// Three parts.
+	g := &stitch.Group{StartTS: t1}
+	id1, err := InsertTrain(db, stitch.Train{StartTS: t1, Part: 1, Group: g, SpeedPxS: -1})
+	require.NoError(t, err)
+	id2, err := InsertTrain(db, stitch.Train{StartTS: t2, Part: 2, Group: g, SpeedPxS: -1})
+	require.NoError(t, err)
+	id3, err := InsertTrain(db, stitch.Train{StartTS: t3, Part: 3, Group: g, SpeedPxS: -1})
+	require.NoError(t, err)
+	assert.Equal(t, id1, g.ID)
+
+	parts, err := GetTrainParts(db, id1)
+	require.NoError(t, err)
+	require.Len(t, parts, 3)
+	for i, id := range []int64{id1, id2, id3} {
+		assert.Equal(t, id, parts[i].ID)
+		assert.Equal(t, i+1, parts[i].Part)
+		assert.Equal(t, -1., parts[i].SpeedPxS)
+		assert.Nil(t, parts[i].ImgH)
+	}
+
+	h, scale := 100, 0.5
+	require.NoError(t, SetTrainBlobs(db, Train{ID: id2, ImgH: &h, ImgScale: &scale}))
+	parts, err = GetTrainParts(db, id1)
+	require.NoError(t, err)
+	require.NotNil(t, parts[1].ImgH)
+	assert.Equal(t, 100, *parts[1].ImgH)
+	assert.Equal(t, 0.5, *parts[1].ImgScale)
+
+	var nUngrouped int
+	err = db.Get(&nUngrouped, "SELECT COUNT(*) FROM trains_v2 WHERE group_id IS NULL")
+	require.NoError(t, err)
+	assert.Equal(t, 1, nUngrouped)
+}
+
+func Test_TrainQuality(t *testing.T) {
+	tmp := t.TempDir()
+	dbpath := filepath.Join(tmp, "test.db")
+	db, err := Open(dbpath)
+	require.NoError(t, err)
+	defer db.Close()
+
+	q := stitch.Quality{
+		Score:          0.5,
+		InlierFraction: 0.6,
+		ResidualRMSPxS: 3,
+		MeanCos:        0.9,
+		LengthCIPx:     12,
+		SpeedCIPxS:     4,
+		LowConfidence:  true,
+	}
+	id, err := InsertTrain(db, stitch.Train{StartTS: t0, Quality: q})
+	require.NoError(t, err)
+
+	var row struct {
+		Score          float64 `db:"quality"`
+		InlierFraction float64 `db:"inlier_fraction"`
+		ResidualRMSPxS float64 `db:"residual_rms_px_s"`
+		MeanCos        float64 `db:"mean_cos"`
+		LengthCIPx     float64 `db:"length_ci_px"`
+		SpeedCIPxS     float64 `db:"speed_ci_px_s"`
+		LowConfidence  bool    `db:"low_confidence"`
+	}
+	err = db.Get(&row, `
+	SELECT
+		quality, inlier_fraction, residual_rms_px_s, mean_cos, length_ci_px, speed_ci_px_s, low_confidence
+	FROM trains_v2
+	WHERE id = ?`, id)
+	require.NoError(t, err)
+	assert.Equal(t, stitch.Quality(row), q)
+
+	// Unknown confidence intervals are stored as NULL.
+	q.LengthCIPx, q.SpeedCIPxS = math.NaN(), math.NaN()
+	id, err = InsertTrain(db, stitch.Train{StartTS: t1, Quality: q})
+	require.NoError(t, err)
+	var ci struct {
+		LengthCIPx *float64 `db:"length_ci_px"`
+		SpeedCIPxS *float64 `db:"speed_ci_px_s"`
+	}
+	err = db.Get(&ci, `SELECT length_ci_px, speed_ci_px_s FROM trains_v2 WHERE id = ?`, id)
+	require.NoError(t, err)
+	assert.Nil(t, ci.LengthCIPx)
+	assert.Nil(t, ci.SpeedCIPxS)
+}
+
+func Test_TrainTrackAngle(t *testing.T) {
+	tmp := t.TempDir()
+	dbpath := filepath.Join(tmp, "test.db")
+	db, err := Open(dbpath)
+	require.NoError(t, err)
+	defer db.Close()
+
+	id, err := InsertTrain(db, stitch.Train{StartTS: t0, TrackAngleDeg: 1.5})
+	require.NoError(t, err)
+	var angle float64
+	require.NoError(t, db.Get(&angle, "SELECT track_angle_deg FROM trains_v2 WHERE id = ?", id))
+	assert.Equal(t, 1.5, angle)
+
+	require.NoError(t, UpdateTrain(db, id, stitch.Train{StartTS: t0, TrackAngleDeg: -0.5}))
+	require.NoError(t, db.Get(&angle, "SELECT track_angle_deg FROM trains_v2 WHERE id = ?", id))
+	assert.Equal(t, -0.5, angle)
+}
+
+func Test_TrainRegions(t *testing.T) {
+	tmp := t.TempDir()
+	dbpath := filepath.Join(tmp, "test.db")
+	db, err := Open(dbpath)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Same start time in different regions is allowed.
+	id0, err := InsertTrain(db, stitch.Train{StartTS: t0})
+	require.NoError(t, err)
+	id1, err := InsertTrain(db, stitch.Train{StartTS: t0, Conf: stitch.Config{Region: "north"}})
+	require.NoError(t, err)
+	_, err = InsertTrain(db, stitch.Train{StartTS: t0, Conf: stitch.Config{Region: "north"}})
+	assert.Error(t, err)
+
+	blobs, err := GetAllBlobs(db)
+	require.NoError(t, err)
+	assert.Len(t, blobs, 4)
+	assert.Contains(t, blobs, (&Train{StartTS: t0, Region: "north"}).ImgFileName())
+
+	next, err := GetNextUpload(db)
+	require.NoError(t, err)
+	assert.Equal(t, id0, next.ID)
+	assert.Equal(t, "", next.Region)
+	require.NoError(t, SetUploaded(db, id0))
+	next, err = GetNextUpload(db)
+	require.NoError(t, err)
+	assert.Equal(t, id1, next.ID)
+	assert.Equal(t, "north", next.Region)
+
+	// Parts are only linked within the same group, even if the start timestamps are equal.
+	p1, err := InsertTrain(db, stitch.Train{StartTS: t1, Part: 1, Group: &stitch.Group{StartTS: t1}})
+	require.NoError(t, err)
+	north := &stitch.Group{StartTS: t1}
+	p2, err := InsertTrain(db, stitch.Train{StartTS: t1, Part: 1, Group: north, Conf: stitch.Config{Region: "north"}})
+	require.NoError(t, err)
+	p3, err := InsertTrain(db, stitch.Train{StartTS: t2, Part: 2, Group: north, Conf: stitch.Config{Region: "north"}})
+	require.NoError(t, err)
+
+	parts, err := GetTrainParts(db, p1)
+	require.NoError(t, err)
+	require.Len(t, parts, 1)
+	parts, err = GetTrainParts(db, p2)
+	require.NoError(t, err)
+	require.Len(t, parts, 2)
+	assert.Equal(t, p3, parts[1].ID)
+	assert.Equal(t, "north", parts[1].Region)
+}
+
+func Test_TrainCars(t *testing.T) {
+	tmp := t.TempDir()
+	dbpath := filepath.Join(tmp, "test.db")
+	db, err := Open(dbpath)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Not segmented.
+	id0, err := InsertTrain(db, stitch.Train{StartTS: t0})
+	require.NoError(t, err)
+	require.NoError(t, SetTrainBlobs(db, Train{ID: id0, CarCrops: true}))
+	// Segmented, without crops.
+	id1, err := InsertTrain(db, stitch.Train{StartTS: t1, Cars: []stitch.Car{{StartPx: 10, EndPx: 100}, {StartPx: 110, EndPx: 180}}})
+	require.NoError(t, err)
+	// Segmented, with crops.
+	id2, err := InsertTrain(db, stitch.Train{StartTS: t2, Cars: []stitch.Car{{StartPx: 10, EndPx: 100}}, Conf: stitch.Config{Region: "north"}})
+	require.NoError(t, err)
+	require.NoError(t, SetTrainBlobs(db, Train{ID: id2, CarCrops: true}))
+
+	var row struct {
+		NCars    *int    `db:"n_cars"`
+		Cars     *string `db:"cars"`
+		CarCrops bool    `db:"car_crops"`
+	}
+	const q = `SELECT n_cars, cars, car_crops FROM trains_v2 WHERE id = ?`
+	require.NoError(t, db.Get(&row, q, id0))
+	assert.Nil(t, row.NCars)
+	assert.Nil(t, row.Cars)
+	assert.False(t, row.CarCrops)
+	require.NoError(t, db.Get(&row, q, id1))
+	assert.Equal(t, 2, *row.NCars)
+	assert.JSONEq(t, `[{"start_px": 10, "end_px": 100}, {"start_px": 110, "end_px": 180}]`, *row.Cars)
+	assert.False(t, row.CarCrops)
+
+	blobs, err := GetAllBlobs(db)
+	require.NoError(t, err)
+	assert.Len(t, blobs, 7)
+	assert.Contains(t, blobs, "train_20231110_125745.897_+01:00_north_car001.jpg")
+
+	next, err := GetNextUpload(db)
+	require.NoError(t, err)
+	assert.Equal(t, []string{next.ImgFileName(), next.GIFFileName()}, next.Blobs())
+}
+
+func Test_InsertTrain_BlobsReady(t *testing.T) {
+	tmp := t.TempDir()
+	dbpath := filepath.Join(tmp, "test.db")
+	db, err := Open(dbpath)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Not uploaded before the blobs were written.
+	id, err := InsertPendingTrain(db, stitch.Train{StartTS: t0})
+	require.NoError(t, err)
+	_, err = GetNextUpload(db)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	require.NoError(t, SetTrainBlobs(db, Train{ID: id}))
+	next, err := GetNextUpload(db)
+	require.NoError(t, err)
+	assert.Equal(t, id, next.ID)
+
+	// Again after it was updated.
+	require.NoError(t, SetUploaded(db, id))
+	require.NoError(t, UpdateTrain(db, id, stitch.Train{StartTS: t0}))
+	_, err = GetNextUpload(db)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	require.NoError(t, SetTrainBlobs(db, Train{ID: id}))
+	_, err = GetNextUpload(db)
+	require.NoError(t, err)
+}
+
+func Test_TrainOrigImg(t *testing.T) {
+	tmp := t.TempDir()
+	dbpath := filepath.Join(tmp, "test.db")
+	db, err := Open(dbpath)
+	require.NoError(t, err)
+	defer db.Close()
+
+	id, err := InsertTrain(db, stitch.Train{StartTS: t0})
+	require.NoError(t, err)
+	require.NoError(t, SetTrainBlobs(db, Train{ID: id, OrigImg: true}))
+
+	next, err := GetNextUpload(db)
+	require.NoError(t, err)
+	assert.True(t, next.OrigImg)
+	assert.Equal(t, "train_20230610_162058.805_+02:00_orig.jpg", next.OrigImgFileName())
+	assert.Equal(t, []string{next.ImgFileName(), next.GIFFileName(), next.OrigImgFileName()}, next.Blobs())
+
+	err = SetTrainBlobs(db, Train{ID: id})
+	require.NoError(t, err)
+	next, err = GetNextUpload(db)
+	require.NoError(t, err)
+	assert.False(t, next.OrigImg)
+	assert.Equal(t, []string{next.ImgFileName(), next.GIFFileName()}, next.Blobs())
+}
+
+func Test_TrainTiles(t *testing.T) {
+	tmp := t.TempDir()
+	dbpath := filepath.Join(tmp, "test.db")
+	db, err := Open(dbpath)
+	require.NoError(t, err)
+	defer db.Close()
+
+	id, err := InsertTrain(db, stitch.Train{StartTS: t0})
+	require.NoError(t, err)
+	w, h := 600, 300
+	err = SetTrainBlobs(db, Train{ID: id, TilesW: &w, TilesH: &h})
+	require.NoError(t, err)
+
+	next, err := GetNextUpload(db)
+	require.NoError(t, err)
+	require.NotNil(t, next.TilesW)
+	assert.Equal(t, 600, *next.TilesW)
+	assert.Equal(t, 300, *next.TilesH)
+	assert.Equal(t, "train_20230610_162058.805_+02:00.dzi", next.DZIFileName())
+	blobs := next.Blobs()
+	assert.Equal(t, []string{next.ImgFileName(), next.GIFFileName(), next.DZIFileName()}, blobs[:3])
+	assert.Contains(t, blobs, "train_20230610_162058.805_+02:00_files/10/2_1.jpg")
+	assert.Contains(t, blobs, "train_20230610_162058.805_+02:00_files/0/0_0.jpg")
+
+	// Tiles are not listed with the blobs in the top level directory.
+	all, err := GetAllBlobs(db)
+	require.NoError(t, err)
+	assert.Len(t, all, 3)
+	assert.Contains(t, all, next.DZIFileName())
+
+	err = SetTrainBlobs(db, Train{ID: id})
+	require.NoError(t, err)
+	next, err = GetNextUpload(db)
+	require.NoError(t, err)
+	assert.Nil(t, next.TilesW)
+	assert.Equal(t, []string{next.ImgFileName(), next.GIFFileName()}, next.Blobs())
+
+	assert.ErrorIs(t, SetTrainBlobs(db, Train{ID: id + 1}), ErrNoRowAffected)
+}
+
+func Test_TrainAxles(t *testing.T) {
+	tmp := t.TempDir()
+	dbpath := filepath.Join(tmp, "test.db")
+	db, err := Open(dbpath)
+	require.NoError(t, err)
+	defer db.Close()
+
+	id0, err := InsertTrain(db, stitch.Train{StartTS: t0})
+	require.NoError(t, err)
+	id1, err := InsertTrain(db, stitch.Train{StartTS: t1, AxlesM: []float64{1.5, 4, 14, 16.5}})
+	require.NoError(t, err)
+
+	var row struct {
+		NAxles       *int    `db:"n_axles"`
+		AxleSpacingM *string `db:"axle_spacing_m"`
+	}
+	const q = `SELECT n_axles, axle_spacing_m FROM trains_v2 WHERE id = ?`
+	require.NoError(t, db.Get(&row, q, id0))
+	assert.Nil(t, row.NAxles)
+	assert.Nil(t, row.AxleSpacingM)
+	require.NoError(t, db.Get(&row, q, id1))
+	assert.Equal(t, 4, *row.NAxles)
+	assert.JSONEq(t, `[2.5, 10, 2.5]`, *row.AxleSpacingM)
+}
+
+func Test_GetSimilarTrains(t *testing.T) {
+	tmp := t.TempDir()
+	dbpath := filepath.Join(tmp, "test.db")
+	db, err := Open(dbpath)
+	require.NoError(t, err)
+	defer db.Close()
+
+	fingerprint := func(r, g, b uint8) *stitch.Fingerprint {
+		return &stitch.Fingerprint{
+			Colors:  []stitch.WeightedColor{{RGB: [3]uint8{r, g, b}, Weight: 1}},
+			Profile: [][3]uint8{{r, g, b}},
+		}
+	}
+
+	noFP, err := InsertTrain(db, stitch.Train{StartTS: t0})
+	require.NoError(t, err)
+	red, err := InsertTrain(db, stitch.Train{StartTS: t1, Fingerprint: fingerprint(200, 20, 20)})
+	require.NoError(t, err)
+	blue, err := InsertTrain(db, stitch.Train{StartTS: t2, Fingerprint: fingerprint(20, 20, 200)})
+	require.NoError(t, err)
+	red2, err := InsertTrain(db, stitch.Train{StartTS: t3, Fingerprint: fingerprint(190, 30, 20)})
+	require.NoError(t, err)
+
+	similar, err := GetSimilarTrains(db, red, 10, 1)
+	require.NoError(t, err)
+	require.Len(t, similar, 2)
+	assert.Equal(t, red2, similar[0].ID)
+	assert.Equal(t, blue, similar[1].ID)
+	assert.Less(t, similar[0].Distance, similar[1].Distance)
+
+	similar, err = GetSimilarTrains(db, red, 1, 1)
+	require.NoError(t, err)
+	require.Len(t, similar, 1)
+	assert.Equal(t, red2, similar[0].ID)
+
+	similar, err = GetSimilarTrains(db, red, 0, 0.3)
+	require.NoError(t, err)
+	require.Len(t, similar, 1)
+	assert.Equal(t, red2, similar[0].ID)
+
+	_, err = GetSimilarTrains(db, noFP, 10, 1)
+	assert.ErrorIs(t, err, ErrNoFingerprint)
+	_, err = GetSimilarTrains(db, 1234, 10, 1)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func Test_UpdateTrain(t *testing.T) {
+	tmp := t.TempDir()
+	dbpath := filepath.Join(tmp, "test.db")
+	db, err := Open(dbpath)
+	require.NoError(t, err)
+	defer db.Close()
+
+	noSeq, err := InsertTrain(db, stitch.Train{StartTS: t0})
+	require.NoError(t, err)
+	id, err := InsertTrain(db, stitch.Train{StartTS: t1, LengthPx: 100, Part: 1, Conf: stitch.Config{Region: "north"}, Sequence: "seq_1"})
+	require.NoError(t, err)
+	require.NoError(t, SetUploaded(db, id))
+
+	_, _, err = GetTrainSequence(db, noSeq)
+	assert.ErrorIs(t, err, ErrNoSequence)
+	train, seq, err := GetTrainSequence(db, id)
+	require.NoError(t, err)
+	assert.Equal(t, "seq_1", seq)
+	assert.Equal(t, "north", train.Region)
+	assert.Equal(t, t1, train.StartTS)
+
+	err = UpdateTrain(db, id, stitch.Train{StartTS: t2, LengthPx: 200, Cars: []stitch.Car{{StartPx: 0, EndPx: 200}}, Sequence: "seq_1"})
+	require.NoError(t, err)
+	err = SetTrainBlobs(db, Train{ID: id, CarCrops: true})
+	require.NoError(t, err)
+	err = UpdateTrain(db, 1234, stitch.Train{})
+	assert.ErrorIs(t, err, ErrNoRowAffected)
+
+	var row struct {
+		StartTS  time.Time `db:"start_ts"`
+		Region   string    `db:"region"`
+		Part     int       `db:"part"`
+		LengthPx float64   `db:"length_px"`
+		NCars    *int      `db:"n_cars"`
+		CarCrops bool      `db:"car_crops"`
+		Uploaded bool      `db:"uploaded"`
+	}
+	err = db.Get(&row, `SELECT start_ts, region, part, length_px, n_cars, car_crops, uploaded FROM trains_v2 WHERE id = ?`, id)
+	require.NoError(t, err)
+	// Kept.
+	assert.Equal(t, t1, row.StartTS)
+	assert.Equal(t, "north", row.Region)
+	assert.Equal(t, 1, row.Part)
+	// Updated.
+	assert.Equal(t, 200., row.LengthPx)
+	assert.Equal(t, 1, *row.NCars)
+	assert.True(t, row.CarCrops)
+	assert.False(t, row.Uploaded)
+}
+
+func Test_RejectedSequences(t *testing.T) {
+	tmp := t.TempDir()
+	dbpath := filepath.Join(tmp, "test.db")
+	db, err := Open(dbpath)
+	require.NoError(t, err)
+	defer db.Close()
+
+	rejected := func(reason stitch.RejectReason, ts time.Time, preview bool) *stitch.RejectError {
+		seq := &stitch.SequenceSummary{StartTS: ts, EndTS: ts.Add(time.Second), NFrames: 30, Dx: stitch.DxSummary{Min: 1, Max: 5, Mean: 3, Sum: 90}}
+		if preview {
+			seq.Preview = image.NewRGBA(image.Rect(0, 0, 32, 16))
+		}
+		return &stitch.RejectError{Reason: reason, Err: errors.New(string(reason)), Seq: seq}
+	}
+
+	_, err = InsertRejectedSequence(db, "", &stitch.RejectError{Reason: stitch.RejectTooShort, Err: errors.New("no summary")}, 0)
+	assert.Error(t, err)
+
+	_, err = InsertRejectedSequence(db, "north", rejected(stitch.RejectTooShort, t0, true), 0)
+	require.NoError(t, err)
+	_, err = InsertRejectedSequence(db, "", rejected(stitch.RejectTooSlow, t1, false), 0)
+	require.NoError(t, err)
+	_, err = InsertRejectedSequence(db, "", rejected(stitch.RejectTooShort, t2, false), 0)
+	require.NoError(t, err)
+
+	all, err := GetRejectedSequences(db, 0, "")
+	require.NoError(t, err)
+	require.Len(t, all, 3)
+	// Most recent first.
+	assert.Equal(t, t2, all[0].StartTS)
+	assert.Equal(t, t0, all[2].StartTS)
+	assert.Equal(t, "north", all[2].Region)
+	assert.Equal(t, stitch.RejectTooShort, all[2].Reason)
+	assert.Equal(t, "too_short", all[2].Error)
+	assert.Equal(t, t0.Add(time.Second), all[2].EndTS)
+	assert.Equal(t, 30, all[2].NFrames)
+	assert.Equal(t, stitch.DxSummary{Min: 1, Max: 5, Mean: 3, Sum: 90}, all[2].Dx)
+	img, err := jpeg.Decode(bytes.NewReader(all[2].Preview))
+	require.NoError(t, err)
+	assert.Equal(t, image.Pt(32, 16), img.Bounds().Size())
+	assert.Nil(t, all[1].Preview)
+
+	short, err := GetRejectedSequences(db, 0, stitch.RejectTooShort)
+	require.NoError(t, err)
+	assert.Len(t, short, 2)
+	latest, err := GetRejectedSequences(db, 1, "")
+	require.NoError(t, err)
+	assert.Len(t, latest, 1)
+
+	// Retention.
+	_, err = InsertRejectedSequence(db, "", rejected(stitch.RejectUnableToFit, t3, false), 2)
+	require.NoError(t, err)
+	all, err = GetRejectedSequences(db, 0, "")
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+	assert.Equal(t, t3, all[0].StartTS)
+	assert.Equal(t, t2, all[1].StartTS)
+}
@@ -65,7 +65,17 @@ CREATE TABLE IF NOT EXISTS trains_v2 (
 
 BEGIN EXCLUSIVE TRANSACTION;
 
-INSERT INTO trains_v2
+INSERT INTO trains_v2 (
+    id,
+    start_ts,
+    n_frames,
+    length_px,
+    speed_px_s,
+    accel_px_s_2,
+    px_per_m,
+    uploaded,
+    cleaned_up
+)
 SELECT
     id,
     start_ts,
@@ -89,3 +99,4 @@ COMMIT;
 
 -- Note: this SQL script will be run every time the database file is opened.
 -- Any contents thus need to be idempotent (IF NOT EXISTS etc).
+-- Changes which cannot be expressed like this (e.g. adding columns) go into migrations/ instead.
@@ -31,9 +31,9 @@ func RecordFrameDisposition(disposition string) {
 	frameDispositions.WithLabelValues(disposition).Inc()
 }
 
-// RecordSequenceLength sets the number of frames stored in memory for the current train.
-func RecordSequenceLength(length int) {
-	sequenceLength.Set(float64(length))
+// RecordSequenceLength sets the number of frames stored in memory for the current train in a region.
+func RecordSequenceLength(region string, length int) {
+	sequenceLength.WithLabelValues(region).Set(float64(length))
 }
 
 // RecordSourceQueueLength sets the number of frames queued up before motion detection and stitching.
@@ -41,9 +41,34 @@ func RecordSourceQueueLength(length int) {
 	sourceQueueLength.Set(float64(length))
 }
 
-// RecordFitAndStitchResult counts fitAndStitch() successes and failure modes.
-func RecordFitAndStitchResult(result string) {
-	fitAndStitchResult.WithLabelValues(result).Inc()
+// RecordFitAndStitchResult counts fitAndStitch() successes and failure modes per region.
+func RecordFitAndStitchResult(region, result string) {
+	fitAndStitchResult.WithLabelValues(region, result).Inc()
+}
+
+// RecordStitchQueueLength sets the number of sequences waiting to be fitted and stitched in a region.
+func RecordStitchQueueLength(region string, length int) {
+	stitchQueueLength.WithLabelValues(region).Set(float64(length))
+}
+
+// RecordStitchDuration records how long fitting and stitching a sequence of a region took.
+func RecordStitchDuration(region string, seconds float64) {
+	stitchDuration.WithLabelValues(region).Observe(seconds)
+}
+
+// RecordStitchEvent counts sequence lifecycle events (started, progress, ended, rejected).
+func RecordStitchEvent(region, eventType string) {
+	stitchEvents.WithLabelValues(region, eventType).Inc()
+}
+
+// RecordTrainPassing sets whether a train is currently passing in a region, and its current speed.
+func RecordTrainPassing(region string, passing bool, speedKPH float64) {
+	if passing {
+		trainPassing.WithLabelValues(region).Set(1)
+	} else {
+		trainPassing.WithLabelValues(region).Set(0)
+	}
+	trainSpeed.WithLabelValues(region).Set(speedKPH)
 }
 
 // RecordBrightnessContrast counts brightness and contrast stats used for discarding bad frames.
@@ -60,11 +85,12 @@ var (
 		},
 		[]string{"disposition"},
 	)
-	sequenceLength = promauto.NewGauge(
+	sequenceLength = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "trainbot_sequence_length",
 			Help: "Current number of frames stored.",
 		},
+		[]string{"region"},
 	)
 	sourceQueueLength = promauto.NewGauge(
 		prometheus.GaugeOpts{
@@ -77,7 +103,43 @@ var (
 			Name: "trainbot_fit_and_stitch_results_total",
 			Help: "Results from fitAndStitch(). Eg. train detected, unable to fit.",
 		},
-		[]string{"result"},
+		[]string{"region", "result"},
+	)
+	stitchQueueLength = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "trainbot_stitch_queue_length",
+			Help: "Sequences waiting to be fitted and stitched (or whose trains were not yet returned).",
+		},
+		[]string{"region"},
+	)
+	stitchDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "trainbot_stitch_duration_seconds",
+			Help:    "Time taken to fit and stitch a sequence.",
+			Buckets: prometheus.ExponentialBucketsRange(0.01, 120, 20),
+		},
+		[]string{"region"},
+	)
+	stitchEvents = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "trainbot_stitch_events_total",
+			Help: "Sequence lifecycle events. Eg. started, ended.",
+		},
+		[]string{"region", "type"},
+	)
+	trainPassing = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "trainbot_train_passing",
+			Help: "1 while a train is passing, 0 otherwise.",
+		},
+		[]string{"region"},
+	)
+	trainSpeed = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "trainbot_train_speed_kph",
+			Help: "Estimated speed of the currently passing train, km/h (positive means to the right).",
+		},
+		[]string{"region"},
 	)
 	brightnessAvg = promauto.NewHistogram(
 		prometheus.HistogramOpts{
@@ -7,10 +7,13 @@ import (
 	"image"
 	"image/jpeg"
 	"net/http"
+	"strconv"
 	"sync"
 
 	"github.com/mattn/go-mjpeg"
 	"github.com/rs/zerolog/log"
+	"jo-m.ch/go/trainbot/internal/pkg/calib"
+	"jo-m.ch/go/trainbot/pkg/imutil"
 	"jo-m.ch/go/trainbot/pkg/vid"
 )
 
@@ -41,6 +44,7 @@ func NewServer(embed bool) (*Server, error) {
 	mux.HandleFunc("/cameras", s.handleCameras)
 	mux.HandleFunc("/stream.mjpeg", s.stream.ServeHTTP)
 	mux.HandleFunc("/stream.jpeg", s.handleStreamSnapshot)
+	mux.HandleFunc("/calibrate", s.handleCalibrate)
 
 	mux.Handle("/", http.FileServer(wwwRoot))
 
@@ -87,6 +91,65 @@ func (s *Server) handleStreamSnapshot(resp http.ResponseWriter, _ *http.Request)
 	}
 }
 
+// calibrateQuery parses the rect and sleeper spacing for handleCalibrate.
+func calibrateQuery(req *http.Request) (image.Rectangle, calib.Config, error) {
+	var vals [5]float64
+	for i, key := range []string{"x", "y", "w", "h", "spacing_m"} {
+		v, err := strconv.ParseFloat(req.URL.Query().Get(key), 64)
+		if err != nil {
+			return image.Rectangle{}, calib.Config{}, fmt.Errorf("invalid parameter %s: %w", key, err)
+		}
+		vals[i] = v
+	}
+
+	rect := image.Rect(0, 0, int(vals[2]), int(vals[3])).Add(image.Pt(int(vals[0]), int(vals[1])))
+	return rect, calib.Config{SpacingM: vals[4]}, nil
+}
+
+// handleCalibrate estimates the pixels per meter from the sleepers in a rect of the last frame,
+// and returns the result as JSON.
+// Test via
+//
+//	http 'localhost:8080/calibrate?x=0&y=0&w=400&h=200&spacing_m=0.6'
+func (s *Server) handleCalibrate(resp http.ResponseWriter, req *http.Request) {
+	rect, conf, err := calibrateQuery(req)
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(resp, err.Error())
+		return
+	}
+
+	s.lastFrameLock.Lock()
+	ref := s.lastFrame
+	s.lastFrameLock.Unlock()
+
+	res, err := func() (calib.Result, error) {
+		frame, err := jpeg.Decode(bytes.NewReader(ref))
+		if err != nil {
+			return calib.Result{}, err
+		}
+		cropped, err := imutil.Sub(frame, rect)
+		if err != nil {
+			return calib.Result{}, err
+		}
+		return calib.Calibrate(cropped, conf)
+	}()
+	if err != nil {
+		log.Err(err).Send()
+
+		resp.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprint(resp, err.Error())
+		return
+	}
+
+	resp.Header().Add("content-type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(res)
+	if err != nil {
+		log.Err(err).Send()
+	}
+}
+
 // GetMux returns the router.
 func (s *Server) GetMux() *http.ServeMux {
 	return s.mux
@@ -0,0 +1,90 @@
+package stitch
+
+import (
+	"image"
+	"math"
+
+	"jo-m.ch/go/trainbot/pkg/imutil"
+	"jo-m.ch/go/trainbot/pkg/pmatch"
+)
+
+const (
+	// Maximum number of frame pairs to match for measuring the angle.
+	angleMaxSamples = 20
+	// Maximum angle which can be measured, in degrees.
+	angleMaxDeg = 10
+)
+
+// measureAngle estimates the angle of the motion in a sequence, in degrees clockwise from horizontal
+// (i.e. positive if things move down when moving to the right).
+// dx are the (fitted) offsets between the frames, see sequence.dx.
+// The vertical offset between two consecutive frames is usually only a fraction of a pixel, so frames are
+// matched against later frames which are about 1/3 of the frame width apart.
+// Returns false if the angle could not be measured.
+func measureAngle(frames []image.Image, dx []int, minCos float64) (float64, bool) {
+	if len(frames) < 2 {
+		return 0, false
+	}
+	bounds := frames[0].Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	baseline := w / 3
+
+	// Size of the patch of the later frame which is searched in the earlier frame.
+	pw, ph := w/4, h/2
+	if pw < 1 || ph < 1 {
+		return 0, false
+	}
+	center := image.Rect(0, 0, pw, ph).Add(image.Pt(w-pw, h-ph).Div(2))
+
+	step := max(len(frames)/angleMaxSamples, 1)
+	var sumX, sumY float64
+	for i := 0; i < len(frames); i += step {
+		// Find the first frame which moved far enough.
+		j, shift := i+1, 0
+		for ; j < len(frames); j++ {
+			shift += dx[j]
+			if iabs(shift) >= baseline {
+				break
+			}
+		}
+		if j == len(frames) {
+			break
+		}
+
+		// The patch and the search window in the earlier frame (around where the patch is expected if there
+		// is no vertical motion) are placed symmetrically around the center.
+		patRect := center.Sub(image.Pt(shift/2, 0))
+		mx := max(iabs(shift)/10, 2)
+		my := min(int(math.Ceil(float64(iabs(shift))*math.Tan(angleMaxDeg*math.Pi/180))), (h-ph)/2)
+		win := patRect.Add(image.Pt(shift, 0)).Inset(-mx)
+		win.Min.Y, win.Max.Y = patRect.Min.Y-my, patRect.Max.Y+my
+		if !win.In(image.Rect(0, 0, w, h)) {
+			continue
+		}
+
+		pat, err := imutil.Sub(imutil.ToRGBA(loadFrame(frames[j])), patRect)
+		if err != nil {
+			panic(err)
+		}
+		search, err := imutil.Sub(imutil.ToRGBA(loadFrame(frames[i])), win)
+		if err != nil {
+			panic(err)
+		}
+		x, y, cos := pmatch.SearchRGBAC(search.(*image.RGBA), pat.(*image.RGBA))
+		sx := win.Min.X + x - patRect.Min.X
+		sy := win.Min.Y + y - patRect.Min.Y
+		if cos < minCos || (my > 0 && iabs(sy) == my) {
+			// Bad match, or the angle is out of range.
+			continue
+		}
+
+		// The patch moved by (-sx, -sy) from frame i to frame j.
+		sumX += float64(iabs(sx))
+		sumY += float64(isign(sx) * sy)
+	}
+
+	if sumX == 0 {
+		return 0, false
+	}
+	return math.Atan2(sumY, sumX) * 180 / math.Pi, true
+}
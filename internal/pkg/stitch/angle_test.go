@@ -0,0 +1,97 @@
+package stitch
+
+import (
+	"image"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"jo-m.ch/go/trainbot/pkg/imutil"
+)
+
+// slantedSequence generates frames looking at a texture which moves by dx pixels per frame along a track
+// with the given angle (clockwise, in degrees).
+func slantedSequence(n, dx int, deg float64) ([]image.Image, []int) {
+	const w, h = 300, 120
+	tex := imutil.RandRGBA(1, w+n*iabs(dx), h*2)
+	x0 := 0
+	if dx < 0 {
+		x0 = n * -dx
+	}
+
+	var frames []image.Image
+	var dxs []int
+	for k := range n {
+		// Positive dx means things move to the left, so the view moves to the right.
+		off := image.Pt(x0+k*dx, h/2+int(math.Round(float64(k*dx)*math.Tan(deg*math.Pi/180))))
+		f, err := imutil.Sub(tex, image.Rect(0, 0, w, h).Add(off))
+		if err != nil {
+			panic(err)
+		}
+		frames = append(frames, imutil.ToRGBA(f))
+		dxs = append(dxs, dx)
+	}
+	return frames, dxs
+}
+
+func Test_measureAngle(t *testing.T) {
+	for _, tc := range []struct {
+		dx  int
+		deg float64
+	}{
+		{8, 0},
+		{8, 3},
+		{8, -2},
+		{-8, 3},
+		{-5, -6},
+	} {
+		frames, dx := slantedSequence(60, tc.dx, tc.deg)
+		angle, ok := measureAngle(frames, dx, 0.9)
+		require.True(t, ok)
+		assert.InDelta(t, tc.deg, angle, 0.3, tc)
+	}
+}
+
+func Test_measureAngle_TooShort(t *testing.T) {
+	frames, dx := slantedSequence(5, 8, 3)
+	_, ok := measureAngle(frames, dx, 0.9)
+	assert.False(t, ok)
+}
+
+func Test_AutoStitcher_TrackAngle(t *testing.T) {
+	frames, ts := genVideo(300, 2000, 10, 20)
+	for i, f := range frames {
+		frames[i] = imutil.Rotate(f, 4)
+	}
+
+	for _, deskew := range []float64{0, 4} {
+		c := Config{PixelsPerM: 10, MinSpeedKPH: 10, MaxSpeedKPH: 160, MinLengthM: 10, MaxFrameCountPerSeq: 1500, TrackAngleDeg: deskew}
+		a := NewAutoStitcher(c)
+		var trains []*Train
+		for i := range frames {
+			trains = append(trains, a.Frame(frames[i], ts[i])...)
+		}
+		trains = append(trains, a.TryStitchAndReset()...)
+
+		require.Len(t, trains, 1)
+		assert.InDelta(t, 4, trains[0].TrackAngleDeg, 0.5, deskew)
+	}
+}
+
+func Test_Config_rotates(t *testing.T) {
+	b := image.Rect(0, 0, 400, 200)
+	c := Config{}
+	assert.False(t, c.rotates(b))
+	// Moves the corners by 0.2 px.
+	c.TrackAngleDeg = 0.05
+	assert.False(t, c.rotates(b))
+	c.TrackAngleDeg = -0.2
+	assert.True(t, c.rotates(b))
+
+	// The mask is rotated and cropped like the frames.
+	c.Mask = image.NewAlpha(b)
+	c.rotateMask()
+	assert.Equal(t, imutil.Rotate(imutil.RandRGBA(1, 400, 200), 0.2).Bounds(), c.Mask.Bounds())
+	assert.NotEqual(t, b, c.Mask.Bounds())
+}
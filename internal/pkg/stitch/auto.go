@@ -5,20 +5,34 @@ import (
 	"math"
 	"time"
 
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"jo-m.ch/go/trainbot/internal/pkg/prometheus"
 	"jo-m.ch/go/trainbot/pkg/avg"
 	"jo-m.ch/go/trainbot/pkg/imutil"
 	"jo-m.ch/go/trainbot/pkg/pmatch"
+	"jo-m.ch/go/trainbot/pkg/privacy"
 )
 
+// Defaults for the detection thresholds in Config.
 const (
-	goodCosScoreNoMove = 0.99
-	goodCosScoreMove   = 0.925
-	minFramePeriodS    = 0.01
-	dxLowPassFactor    = 0.95
-	minContrastAvg     = 0.005
-	minContrastAvgDev  = 0.01
+	DefaultGoodCosScoreNoMove = 0.99
+	DefaultGoodCosScoreMove   = 0.925
+	DefaultMinFramePeriodS    = 0.01
+	DefaultDxLowPassFactor    = 0.95
+	DefaultMinContrastAvgDev  = 0.01
+)
+
+const (
+	minContrastAvg = 0.005
+
+	// In low memory mode, how many full frames at the start of a sequence are kept for the GIF.
+	lowMemoryFullFrames = 120
+	// In low memory mode, the width of the strip which is kept from each frame, as a multiple of the max pixels per frame.
+	lowMemoryStripFactor = 2
+
+	// Rotations (see Config.TrackAngleDeg) which move no pixel by more than this are skipped.
+	minRotationPx = 0.5
 )
 
 // Config is the configuration for a AutoStitcher.
@@ -29,7 +43,132 @@ type Config struct {
 	MaxSpeedKPH         float64
 	MinLengthM          float64
 	MaxFrameCountPerSeq int
-	Mask                image.Image
+	Mask                image.Image `json:"-"`
+	// Region is the name of the region (e.g. track) this AutoStitcher looks at, empty for the default region.
+	// It is not used for stitching, but allows to tell apart trains via Train.Conf.
+	Region string
+
+	// LowMemory enables a mode in which only the central strip of each frame is kept, instead of the entire frame.
+	// The strips are written to a temporary file (see SpillDir) instead of being kept in memory, and the image is
+	// assembled from them one at a time. This allows stitching much longer sequences (i.e. a higher
+	// MaxFrameCountPerSeq). The resulting image will be slightly narrower, and the GIF will only show the start of the
+	// sequence.
+	LowMemory bool
+	// SpillDir is the directory for the temporary files in low memory mode.
+	// Defaults to the default directory for temporary files if empty.
+	SpillDir string
+	// MaxImageMB is the maximum size of a stitched image, in MiB.
+	// Sequences which would result in larger images are discarded.
+	// Defaults to 50 if 0.
+	MaxImageMB int
+	// MotionModel is the name of the motion model used to smooth the measured speeds, see MotionModelNames.
+	// Defaults to constant acceleration if empty. MotionModelAuto selects the best model for each sequence.
+	MotionModel string
+	// MinQuality is the minimum Quality.Score of a train, trains below are marked as low confidence.
+	// 0 means no train is marked.
+	MinQuality float64
+	// TrackAngleDeg is the angle of the track in the frames, in degrees clockwise from horizontal.
+	// If not 0, frames (and Mask) are rotated by the opposite angle before processing, so that trains move
+	// horizontally. The corners which are missing after the rotation are cropped. Angles which would move no pixel by
+	// more than half a pixel are ignored. The measured angle is reported in Train.TrackAngleDeg.
+	TrackAngleDeg float64
+	// LineReadoutS is the time between the readout of two consecutive rows of the camera sensor, in seconds.
+	// Cameras with a rolling shutter read out the rows one after the other, so fast trains appear leaning.
+	// If not 0, each frame is sheared back according to the fitted speed of the train before it is stitched.
+	// Negative if the rows are read out from the bottom to the top (e.g. because the picture is rotated).
+	LineReadoutS float64
+	// Fusion selects how the overlapping frames are combined into the stitched image, see FusionNames.
+	// Defaults to FusionLast if empty, which takes each pixel from the last frame. FusionMean and FusionMedian combine
+	// all frames which cover a pixel, this reduces noise (e.g. at night) and removes rain and snow, but is slower.
+	Fusion string
+	// Privacy selects parts of the frames to pixelate or blur, e.g. the height range of the windows. This is done before
+	// the frames are kept for stitching (but after they are matched), so that no image derived from a sequence (stitched
+	// image, GIF, saved sequences, debug bundles) contains the original pixels. Disabled if empty.
+	Privacy privacy.Config
+
+	// Detection thresholds, the defaults (Default*) are used if 0.
+
+	// GoodCosScoreNoMove is the minimum cosine similarity between consecutive frames to consider the scene idle.
+	GoodCosScoreNoMove float64
+	// GoodCosScoreMove is the minimum cosine similarity between consecutive frames to start a new sequence.
+	GoodCosScoreMove float64
+	// DxLowPassFactor is the factor (0..1) of the low pass filter on dx, which is used to detect the end of a sequence.
+	// Higher values mean that the sequence ends later after the movement stopped.
+	DxLowPassFactor float64
+	// MinContrastAvgDev is the minimum average deviation of the pixel values in a frame, frames with less contrast are discarded.
+	MinContrastAvgDev float64
+	// MinFramePeriodS is the minimum time between consecutive frames, frames coming faster are discarded.
+	MinFramePeriodS float64
+
+	// StitchQueueSize is the number of ended sequences which may wait to be fitted and stitched in the background.
+	// If 0, sequences are stitched synchronously within Frame(). Otherwise, a worker goroutine is started, and
+	// trains are returned from later calls to Frame(). If the queue is full, ended sequences are dropped and
+	// rejected (see RejectQueueFull), so that Frame() never waits for stitching.
+	StitchQueueSize int
+
+	// SequenceDir is the directory to which each sequence is saved in the background while it is fitted and
+	// stitched, so that it can be stitched again later with different settings (see LoadSequence()). Sequences which
+	// do not result in a train are deleted again, and sequences are skipped while too many are being saved.
+	// Sequences are not saved if empty.
+	SequenceDir string
+	// DebugDir is the directory to which a diagnostic bundle (measurements, motion model fits, images and a HTML
+	// report of the decisions taken) is written for each sequence, after it was fitted and stitched.
+	// Disabled if empty.
+	DebugDir string
+
+	// Logger receives the log output of the AutoStitcher and of stitching, the global logger is used if nil.
+	Logger *zerolog.Logger `json:"-"`
+}
+
+func orDefault(v, def float64) float64 {
+	if v == 0 {
+		return def
+	}
+	return v
+}
+
+func (c *Config) logger() *zerolog.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return &log.Logger
+}
+
+// rotates returns whether frames with bounds b need to be rotated (see TrackAngleDeg).
+func (c *Config) rotates(b image.Rectangle) bool {
+	if c.TrackAngleDeg == 0 {
+		return false
+	}
+	// The corners move the most.
+	r := math.Hypot(float64(b.Dx()), float64(b.Dy())) / 2
+	return 2*r*math.Sin(math.Abs(c.TrackAngleDeg)*math.Pi/360) >= minRotationPx
+}
+
+// rotateMask rotates Mask like the frames, if needed.
+func (c *Config) rotateMask() {
+	if c.Mask != nil && c.rotates(c.Mask.Bounds()) {
+		c.Mask = imutil.Rotate(c.Mask, -c.TrackAngleDeg)
+	}
+}
+
+func (c *Config) goodCosScoreNoMove() float64 {
+	return orDefault(c.GoodCosScoreNoMove, DefaultGoodCosScoreNoMove)
+}
+
+func (c *Config) goodCosScoreMove() float64 {
+	return orDefault(c.GoodCosScoreMove, DefaultGoodCosScoreMove)
+}
+
+func (c *Config) dxLowPassFactor() float64 {
+	return orDefault(c.DxLowPassFactor, DefaultDxLowPassFactor)
+}
+
+func (c *Config) minContrastAvgDev() float64 {
+	return orDefault(c.MinContrastAvgDev, DefaultMinContrastAvgDev)
+}
+
+func (c *Config) minFramePeriodS() float64 {
+	return orDefault(c.MinFramePeriodS, DefaultMinFramePeriodS)
 }
 
 func (c *Config) minPxPerFrame(framePeriodS float64) int {
@@ -56,6 +195,20 @@ func (c *Config) maxPxPerFrame(framePeriodS float64) int {
 	return ret
 }
 
+func (c *Config) maxImageBytes() int {
+	if c.MaxImageMB == 0 {
+		return defaultMaxImageMB * 1024 * 1024
+	}
+	return c.MaxImageMB * 1024 * 1024
+}
+
+// stripRect computes the central strip of a frame which is kept in low memory mode.
+func (c *Config) stripRect(frame image.Rectangle, maxDx int) image.Rectangle {
+	w := min(maxDx*lowMemoryStripFactor, frame.Dx())
+	x0 := frame.Min.X + (frame.Dx()-w)/2
+	return image.Rect(x0, frame.Min.Y, x0+w, frame.Max.Y)
+}
+
 func (c *Config) minSpeedPxPS() float64 {
 	return c.MinSpeedKPH / 3.6 * c.PixelsPerM
 }
@@ -70,17 +223,41 @@ type sequence struct {
 	// (for example, a video file without metadata/known start time might have time.Time{} as first timestamp).
 	startTS *time.Time
 
-	// The slices must always have the same length.
+	// Bounds of the frames in the sequence.
+	frameBounds image.Rectangle
+	// In low memory mode, bounds of the strip which is kept of each frame.
+	stripBounds image.Rectangle
+	// Idle background before the sequence started (same size as the frames, but origin might differ), nil if unknown.
+	bg *image.RGBA
+
+	// The slices must always have the same length (except for full).
 
 	// frame[i] contains the i-th frame.
 	// All frames must have the same image size.
+	// In low memory mode, this only contains the central strip of each frame (all strips have the same bounds,
+	// and are contained within frameBounds), which are usually spilled to disk (use loadFrame()).
 	frames []image.Image
+	// In low memory mode, contains the full frames for the beginning of the sequence (only used for the GIF).
+	// Nil otherwise.
+	full []image.Image
 	// dx[x] is the pixel offset between frames[i-1] and frames[i].
 	// Speed of a frame, in pixels/s is calculated as dx[i]/(ts[i] - ts[i-1]).
 	// dx[0] must never be 0.
 	dx []int
 	// ts[i] is the timestamp of the i-th frame.
 	ts []time.Time
+	// cos[i] is the cosine similarity of the match between frames[i-1] and frames[i].
+	cos []float64
+	// bgCos[i] is the cosine similarity of the i-th frame to the idle background, 0 if unknown.
+	bgCos []float64
+
+	// Decisions taken for the sequence, nil unless Config.DebugDir is set.
+	trace *seqTrace
+
+	// In low memory mode, the file to which the frames are written (see spillFrame()), shared with sub-sequences.
+	// Must be closed when the sequence is done.
+	spill    *spill
+	spillErr error
 }
 
 // AutoStitcher is an automatic train detector and stitcher.
@@ -97,26 +274,63 @@ type AutoStitcher struct {
 	seq          sequence
 	dxAbsLowPass float64
 
+	// Last frame in which nothing was moving, used to detect gaps between trains.
+	bg *image.RGBA
+	// bg subsampled by bgCosScale, computed when first needed.
+	bgSmall *image.RGBA
+	// Recent frames in which nothing was moving, oldest first, see addIdle().
+	idle []idleFrame
+
+	// Number of sequences started so far.
+	nSequences int
+
+	eventHandler   EventHandler
+	lastProgressTS time.Time
+
+	// Jobs which were submitted, but whose trains were not yet returned, in order.
+	queue []*stitchJob
+	// Queue of the worker goroutine, nil in synchronous mode.
+	jobs chan *stitchJob
+	// Nil if sequences are not saved.
+	saver *sequenceSaver
+
+	// Set if the current train was too long and had to be split into parts.
+	// part is the number of the last part which was stitched, group is shared by all successfully stitched parts.
+	part  int
+	group *Group
+
 	pm pmatch.Instance
 }
 
 // NewAutoStitcher creates a new AutoStitcher.
+// If c.StitchQueueSize > 0 or c.SequenceDir is set, call Close() when done.
 func NewAutoStitcher(c Config) *AutoStitcher {
-	return &AutoStitcher{
+	r := &AutoStitcher{
 		c: c,
 
 		pm: pmatch.NewInstance(),
 	}
+	r.c.rotateMask()
+
+	if c.SequenceDir != "" {
+		r.saver = newSequenceSaver(c.SequenceDir)
+	}
+	if c.StitchQueueSize > 0 {
+		r.jobs = make(chan *stitchJob, c.StitchQueueSize)
+		go r.worker(r.jobs)
+	}
+
+	return r
 }
 
 func (r *AutoStitcher) findOffset(prev, curr *image.RGBA, maxDx int) (dx int, cos float64) {
 	t0 := time.Now()
 	defer func() {
-		log.Trace().Dur("dur", time.Since(t0)).Msg("findOffset() duration")
+		r.c.logger().Trace().Dur("dur", time.Since(t0)).Msg("findOffset() duration")
 	}()
 
 	if prev.Rect.Size() != curr.Rect.Size() {
-		log.Panic().Msg("inconsistent size, this should not happen")
+		r.c.logger().Panic().Msg("inconsistent size, this should not happen")
 	}
 
 	// Centered crop from prev frame,
@@ -136,7 +350,7 @@ func (r *AutoStitcher) findOffset(prev, curr *image.RGBA, maxDx int) (dx int, co
 		)
 	sub, err := imutil.Sub(prev, subRect)
 	if err != nil {
-		log.Panic().Err(err).Msg("this should not happen")
+		r.c.logger().Panic().Err(err).Msg("this should not happen")
 	}
 
 	// Centered slice crop from next frame,
@@ -152,7 +366,7 @@ func (r *AutoStitcher) findOffset(prev, curr *image.RGBA, maxDx int) (dx int, co
 
 	slice, err := imutil.Sub(curr, sliceRect)
 	if err != nil {
-		log.Panic().Err(err).Msg("this should not happen")
+		r.c.logger().Panic().Err(err).Msg("this should not happen")
 	}
 
 	// We expect this x value to be found by the search if the frame has not moved.
@@ -163,23 +377,127 @@ func (r *AutoStitcher) findOffset(prev, curr *image.RGBA, maxDx int) (dx int, co
 }
 
 func (r *AutoStitcher) reset() {
-	log.Trace().Msg("resetting sequence")
+	r.c.logger().Trace().Msg("resetting sequence")
 
 	r.seq = sequence{}
-	prometheus.RecordSequenceLength(0)
+	prometheus.RecordSequenceLength(r.c.Region, 0)
 	r.dxAbsLowPass = 0
 }
 
-func (r *AutoStitcher) record(prevTS time.Time, frame image.Image, dx int, ts time.Time) {
-	log.Trace().Time("prevTS", prevTS).Time("ts", ts).Int("dx", dx).Msg("record")
+// assignPart marks a train as the next part of the current group of parts.
+// train might be nil, in which case the part number is skipped.
+func (r *AutoStitcher) assignPart(train *Train) {
+	r.part++
+	if train == nil {
+		return
+	}
+
+	if r.group == nil {
+		r.group = &Group{StartTS: train.StartTS}
+	}
+	train.Part = r.part
+	train.Group = r.group
+}
+
+// assignParts assigns part numbers to the trains which were stitched from the current sequence,
+// if the train was split into parts. continued is true if the train continues in the next part.
+// Trains from the same sequence are separated by gaps, so only the first one can be the continuation of the
+// previous part, and only the last one can be continued in the next part.
+func (r *AutoStitcher) assignParts(trains []*Train, continued bool) {
+	if len(trains) == 0 {
+		if continued {
+			r.assignPart(nil)
+		}
+		return
+	}
+
+	if len(trains) > 1 {
+		if r.part > 0 {
+			r.assignPart(trains[0])
+		}
+		r.part = 0
+		r.group = nil
+		if continued {
+			r.assignPart(trains[len(trains)-1])
+		}
+		return
+	}
+
+	if continued || r.part > 0 {
+		r.assignPart(trains[0])
+	}
+}
+
+// stitchPartAndContinue submits the current sequence as a part of a train which is too long to be stitched at once.
+// A new sequence is started, which continues the current one: the motion state is kept, and the last frame
+// of the current sequence is also the first frame of the new one, so that the parts overlap and can be joined later.
+func (r *AutoStitcher) stitchPartAndContinue() {
+	n := len(r.seq.dx)
+	lastPrevTS := *r.seq.startTS
+	if n > 1 {
+		lastPrevTS = r.seq.ts[n-2]
+	}
+	lastDx, lastCos, lastBgCos, lastTS := r.seq.dx[n-1], r.seq.cos[n-1], r.seq.bgCos[n-1], r.seq.ts[n-1]
+
+	r.c.logger().Info().Msg("sequence too long, stitching part")
+	r.seq.trace.add(lastTS, "detect", "sequence too long (%d > %d frames), stitching it as a part, the train continues in a new sequence", n, r.c.MaxFrameCountPerSeq)
+	r.submit(lastTS, true)
+
+	// The last recorded frame is still available in full as the previous frame.
+	maxDx := r.c.maxPxPerFrame(lastTS.Sub(lastPrevTS).Seconds())
+	r.record(lastPrevTS, r.prevFrameColor, lastDx, lastCos, lastBgCos, lastTS, maxDx)
+	r.seq.trace.add(lastTS, "detect", "continues the previous part, starting with its last frame")
+}
+
+// bgCos computes the cosine similarity of a frame to the idle background.
+// Both are subsampled first, as this runs on every recorded frame.
+// Returns 0 if there is no background yet.
+func (r *AutoStitcher) bgCos(frame *image.RGBA) float64 {
+	if r.bg == nil || r.bg.Rect != frame.Rect {
+		return 0
+	}
+	if r.bgSmall == nil {
+		r.bgSmall = subsample(r.bg, bgCosScale)
+	}
+
+	// Same size, so there is only one position to search.
+	_, _, cos := r.pm.SearchRGBA(r.bgSmall, subsample(frame, bgCosScale))
+	return cos
+}
+
+func (r *AutoStitcher) record(prevTS time.Time, frame image.Image, dx int, cos, bgCos float64, ts time.Time, maxDx int) {
+	r.c.logger().Trace().Time("prevTS", prevTS).Time("ts", ts).Int("dx", dx).Msg("record")
 	if r.seq.startTS == nil {
 		r.seq.startTS = &prevTS
+		r.seq.frameBounds = frame.Bounds()
+		r.seq.bg = r.idleBackground(prevTS, frame.Bounds().Size())
+		if r.seq.bg != nil && r.c.Privacy.Enabled() {
+			r.seq.bg = r.c.Privacy.Apply(r.seq.bg)
+		}
+		if r.c.DebugDir != "" {
+			r.seq.trace = newSeqTrace()
+		}
+		if r.c.LowMemory {
+			r.seq.stripBounds = r.c.stripRect(frame.Bounds(), maxDx)
+		}
+	}
+
+	if r.c.Privacy.Enabled() {
+		frame = r.c.Privacy.Apply(frame)
+	}
+	if r.c.LowMemory {
+		if len(r.seq.full) < lowMemoryFullFrames {
+			r.seq.full = append(r.seq.full, frame)
+		}
+		frame = r.seq.spillFrame(r.c.SpillDir, imutil.CopyRect(frame, r.seq.stripBounds))
 	}
 
 	r.seq.frames = append(r.seq.frames, frame)
 	r.seq.dx = append(r.seq.dx, dx)
 	r.seq.ts = append(r.seq.ts, ts)
-	prometheus.RecordSequenceLength(len(r.seq.frames))
+	r.seq.cos = append(r.seq.cos, cos)
+	r.seq.bgCos = append(r.seq.bgCos, bgCos)
+	prometheus.RecordSequenceLength(r.c.Region, len(r.seq.frames))
 }
 
 func iabs(i int) int {
@@ -189,22 +507,30 @@ func iabs(i int) int {
 	return i
 }
 
-// TryStitchAndReset tries to stitch any remaining frames and resets the sequence.
-func (r *AutoStitcher) TryStitchAndReset() *Train {
+// Sequences returns the number of sequences (i.e. periods of movement) which were started so far.
+func (r *AutoStitcher) Sequences() int {
+	return r.nSequences
+}
+
+// endSequence submits the current sequence to be stitched, and resets it.
+func (r *AutoStitcher) endSequence() {
 	defer r.reset()
 
 	if len(r.seq.dx) == 0 {
-		log.Info().Msg("nothing to assemble")
-		return nil
+		r.c.logger().Info().Msg("nothing to assemble")
+		return
 	}
 
-	log.Info().Msg("end of sequence, trying to stitch")
-	train, err := fitAndStitch(r.seq, r.c)
-	if err != nil {
-		log.Err(err).Time("startTs", r.seq.ts[0]).Msg("unable to fit and stitch sequence")
-	}
+	r.c.logger().Info().Msg("end of sequence, trying to stitch")
+	r.submit(r.seq.ts[len(r.seq.ts)-1], false)
+}
 
-	return train
+// TryStitchAndReset tries to stitch any remaining frames and resets the sequence.
+// Waits for all sequences which are still being stitched in the background.
+func (r *AutoStitcher) TryStitchAndReset() []*Train {
+	r.seq.trace.add(r.prevFrameTS, "detect", "end of sequence: stitcher was reset (e.g. end of input)")
+	r.endSequence()
+	return r.collect(true)
 }
 
 func sum3(v [3]float64) float64 {
@@ -213,16 +539,29 @@ func sum3(v [3]float64) float64 {
 
 // Frame adds a frame to the AutoStitcher.
 // Takes ownership of the image data buffer, so be sure to make a copy before passing it.
-func (r *AutoStitcher) Frame(frameColor image.Image, ts time.Time) *Train {
+// Returns the trains which were completed since the last call, if any.
+func (r *AutoStitcher) Frame(frameColor image.Image, ts time.Time) []*Train {
 	t0 := time.Now()
 	defer func() {
-		log.Trace().Dur("dur", time.Since(t0)).Msg("Frame() duration")
+		r.c.logger().Trace().Dur("dur", time.Since(t0)).Msg("Frame() duration")
 	}()
 
-	log.Trace().Time("ts", ts).Uint64("frameIx", r.prevFrameIx).Msg("Frame()")
+	r.frame(frameColor, ts)
+	return r.collect(false)
+}
+
+func (r *AutoStitcher) frame(frameColor image.Image, ts time.Time) {
+	r.c.logger().Trace().Time("ts", ts).Uint64("frameIx", r.prevFrameIx).Msg("Frame()")
 
 	// Convert to RGBA.
-	frameRGBA := imutil.ToRGBA(frameColor)
+	var frameRGBA *image.RGBA
+	if r.c.rotates(frameColor.Bounds()) {
+		// Deskew, so that trains move horizontally.
+		frameRGBA = imutil.Rotate(frameColor, -r.c.TrackAngleDeg)
+		frameColor = frameRGBA
+	} else {
+		frameRGBA = imutil.ToRGBA(frameColor)
+	}
 	// Make sure we always save the previous frame.
 	defer func() {
 		r.prevFrameIx++
@@ -233,75 +572,101 @@ func (r *AutoStitcher) Frame(frameColor image.Image, ts time.Time) *Train {
 
 	if r.prevFrameColor == nil {
 		// First frame, we skip as we need a previous one to do any processing.
-		return nil
+		return
 	}
 
 	// Compute fps and min/max allowed pixel difference.
 	framePeriodS := ts.Sub(r.prevFrameTS).Seconds()
-	if framePeriodS < minFramePeriodS {
-		log.Warn().Float64("framePeriodS", framePeriodS).Msg("frame period too small")
-		return nil
+	if framePeriodS < r.c.minFramePeriodS() {
+		r.c.logger().Warn().Float64("framePeriodS", framePeriodS).Msg("frame period too small")
+		r.seq.trace.skip("frame_period_too_small")
+		return
 	}
 	minDx := r.c.minPxPerFrame(framePeriodS)
 	maxDx := r.c.maxPxPerFrame(framePeriodS)
 
 	// Sanity check.
 	if frameRGBA.Rect.Dx() < maxDx*3 {
-		log.Error().Int("dx", frameRGBA.Rect.Dx()).Int("maxDx*3", maxDx*3).Float64("framePeriodS", framePeriodS).Msg("image is not wide enough to resolve the given max speed")
+		r.c.logger().Error().Int("dx", frameRGBA.Rect.Dx()).Int("maxDx*3", maxDx*3).Float64("framePeriodS", framePeriodS).Msg("image is not wide enough to resolve the given max speed")
 		prometheus.RecordFrameDisposition("slow_frame")
-		return nil
+		r.seq.trace.skip("slow_frame")
+		return
 	}
 
 	// Check for minimal contrast and brightness.
 	avg, avgDev := avg.RGBAC(frameRGBA)
 	prometheus.RecordBrightnessContrast(sum3(avg)/3, sum3(avgDev)/3)
-	if sum3(avgDev)/3 < minContrastAvgDev {
-		log.Trace().Interface("avgDev", avgDev).Interface("avg", avg).Msg("contrast too low, discarding")
+	if sum3(avgDev)/3 < r.c.minContrastAvgDev() {
+		r.c.logger().Trace().Interface("avgDev", avgDev).Interface("avg", avg).Msg("contrast too low, discarding")
 		prometheus.RecordFrameDisposition("low_contrast")
-		return nil
+		r.seq.trace.skip("low_contrast")
+		return
 	}
 
 	dx, cos := r.findOffset(r.prevFrameRGBA, frameRGBA, maxDx)
-	log.Debug().Uint64("prevFrameIx", r.prevFrameIx).Int("dx", dx).Float64("cos", cos).Msg("received frame")
+	r.c.logger().Debug().Uint64("prevFrameIx", r.prevFrameIx).Int("dx", dx).Float64("cos", cos).Msg("received frame")
 
 	isActive := len(r.seq.dx) > 0
 	if isActive {
-		r.dxAbsLowPass = r.dxAbsLowPass*(dxLowPassFactor) + math.Abs(float64(dx))*(1-dxLowPassFactor)
-
-		// Bail out before we use too much memory.
-		if len(r.seq.dx) > r.c.MaxFrameCountPerSeq {
-			log.Debug().Int("MaxFrameCountPerSeq", r.c.MaxFrameCountPerSeq).Msg("len(r.seq.dx) > MaxFrameCountPerSeq")
-			return r.TryStitchAndReset()
-		}
+		lp := r.c.dxLowPassFactor()
+		r.dxAbsLowPass = r.dxAbsLowPass*lp + math.Abs(float64(dx))*(1-lp)
 
 		// We have reached the end of a sequence.
+		// Checked before the frame count (unlike before trains were split into parts), so that a train which stops
+		// right at the limit ends there, instead of starting a new part which only contains the stopping frames.
 		if r.dxAbsLowPass < float64(minDx) {
-			log.Debug().Float64("dxAbsLowPass", r.dxAbsLowPass).Msg("r.dxAbsLowPass < float64(minDx)")
-			return r.TryStitchAndReset()
+			r.c.logger().Debug().Float64("dxAbsLowPass", r.dxAbsLowPass).Msg("r.dxAbsLowPass < float64(minDx)")
+			r.seq.trace.add(ts, "detect", "end of sequence: movement stopped (low pass filtered |dx| %.2f < min dx %d)", r.dxAbsLowPass, minDx)
+			r.endSequence()
+			return
+		}
+
+		// Bail out before we use too much memory, the train continues in a new part.
+		if len(r.seq.dx) > r.c.MaxFrameCountPerSeq {
+			r.c.logger().Debug().Int("MaxFrameCountPerSeq", r.c.MaxFrameCountPerSeq).Msg("len(r.seq.dx) > MaxFrameCountPerSeq")
+			if r.seq.dx[len(r.seq.dx)-1] == 0 {
+				// Cannot start a new sequence with a frame without movement.
+				r.seq.trace.add(ts, "detect", "end of sequence: too long (%d > %d frames), and the last frame did not move", len(r.seq.dx), r.c.MaxFrameCountPerSeq)
+				r.endSequence()
+				return
+			}
+
+			r.stitchPartAndContinue()
+			r.record(r.prevFrameTS, frameColor, dx, cos, r.bgCos(frameRGBA), ts, maxDx)
+			prometheus.RecordFrameDisposition("recorded")
+			return
 		}
 
-		r.record(r.prevFrameTS, frameColor, dx, ts)
+		r.record(r.prevFrameTS, frameColor, dx, cos, r.bgCos(frameRGBA), ts, maxDx)
 		prometheus.RecordFrameDisposition("recorded")
-		return nil
+		r.emitProgress(ts)
+		return
 	}
 
-	if cos >= goodCosScoreNoMove && iabs(dx) < minDx {
-		log.Debug().Msg("not moving")
+	if cos >= r.c.goodCosScoreNoMove() && iabs(dx) < minDx {
+		r.c.logger().Debug().Msg("not moving")
+		r.bg = frameRGBA
+		r.bgSmall = nil
+		r.addIdle(frameRGBA, ts)
 		prometheus.RecordFrameDisposition("not_moving")
-		return nil
+		return
 	}
 
-	if cos >= goodCosScoreMove && iabs(dx) >= minDx && iabs(dx) <= maxDx {
-		log.Info().Msg("start of new sequence")
+	if cos >= r.c.goodCosScoreMove() && iabs(dx) >= minDx && iabs(dx) <= maxDx {
+		r.c.logger().Info().Msg("start of new sequence")
+		r.nSequences++
 		prometheus.RecordFrameDisposition("recorded_new_sequence")
-		r.record(r.prevFrameTS, frameColor, dx, ts)
+		r.record(r.prevFrameTS, frameColor, dx, cos, r.bgCos(frameRGBA), ts, maxDx)
+		r.seq.trace.add(ts, "detect", "start of sequence: dx %d in [%d, %d], cos %.3f >= %.3f", dx, minDx, maxDx, cos, r.c.goodCosScoreMove())
 		r.dxAbsLowPass = math.Abs(float64(dx))
-		return nil
+		r.lastProgressTS = ts
+		r.emit(&r.seq, Event{Type: EventSequenceStarted, TS: ts, SpeedPxS: r.currentSpeed()})
+		return
 	}
 
-	log.Debug().
+	r.c.logger().Debug().
 		Float64("cos", cos).
-		Float64("goodCosScoreMove", goodCosScoreMove).
+		Float64("goodCosScoreMove", r.c.goodCosScoreMove()).
 		Interface("avgDev", avgDev).
 		Interface("avg", avg).
 		Int("dx", dx).
@@ -309,5 +674,5 @@ func (r *AutoStitcher) Frame(frameColor image.Image, ts time.Time) *Train {
 		Int("maxDx", maxDx).
 		Msg("inconclusive frame")
 	prometheus.RecordFrameDisposition("inconclusive")
-	return nil
+	return
 }
@@ -73,14 +73,13 @@ func runTestSimple(t *testing.T, c Config, r image.Rectangle, video string, leng
 
 		frame, err = imutil.Sub(frame, r)
 		require.NoError(t, err)
-		tr := auto.Frame(imutil.Copy(frame), *ts)
-		if tr != nil {
+		for _, tr := range auto.Frame(imutil.Copy(frame), *ts) {
 			trains = append(trains, *tr)
 			log.Info().Msg("got train")
 		}
 	}
 
-	if tr := auto.TryStitchAndReset(); tr != nil {
+	for _, tr := range auto.TryStitchAndReset() {
 		trains = append(trains, *tr)
 	}
 
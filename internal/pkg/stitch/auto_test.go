@@ -0,0 +1,80 @@
+package stitch
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Config_thresholds(t *testing.T) {
+	c := Config{}
+	assert.Equal(t, DefaultGoodCosScoreNoMove, c.goodCosScoreNoMove())
+	assert.Equal(t, DefaultGoodCosScoreMove, c.goodCosScoreMove())
+	assert.Equal(t, DefaultDxLowPassFactor, c.dxLowPassFactor())
+	assert.Equal(t, DefaultMinContrastAvgDev, c.minContrastAvgDev())
+	assert.Equal(t, DefaultMinFramePeriodS, c.minFramePeriodS())
+
+	c = Config{
+		GoodCosScoreNoMove: 0.5,
+		GoodCosScoreMove:   0.4,
+		DxLowPassFactor:    0.3,
+		MinContrastAvgDev:  0.2,
+		MinFramePeriodS:    0.1,
+	}
+	assert.Equal(t, 0.5, c.goodCosScoreNoMove())
+	assert.Equal(t, 0.4, c.goodCosScoreMove())
+	assert.Equal(t, 0.3, c.dxLowPassFactor())
+	assert.Equal(t, 0.2, c.minContrastAvgDev())
+	assert.Equal(t, 0.1, c.minFramePeriodS())
+}
+
+func Test_AutoStitcher_Logger(t *testing.T) {
+	frames, ts := genCarsVideo([]int{80, 60, 100, 70}, 8, 10)
+
+	var buf bytes.Buffer
+	l := zerolog.New(&buf).Level(zerolog.InfoLevel)
+	a := NewAutoStitcher(Config{PixelsPerM: 10, MinSpeedKPH: 10, MaxSpeedKPH: 160, MinLengthM: 10, MaxFrameCountPerSeq: 1500, Logger: &l})
+	var trains []*Train
+	for i := range frames {
+		trains = append(trains, a.Frame(frames[i], ts[i])...)
+	}
+	trains = append(trains, a.TryStitchAndReset()...)
+	require.Len(t, trains, 1)
+
+	assert.Contains(t, buf.String(), "start of new sequence")
+	assert.Contains(t, buf.String(), "selected motion model")
+}
+
+func Test_AutoStitcher_Parts(t *testing.T) {
+	const (
+		period = time.Second / 30
+		speed  = 10 // [px/frame]
+	)
+	frames, ts := genVideo(400, 3000, speed, 20)
+	c := Config{PixelsPerM: 10, MinSpeedKPH: 10, MaxSpeedKPH: 160, MinLengthM: 10, MaxFrameCountPerSeq: 100}
+	a := NewAutoStitcher(c)
+	var trains []*Train
+	for i := range frames {
+		trains = append(trains, a.Frame(frames[i], ts[i])...)
+	}
+	trains = append(trains, a.TryStitchAndReset()...)
+
+	require.Greater(t, len(trains), 2)
+	for i, train := range trains {
+		assert.Equal(t, i+1, train.Part)
+		assert.Same(t, trains[0].Group, train.Group)
+		// The speed is carried over, each part is measured as fast as the whole train.
+		assert.InDelta(t, speed*float64(time.Second/period), math.Abs(train.SpeedPxS), 5, i)
+		if i > 0 {
+			// Each part continues with the last frame of the previous one.
+			prev := trains[i-1]
+			assert.Equal(t, prev.StartTS.Add(period*time.Duration(prev.NFrames-1)), train.StartTS, i)
+		}
+	}
+	assert.Equal(t, trains[0].StartTS, trains[0].Group.StartTS)
+}
@@ -0,0 +1,208 @@
+package stitch
+
+import (
+	"image"
+	"math"
+
+	"github.com/nfnt/resize"
+	"jo-m.ch/go/trainbot/pkg/imutil"
+)
+
+const (
+	// Typical wheel diameter, in m.
+	wheelDiameterM = 0.9
+	// Images are scaled down so that wheels have about this radius, in px.
+	axleScaledRadiusPx = 5
+	// Wheels are only searched in this (lower) fraction of the image.
+	axleSearchFraction = 0.5
+	// Minimum distance between two axles, in m.
+	axleMinSpacingM = 1.3
+	// A wheel must stand out by this many standard deviations from the mean response of its row.
+	axleMinPeakStd = 3
+	// Minimum blob response (see blobResponse()) of a wheel. A dark disc with a luminance contrast of 0.25 to its
+	// surroundings has about this response, corners of other dark shapes have a much lower one.
+	axleMinResponse = 0.15
+	// Fewer axles than this are not considered a valid detection.
+	axleMinCount = 2
+)
+
+// gaussKernel returns a normalized gaussian kernel with radius 3*sigma.
+func gaussKernel(sigma float64) []float64 {
+	r := int(math.Ceil(3 * sigma))
+	ret := make([]float64, 2*r+1)
+	var sum float64
+	for i := range ret {
+		d := float64(i - r)
+		ret[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		sum += ret[i]
+	}
+	for i := range ret {
+		ret[i] /= sum
+	}
+	return ret
+}
+
+// gaussBlur blurs a w*h image (row major) with a separable gaussian kernel, extending the borders.
+func gaussBlur(v []float64, w, h int, sigma float64) []float64 {
+	kernel := gaussKernel(sigma)
+	r := len(kernel) / 2
+
+	tmp := make([]float64, len(v))
+	for y := range h {
+		for x := range w {
+			var acc float64
+			for k, f := range kernel {
+				acc += f * v[y*w+min(max(x+k-r, 0), w-1)]
+			}
+			tmp[y*w+x] = acc
+		}
+	}
+
+	ret := make([]float64, len(v))
+	for y := range h {
+		for x := range w {
+			var acc float64
+			for k, f := range kernel {
+				acc += f * tmp[min(max(y+k-r, 0), h-1)*w+x]
+			}
+			ret[y*w+x] = acc
+		}
+	}
+	return ret
+}
+
+// blobResponse computes the scale normalized laplacian of gaussian of a w*h image (row major).
+// Dark blobs with a radius of about sqrt(2)*sigma have a large positive response at their center.
+func blobResponse(v []float64, w, h int, sigma float64) []float64 {
+	b := gaussBlur(v, w, h, sigma)
+	ret := make([]float64, len(v))
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			i := y*w + x
+			ret[i] = sigma * sigma * (b[i-1] + b[i+1] + b[i-w] + b[i+w] - 4*b[i])
+		}
+	}
+	return ret
+}
+
+// rowPeaks finds the local maxima in a row which stand out from the rest of the row, at least minDist apart.
+func rowPeaks(row []float64, minDist int) []int {
+	var mean, sq float64
+	for _, v := range row {
+		mean += v
+		sq += v * v
+	}
+	mean /= float64(len(row))
+	std := math.Sqrt(math.Max(sq/float64(len(row))-mean*mean, 0))
+	threshold := math.Max(mean+axleMinPeakStd*std, axleMinResponse)
+
+	var ret []int
+	for x, v := range row {
+		if v <= threshold {
+			continue
+		}
+		isMax := true
+		for d := -minDist / 2; d <= minDist/2; d++ {
+			if x+d >= 0 && x+d < len(row) && d != 0 && (row[x+d] > v || (row[x+d] == v && d < 0)) {
+				isMax = false
+				break
+			}
+		}
+		if isMax {
+			ret = append(ret, x)
+		}
+	}
+	return ret
+}
+
+// findAxles locates the wheels along the bottom of a stitched train image, as dark round blobs which all lie on
+// the same row. Returns the positions of the axles from the left edge of the image in m, in image order (left to
+// right). Returns nil if no axles were found.
+func findAxles(img image.Image, pxPerM float64) []float64 {
+	// Scale down, so that wheels have a known size in pixels.
+	scale := math.Min(axleScaledRadiusPx/(wheelDiameterM/2*pxPerM), 1)
+	w := int(float64(img.Bounds().Dx()) * scale)
+	h := int(float64(img.Bounds().Dy()) * scale)
+	if w < 3 || h < 3 {
+		return nil
+	}
+	scaled := imutil.ToRGBA(resize.Resize(uint(w), uint(h), img, resize.Bilinear))
+
+	// Transparent (masked) pixels would look like dark blobs, fill them with the mean luminance instead.
+	lum := make([]float64, w*h)
+	var sum float64
+	var n int
+	for y := range h {
+		for x := range w {
+			i := scaled.PixOffset(x, y)
+			p := scaled.Pix[i : i+4 : i+4]
+			if p[3] == 0 {
+				lum[y*w+x] = -1
+				continue
+			}
+			// Pixels are premultiplied.
+			lum[y*w+x] = (0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])) / float64(p[3])
+			sum += lum[y*w+x]
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	for i, v := range lum {
+		if v < 0 {
+			lum[i] = sum / float64(n)
+		}
+	}
+
+	radius := wheelDiameterM / 2 * pxPerM * scale
+	resp := blobResponse(lum, w, h, radius/math.Sqrt2)
+	minDist := int(axleMinSpacingM * pxPerM * scale)
+
+	// All wheel centers are on the same row, find the row with the strongest peaks.
+	var bestPeaks []int
+	var bestY int
+	var bestScore float64
+	for y := max(int(float64(h)*(1-axleSearchFraction)), 1); y < h-1; y++ {
+		row := resp[y*w : (y+1)*w]
+		peaks := rowPeaks(row, minDist)
+		var score float64
+		for _, x := range peaks {
+			score += row[x]
+		}
+		if score > bestScore {
+			bestScore, bestPeaks, bestY = score, peaks, y
+		}
+	}
+	if len(bestPeaks) < axleMinCount {
+		return nil
+	}
+
+	row := resp[bestY*w : (bestY+1)*w]
+	ret := make([]float64, len(bestPeaks))
+	for i, x := range bestPeaks {
+		// Refine with a parabola through the neighbours.
+		fx := float64(x)
+		if x > 0 && x < w-1 {
+			den := row[x-1] - 2*row[x] + row[x+1]
+			if den < 0 {
+				fx += 0.5 * (row[x-1] - row[x+1]) / den
+			}
+		}
+		// Center of the scaled pixel, in original pixels.
+		ret[i] = (fx + 0.5) / scale / pxPerM
+	}
+	return ret
+}
+
+// axleSpacings returns the distances between consecutive axles.
+func axleSpacings(axlesM []float64) []float64 {
+	if len(axlesM) < 2 {
+		return nil
+	}
+	ret := make([]float64, len(axlesM)-1)
+	for i := range ret {
+		ret[i] = axlesM[i+1] - axlesM[i]
+	}
+	return ret
+}
@@ -0,0 +1,75 @@
+package stitch
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// genAxlesImage draws a train with dark wheels at the given positions (in m) on a noisy background.
+func genAxlesImage(pxPerM float64, axlesM []float64, wheels bool) *image.RGBA {
+	const w, h = 800, 100
+	rnd := rand.New(rand.NewSource(1))
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			v := uint8(170 + rnd.Intn(40))
+			c := color.RGBA{v, v, v, 0xff}
+			switch {
+			case y >= 10 && y < 70 && x >= 20 && x < w-20:
+				// Car body.
+				c = color.RGBA{40 + v/4, 90 + v/4, 150 + v/4, 0xff}
+			case y >= 90 && y < 93:
+				// Rail.
+				c = color.RGBA{120, 120, 120, 0xff}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+
+	if !wheels {
+		return img
+	}
+	r := wheelDiameterM / 2 * pxPerM
+	cy := 90 - r
+	for _, m := range axlesM {
+		cx := m * pxPerM
+		for y := range h {
+			for x := range w {
+				dx, dy := float64(x)+0.5-cx, float64(y)+0.5-cy
+				if dx*dx+dy*dy <= r*r {
+					img.SetRGBA(x, y, color.RGBA{25, 20, 20, 0xff})
+				}
+			}
+		}
+	}
+	return img
+}
+
+func Test_findAxles(t *testing.T) {
+	for _, pxPerM := range []float64{20, 10} {
+		axles := []float64{4, 6.5, 20, 22.5, 26, 28.5}
+		if pxPerM == 10 {
+			axles = []float64{10, 12.5, 50, 52.5, 60, 62.5, 70}
+		}
+		img := genAxlesImage(pxPerM, axles, true)
+
+		found := findAxles(img, pxPerM)
+		require.Len(t, found, len(axles), pxPerM)
+		for i := range axles {
+			assert.InDelta(t, axles[i], found[i], 0.1, pxPerM)
+		}
+		spacings := axleSpacings(found)
+		require.Len(t, spacings, len(axles)-1)
+		assert.InDelta(t, axles[1]-axles[0], spacings[0], 0.1)
+	}
+}
+
+func Test_findAxles_None(t *testing.T) {
+	img := genAxlesImage(20, nil, false)
+	assert.Nil(t, findAxles(img, 20))
+}
@@ -0,0 +1,209 @@
+package stitch
+
+import (
+	"image"
+	"math"
+	"slices"
+	"time"
+)
+
+const (
+	// Minimum color difference (0..1) of a pixel to the background to count as foreground.
+	carFgMinDiff = 0.1
+	// A column is part of a gap between cars if its foreground fraction is below this fraction of the reference level.
+	carGapFraction = 0.5
+	// Gaps between cars must be at least this long, in m.
+	carMinGapM = 0.2
+	// Shorter segments (e.g. buffers, or background seen through parts of a car) are not counted as cars, in m.
+	carMinLengthM = 3
+	// The foreground profile is smoothed over this length, in m.
+	carSmoothM = 0.2
+)
+
+// Bounds for Config.idleLagS(), in s.
+const (
+	minIdleLagS = 0.2
+	maxIdleLagS = 10
+)
+
+type idleFrame struct {
+	ts    time.Time
+	frame *image.RGBA
+}
+
+// idleLagS returns how long a train at minimum speed needs to cross half of a frame with the given width.
+// The central part of the frame is still idle while a train enters from the side, so only frames which are at
+// least this much older than the start of a sequence can be used as the background.
+func (c *Config) idleLagS(w int) float64 {
+	if c.minSpeedPxPS() <= 0 {
+		return maxIdleLagS
+	}
+	return math.Min(math.Max(float64(w)/2/c.minSpeedPxPS(), minIdleLagS), maxIdleLagS)
+}
+
+// addIdle records a frame in which nothing was moving.
+// Only a few frames are kept, spaced so that there is always one which is older than Config.idleLagS().
+func (r *AutoStitcher) addIdle(frame *image.RGBA, ts time.Time) {
+	lag := time.Duration(r.c.idleLagS(frame.Rect.Dx()) * float64(time.Second))
+	if n := len(r.idle); n == 0 || ts.Sub(r.idle[n-1].ts) >= lag/4 {
+		r.idle = append(r.idle, idleFrame{ts: ts, frame: frame})
+	}
+	for len(r.idle) >= 2 && !r.idle[1].ts.After(ts.Add(-lag)) {
+		r.idle = r.idle[1:]
+	}
+}
+
+// idleBackground returns the most recent idle frame which is old enough to not show a train starting a sequence
+// at startTS, or the oldest one if there is none. Returns nil if there is no idle frame of the given size.
+func (r *AutoStitcher) idleBackground(startTS time.Time, size image.Point) *image.RGBA {
+	lag := time.Duration(r.c.idleLagS(size.X) * float64(time.Second))
+	var ret *image.RGBA
+	for _, f := range r.idle {
+		if f.frame.Rect.Size() != size {
+			continue
+		}
+		if ret != nil && f.ts.After(startTS.Add(-lag)) {
+			break
+		}
+		ret = f.frame
+	}
+	return ret
+}
+
+// Car is a car (wagon or locomotive) of a train.
+type Car struct {
+	// Left and right edge of the car in the stitched image (Train.Image), in pixels.
+	StartPx int `json:"start_px"`
+	EndPx   int `json:"end_px"`
+}
+
+// LengthPx returns the length of the car, in pixels.
+func (c Car) LengthPx() int {
+	return c.EndPx - c.StartPx
+}
+
+// backgroundImage stitches the idle background of a sequence in the same way as the frames (including the shear,
+// see stitch()), so that it can be compared pixel by pixel to the stitched train image.
+// Returns nil if there is no background.
+func backgroundImage(seq sequence, dx []int, shear []float64, c Config) *image.RGBA {
+	if seq.bg == nil || seq.bg.Rect.Size() != seq.frameBounds.Size() {
+		return nil
+	}
+
+	// The background might have been converted to RGBA, which resets the origin.
+	bg := &image.RGBA{Pix: seq.bg.Pix, Stride: seq.bg.Stride, Rect: seq.frameBounds}
+	var frame image.Image = bg
+	if c.LowMemory {
+		frame = bg.SubImage(seq.stripBounds)
+	}
+	frames := make([]image.Image, len(seq.frames))
+	for i := range frames {
+		frames[i] = frame
+	}
+
+	// All frames are the same, no need to fuse them.
+	img, err := stitch(c.logger(), frames, seq.frameBounds, dx, shear, c.Mask, FusionLast, c.maxImageBytes())
+	if err != nil {
+		return nil
+	}
+	return img
+}
+
+// foregroundProfile computes the fraction of foreground pixels in each column of img,
+// compared to the stitched background. Transparent (masked) pixels are not counted.
+func foregroundProfile(img, bg *image.RGBA) []float64 {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	ret := make([]float64, w)
+	for x := range w {
+		var n, fg int
+		for y := range h {
+			i := img.PixOffset(img.Rect.Min.X+x, img.Rect.Min.Y+y)
+			j := bg.PixOffset(bg.Rect.Min.X+x, bg.Rect.Min.Y+y)
+			if img.Pix[i+3] == 0 {
+				continue
+			}
+			n++
+			diff := iabs(int(img.Pix[i])-int(bg.Pix[j])) +
+				iabs(int(img.Pix[i+1])-int(bg.Pix[j+1])) +
+				iabs(int(img.Pix[i+2])-int(bg.Pix[j+2]))
+			if float64(diff)/3/0xff >= carFgMinDiff {
+				fg++
+			}
+		}
+		if n > 0 {
+			ret[x] = float64(fg) / float64(n)
+		}
+	}
+	return ret
+}
+
+// smooth computes the moving average over n values.
+func smooth(v []float64, n int) []float64 {
+	cum := make([]float64, len(v)+1)
+	for i, x := range v {
+		cum[i+1] = cum[i] + x
+	}
+	ret := make([]float64, len(v))
+	for i := range v {
+		i0, i1 := max(i-n/2, 0), min(i+n/2+1, len(v))
+		ret[i] = (cum[i1] - cum[i0]) / float64(i1-i0)
+	}
+	return ret
+}
+
+// findCars finds the cars in a foreground profile (see foregroundProfile()), by looking for gaps between them.
+// Returns the cars in image order (left to right).
+func findCars(profile []float64, pxPerM float64) []Car {
+	if len(profile) == 0 {
+		return nil
+	}
+	profile = smooth(profile, max(int(carSmoothM*pxPerM), 1))
+
+	// Reference level of the foreground fraction for cars. The image usually starts and ends with background,
+	// so the median is not a good choice for short trains.
+	sorted := slices.Clone(profile)
+	slices.Sort(sorted)
+	threshold := carGapFraction * sorted[len(sorted)*3/4]
+	if threshold == 0 {
+		return nil
+	}
+	minGap := max(int(carMinGapM*pxPerM), 2)
+	minLength := int(carMinLengthM * pxPerM)
+
+	var cars []Car
+	start := -1
+	gapStart := -1
+	for x := 0; x <= len(profile); x++ {
+		isGap := x == len(profile) || profile[x] < threshold
+		if !isGap {
+			if start < 0 {
+				start = x
+			}
+			gapStart = -1
+			continue
+		}
+
+		if gapStart < 0 {
+			gapStart = x
+		}
+		if start >= 0 && (x-gapStart+1 >= minGap || x == len(profile)) {
+			if gapStart-start >= minLength {
+				cars = append(cars, Car{StartPx: start, EndPx: gapStart})
+			}
+			start = -1
+		}
+	}
+
+	return cars
+}
+
+// segmentCars finds the cars of a train in its stitched image.
+// Returns nil if the sequence has no background to compare to.
+func segmentCars(seq sequence, dx []int, shear []float64, img *image.RGBA, c Config) []Car {
+	bg := backgroundImage(seq, dx, shear, c)
+	if bg == nil || bg.Rect.Size() != img.Rect.Size() {
+		return nil
+	}
+
+	return findCars(foregroundProfile(img, bg), c.PixelsPerM)
+}
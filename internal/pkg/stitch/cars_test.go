@@ -0,0 +1,103 @@
+package stitch
+
+import (
+	"image"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"jo-m.ch/go/trainbot/pkg/imutil"
+)
+
+func Test_findCars(t *testing.T) {
+	// 10 px/m: background, 6 m car, 1 m gap, 4 m car, 0.1 m gap (too short), 5 m car, background.
+	var profile []float64
+	add := func(n int, v float64) {
+		for range n {
+			profile = append(profile, v)
+		}
+	}
+	add(50, 0)
+	add(60, 0.9)
+	add(10, 0.1)
+	add(40, 0.8)
+	add(1, 0.1)
+	add(50, 0.9)
+	add(50, 0)
+
+	cars := findCars(profile, 10)
+	require.Len(t, cars, 2)
+	assert.InDelta(t, 50, cars[0].StartPx, 2)
+	assert.InDelta(t, 110, cars[0].EndPx, 2)
+	assert.InDelta(t, 120, cars[1].StartPx, 2)
+	assert.InDelta(t, 211, cars[1].EndPx, 2)
+}
+
+func Test_findCars_Empty(t *testing.T) {
+	assert.Nil(t, findCars(nil, 10))
+	assert.Nil(t, findCars(make([]float64, 100), 10))
+}
+
+// genCarsVideo generates frames of a train consisting of cars with the given lengths (in px), with gaps between
+// them through which the background is visible, moving to the left in front of a random background.
+func genCarsVideo(carLens []int, gap, speed int) ([]image.Image, []time.Time) {
+	const w, h = 200, 100
+	const startFrame = 20
+	bg := imutil.RandRGBA(1, w, h)
+
+	var isCar []bool
+	for _, l := range carLens {
+		for range l {
+			isCar = append(isCar, true)
+		}
+		for range gap {
+			isCar = append(isCar, false)
+		}
+	}
+	trainLen := len(isCar)
+	train := imutil.RandRGBA(2, trainLen, h)
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var frames []image.Image
+	var ts []time.Time
+	nFrames := startFrame*2 + (w+trainLen)/speed
+	for k := range nFrames {
+		f := imutil.Copy(bg).(*image.RGBA)
+		off := w - speed*(k-startFrame)
+		for y := range h {
+			for x := range w {
+				tx := x - off
+				if k >= startFrame && tx >= 0 && tx < trainLen && isCar[tx] {
+					f.SetRGBA(x, y, train.RGBAAt(tx, y))
+				}
+			}
+		}
+		frames = append(frames, f)
+		ts = append(ts, t0.Add(time.Second/30*time.Duration(k)))
+	}
+	return frames, ts
+}
+
+func Test_AutoStitcher_Cars(t *testing.T) {
+	carLens := []int{80, 60, 100, 70}
+	frames, ts := genCarsVideo(carLens, 8, 10)
+
+	for _, lowMem := range []bool{false, true} {
+		c := Config{PixelsPerM: 10, MinSpeedKPH: 10, MaxSpeedKPH: 160, MinLengthM: 10, MaxFrameCountPerSeq: 1500, LowMemory: lowMem}
+		a := NewAutoStitcher(c)
+		var trains []*Train
+		for i := range frames {
+			trains = append(trains, a.Frame(frames[i], ts[i])...)
+		}
+		trains = append(trains, a.TryStitchAndReset()...)
+
+		require.Len(t, trains, 1)
+		cars := trains[0].Cars
+		require.Len(t, cars, len(carLens), lowMem)
+		for i, car := range cars {
+			assert.InDelta(t, carLens[i], car.LengthPx(), 3, lowMem)
+			assert.InDelta(t, float64(carLens[i])/10, trains[0].CarLengthM(car), 0.3, lowMem)
+		}
+	}
+}
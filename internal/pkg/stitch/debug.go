@@ -0,0 +1,299 @@
+package stitch
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"image"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/nfnt/resize"
+	"jo-m.ch/go/trainbot/pkg/imutil"
+	"jo-m.ch/go/trainbot/pkg/ransac"
+)
+
+// Stitched images in the diagnostic bundle are scaled down to this size.
+const debugMaxImageDimension = 4000
+
+// traceStep is a decision taken for a sequence.
+type traceStep struct {
+	// Timestamp of the frame which caused the decision, zero if not related to a frame.
+	TS time.Time `json:"ts"`
+	// Stage is "detect" (AutoStitcher.Frame()), "fit" or "stitch" (fitAndStitch()).
+	Stage string `json:"stage"`
+	// Segment is the index of the part (separated by gaps) of the sequence, -1 if the whole sequence.
+	Segment int    `json:"segment"`
+	Msg     string `json:"msg"`
+}
+
+// traceFit is an attempt to fit a motion model to a segment.
+type traceFit struct {
+	Segment int
+	Model   MotionModel
+	// Data points: time since start [s] and speed [px/s].
+	T, V []float64
+	// Fitted params, nil if the fit failed.
+	Params   []float64
+	BIC      float64
+	NInliers int
+	Err      string
+	// File name of the plot in the bundle.
+	Plot string
+}
+
+// seqTrace records the decisions taken for a sequence, for the diagnostic bundle (see Config.DebugDir).
+// All methods are no-ops on a nil *seqTrace.
+type seqTrace struct {
+	steps []traceStep
+	fits  []traceFit
+	// Frames which were skipped while the sequence was active, by reason.
+	skipped map[string]int
+	// Index of the segment which is currently being fitted and stitched, -1 before.
+	segment int
+}
+
+func newSeqTrace() *seqTrace {
+	return &seqTrace{skipped: map[string]int{}, segment: -1}
+}
+
+func (t *seqTrace) add(ts time.Time, stage, format string, args ...any) {
+	if t == nil {
+		return
+	}
+	t.steps = append(t.steps, traceStep{TS: ts, Stage: stage, Segment: t.segment, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (t *seqTrace) skip(reason string) {
+	if t == nil {
+		return
+	}
+	t.skipped[reason]++
+}
+
+func (t *seqTrace) addFit(f traceFit) {
+	if t == nil {
+		return
+	}
+	f.Segment = t.segment
+	t.fits = append(t.fits, f)
+}
+
+// debugSeries is the JSON file in the diagnostic bundle.
+type debugSeries struct {
+	StartTS time.Time      `json:"start_ts"`
+	TS      []time.Time    `json:"ts"`
+	Dx      []int          `json:"dx"`
+	Cos     []float64      `json:"cos"`
+	BgCos   []float64      `json:"bg_cos"`
+	Steps   []traceStep    `json:"steps"`
+	Skipped map[string]int `json:"skipped"`
+}
+
+type debugTrain struct {
+	*Train
+	Image string
+}
+
+type debugReport struct {
+	Name      string
+	Region    string
+	StartTS   time.Time
+	NFrames   int
+	DurationS float64
+	Skipped   map[string]int
+	Trains    []debugTrain
+	Rejected  []*RejectError
+	Steps     []traceStep
+	Fits      []traceFit
+	First     string
+	Last      string
+}
+
+var debugReportTmpl = template.Must(template.New("report").Funcs(template.FuncMap{
+	"kph": func(t *Train) float64 { return t.SpeedMpS() * 3.6 },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Sequence {{.Name}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 2px 6px; text-align: left; vertical-align: top; }
+img { max-width: 100%; }
+.ok { color: #070; }
+.rejected { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Sequence {{.Name}}</h1>
+<table>
+<tr><th>Region</th><td>{{.Region}}</td></tr>
+<tr><th>Start</th><td>{{.StartTS}}</td></tr>
+<tr><th>Frames</th><td>{{.NFrames}} ({{printf "%.1f" .DurationS}} s)</td></tr>
+<tr><th>Skipped frames</th><td>{{range $reason, $n := .Skipped}}{{$reason}}: {{$n}}<br>{{else}}none{{end}}</td></tr>
+<tr><th>Result</th><td>
+{{- if .Trains}}<span class="ok">{{len .Trains}} train(s)</span>{{end}}
+{{- if .Rejected}} <span class="rejected">{{len .Rejected}} rejected</span>{{end}}
+{{- if not (or .Trains .Rejected)}}nothing{{end}}</td></tr>
+</table>
+
+{{if .Trains}}
+<h2>Trains</h2>
+<table>
+<tr><th>Start</th><th>Length</th><th>Speed</th><th>Model</th><th>Quality</th><th>Cars</th><th>Axles</th></tr>
+{{range .Trains}}<tr>
+<td>{{.StartTS}}</td>
+<td>{{printf "%.1f" .LengthM}} m</td>
+<td>{{printf "%.1f" (kph .Train)}} km/h, {{.DirectionS}}</td>
+<td>{{.Model}}</td>
+<td>{{printf "%.3f" .Quality.Score}}{{if .Quality.LowConfidence}} (low confidence){{end}}</td>
+<td>{{len .Cars}}</td>
+<td>{{len .AxlesM}}</td>
+</tr>{{end}}
+</table>
+{{end}}
+
+{{if .Rejected}}
+<h2>Rejected</h2>
+<ul>
+{{range .Rejected}}<li class="rejected">{{.Reason}}: {{.Err}}</li>{{end}}
+</ul>
+{{end}}
+
+<h2>Decisions</h2>
+<table>
+<tr><th>Frame time</th><th>Stage</th><th>Segment</th><th>Decision</th></tr>
+{{range .Steps}}<tr>
+<td>{{if not .TS.IsZero}}{{.TS.Format "15:04:05.000"}}{{end}}</td>
+<td>{{.Stage}}</td>
+<td>{{if ge .Segment 0}}{{.Segment}}{{end}}</td>
+<td>{{.Msg}}</td>
+</tr>{{end}}
+</table>
+
+{{if .Fits}}
+<h2>Motion model fits</h2>
+<p>Measured speed (blue) and fitted model (red), in px/s over s since the start of the sequence.</p>
+{{range .Fits}}
+<h3>Segment {{.Segment}}, {{.Model.Name}}</h3>
+{{if .Err}}<p class="rejected">{{.Err}}</p>{{else}}<p>BIC {{printf "%.1f" .BIC}}, {{.NInliers}} of {{len .T}} inliers, params {{.Params}}</p>{{end}}
+{{if .Plot}}<img src="{{.Plot}}" alt="fit">{{end}}
+{{end}}
+{{end}}
+
+{{if .Trains}}
+<h2>Stitched images</h2>
+{{range .Trains}}<p><img src="{{.Image}}" alt="train"></p>{{end}}
+{{end}}
+
+<h2>Frames</h2>
+<p>First and last frame (in low memory mode, only the central strip of the last frame is kept).</p>
+<p><img src="{{.First}}" alt="first frame"> <img src="{{.Last}}" alt="last frame"></p>
+
+<p>Raw data: <a href="series.json">series.json</a></p>
+</body>
+</html>
+`))
+
+// writeDebugBundle writes a diagnostic bundle for a sequence to a new subdirectory of dir, with the measured
+// series, the motion model fits, the first and last frame, the stitched images and a HTML report.
+// trains and stitchErr are the result of fitAndStitch().
+func writeDebugBundle(dir string, seq sequence, c Config, trains []*Train, stitchErr error) (string, error) {
+	if len(seq.frames) == 0 {
+		return "", nil
+	}
+
+	path := filepath.Join(dir, sequenceName(seq, c.Region))
+	err := os.MkdirAll(path, 0750)
+	if err != nil {
+		return "", err
+	}
+
+	trace := seq.trace
+	if trace == nil {
+		trace = newSeqTrace()
+	}
+
+	// Data.
+	buf, err := json.MarshalIndent(debugSeries{
+		StartTS: *seq.startTS,
+		TS:      seq.ts,
+		Dx:      seq.dx,
+		Cos:     seq.cos,
+		BgCos:   seq.bgCos,
+		Steps:   trace.steps,
+		Skipped: trace.skipped,
+	}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	err = os.WriteFile(filepath.Join(path, "series.json"), buf, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	// Fits.
+	fits := slices.Clone(trace.fits)
+	for i := range fits {
+		f := &fits[i]
+		f.Plot = fmt.Sprintf("fit_%d_%s.png", f.Segment, f.Model.Name())
+		var fn ransac.ModelFn
+		if f.Params != nil {
+			fn = f.Model.Speed
+		}
+		err = ransac.Plot(filepath.Join(path, f.Plot), f.T, f.V, f.Params, fn, "t [s]", "v [px/s]")
+		if err != nil {
+			return "", err
+		}
+	}
+
+	report := debugReport{
+		Name:      filepath.Base(path),
+		Region:    c.Region,
+		StartTS:   seq.ts[0],
+		NFrames:   len(seq.frames),
+		DurationS: seq.ts[len(seq.ts)-1].Sub(*seq.startTS).Seconds(),
+		Skipped:   trace.skipped,
+		Rejected:  rejectErrors(stitchErr),
+		Steps:     trace.steps,
+		Fits:      fits,
+		First:     "first.jpg",
+		Last:      "last.jpg",
+	}
+
+	// Images.
+	first := seq.frames[0]
+	if len(seq.full) > 0 {
+		first = seq.full[0]
+	}
+	for name, img := range map[string]image.Image{report.First: first, report.Last: seq.frames[len(seq.frames)-1]} {
+		err = imutil.Dump(filepath.Join(path, name), loadFrame(img))
+		if err != nil {
+			return "", err
+		}
+	}
+	for i, t := range trains {
+		name := fmt.Sprintf("train_%d.jpg", i)
+		err = imutil.Dump(filepath.Join(path, name), resize.Thumbnail(debugMaxImageDimension, debugMaxImageDimension, t.Image, resize.Bilinear))
+		if err != nil {
+			return "", err
+		}
+		report.Trains = append(report.Trains, debugTrain{Train: t, Image: name})
+	}
+
+	f, err := os.Create(filepath.Join(path, "report.html"))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	err = debugReportTmpl.Execute(f, report)
+	if err != nil {
+		return "", err
+	}
+
+	return path, f.Close()
+}
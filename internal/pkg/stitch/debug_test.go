@@ -0,0 +1,61 @@
+package stitch
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func runDebug(t *testing.T, c Config) string {
+	frames, ts := genVideo(150, 1000, 10, 10)
+
+	c.DebugDir = t.TempDir()
+	a := NewAutoStitcher(c)
+	for i := range frames {
+		a.Frame(frames[i], ts[i])
+	}
+	a.TryStitchAndReset()
+
+	entries, err := os.ReadDir(c.DebugDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	return filepath.Join(c.DebugDir, entries[0].Name())
+}
+
+func Test_DebugBundle(t *testing.T) {
+	dir := runDebug(t, Config{PixelsPerM: 10, MinSpeedKPH: 10, MaxSpeedKPH: 160, MinLengthM: 10, MaxFrameCountPerSeq: 1500, MotionModel: MotionModelAuto})
+
+	for _, name := range []string{"first.jpg", "last.jpg", "train_0.jpg", "fit_0_constant_speed.png", "fit_0_constant_accel.png"} {
+		assert.FileExists(t, filepath.Join(dir, name))
+	}
+
+	buf, err := os.ReadFile(filepath.Join(dir, "series.json"))
+	require.NoError(t, err)
+	var series debugSeries
+	require.NoError(t, json.Unmarshal(buf, &series))
+	assert.NotEmpty(t, series.Dx)
+	assert.Len(t, series.TS, len(series.Dx))
+	require.NotEmpty(t, series.Steps)
+	assert.Contains(t, series.Steps[0].Msg, "start of sequence")
+
+	report, err := os.ReadFile(filepath.Join(dir, "report.html"))
+	require.NoError(t, err)
+	assert.Contains(t, string(report), "1 train(s)")
+	assert.Contains(t, string(report), "end of sequence")
+	assert.Contains(t, string(report), "selected motion model")
+	assert.Contains(t, string(report), `src="train_0.jpg"`)
+}
+
+func Test_DebugBundle_Rejected(t *testing.T) {
+	dir := runDebug(t, Config{PixelsPerM: 10, MinSpeedKPH: 10, MaxSpeedKPH: 160, MinLengthM: 1000, MaxFrameCountPerSeq: 1500})
+
+	assert.NoFileExists(t, filepath.Join(dir, "train_0.jpg"))
+	report, err := os.ReadFile(filepath.Join(dir, "report.html"))
+	require.NoError(t, err)
+	assert.Contains(t, string(report), "1 rejected")
+	assert.Contains(t, string(report), string(RejectTooShort))
+}
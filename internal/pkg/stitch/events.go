@@ -0,0 +1,235 @@
+package stitch
+
+import (
+	"errors"
+	"image"
+	"time"
+
+	"github.com/nfnt/resize"
+)
+
+const (
+	// How often progress events are published while a sequence is active (in frame time).
+	eventProgressInterval = time.Second
+	// Number of recent frames used to estimate the current speed for progress events.
+	eventSpeedFrames = 10
+	// Maximum width and height of SequenceSummary.Preview.
+	previewMaxDimension = 320
+)
+
+// EventType is the type of an Event.
+type EventType int
+
+const (
+	// EventSequenceStarted is published when movement is detected and a new sequence is started.
+	EventSequenceStarted EventType = iota
+	// EventSequenceProgress is published periodically while a sequence is active.
+	EventSequenceProgress
+	// EventSequenceEnded is published when the movement stopped and the sequence was stitched.
+	EventSequenceEnded
+	// EventSequenceRejected is published when (a part of) a sequence did not result in a train.
+	EventSequenceRejected
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventSequenceStarted:
+		return "started"
+	case EventSequenceProgress:
+		return "progress"
+	case EventSequenceEnded:
+		return "ended"
+	case EventSequenceRejected:
+		return "rejected"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes the lifecycle of a sequence (i.e. a train passing), see AutoStitcher.SetEventHandler().
+type Event struct {
+	Type EventType
+	// Timestamp of the frame which caused the event.
+	TS time.Time
+	// Timestamp of the first frame of the sequence (same as Train.StartTS, unless the sequence was split).
+	StartTS time.Time
+	// Number of frames recorded so far.
+	NFrames int
+	// Estimated speed over the last few frames, same sign convention as Train.SpeedPxS.
+	// Only set for EventSequenceStarted and EventSequenceProgress.
+	SpeedPxS float64
+	// Number of trains detected in the sequence, only set for EventSequenceEnded.
+	NTrains int
+	// Only set for EventSequenceRejected.
+	Err *RejectError
+}
+
+// EventHandler receives events from an AutoStitcher.
+// It is called synchronously from Frame() and TryStitchAndReset(), and thus must not block.
+// Ended and rejected events are published when stitching is done, which might be a few frames later
+// if stitching runs in the background (see Config.StitchQueueSize).
+type EventHandler func(Event)
+
+// RejectReason describes why a sequence was rejected.
+type RejectReason string
+
+// Possible reasons for rejecting a sequence.
+const (
+	RejectUnableToFit           RejectReason = "unable_to_fit"
+	RejectTooShort              RejectReason = "too_short"
+	RejectTooSlow               RejectReason = "too_slow"
+	RejectUnableToAssembleImage RejectReason = "unable_to_assemble_image"
+	RejectQueueFull             RejectReason = "queue_full"
+)
+
+// RejectError is returned when a sequence could not be stitched to a train.
+type RejectError struct {
+	Reason RejectReason
+	Err    error
+	// Seq describes the rejected (part of the) sequence.
+	// Set for errors from fitAndStitch() and for sequences dropped because the stitch queue was full.
+	Seq *SequenceSummary
+}
+
+func (e *RejectError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RejectError) Unwrap() error {
+	return e.Err
+}
+
+// DxSummary summarizes the measured displacements (dx) of a sequence.
+// Positive values mean movement to the left, see Train.SpeedPxS.
+type DxSummary struct {
+	Min  int     `json:"min"`
+	Max  int     `json:"max"`
+	Mean float64 `json:"mean"`
+	// Sum is the total displacement.
+	Sum int `json:"sum"`
+	// Zeros is the number of frames without movement.
+	Zeros int `json:"zeros"`
+}
+
+// SequenceSummary describes a (part of a) sequence which did not result in a train.
+type SequenceSummary struct {
+	// Timestamps of the first and last frame.
+	StartTS time.Time
+	EndTS   time.Time
+	NFrames int
+	Dx      DxSummary
+	// Preview is a low resolution image of a frame from the middle of the sequence (or, in low memory mode,
+	// of the last full frame kept). Nil if there are no frames.
+	Preview image.Image
+}
+
+// summarize creates a SequenceSummary of a sequence.
+func summarize(seq sequence) *SequenceSummary {
+	ret := SequenceSummary{NFrames: len(seq.dx)}
+	if len(seq.ts) > 0 {
+		ret.StartTS = seq.ts[0]
+		ret.EndTS = seq.ts[len(seq.ts)-1]
+	}
+
+	for i, dx := range seq.dx {
+		if i == 0 || dx < ret.Dx.Min {
+			ret.Dx.Min = dx
+		}
+		if i == 0 || dx > ret.Dx.Max {
+			ret.Dx.Max = dx
+		}
+		if dx == 0 {
+			ret.Dx.Zeros++
+		}
+		ret.Dx.Sum += dx
+	}
+	if len(seq.dx) > 0 {
+		ret.Dx.Mean = float64(ret.Dx.Sum) / float64(len(seq.dx))
+	}
+
+	var frame image.Image
+	if len(seq.full) > 0 {
+		frame = seq.full[len(seq.full)-1]
+	} else if len(seq.frames) > 0 {
+		frame = loadFrame(seq.frames[len(seq.frames)/2])
+	}
+	if frame != nil {
+		ret.Preview = resize.Thumbnail(previewMaxDimension, previewMaxDimension, frame, resize.Bilinear)
+	}
+
+	return &ret
+}
+
+// rejectErrors extracts all RejectErrors from a (joined) error.
+func rejectErrors(err error) []*RejectError {
+	if err == nil {
+		return nil
+	}
+
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var ret []*RejectError
+		for _, err := range joined.Unwrap() {
+			ret = append(ret, rejectErrors(err)...)
+		}
+		return ret
+	}
+
+	var rejectErr *RejectError
+	if errors.As(err, &rejectErr) {
+		return []*RejectError{rejectErr}
+	}
+	return nil
+}
+
+// SetEventHandler sets a handler which is called on sequence lifecycle events.
+// Pass nil to remove the handler.
+func (r *AutoStitcher) SetEventHandler(h EventHandler) {
+	r.eventHandler = h
+}
+
+func (r *AutoStitcher) emit(seq *sequence, e Event) {
+	if r.eventHandler == nil {
+		return
+	}
+
+	if len(seq.ts) > 0 {
+		e.StartTS = seq.ts[0]
+	}
+	e.NFrames = len(seq.dx)
+	r.eventHandler(e)
+}
+
+// currentSpeed estimates the speed over the last few frames of the current sequence.
+func (r *AutoStitcher) currentSpeed() float64 {
+	n := len(r.seq.dx)
+	if n == 0 {
+		return 0
+	}
+
+	i0 := max(n-eventSpeedFrames, 0)
+	t0 := *r.seq.startTS
+	if i0 > 0 {
+		t0 = r.seq.ts[i0-1]
+	}
+	dt := r.seq.ts[n-1].Sub(t0).Seconds()
+	if dt <= 0 {
+		return 0
+	}
+
+	sum := 0
+	for _, dx := range r.seq.dx[i0:] {
+		sum += dx
+	}
+	// Negate because when things move to the left we get positive dx values.
+	return -float64(sum) / dt
+}
+
+// emitProgress publishes a progress event, if enough time has passed since the last one.
+func (r *AutoStitcher) emitProgress(ts time.Time) {
+	if ts.Sub(r.lastProgressTS) < eventProgressInterval {
+		return
+	}
+
+	r.lastProgressTS = ts
+	r.emit(&r.seq, Event{Type: EventSequenceProgress, TS: ts, SpeedPxS: r.currentSpeed()})
+}
@@ -0,0 +1,146 @@
+package stitch
+
+import (
+	"errors"
+	"image"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"jo-m.ch/go/trainbot/pkg/imutil"
+)
+
+// genVideo generates frames of a train with random texture moving to the left in front of a random background.
+func genVideo(nFrames, trainLen, speed, startFrame int) ([]image.Image, []time.Time) {
+	const w, h = 200, 100
+	bg := imutil.RandRGBA(1, w, h)
+	train := imutil.RandRGBA(2, trainLen, h)
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var frames []image.Image
+	var ts []time.Time
+	for k := range nFrames {
+		f := imutil.Copy(bg).(*image.RGBA)
+		off := w - speed*(k-startFrame)
+		for y := range h {
+			for x := range w {
+				tx := x - off
+				if k >= startFrame && tx >= 0 && tx < trainLen {
+					f.SetRGBA(x, y, train.RGBAAt(tx, y))
+				}
+			}
+		}
+		frames = append(frames, f)
+		ts = append(ts, t0.Add(time.Second/30*time.Duration(k)))
+	}
+	return frames, ts
+}
+
+func runEvents(t *testing.T, c Config) ([]*Train, []Event) {
+	t.Helper()
+
+	frames, ts := genVideo(300, 2000, 10, 20)
+	a := NewAutoStitcher(c)
+	t.Cleanup(a.Close)
+	var events []Event
+	a.SetEventHandler(func(e Event) {
+		events = append(events, e)
+	})
+
+	var trains []*Train
+	for i := range frames {
+		trains = append(trains, a.Frame(frames[i], ts[i])...)
+	}
+	trains = append(trains, a.TryStitchAndReset()...)
+	require.NotEmpty(t, events)
+
+	return trains, events
+}
+
+func Test_AutoStitcher_Events(t *testing.T) {
+	c := Config{PixelsPerM: 10, MinSpeedKPH: 10, MaxSpeedKPH: 160, MinLengthM: 10, MaxFrameCountPerSeq: 1500}
+	trains, events := runEvents(t, c)
+	require.Len(t, trains, 1)
+
+	assert.Equal(t, EventSequenceStarted, events[0].Type)
+	assert.InDelta(t, -300, events[0].SpeedPxS, 1)
+	assert.Equal(t, 1, events[0].NFrames)
+
+	last := events[len(events)-1]
+	assert.Equal(t, EventSequenceEnded, last.Type)
+	assert.Equal(t, 1, last.NTrains)
+	assert.Equal(t, trains[0].StartTS, last.StartTS)
+
+	progress := events[1 : len(events)-1]
+	assert.NotEmpty(t, progress)
+	for i, e := range progress {
+		assert.Equal(t, EventSequenceProgress, e.Type)
+		if e.NFrames < 180 {
+			// Train still in the picture.
+			assert.InDelta(t, -300, e.SpeedPxS, 1)
+		}
+		assert.Equal(t, events[0].StartTS, e.StartTS)
+		if i > 0 {
+			assert.GreaterOrEqual(t, e.TS.Sub(progress[i-1].TS), eventProgressInterval)
+			assert.Greater(t, e.NFrames, progress[i-1].NFrames)
+		}
+	}
+}
+
+func Test_AutoStitcher_Events_Rejected(t *testing.T) {
+	c := Config{PixelsPerM: 10, MinSpeedKPH: 10, MaxSpeedKPH: 160, MinLengthM: 1000, MaxFrameCountPerSeq: 1500}
+	trains, events := runEvents(t, c)
+	assert.Empty(t, trains)
+
+	require.GreaterOrEqual(t, len(events), 3)
+	rejected := events[len(events)-2]
+	assert.Equal(t, EventSequenceRejected, rejected.Type)
+	require.NotNil(t, rejected.Err)
+	assert.Equal(t, RejectTooShort, rejected.Err.Reason)
+	seq := rejected.Err.Seq
+	require.NotNil(t, seq)
+	assert.Equal(t, 200, seq.NFrames)
+	assert.Equal(t, DxSummary{Min: 10, Max: 10, Mean: 10, Sum: 2000}, seq.Dx)
+	assert.Equal(t, rejected.StartTS, seq.StartTS)
+	assert.True(t, seq.EndTS.After(seq.StartTS))
+	require.NotNil(t, seq.Preview)
+	assert.LessOrEqual(t, seq.Preview.Bounds().Dx(), previewMaxDimension)
+	assert.LessOrEqual(t, seq.Preview.Bounds().Dy(), previewMaxDimension)
+
+	last := events[len(events)-1]
+	assert.Equal(t, EventSequenceEnded, last.Type)
+	assert.Equal(t, 0, last.NTrains)
+}
+
+func Test_summarize(t *testing.T) {
+	ts := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	seq := sequence{
+		dx:     []int{3, 0, -1, 6},
+		ts:     []time.Time{ts, ts.Add(time.Second), ts.Add(2 * time.Second), ts.Add(3 * time.Second)},
+		frames: []image.Image{nil, nil, image.NewRGBA(image.Rect(0, 0, 1000, 500)), nil},
+	}
+
+	s := summarize(seq)
+	assert.Equal(t, 4, s.NFrames)
+	assert.Equal(t, ts, s.StartTS)
+	assert.Equal(t, ts.Add(3*time.Second), s.EndTS)
+	assert.Equal(t, DxSummary{Min: -1, Max: 6, Mean: 2, Sum: 8, Zeros: 1}, s.Dx)
+	// Middle frame.
+	assert.Equal(t, image.Pt(previewMaxDimension, previewMaxDimension/2), s.Preview.Bounds().Size())
+
+	s = summarize(sequence{})
+	assert.Zero(t, s.NFrames)
+	assert.Nil(t, s.Preview)
+}
+
+func Test_rejectErrors(t *testing.T) {
+	assert.Empty(t, rejectErrors(nil))
+	assert.Empty(t, rejectErrors(errors.New("test")))
+
+	e1 := &RejectError{Reason: RejectTooShort, Err: errors.New("short")}
+	e2 := &RejectError{Reason: RejectTooSlow, Err: errors.New("slow")}
+	assert.Equal(t, []*RejectError{e1}, rejectErrors(e1))
+	assert.Equal(t, []*RejectError{e1, e2}, rejectErrors(errors.Join(e1, errors.New("other"), e2)))
+	assert.ErrorIs(t, errors.Join(e1, e2), e2)
+}
@@ -0,0 +1,288 @@
+package stitch
+
+import (
+	"cmp"
+	"image"
+	"math"
+	"math/rand"
+	"slices"
+)
+
+const (
+	// Number of dominant colors kept in a fingerprint.
+	fingerprintColors = 6
+	// Number of horizontal bands in the vertical color profile of a fingerprint.
+	fingerprintBands = 8
+	// Weight of the dominant colors in Fingerprint.Distance(), the rest is the vertical profile.
+	fingerprintColorsWeight = 0.5
+	// Maximum number of k-means iterations in dominantColors().
+	dominantColorsIter = 20
+	// Seed for the initialization of dominantColors(). Fixed, so that the same image always results in the same
+	// fingerprint.
+	dominantColorsSeed = 1
+)
+
+// WeightedColor is a dominant color of a train.
+type WeightedColor struct {
+	RGB [3]uint8 `json:"rgb"`
+	// Weight is the fraction of the train this color stands for, all weights of a fingerprint sum up to 1.
+	Weight float64 `json:"weight"`
+}
+
+// Fingerprint is a compact description of the colors of a train (i.e. its livery).
+// Trains of the same type (and operator) have similar fingerprints.
+type Fingerprint struct {
+	// Colors are the dominant colors, sorted by weight (highest first).
+	Colors []WeightedColor `json:"colors"`
+	// Profile is the mean color of each horizontal band of the train, from top to bottom.
+	Profile [][3]uint8 `json:"profile"`
+}
+
+// rgbDistance returns the euclidean distance of two colors, normalized to [0, 1].
+func rgbDistance(a, b [3]uint8) float64 {
+	var sq float64
+	for i := range a {
+		d := float64(a[i]) - float64(b[i])
+		sq += d * d
+	}
+	return math.Sqrt(sq/3) / 0xff
+}
+
+// colorsDistance returns the weighted mean distance of each color in a to the closest color in b.
+func colorsDistance(a, b []WeightedColor) float64 {
+	var ret, weights float64
+	for _, ca := range a {
+		closest := 1.
+		for _, cb := range b {
+			closest = math.Min(closest, rgbDistance(ca.RGB, cb.RGB))
+		}
+		ret += ca.Weight * closest
+		weights += ca.Weight
+	}
+	if weights == 0 {
+		return 1
+	}
+	return ret / weights
+}
+
+// Distance compares two fingerprints. Returns a value in [0, 1], 0 means identical.
+func (f *Fingerprint) Distance(g *Fingerprint) float64 {
+	if len(f.Colors) == 0 || len(g.Colors) == 0 {
+		return 1
+	}
+	colors := (colorsDistance(f.Colors, g.Colors) + colorsDistance(g.Colors, f.Colors)) / 2
+
+	profile := 1.
+	if len(f.Profile) == len(g.Profile) && len(f.Profile) > 0 {
+		profile = 0
+		for i := range f.Profile {
+			profile += rgbDistance(f.Profile[i], g.Profile[i])
+		}
+		profile /= float64(len(f.Profile))
+	}
+
+	return fingerprintColorsWeight*colors + (1-fingerprintColorsWeight)*profile
+}
+
+// MeanColor returns the mean color of the profile, see MinDistance().
+func (f *Fingerprint) MeanColor() [3]float64 {
+	var ret [3]float64
+	for _, c := range f.Profile {
+		for i := range ret {
+			ret[i] += float64(c[i])
+		}
+	}
+	if len(f.Profile) > 0 {
+		for i := range ret {
+			ret[i] /= float64(len(f.Profile))
+		}
+	}
+	return ret
+}
+
+// MinDistance returns a lower bound for the Distance() of two fingerprints, given only the squared euclidean distance
+// of their mean colors (see MeanColor()). This allows to pre-filter fingerprints without comparing them one by one.
+func MinDistance(meanColorSqDist float64) float64 {
+	// The distance of the means is at most the mean of the distances (of the profile bands).
+	return (1 - fingerprintColorsWeight) * math.Sqrt(meanColorSqDist/3) / 0xff
+}
+
+// MaxMeanColorSqDistance is the inverse of MinDistance(): fingerprints whose mean colors have a larger squared distance
+// are further apart than distance.
+func MaxMeanColorSqDistance(distance float64) float64 {
+	d := distance / (1 - fingerprintColorsWeight) * 0xff
+	return 3 * d * d
+}
+
+func sqDistance(a, b [3]float64) float64 {
+	var ret float64
+	for i := range a {
+		d := a[i] - b[i]
+		ret += d * d
+	}
+	return ret
+}
+
+// nearest returns the index of the center closest to p.
+func nearest(p [3]float64, centers [][3]float64) int {
+	ret, retDist := 0, math.Inf(1)
+	for i, c := range centers {
+		d := sqDistance(p, c)
+		if d < retDist {
+			ret, retDist = i, d
+		}
+	}
+	return ret
+}
+
+// dominantColors clusters the colors of the (not masked) pixels of img into (at most) k clusters using k-means, and
+// returns their means, sorted by weight (highest first).
+// Unlike palettor (which is used for the GIF palette), the initialization is deterministic.
+func dominantColors(img image.Image, k int) []WeightedColor {
+	bounds := img.Bounds()
+	px := make([][3]float64, 0, bounds.Dx()*bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			if a == 0 {
+				// Masked.
+				continue
+			}
+			// Colors are premultiplied.
+			px = append(px, [3]float64{
+				float64(r) / float64(a) * 0xff,
+				float64(g) / float64(a) * 0xff,
+				float64(b) / float64(a) * 0xff,
+			})
+		}
+	}
+	if len(px) == 0 {
+		return nil
+	}
+
+	// k-means++ initialization.
+	rnd := rand.New(rand.NewSource(dominantColorsSeed)) // #nosec G404
+	centers := [][3]float64{px[rnd.Intn(len(px))]}
+	dists := make([]float64, len(px))
+	for len(centers) < k {
+		var sum float64
+		for i, p := range px {
+			d := sqDistance(p, centers[len(centers)-1])
+			if len(centers) == 1 || d < dists[i] {
+				dists[i] = d
+			}
+			sum += dists[i]
+		}
+		if sum == 0 {
+			// Fewer distinct colors than k.
+			break
+		}
+		target := rnd.Float64() * sum
+		i := 0
+		for ; i < len(px)-1; i++ {
+			target -= dists[i]
+			if target < 0 {
+				break
+			}
+		}
+		centers = append(centers, px[i])
+	}
+
+	assign := make([]int, len(px))
+	for iter := range dominantColorsIter {
+		changed := false
+		for i, p := range px {
+			n := nearest(p, centers)
+			if iter == 0 || n != assign[i] {
+				assign[i] = n
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+
+		sums := make([][3]float64, len(centers))
+		counts := make([]int, len(centers))
+		for i, p := range px {
+			for c := range p {
+				sums[assign[i]][c] += p[c]
+			}
+			counts[assign[i]]++
+		}
+		for j := range centers {
+			if counts[j] == 0 {
+				continue
+			}
+			for c := range centers[j] {
+				centers[j][c] = sums[j][c] / float64(counts[j])
+			}
+		}
+	}
+
+	counts := make([]int, len(centers))
+	for _, a := range assign {
+		counts[a]++
+	}
+	ret := []WeightedColor{}
+	for j, c := range centers {
+		if counts[j] == 0 {
+			continue
+		}
+		var rgb [3]uint8
+		for i := range rgb {
+			rgb[i] = uint8(math.Round(min(max(c[i], 0), 0xff)))
+		}
+		ret = append(ret, WeightedColor{RGB: rgb, Weight: float64(counts[j]) / float64(len(px))})
+	}
+	slices.SortStableFunc(ret, func(a, b WeightedColor) int {
+		return cmp.Compare(b.Weight, a.Weight)
+	})
+	return ret
+}
+
+// newFingerprint computes the fingerprint of a train from a thumbnail of its image (see extractPalette()).
+// imgWidth is the width of the full image.
+// If cars were found, the profile only covers them, and not the background at the start and end of the image.
+func newFingerprint(thumb image.Image, imgWidth int, cars []Car) *Fingerprint {
+	ret := Fingerprint{
+		Colors: dominantColors(thumb, fingerprintColors),
+	}
+
+	bounds := thumb.Bounds()
+	x0, x1 := bounds.Min.X, bounds.Max.X
+	if len(cars) > 0 && imgWidth > 0 {
+		scale := float64(bounds.Dx()) / float64(imgWidth)
+		x0 = bounds.Min.X + int(float64(cars[0].StartPx)*scale)
+		x1 = max(bounds.Min.X+int(float64(cars[len(cars)-1].EndPx)*scale), x0+1)
+	}
+	for band := range fingerprintBands {
+		y0 := bounds.Min.Y + bounds.Dy()*band/fingerprintBands
+		y1 := max(bounds.Min.Y+bounds.Dy()*(band+1)/fingerprintBands, y0+1)
+		var acc [3]float64
+		var n float64
+		for y := y0; y < y1 && y < bounds.Max.Y; y++ {
+			for x := x0; x < x1 && x < bounds.Max.X; x++ {
+				r, g, b, a := thumb.At(x, y).RGBA()
+				if a == 0 {
+					// Masked.
+					continue
+				}
+				// Colors are premultiplied.
+				acc[0] += float64(r) / float64(a)
+				acc[1] += float64(g) / float64(a)
+				acc[2] += float64(b) / float64(a)
+				n++
+			}
+		}
+		var c [3]uint8
+		if n > 0 {
+			for i := range c {
+				c[i] = uint8(math.Round(acc[i] / n * 0xff))
+			}
+		}
+		ret.Profile = append(ret.Profile, c)
+	}
+
+	return &ret
+}
@@ -0,0 +1,87 @@
+package stitch
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// genLivery draws a train with a top and a bottom color on a gray background, with some noise.
+func genLivery(seed int64, top, bottom color.RGBA) *image.RGBA {
+	const w, h = 600, 80
+	rnd := rand.New(rand.NewSource(seed))
+	noisy := func(c color.RGBA) color.RGBA {
+		n := func(v uint8) uint8 { return uint8(min(max(int(v)+rnd.Intn(21)-10, 0), 0xff)) }
+		return color.RGBA{n(c.R), n(c.G), n(c.B), 0xff}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			c := color.RGBA{128, 128, 128, 0xff}
+			if x >= 50 && x < w-50 && y >= 10 {
+				c = top
+				if y >= 45 {
+					c = bottom
+				}
+			}
+			img.SetRGBA(x, y, noisy(c))
+		}
+	}
+	return img
+}
+
+func fingerprintOf(t *testing.T, img *image.RGBA, cars []Car) *Fingerprint {
+	_, thumb, err := extractPalette(img)
+	require.NoError(t, err)
+	fp := newFingerprint(thumb, img.Rect.Dx(), cars)
+	require.NotNil(t, fp)
+	return fp
+}
+
+func Test_Fingerprint(t *testing.T) {
+	red := color.RGBA{200, 20, 30, 0xff}
+	white := color.RGBA{240, 240, 240, 0xff}
+	blue := color.RGBA{20, 40, 200, 0xff}
+	yellow := color.RGBA{240, 220, 20, 0xff}
+	cars := []Car{{StartPx: 50, EndPx: 550}}
+
+	a := fingerprintOf(t, genLivery(1, red, white), cars)
+	b := fingerprintOf(t, genLivery(2, red, white), cars)
+	flipped := fingerprintOf(t, genLivery(3, white, red), cars)
+	other := fingerprintOf(t, genLivery(4, blue, yellow), cars)
+
+	assert.LessOrEqual(t, len(a.Colors), fingerprintColors)
+	var sum float64
+	for _, c := range a.Colors {
+		sum += c.Weight
+	}
+	assert.InDelta(t, 1, sum, 1e-9)
+	require.Len(t, a.Profile, fingerprintBands)
+	// The first band is background, the second red, and the last one white.
+	assert.InDelta(t, 200, int(a.Profile[1][0]), 15)
+	assert.InDelta(t, 20, int(a.Profile[1][1]), 15)
+	assert.InDelta(t, 240, int(a.Profile[fingerprintBands-1][1]), 15)
+
+	// Deterministic.
+	assert.Equal(t, a, fingerprintOf(t, genLivery(1, red, white), cars))
+
+	assert.InDelta(t, 0, a.Distance(a), 1e-9)
+	assert.InDelta(t, a.Distance(b), b.Distance(a), 1e-9)
+	assert.Less(t, a.Distance(b), 0.05)
+	// Same colors, but different layout.
+	assert.Less(t, a.Distance(b), a.Distance(flipped))
+	assert.Less(t, a.Distance(flipped), a.Distance(other))
+
+	// MinDistance() is a lower bound.
+	for _, f := range []*Fingerprint{b, flipped, other} {
+		ma, mf := a.MeanColor(), f.MeanColor()
+		sq := sqDistance(ma, mf)
+		assert.LessOrEqual(t, MinDistance(sq), a.Distance(f))
+		assert.InDelta(t, sq, MaxMeanColorSqDistance(MinDistance(sq)), 1e-6)
+	}
+}
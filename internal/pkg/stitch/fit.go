@@ -5,33 +5,125 @@ import (
 	"math"
 	"time"
 
-	"github.com/rs/zerolog/log"
+	"github.com/rs/zerolog"
+	"gonum.org/v1/gonum/mat"
 	"jo-m.ch/go/trainbot/pkg/ransac"
 )
 
-const modelNParams = 2
+// z-score for 95% confidence intervals.
+const ci95Z = 1.96
 
-// model computes velocity at a given time, assuming constant acceleration.
-func model(t float64, params []float64) float64 {
-	v0 := params[0]
-	a := params[1]
-	return v0 + a*t
+// fitResult is the result of fitting a MotionModel to a sequence.
+type fitResult struct {
+	model  MotionModel
+	params []float64
+
+	// Fitted dx values, same length as the input.
+	dx []int
+	// Estimated length [px], always positive.
+	ds float64
+	// residuals[i] is the measured minus the fitted speed [px/s] of the i-th frame.
+	residuals []float64
+	// Number of frames with a residual below the RANSAC inlier threshold.
+	nInliers int
+	// Root mean square of the residuals of the inliers [px/s].
+	rmsInliers float64
+	// Covariance matrix of params, nil if it could not be estimated (see covErr).
+	cov    *mat.SymDense
+	covErr error
+	// Half width of the 95% confidence interval of ds [px], NaN if unknown.
+	dsCI float64
+	// Bayesian information criterion, used to select the model.
+	bic float64
+}
+
+// speed returns the fitted speed [px/s] at time t [s] since the start of the sequence.
+func (f *fitResult) speed(t float64) float64 {
+	return f.model.Speed(t, f.params)
+}
+
+// accel returns the fitted acceleration [px/s^2] at time t [s] since the start of the sequence.
+func (f *fitResult) accel(t float64) float64 {
+	return accel(f.model, f.params, t)
+}
+
+// speedCI returns the half width of the 95% confidence interval of the speed [px/s] at time t [s], NaN if unknown.
+func (f *fitResult) speedCI(t float64) float64 {
+	g := gradient(func(params []float64) float64 {
+		return f.model.Speed(t, params)
+	}, f.params)
+	return ci95Z * math.Sqrt(propagate(f.cov, g))
+}
+
+// gradient computes the gradient of fn at params numerically.
+func gradient(fn func(params []float64) float64, params []float64) []float64 {
+	ret := make([]float64, len(params))
+	p := make([]float64, len(params))
+	for k := range params {
+		copy(p, params)
+		h := 1e-6 * math.Max(1, math.Abs(params[k]))
+		p[k] = params[k] + h
+		f1 := fn(p)
+		p[k] = params[k] - h
+		f0 := fn(p)
+		ret[k] = (f1 - f0) / (2 * h)
+	}
+	return ret
+}
+
+// propagate computes the variance of a function with gradient g, given the covariance of its inputs.
+// Returns NaN if cov is nil.
+func propagate(cov *mat.SymDense, g []float64) float64 {
+	if cov == nil {
+		return math.NaN()
+	}
+	v := mat.NewVecDense(len(g), g)
+	return math.Max(mat.Inner(v, cov, v), 0)
+}
+
+// covariance estimates the covariance matrix of the params of a least squares fit of m
+// to the data points (t, v), by linearizing the model.
+func covariance(m MotionModel, params []float64, t, v []float64) (*mat.SymDense, error) {
+	n, k := len(t), len(params)
+	if n <= k {
+		return nil, errors.New("not enough data points to estimate covariance")
+	}
+
+	j := mat.NewDense(n, k, nil)
+	var rss float64
+	for i := range t {
+		j.SetRow(i, gradient(func(params []float64) float64 {
+			return m.Speed(t[i], params)
+		}, params))
+		r := v[i] - m.Speed(t[i], params)
+		rss += r * r
+	}
+
+	// cov = sigma^2 * (J^T J)^-1
+	var jtj mat.SymDense
+	jtj.SymOuterK(1, j.T())
+	var chol mat.Cholesky
+	if ok := chol.Factorize(&jtj); !ok {
+		return nil, errors.New("singular matrix, unable to estimate covariance")
+	}
+	var cov mat.SymDense
+	err := chol.InverseTo(&cov)
+	if err != nil {
+		return nil, err
+	}
+	cov.ScaleSym(rss/float64(n-k), &cov)
+
+	return &cov, nil
 }
 
-// Returns fitted dx values. Length will always be the same as the input.
+// Fits each of the models to the sequence, and returns the best fit.
 // Does not modify seq.
-// Also returns estimated length [px], v0 [px/s] and acceleration [px/s^2].
-func fitDx(seq sequence, maxSpeedPxS float64) ([]int, float64, float64, float64, error) {
+func fitDx(logger *zerolog.Logger, seq sequence, maxSpeedPxS float64, models []MotionModel) (*fitResult, error) {
 	start := time.Now()
 	defer func() {
-		log.Trace().Dur("dur", time.Since(start)).Msg("fitDx() duration")
+		logger.Trace().Dur("dur", time.Since(start)).Msg("fitDx() duration")
 	}()
 
-	// Sanity checks.
-	if len(seq.dx) < (modelNParams+1)*3 {
-		return nil, 0, 0, 0, errors.New("sequence length too short")
-	}
-
 	// Prepare data for fitting.
 	n := len(seq.dx)
 	dt := make([]float64, n) // Time since last data point [s].
@@ -47,25 +139,57 @@ func fitDx(seq sequence, maxSpeedPxS float64) ([]int, float64, float64, float64,
 		v[i] = float64(seq.dx[i]) / dt[i]
 	}
 
+	var best *fitResult
+	var err error
+	for _, m := range models {
+		var res *fitResult
+		res, err = fitModel(logger, m, seq.dx, dt, t, v, maxSpeedPxS)
+		if err != nil {
+			logger.Debug().Err(err).Str("model", m.Name()).Msg("unable to fit model")
+			seq.trace.addFit(traceFit{Model: m, T: t, V: v, Err: err.Error()})
+			continue
+		}
+
+		logger.Debug().Str("model", m.Name()).Float64("bic", res.bic).Int("nInliers", res.nInliers).Msg("fitted model")
+		seq.trace.addFit(traceFit{Model: m, T: t, V: v, Params: res.params, BIC: res.bic, NInliers: res.nInliers})
+		if best == nil || res.bic < best.bic {
+			best = res
+		}
+	}
+	if best == nil {
+		return nil, err
+	}
+	seq.trace.add(time.Time{}, "fit", "selected motion model %s (BIC %.1f, %d of %d inliers)", best.model.Name(), best.bic, best.nInliers, n)
+
+	return best, nil
+}
+
+func fitModel(logger *zerolog.Logger, m MotionModel, dx []int, dt, t, v []float64, maxSpeedPxS float64) (*fitResult, error) {
+	// Sanity checks.
+	nParams := m.NParams()
+	if len(dx) < (nParams+1)*3 {
+		return nil, errors.New("sequence length too short")
+	}
+
 	// Fit.
 	params := ransac.MetaParams{
-		MinModelPoints:  modelNParams + 1,
+		MinModelPoints:  nParams + 1,
 		MaxIter:         25,
 		MinInliers:      len(v) / 2,
 		InlierThreshold: maxSpeedPxS * 0.05, // 5% of max speed.
 		Seed:            0,
 	}
-	log.Debug().Floats64("t", t).Floats64("v", v).Ints("dx", seq.dx).Interface("params", params).Msg("RANSAC")
-	fit, err := ransac.Ransac(t, v, model, modelNParams, params)
+	logger.Debug().Str("model", m.Name()).Floats64("t", t).Floats64("v", v).Ints("dx", dx).Interface("params", params).Msg("RANSAC")
+	fit, err := ransac.Ransac(t, v, m.Speed, nParams, params)
 	if err != nil {
-		return nil, 0, 0, 0, err
+		return nil, err
 	}
 
 	// Generate dx from fit.
-	dxFit := make([]int, n)
+	dxFit := make([]int, len(dx))
 	var roundErr float64 // Sum of values we have rounded away.
-	for i := range seq.dx {
-		dxF := model(t[i], fit.X) * dt[i]
+	for i := range dx {
+		dxF := m.Speed(t[i], fit.X) * dt[i]
 		dxRound := math.Round(dxF)
 		roundErr += dxF - dxRound
 
@@ -77,13 +201,45 @@ func fitDx(seq sequence, maxSpeedPxS float64) ([]int, float64, float64, float64,
 		dxFit[i] = int(dxRound)
 	}
 
-	log.Debug().Floats64("fit", fit.X).Ints("dxFit", dxFit).Float64("roundErr", roundErr).Msg("RANSAC results")
+	logger.Debug().Str("model", m.Name()).Floats64("fit", fit.X).Ints("dxFit", dxFit).Float64("roundErr", roundErr).Msg("RANSAC results")
 
-	v0 := fit.X[0]
-	a := fit.X[1]
-	ds := v0*t[len(t)-1] + 0.5*a*t[len(t)-1]*t[len(t)-1]
-	if ds < 0 {
-		ds = -ds
+	// Residuals, truncated at the inlier threshold so that outliers do not dominate
+	// and models with different inlier sets can be compared.
+	residuals := make([]float64, len(v))
+	var tIn, vIn []float64
+	var rss, rssIn float64
+	for i := range v {
+		residuals[i] = v[i] - m.Speed(t[i], fit.X)
+		r := math.Min(math.Abs(residuals[i]), params.InlierThreshold)
+		if r < params.InlierThreshold {
+			tIn = append(tIn, t[i])
+			vIn = append(vIn, v[i])
+			rssIn += r * r
+		}
+		rss += r * r
 	}
-	return dxFit, ds, v0, a, nil
+
+	// Uncertainty, estimated from the inliers only.
+	// The fit is still usable without it.
+	cov, covErr := covariance(m, fit.X, tIn, vIn)
+
+	tEnd := t[len(t)-1]
+	ds := math.Abs(integrateSpeed(m, fit.X, 0, tEnd))
+	dsGrad := gradient(func(params []float64) float64 {
+		return integrateSpeed(m, params, 0, tEnd)
+	}, fit.X)
+
+	return &fitResult{
+		model:      m,
+		params:     fit.X,
+		dx:         dxFit,
+		ds:         ds,
+		residuals:  residuals,
+		nInliers:   len(tIn),
+		rmsInliers: math.Sqrt(rssIn / float64(max(len(tIn), 1))),
+		cov:        cov,
+		covErr:     covErr,
+		dsCI:       ci95Z * math.Sqrt(propagate(cov, dsGrad)),
+		bic:        bic(len(v), nParams, rss),
+	}, nil
 }
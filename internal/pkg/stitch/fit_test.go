@@ -2,9 +2,11 @@ package stitch
 
 import (
 	"image"
+	"math"
 	"testing"
 	"time"
 
+	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -40,8 +42,9 @@ func Test_fitDx_simple(t *testing.T) {
 		34, 35, 35, 35, 35, 35, 35, 35, 35, 35, 1, 35, 35, 35, 35, 35, 35, 35, 35, 36, 35, 36, 35, 35, 35, 35, 36, 35, 36, 21, 35, 35, 36, 35, 35, 36, 36, 36, 35, 36, 35, 36, 35, 36, 35, 36, 36, 36, 36, 36, 36, 36, 36, 36, 35, 35, 36, 36, 36, 36, 36, 36, 36, 35, 36, 36, 36, 36, 36, 36, 36, 36, 36, 36, 36, 36, 36, 36, 36, 36, 36, 36, 36, 36, 36, 36, 36, 36, 36, 36, 36, 36, 37, 37, 36, 37, 37, 37, 37, 37, 36, 37, 36, 37, 37, 37, 37, 37, 37, 37, 36, 36, 36, 37, 37, 37, 36, 36, 36, 24,
 	}
 
-	res, ds, v0, a, err := fitDx(genTestSeq(dx), 35*fps*2)
+	fit, err := fitDx(&log.Logger, genTestSeq(dx), 35*fps*2, []MotionModel{constantAccel{}})
 	require.NoError(t, err)
+	res, ds, v0, a := fit.dx, fit.ds, fit.params[0], fit.params[1]
 	assert.Equal(t, len(dx), len(res))
 	// Found to be good by looking at plot.
 	truth := []int{
@@ -72,8 +75,9 @@ func Test_fitDx_difficult(t *testing.T) {
 		35, 42, 35, 41, 36, 41, 17, 0, 17, 36, 41, 36, 36, 35,
 	}
 
-	res, ds, v0, a, err := fitDx(genTestSeq(dx), 35*fps*2)
+	fit, err := fitDx(&log.Logger, genTestSeq(dx), 35*fps*2, []MotionModel{constantAccel{}})
 	require.NoError(t, err)
+	res, ds, v0, a := fit.dx, fit.ds, fit.params[0], fit.params[1]
 	assert.Equal(t, len(dx), len(res))
 	// Found to be good by looking at plot.
 	truth := []int{
@@ -91,8 +95,9 @@ func Test_fitDx_negative(t *testing.T) {
 		-9, -9, -9, -9, -9, -9, -9, -9, -9, -9, -10, -10, -10, -10, -10, -10, -10, -10, -10, -10,
 	}
 
-	res, ds, v0, a, err := fitDx(genTestSeq(dx), 10*fps*2)
+	fit, err := fitDx(&log.Logger, genTestSeq(dx), 10*fps*2, []MotionModel{constantAccel{}})
 	require.NoError(t, err)
+	res, ds, v0, a := fit.dx, fit.ds, fit.params[0], fit.params[1]
 	assert.Equal(t, len(dx), len(res))
 	truth := []int{-10, -10, -10, -10, -10, -10, -10, -10, -10, -10, -10, -10, -10, -10, -10, -10, -10, -10, -10, -10}
 	assert.Equal(t, truth, res)
@@ -107,9 +112,43 @@ func Test_fitDx_rounding(t *testing.T) {
 		10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10,
 	}
 
-	res, _, _, _, err := fitDx(genTestSeq(dx), 10*fps*2)
+	fit, err := fitDx(&log.Logger, genTestSeq(dx), 10*fps*2, []MotionModel{constantAccel{}})
 	require.NoError(t, err)
+	res := fit.dx
 	assert.Equal(t, len(dx), len(res))
 	truth := []int{10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10}
 	assert.Equal(t, truth, res)
 }
+
+func Test_fitDx_uncertainty(t *testing.T) {
+	// Exact data.
+	dx := repeat(10, 100)
+	fit, err := fitDx(&log.Logger, genTestSeq(dx), 80*fps, []MotionModel{constantSpeed{}})
+	require.NoError(t, err)
+	assert.Equal(t, len(dx), fit.nInliers)
+	assert.InDelta(t, 0, fit.rmsInliers, 1e-6)
+	assert.InDelta(t, 0, fit.dsCI, 1e-6)
+	assert.InDelta(t, 0, fit.speedCI(1), 1e-6)
+
+	// Noisy data.
+	for i := 0; i < len(dx); i += 2 {
+		dx[i]--
+		dx[i+1]++
+	}
+	fit, err = fitDx(&log.Logger, genTestSeq(dx), 80*fps, []MotionModel{constantSpeed{}})
+	require.NoError(t, err)
+	assert.Equal(t, len(dx), fit.nInliers)
+	assert.InDelta(t, fps, fit.rmsInliers, 0.1)
+	// 1.96 * sigma / sqrt(n).
+	assert.InDelta(t, 1.96*fps/10, fit.speedCI(1), 0.1)
+	assert.InDelta(t, fit.speedCI(1)*100/fps, fit.dsCI, 0.1)
+
+	// More measurements, less uncertainty.
+	fit2, err := fitDx(&log.Logger, genTestSeq(append(dx, dx...)), 80*fps, []MotionModel{constantSpeed{}})
+	require.NoError(t, err)
+	assert.Less(t, fit2.speedCI(1), fit.speedCI(1))
+
+	// Unknown covariance.
+	fit.cov = nil
+	assert.True(t, math.IsNaN(fit.speedCI(1)))
+}
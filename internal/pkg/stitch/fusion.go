@@ -0,0 +1,184 @@
+package stitch
+
+import (
+	"image"
+	"slices"
+
+	"jo-m.ch/go/trainbot/pkg/imutil"
+)
+
+// Names of the available fusion modes, see Config.Fusion.
+const (
+	// FusionLast takes each pixel from the last frame which covers it.
+	FusionLast = "last"
+	// FusionMean averages all frames which cover a pixel, this reduces sensor noise (e.g. at night).
+	FusionMean = "mean"
+	// FusionMedian takes the median of all frames which cover a pixel, this also removes rain and snow flakes.
+	// Like the mean, it is weighted by the mask.
+	FusionMedian = "median"
+)
+
+// FusionNames contains all valid values for Config.Fusion.
+var FusionNames = []string{
+	FusionLast,
+	FusionMean,
+	FusionMedian,
+}
+
+// maskAlpha returns the alpha value (0..0xff) of a mask pixel.
+func maskAlpha(mask image.Image, x, y int) uint32 {
+	switch m := mask.(type) {
+	case *image.RGBA:
+		return uint32(m.Pix[m.PixOffset(x, y)+3])
+	case *image.Alpha:
+		return uint32(m.Pix[m.PixOffset(x, y)])
+	default:
+		_, _, _, a := mask.At(x, y).RGBA()
+		return a >> 8
+	}
+}
+
+// observation is the value of a pixel in one frame, weighted by the alpha of the mask (0..0xff).
+type observation struct {
+	v uint8
+	w uint32
+}
+
+// fusionFrame is a frame prepared for fuse().
+type fusionFrame struct {
+	img  *image.RGBA
+	mask image.Image
+}
+
+// fuse combines all frames which overlap at each pixel of img, with the given fusion mode (FusionMean or
+// FusionMedian). This is the counterpart of drawing the frames one over the other in stitch(), which takes each pixel
+// from the last frame. Frame i is placed at the same position as there: pixel (x, y) of the frame ends up at
+// (x + offX[i], y + offY) in img, and only the part srcRects[i] of it is used.
+// Works column by column, so that only the frames which overlap the current column need to be kept converted (and
+// sheared) in memory.
+func fuse(img *image.RGBA, frames []image.Image, srcRects []image.Rectangle, offX []int, offY int, shear []float64, mask image.Image, fusion string) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+
+	// Frames sorted by their left edge in img.
+	order := make([]int, len(frames))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int {
+		return (srcRects[a].Min.X + offX[a]) - (srcRects[b].Min.X + offX[b])
+	})
+
+	prepared := map[int]fusionFrame{}
+	prepare := func(i int) fusionFrame {
+		if f, ok := prepared[i]; ok {
+			return f
+		}
+		f := fusionFrame{mask: mask}
+		frame := loadFrame(frames[i])
+		if shear != nil && shear[i] != 0 {
+			f.img = imutil.Shear(frame, shear[i])
+			if mask != nil {
+				f.mask = imutil.Shear(mask, shear[i])
+			}
+		} else if rgba, ok := frame.(*image.RGBA); ok {
+			f.img = rgba
+		} else {
+			f.img = imutil.ToRGBA(frame)
+			f.img.Rect = frame.Bounds()
+		}
+		prepared[i] = f
+		return f
+	}
+
+	// Observations of each row in the current column, weighted by the mask.
+	sums := make([][3]uint32, h)
+	weights := make([]uint32, h)
+	values := make([][3][]observation, h)
+
+	first := 0
+	for x := range w {
+		for y := range h {
+			sums[y] = [3]uint32{}
+			weights[y] = 0
+			for c := range values[y] {
+				values[y][c] = values[y][c][:0]
+			}
+		}
+
+		// Frames which end left of this column are not needed any more.
+		for first < len(order) && srcRects[order[first]].Max.X+offX[order[first]] <= x {
+			delete(prepared, order[first])
+			first++
+		}
+		for _, i := range order[first:] {
+			r := srcRects[i]
+			sx := x - offX[i]
+			if sx < r.Min.X {
+				break
+			}
+			if sx >= r.Max.X {
+				continue
+			}
+
+			f := prepare(i)
+			for y := range h {
+				sy := y - offY
+				if sy < r.Min.Y || sy >= r.Max.Y {
+					continue
+				}
+				a := uint32(0xff)
+				if f.mask != nil {
+					a = maskAlpha(f.mask, sx, sy)
+					if a == 0 {
+						continue
+					}
+				}
+				p := f.img.PixOffset(sx, sy)
+				for c := range 3 {
+					sums[y][c] += uint32(f.img.Pix[p+c]) * a
+					values[y][c] = append(values[y][c], observation{f.img.Pix[p+c], a})
+				}
+				weights[y] += a
+			}
+		}
+
+		for y := range h {
+			if weights[y] == 0 {
+				continue
+			}
+			p := img.PixOffset(img.Rect.Min.X+x, img.Rect.Min.Y+y)
+			for c := range 3 {
+				if fusion == FusionMedian {
+					img.Pix[p+c] = median(values[y][c])
+				} else {
+					img.Pix[p+c] = uint8((sums[y][c] + weights[y]/2) / weights[y])
+				}
+			}
+			img.Pix[p+3] = 0xff
+		}
+	}
+}
+
+// median returns the weighted median of values, which are sorted in place: the value at which half of the total weight
+// is reached. If this is exactly between two values, their mean is returned.
+func median(values []observation) uint8 {
+	slices.SortFunc(values, func(a, b observation) int {
+		return int(a.v) - int(b.v)
+	})
+
+	var total uint32
+	for _, o := range values {
+		total += o.w
+	}
+	var sum uint32
+	for i, o := range values {
+		sum += o.w
+		if 2*sum == total && i+1 < len(values) {
+			return uint8((uint16(o.v) + uint16(values[i+1].v) + 1) / 2)
+		}
+		if 2*sum >= total {
+			return o.v
+		}
+	}
+	return values[len(values)-1].v
+}
@@ -0,0 +1,159 @@
+package stitch
+
+import (
+	"image"
+	"math"
+	"slices"
+)
+
+const (
+	// Frames with a cosine similarity to the idle background of at least this are considered to show no train.
+	gapMinBgCos = 0.98
+	// Frames are subsampled by this factor in both directions before comparing them to the idle background.
+	bgCosScale = 4
+	// Minimum number of consecutive background frames to split a sequence.
+	gapMinBgFrames = 3
+	// Window size (number of frames before and after) to detect jumps in dx.
+	gapDxWindow = 9
+	// Minimum ratio between the median dx before and after a point to be considered a jump.
+	gapMinDxRatio = 1.5
+	// Minimum absolute difference between the median dx before and after a point to be considered a jump,
+	// so that quantization does not trigger jumps at low speeds.
+	gapMinDxDiff = 3
+)
+
+// subsample returns every scale-th pixel of img in both directions.
+func subsample(img *image.RGBA, scale int) *image.RGBA {
+	b := img.Rect
+	ret := image.NewRGBA(image.Rect(0, 0, (b.Dx()+scale-1)/scale, (b.Dy()+scale-1)/scale))
+	for y := range ret.Rect.Dy() {
+		src := img.PixOffset(b.Min.X, b.Min.Y+y*scale)
+		dst := ret.PixOffset(0, y)
+		for x := range ret.Rect.Dx() {
+			copy(ret.Pix[dst+x*4:dst+x*4+4], img.Pix[src+x*scale*4:src+x*scale*4+4])
+		}
+	}
+	return ret
+}
+
+// segment is a half-open range [start, end) of frame indices in a sequence.
+type segment struct {
+	start, end int
+}
+
+func medianAbs(dx []int) float64 {
+	abs := make([]float64, len(dx))
+	for i, x := range dx {
+		abs[i] = math.Abs(float64(x))
+	}
+	slices.Sort(abs)
+	return abs[len(abs)/2]
+}
+
+// findDxJumps finds indices at which the magnitude of dx changes abruptly,
+// which means that a different object (i.e. another train) is moving in front of the camera.
+func findDxJumps(dx []int) []int {
+	var jumps []int
+
+	// Of a run of candidates, only keep the point with the highest ratio.
+	// The ratio is constant while the jump is within the windows, so we take the middle of that plateau.
+	bestStart, bestEnd, bestRatio := -1, -1, 0.
+	for i := gapDxWindow; i <= len(dx)-gapDxWindow; i++ {
+		before := medianAbs(dx[i-gapDxWindow : i])
+		after := medianAbs(dx[i : i+gapDxWindow])
+
+		ratio := math.Max(before, after) / math.Max(math.Min(before, after), 1)
+		if ratio < gapMinDxRatio || math.Abs(before-after) < gapMinDxDiff {
+			if bestStart >= 0 {
+				jumps = append(jumps, (bestStart+bestEnd)/2)
+				bestStart, bestEnd, bestRatio = -1, -1, 0
+			}
+			continue
+		}
+
+		if ratio > bestRatio {
+			bestStart, bestEnd, bestRatio = i, i, ratio
+		} else if ratio == bestRatio && bestEnd == i-1 {
+			bestEnd = i
+		}
+	}
+	if bestStart >= 0 {
+		jumps = append(jumps, (bestStart+bestEnd)/2)
+	}
+
+	return jumps
+}
+
+// findSegments splits a sequence at gaps between trains.
+// Gaps are detected as runs of frames which look like the idle background,
+// and as abrupt jumps in dx (e.g. a locomotive following a train at a different speed).
+// Returns a single segment covering the whole sequence if no gaps were found.
+func findSegments(seq sequence) []segment {
+	n := len(seq.dx)
+	var segs []segment
+
+	// Split at background frames.
+	start := 0
+	for i := 0; i < n; {
+		if seq.bgCos[i] < gapMinBgCos {
+			i++
+			continue
+		}
+
+		runStart := i
+		for i < n && seq.bgCos[i] >= gapMinBgCos {
+			i++
+		}
+		if i-runStart < gapMinBgFrames {
+			continue
+		}
+
+		if runStart > start {
+			segs = append(segs, segment{start, runStart})
+		}
+		start = i
+	}
+	if start < n {
+		segs = append(segs, segment{start, n})
+	}
+
+	// Split at jumps in dx.
+	var ret []segment
+	for _, seg := range segs {
+		start := seg.start
+		for _, jump := range findDxJumps(seq.dx[seg.start:seg.end]) {
+			ret = append(ret, segment{start, seg.start + jump})
+			start = seg.start + jump
+		}
+		ret = append(ret, segment{start, seg.end})
+	}
+
+	return ret
+}
+
+// sub returns the part of the sequence within seg.
+// Leading frames without movement are dropped, returns false if nothing is left.
+func (s *sequence) sub(seg segment) (sequence, bool) {
+	for seg.start < seg.end && s.dx[seg.start] == 0 {
+		seg.start++
+	}
+	if seg.start == seg.end {
+		return sequence{}, false
+	}
+
+	ret := *s
+	if seg.start > 0 {
+		ts := s.ts[seg.start-1]
+		ret.startTS = &ts
+	}
+	ret.frames = s.frames[seg.start:seg.end]
+	ret.dx = s.dx[seg.start:seg.end]
+	ret.ts = s.ts[seg.start:seg.end]
+	ret.cos = s.cos[seg.start:seg.end]
+	ret.bgCos = s.bgCos[seg.start:seg.end]
+	if s.full != nil {
+		ret.full = s.full[min(seg.start, len(s.full)):min(seg.end, len(s.full))]
+	}
+
+	return ret, true
+}
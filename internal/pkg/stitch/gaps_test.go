@@ -0,0 +1,123 @@
+package stitch
+
+import (
+	"image"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"jo-m.ch/go/trainbot/pkg/imutil"
+)
+
+func repeat[T any](v T, n int) []T {
+	ret := make([]T, n)
+	for i := range ret {
+		ret[i] = v
+	}
+	return ret
+}
+
+func Test_findDxJumps(t *testing.T) {
+	assert.Empty(t, findDxJumps(repeat(10, 50)))
+	assert.Empty(t, findDxJumps(repeat(10, 5)))
+
+	// Quantization at low speeds.
+	assert.Empty(t, findDxJumps(append(repeat(2, 20), repeat(3, 20)...)))
+
+	// Noise and a slow change are not jumps.
+	assert.Empty(t, findDxJumps([]int{10, 11, 9, 10, 12, 10, 9, 11, 10, 13, 12, 14, 13, 15, 14, 13, 15, 14, 15, 14}))
+
+	// Jump from 10 to 25 px.
+	dx := append(repeat(10, 30), repeat(25, 30)...)
+	assert.Equal(t, []int{30}, findDxJumps(dx))
+
+	// Direction does not matter, only magnitude.
+	dx = append(repeat(-20, 30), repeat(-8, 30)...)
+	assert.Equal(t, []int{30}, findDxJumps(dx))
+
+	// Two jumps.
+	dx = append(append(repeat(10, 20), repeat(30, 20)...), repeat(10, 20)...)
+	assert.Equal(t, []int{20, 40}, findDxJumps(dx))
+}
+
+func testSequence(dx []int, bgCos []float64) sequence {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	seq := sequence{startTS: &t0, cos: repeat(1., len(dx)), bgCos: bgCos, dx: dx}
+	for i := range dx {
+		seq.frames = append(seq.frames, image.NewRGBA(image.Rect(0, 0, 1, 1)))
+		seq.ts = append(seq.ts, t0.Add(time.Duration(i+1)*time.Second))
+	}
+	return seq
+}
+
+func Test_findSegments(t *testing.T) {
+	// No gaps.
+	seq := testSequence(repeat(10, 40), repeat(0.5, 40))
+	assert.Equal(t, []segment{{0, 40}}, findSegments(seq))
+
+	// Background unknown.
+	seq = testSequence(repeat(10, 40), repeat(0., 40))
+	assert.Equal(t, []segment{{0, 40}}, findSegments(seq))
+
+	// Gap between two trains.
+	bgCos := append(append(repeat(0.5, 20), repeat(0.99, 5)...), repeat(0.5, 15)...)
+	seq = testSequence(repeat(10, 40), bgCos)
+	assert.Equal(t, []segment{{0, 20}, {25, 40}}, findSegments(seq))
+
+	// Too short to be a gap.
+	bgCos = append(append(repeat(0.5, 20), repeat(0.99, 2)...), repeat(0.5, 18)...)
+	seq = testSequence(repeat(10, 40), bgCos)
+	assert.Equal(t, []segment{{0, 40}}, findSegments(seq))
+
+	// Background at the end.
+	bgCos = append(repeat(0.5, 30), repeat(0.99, 10)...)
+	seq = testSequence(repeat(10, 40), bgCos)
+	assert.Equal(t, []segment{{0, 30}}, findSegments(seq))
+
+	// Jump in dx without a visible gap.
+	seq = testSequence(append(repeat(10, 30), repeat(25, 30)...), repeat(0.5, 60))
+	assert.Equal(t, []segment{{0, 30}, {30, 60}}, findSegments(seq))
+}
+
+func Test_sequence_sub(t *testing.T) {
+	dx := append(append(repeat(10, 10), repeat(0, 5)...), repeat(10, 10)...)
+	seq := testSequence(dx, repeat(0.5, 25))
+
+	sub, ok := seq.sub(segment{0, 10})
+	require.True(t, ok)
+	assert.Equal(t, seq.startTS, sub.startTS)
+	assert.Len(t, sub.frames, 10)
+	assert.Len(t, sub.bgCos, 10)
+
+	// Leading zeros are dropped, and startTS is the timestamp of the preceding frame.
+	sub, ok = seq.sub(segment{10, 25})
+	require.True(t, ok)
+	assert.Equal(t, seq.ts[14], *sub.startTS)
+	assert.Equal(t, repeat(10, 10), sub.dx)
+	assert.Equal(t, seq.ts[15:], sub.ts)
+	assert.Len(t, sub.frames, 10)
+
+	_, ok = seq.sub(segment{10, 15})
+	assert.False(t, ok)
+
+	// Full frames are clamped.
+	seq.full = seq.frames[:12]
+	sub, ok = seq.sub(segment{10, 25})
+	require.True(t, ok)
+	assert.NotNil(t, sub.full)
+	assert.Empty(t, sub.full)
+	sub, ok = seq.sub(segment{5, 25})
+	require.True(t, ok)
+	assert.Len(t, sub.full, 7)
+}
+
+func Test_subsample(t *testing.T) {
+	img := imutil.RandRGBA(1, 30, 21)
+	sub := imutil.CopyRect(img, image.Rect(3, 5, 30, 21))
+
+	s := subsample(sub, 4)
+	assert.Equal(t, image.Rect(0, 0, 7, 4), s.Rect)
+	assert.Equal(t, sub.At(3, 5), s.At(0, 0))
+	assert.Equal(t, sub.At(3+6*4, 5+3*4), s.At(6, 3))
+}
@@ -0,0 +1,70 @@
+package stitch
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"slices"
+
+	"github.com/rs/zerolog"
+	"jo-m.ch/go/trainbot/pkg/imutil"
+	"jo-m.ch/go/trainbot/pkg/pmatch"
+)
+
+const (
+	// Width of the patch from the start of a part which is searched for in the previous part.
+	joinPatchW = 16
+	// Width of the region at the end of the previous part which is searched.
+	joinSearchW = 1024
+	// Minimum cosine similarity for the overlap to be accepted.
+	joinMinCos = 0.9
+)
+
+// JoinParts joins the images of a train which was split into multiple parts (see Train.Part) into a single image.
+// parts must be ordered by part number, and direction is the direction of the train (see Train.Direction()).
+// Consecutive parts are expected to overlap (by at least one frame), the exact overlap is determined by patch matching.
+func JoinParts(logger *zerolog.Logger, parts []image.Image, direction bool) (*image.RGBA, error) {
+	if len(parts) == 0 {
+		return nil, errors.New("no parts to join")
+	}
+
+	// Order from left to right. For trains going to the left, the first part is on the left.
+	rgba := make([]*image.RGBA, len(parts))
+	for i, p := range parts {
+		rgba[i] = imutil.ToRGBA(p)
+		if rgba[i].Rect.Dy() != rgba[0].Rect.Dy() {
+			return nil, errors.New("parts do not have the same height (e.g. because they were stored at different scales)")
+		}
+	}
+	if direction {
+		slices.Reverse(rgba)
+	}
+
+	// Find x position of each part in the joined image.
+	pos := make([]int, len(rgba))
+	for i := 1; i < len(rgba); i++ {
+		left, right := rgba[i-1], rgba[i]
+
+		searchW := min(joinSearchW, left.Rect.Dx())
+		patchW := min(joinPatchW, right.Rect.Dx(), searchW)
+		search := left.SubImage(image.Rect(left.Rect.Dx()-searchW, 0, left.Rect.Dx(), left.Rect.Dy())).(*image.RGBA)
+		patch := right.SubImage(image.Rect(0, 0, patchW, right.Rect.Dy())).(*image.RGBA)
+
+		x, _, cos := pmatch.SearchRGBA(search, patch)
+		logger.Debug().Int("i", i).Int("x", x).Float64("cos", cos).Msg("joining parts")
+		if cos < joinMinCos {
+			return nil, fmt.Errorf("unable to find overlap between parts, cos=%f", cos)
+		}
+
+		pos[i] = pos[i-1] + left.Rect.Dx() - searchW + x
+	}
+
+	last := len(rgba) - 1
+	img := image.NewRGBA(image.Rect(0, 0, pos[last]+rgba[last].Rect.Dx(), rgba[0].Rect.Dy()))
+	for i, p := range rgba {
+		draw.Draw(img, p.Rect.Add(image.Pt(pos[i], 0)), p, image.Point{}, draw.Src)
+	}
+
+	return img, nil
+}
@@ -0,0 +1,34 @@
+package stitch
+
+import (
+	"image"
+	"testing"
+
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"jo-m.ch/go/trainbot/pkg/imutil"
+)
+
+func Test_JoinParts(t *testing.T) {
+	pano := imutil.RandRGBA(123, 1000, 50)
+	cut := func(x0, x1 int) image.Image {
+		sub, err := imutil.Sub(pano, image.Rect(x0, 0, x1, 50))
+		require.NoError(t, err)
+		return imutil.ToRGBA(sub)
+	}
+
+	// Train going to the left, parts ordered left to right.
+	joined, err := JoinParts(&log.Logger, []image.Image{cut(0, 400), cut(300, 700), cut(650, 1000)}, false)
+	require.NoError(t, err)
+	assert.Equal(t, pano.Pix, joined.Pix)
+
+	// Train going to the right, parts ordered right to left.
+	joined, err = JoinParts(&log.Logger, []image.Image{cut(650, 1000), cut(300, 700), cut(0, 400)}, true)
+	require.NoError(t, err)
+	assert.Equal(t, pano.Pix, joined.Pix)
+
+	// No overlap.
+	_, err = JoinParts(&log.Logger, []image.Image{cut(0, 400), imutil.RandRGBA(456, 400, 50)}, false)
+	assert.Error(t, err)
+}
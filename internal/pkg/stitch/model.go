@@ -0,0 +1,162 @@
+package stitch
+
+import (
+	"fmt"
+	"math"
+)
+
+// Names of the available motion models, see MotionModel.
+const (
+	MotionModelConstantSpeed = "constant_speed"
+	MotionModelConstantAccel = "constant_accel"
+	MotionModelConstantJerk  = "constant_jerk"
+	MotionModelSpline        = "spline"
+	// MotionModelAuto selects the best model per sequence.
+	MotionModelAuto = "auto"
+)
+
+// MotionModelNames contains all valid values for Config.MotionModel.
+var MotionModelNames = []string{
+	MotionModelConstantSpeed,
+	MotionModelConstantAccel,
+	MotionModelConstantJerk,
+	MotionModelSpline,
+	MotionModelAuto,
+}
+
+const (
+	// Desired spacing of the spline knots [s].
+	splineKnotSpacingS = 2
+	// Maximum number of spline segments, to keep it smooth for long sequences.
+	splineMaxSegments = 6
+	// Number of steps for numeric integration and differentiation.
+	modelIntegrationSteps = 1000
+)
+
+// MotionModel models the speed of a train over time.
+// It is fitted to the measured speeds of a sequence, and the fitted speeds are then used for stitching.
+type MotionModel interface {
+	// Name returns the name of the model (one of the MotionModel* constants).
+	Name() string
+	// NParams returns the number of parameters.
+	NParams() int
+	// Speed returns the speed [px/s] at time t [s] since the start of the sequence.
+	Speed(t float64, params []float64) float64
+}
+
+// constantSpeed models a train moving at constant speed.
+type constantSpeed struct{}
+
+func (constantSpeed) Name() string { return MotionModelConstantSpeed }
+func (constantSpeed) NParams() int { return 1 }
+
+func (constantSpeed) Speed(_ float64, params []float64) float64 {
+	return params[0]
+}
+
+// constantAccel models a train with constant acceleration.
+type constantAccel struct{}
+
+func (constantAccel) Name() string { return MotionModelConstantAccel }
+func (constantAccel) NParams() int { return 2 }
+
+func (constantAccel) Speed(t float64, params []float64) float64 {
+	v0 := params[0]
+	a := params[1]
+	return v0 + a*t
+}
+
+// constantJerk models a train with linearly changing acceleration (quadratic speed).
+type constantJerk struct{}
+
+func (constantJerk) Name() string { return MotionModelConstantJerk }
+func (constantJerk) NParams() int { return 3 }
+
+func (constantJerk) Speed(t float64, params []float64) float64 {
+	v0 := params[0]
+	a := params[1]
+	j := params[2]
+	return v0 + a*t + 0.5*j*t*t
+}
+
+// spline models the speed as an uniform cubic B-spline.
+// Knots are spaced far enough apart that it cannot follow noise in the measurements.
+type spline struct {
+	// Length of each segment [s].
+	h float64
+	// Number of segments.
+	n int
+}
+
+func newSpline(durationS float64) spline {
+	n := min(max(int(durationS/splineKnotSpacingS), 1), splineMaxSegments)
+	return spline{
+		h: math.Max(durationS, DefaultMinFramePeriodS) / float64(n),
+		n: n,
+	}
+}
+
+func (spline) Name() string   { return MotionModelSpline }
+func (s spline) NParams() int { return s.n + 3 }
+
+func (s spline) Speed(t float64, params []float64) float64 {
+	// Find segment, outside of the range the outermost segments are extrapolated.
+	u := t / s.h
+	i := min(max(int(math.Floor(u)), 0), s.n-1)
+	x := u - float64(i)
+
+	// Uniform cubic B-spline basis functions.
+	b0 := (1 - x) * (1 - x) * (1 - x) / 6
+	b1 := (3*x*x*x - 6*x*x + 4) / 6
+	b2 := (-3*x*x*x + 3*x*x + 3*x + 1) / 6
+	b3 := x * x * x / 6
+
+	return b0*params[i] + b1*params[i+1] + b2*params[i+2] + b3*params[i+3]
+}
+
+// motionModels returns the models to try for a sequence with the given duration [s].
+func motionModels(name string, durationS float64) ([]MotionModel, error) {
+	switch name {
+	case MotionModelConstantSpeed:
+		return []MotionModel{constantSpeed{}}, nil
+	case "", MotionModelConstantAccel:
+		return []MotionModel{constantAccel{}}, nil
+	case MotionModelConstantJerk:
+		return []MotionModel{constantJerk{}}, nil
+	case MotionModelSpline:
+		return []MotionModel{newSpline(durationS)}, nil
+	case MotionModelAuto:
+		return []MotionModel{constantSpeed{}, constantAccel{}, constantJerk{}, newSpline(durationS)}, nil
+	default:
+		return nil, fmt.Errorf("unknown motion model '%s'", name)
+	}
+}
+
+// integrateSpeed computes the distance [px] travelled from t0 to t1 [s].
+func integrateSpeed(m MotionModel, params []float64, t0, t1 float64) float64 {
+	// Simpson's rule, exact for polynomials up to degree 3.
+	h := (t1 - t0) / modelIntegrationSteps
+	sum := m.Speed(t0, params) + m.Speed(t1, params)
+	for i := 1; i < modelIntegrationSteps; i++ {
+		w := 2.
+		if i%2 == 1 {
+			w = 4
+		}
+		sum += w * m.Speed(t0+float64(i)*h, params)
+	}
+	return sum * h / 3
+}
+
+// accel computes the acceleration [px/s^2] at time t [s].
+func accel(m MotionModel, params []float64, t float64) float64 {
+	const h = 1e-3
+	return (m.Speed(t+h, params) - m.Speed(t-h, params)) / (2 * h)
+}
+
+// bic computes the Bayesian information criterion for a fit with n data points, nParams parameters
+// and sum of squared residuals rss. Lower is better.
+func bic(n, nParams int, rss float64) float64 {
+	// Prevent log(0) for perfect fits.
+	rss = math.Max(rss, 1e-9)
+	return float64(n)*math.Log(rss/float64(n)) + float64(nParams)*math.Log(float64(n))
+}
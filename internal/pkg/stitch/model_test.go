@@ -0,0 +1,95 @@
+package stitch
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_spline(t *testing.T) {
+	s := newSpline(10)
+	assert.Equal(t, 5, s.n)
+	assert.Equal(t, 8, s.NParams())
+
+	assert.Equal(t, 1, newSpline(0.5).n)
+	assert.Equal(t, splineMaxSegments, newSpline(100).n)
+
+	// Basis functions sum up to 1, so constant params give a constant speed.
+	params := []float64{3, 3, 3, 3, 3, 3, 3, 3}
+	for x := -1.; x <= 11; x += 0.1 {
+		assert.InDelta(t, 3, s.Speed(x, params), 1e-9)
+	}
+
+	// Continuity at the knots.
+	params = []float64{1, 5, -2, 7, 0, 3, 8, -1}
+	for i := 1; i < s.n; i++ {
+		x := float64(i) * s.h
+		assert.InDelta(t, s.Speed(x-1e-9, params), s.Speed(x+1e-9, params), 1e-6)
+	}
+}
+
+func Test_integrateSpeed(t *testing.T) {
+	m := constantJerk{}
+	params := []float64{10, 2, -0.5}
+	// Closed form: v0*t + a/2*t^2 + j/6*t^3.
+	truth := 10*4 + 1*4*4 - 0.5/6*4*4*4
+	assert.InDelta(t, truth, integrateSpeed(m, params, 0, 4), 1e-9)
+	assert.InDelta(t, 2-0.5*3, accel(m, params, 3), 1e-6)
+}
+
+func Test_motionModels(t *testing.T) {
+	models, err := motionModels("", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []MotionModel{constantAccel{}}, models)
+
+	models, err = motionModels(MotionModelAuto, 10)
+	require.NoError(t, err)
+	assert.Len(t, models, 4)
+
+	for _, name := range MotionModelNames {
+		_, err = motionModels(name, 10)
+		assert.NoError(t, err)
+	}
+
+	_, err = motionModels("unknown", 10)
+	assert.Error(t, err)
+}
+
+// genModelSeq generates dx values for a position function with some noise.
+func genModelSeq(seed int64, n int, pos func(t float64) float64) []int {
+	// #nosec G404
+	rnd := rand.New(rand.NewSource(seed))
+	dx := make([]int, n)
+	prev := 0.
+	for i := range dx {
+		s := math.Round(pos(float64(i+1)/fps) + rnd.NormFloat64()*0.3)
+		dx[i] = int(s - prev)
+		prev = s
+	}
+	return dx
+}
+
+func Test_fitDx_modelSelection(t *testing.T) {
+	models, err := motionModels(MotionModelAuto, 200./fps)
+	require.NoError(t, err)
+
+	// Constant speed.
+	dx := genModelSeq(1, 200, func(t float64) float64 { return 20 * fps * t })
+	fit, err := fitDx(&log.Logger, genTestSeq(dx), 40*fps, models)
+	require.NoError(t, err)
+	assert.Equal(t, MotionModelConstantSpeed, fit.model.Name())
+	assert.Len(t, fit.residuals, len(dx))
+	assert.InDelta(t, sumAbs(dx), fit.ds, 5)
+
+	// Strongly decelerating.
+	dx = genModelSeq(2, 200, func(t float64) float64 { return (30*t - 1.5*t*t) * fps })
+	fit, err = fitDx(&log.Logger, genTestSeq(dx), 40*fps, models)
+	require.NoError(t, err)
+	assert.Contains(t, []string{MotionModelConstantAccel, MotionModelConstantJerk}, fit.model.Name())
+	assert.InDelta(t, -3*fps, fit.accel(3), 10)
+	assert.InDelta(t, sumAbs(dx), fit.ds, 50)
+}
@@ -0,0 +1,53 @@
+package stitch
+
+import (
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"jo-m.ch/go/trainbot/pkg/imutil"
+	"jo-m.ch/go/trainbot/pkg/privacy"
+)
+
+// equalNeighbors returns the fraction of pixels in row y of img which are equal to their right neighbor.
+func equalNeighbors(img *image.RGBA, y int) float64 {
+	b := img.Rect
+	n := 0
+	for x := b.Min.X; x < b.Max.X-1; x++ {
+		if img.RGBAAt(x, y) == img.RGBAAt(x+1, y) {
+			n++
+		}
+	}
+	return float64(n) / float64(b.Dx()-1)
+}
+
+func Test_AutoStitcher_Privacy(t *testing.T) {
+	carLens := []int{80, 60, 100, 70}
+	frames, ts := genCarsVideo(carLens, 8, 10)
+
+	for _, lowMem := range []bool{false, true} {
+		c := Config{PixelsPerM: 10, MinSpeedKPH: 10, MaxSpeedKPH: 160, MinLengthM: 10, MaxFrameCountPerSeq: 1500, LowMemory: lowMem}
+		c.Privacy = privacy.Config{Bands: []privacy.Band{{Y0: 40, Y1: 60}}, BlockPx: 10}
+		a := NewAutoStitcher(c)
+		var trains []*Train
+		for i := range frames {
+			trains = append(trains, a.Frame(frames[i], ts[i])...)
+		}
+		trains = append(trains, a.TryStitchAndReset()...)
+
+		require.Len(t, trains, 1)
+		// The train is still detected and measured as usual.
+		require.Len(t, trains[0].Cars, len(carLens), lowMem)
+
+		// Pixelated rows consist of runs of equal pixels, the others of random noise.
+		img := trains[0].Image
+		top := img.Rect.Min.Y
+		assert.Greater(t, equalNeighbors(img, top+50), 0.5, lowMem)
+		assert.Less(t, equalNeighbors(img, top+20), 0.1, lowMem)
+
+		// The same goes for the GIF.
+		g := trains[0].GIF.Image[len(trains[0].GIF.Image)/2]
+		assert.Greater(t, equalNeighbors(imutil.ToRGBA(g), g.Rect.Min.Y+50), 0.5, lowMem)
+	}
+}
@@ -0,0 +1,331 @@
+package stitch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"jo-m.ch/go/trainbot/pkg/imutil"
+)
+
+const (
+	sequenceTSFormat = "20060102_150405.000_Z07:00"
+	sequenceFile     = "sequence.json"
+	sequenceBg       = "bg.png"
+	sequenceMask     = "mask.png"
+)
+
+// sequenceHeader is the JSON file of a saved sequence, the images are stored next to it as PNGs.
+type sequenceHeader struct {
+	StartTS     time.Time       `json:"start_ts"`
+	FrameBounds image.Rectangle `json:"frame_bounds"`
+	// Only set in low memory mode.
+	StripBounds image.Rectangle `json:"strip_bounds"`
+
+	TS    []time.Time `json:"ts"`
+	Dx    []int       `json:"dx"`
+	Cos   []float64   `json:"cos"`
+	BgCos []float64   `json:"bg_cos"`
+
+	// Number of full frames (low memory mode), nil if there are none.
+	NFull *int `json:"n_full"`
+	// Bounds of the background image, nil if there is none.
+	BgBounds *image.Rectangle `json:"bg_bounds"`
+	// Bounds of the mask (Config.Mask), nil if there is none.
+	MaskBounds *image.Rectangle `json:"mask_bounds"`
+
+	// Config the sequence was recorded with, without the mask.
+	Config Config `json:"config"`
+}
+
+func frameFileName(i int) string {
+	return fmt.Sprintf("frame_%05d.png", i)
+}
+
+func fullFileName(i int) string {
+	return fmt.Sprintf("full_%05d.png", i)
+}
+
+// sequenceName returns the name of the directory a sequence is saved to.
+func sequenceName(seq sequence, region string) string {
+	ts := seq.ts[0].Format(sequenceTSFormat)
+	if region == "" {
+		return fmt.Sprintf("seq_%s", ts)
+	}
+	return fmt.Sprintf("seq_%s_%s", ts, region)
+}
+
+// saveSequence saves a sequence to a new subdirectory of dir, so that it can be stitched again later (see
+// LoadSequence()). Returns the name of the subdirectory.
+func saveSequence(dir string, seq sequence, c Config) (string, error) {
+	name := sequenceName(seq, c.Region)
+	path := filepath.Join(dir, name)
+	err := os.MkdirAll(path, 0750)
+	if err != nil {
+		return "", err
+	}
+
+	h := sequenceHeader{
+		StartTS:     *seq.startTS,
+		FrameBounds: seq.frameBounds,
+		StripBounds: seq.stripBounds,
+		TS:          seq.ts,
+		Dx:          seq.dx,
+		Cos:         seq.cos,
+		BgCos:       seq.bgCos,
+		Config:      c,
+	}
+
+	for i, f := range seq.frames {
+		err := imutil.Dump(filepath.Join(path, frameFileName(i)), loadFrame(f))
+		if err != nil {
+			return "", err
+		}
+	}
+	if seq.full != nil {
+		for i, f := range seq.full {
+			err := imutil.Dump(filepath.Join(path, fullFileName(i)), f)
+			if err != nil {
+				return "", err
+			}
+		}
+		n := len(seq.full)
+		h.NFull = &n
+	}
+	if seq.bg != nil {
+		err := imutil.Dump(filepath.Join(path, sequenceBg), seq.bg)
+		if err != nil {
+			return "", err
+		}
+		h.BgBounds = &seq.bg.Rect
+	}
+	if c.Mask != nil {
+		err := imutil.Dump(filepath.Join(path, sequenceMask), c.Mask)
+		if err != nil {
+			return "", err
+		}
+		b := c.Mask.Bounds()
+		h.MaskBounds = &b
+	}
+
+	// Written last, so that incomplete sequences cannot be loaded.
+	buf, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	err = os.WriteFile(filepath.Join(path, sequenceFile), buf, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// maxPendingSaves is the maximum number of sequences which are saved in the background at the same time.
+// Further sequences are not saved, so that they cannot pile up in memory (or disk space) if the storage is slow.
+const maxPendingSaves = 2
+
+// sequenceSaver saves sequences in the background, see Config.SequenceDir.
+type sequenceSaver struct {
+	dir   string
+	slots chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newSequenceSaver(dir string) *sequenceSaver {
+	return &sequenceSaver{
+		dir:   dir,
+		slots: make(chan struct{}, maxPendingSaves),
+	}
+}
+
+// pendingSave is a sequence which is being saved in the background.
+type pendingSave struct {
+	name string
+	// Receives exactly once whether the sequence should be kept, i.e. whether a train was stitched from it.
+	keep chan bool
+}
+
+// start starts saving seq in the background, and returns nil if too many sequences are being saved already.
+// The caller has to send to keep when it knows whether the saved sequence is needed. The spill of seq (if any) is
+// closed when it has been saved.
+func (s *sequenceSaver) start(seq sequence, c Config) *pendingSave {
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		c.logger().Warn().Int("pending", maxPendingSaves).Msg("too many sequences are being saved, not saving this one")
+		return nil
+	}
+
+	p := &pendingSave{
+		name: sequenceName(seq, c.Region),
+		keep: make(chan bool, 1),
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() { <-s.slots }()
+		defer seq.spill.close()
+
+		_, err := saveSequence(s.dir, seq, c)
+		if err != nil {
+			c.logger().Err(err).Str("sequence", p.name).Msg("failed to save sequence")
+		}
+		if !<-p.keep || err != nil {
+			err := os.RemoveAll(filepath.Join(s.dir, p.name))
+			if err != nil {
+				c.logger().Err(err).Str("sequence", p.name).Msg("failed to delete sequence")
+			}
+		}
+	}()
+
+	return p
+}
+
+// wait waits until all sequences have been saved.
+func (s *sequenceSaver) wait() {
+	if s == nil {
+		return
+	}
+	s.wg.Wait()
+}
+
+// loadRGBA loads an image, and moves it to the given bounds.
+func loadRGBA(path string, bounds image.Rectangle) (*image.RGBA, error) {
+	img, err := imutil.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	rgba := imutil.ToRGBA(img)
+	if rgba.Rect.Size() != bounds.Size() {
+		return nil, fmt.Errorf("%s: unexpected size %v, expected %v", path, rgba.Rect.Size(), bounds.Size())
+	}
+	rgba.Rect = bounds
+	return rgba, nil
+}
+
+// SavedSequence is a sequence of frames which was saved to disk (see Config.SequenceDir), and can be stitched again.
+type SavedSequence struct {
+	// Name of the sequence, see Train.Sequence.
+	Name string
+	// Conf is the configuration the sequence was recorded with.
+	Conf Config
+
+	seq sequence
+}
+
+// LoadSequence loads a sequence which was saved to the directory path.
+func LoadSequence(path string) (*SavedSequence, error) {
+	// #nosec G304
+	buf, err := os.ReadFile(filepath.Join(path, sequenceFile))
+	if err != nil {
+		return nil, err
+	}
+	var h sequenceHeader
+	err = json.Unmarshal(buf, &h)
+	if err != nil {
+		return nil, err
+	}
+	n := len(h.Dx)
+	if n == 0 || len(h.TS) != n || len(h.Cos) != n || len(h.BgCos) != n {
+		return nil, errors.New("inconsistent sequence")
+	}
+
+	ret := SavedSequence{
+		Name: filepath.Base(path),
+		Conf: h.Config,
+		seq: sequence{
+			startTS:     &h.StartTS,
+			frameBounds: h.FrameBounds,
+			stripBounds: h.StripBounds,
+			dx:          h.Dx,
+			ts:          h.TS,
+			cos:         h.Cos,
+			bgCos:       h.BgCos,
+		},
+	}
+
+	frameBounds := h.FrameBounds
+	if h.Config.LowMemory {
+		frameBounds = h.StripBounds
+	}
+	for i := range n {
+		f, err := loadRGBA(filepath.Join(path, frameFileName(i)), frameBounds)
+		if err != nil {
+			return nil, err
+		}
+		ret.seq.frames = append(ret.seq.frames, f)
+	}
+	if h.NFull != nil {
+		ret.seq.full = []image.Image{}
+		for i := range *h.NFull {
+			f, err := loadRGBA(filepath.Join(path, fullFileName(i)), h.FrameBounds)
+			if err != nil {
+				return nil, err
+			}
+			ret.seq.full = append(ret.seq.full, f)
+		}
+	}
+	if h.BgBounds != nil {
+		ret.seq.bg, err = loadRGBA(filepath.Join(path, sequenceBg), *h.BgBounds)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if h.MaskBounds != nil {
+		ret.Conf.Mask, err = loadRGBA(filepath.Join(path, sequenceMask), *h.MaskBounds)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &ret, nil
+}
+
+// StartTS returns the timestamp of the first frame of the sequence.
+func (s *SavedSequence) StartTS() time.Time {
+	return s.seq.ts[0]
+}
+
+// Restitch fits and stitches the sequence again, with a different configuration.
+// The frames were recorded with the region, low memory mode and track angle of the original configuration, so
+// those are always taken from Conf. If c.Mask is nil, the original mask is used, otherwise it is rotated like the
+// frames were.
+// Trains are not assigned part numbers. If c.DebugDir is set, a diagnostic bundle is written.
+func (s *SavedSequence) Restitch(c Config) ([]*Train, error) {
+	c.Region = s.Conf.Region
+	c.LowMemory = s.Conf.LowMemory
+	c.TrackAngleDeg = s.Conf.TrackAngleDeg
+	if c.Mask == nil {
+		c.Mask = s.Conf.Mask
+	} else {
+		c.rotateMask()
+	}
+
+	seq := s.seq
+	if c.DebugDir != "" {
+		seq.trace = newSeqTrace()
+		seq.trace.add(time.Time{}, "detect", "loaded saved sequence %s", s.Name)
+	}
+
+	trains, err := fitAndStitch(seq, c)
+	for _, t := range trains {
+		t.Sequence = s.Name
+	}
+
+	if c.DebugDir != "" {
+		path, bundleErr := writeDebugBundle(c.DebugDir, seq, c, trains, err)
+		if bundleErr != nil {
+			c.logger().Err(bundleErr).Msg("failed to write diagnostic bundle")
+		} else {
+			c.logger().Info().Str("path", path).Msg("wrote diagnostic bundle")
+		}
+	}
+
+	return trains, err
+}
@@ -0,0 +1,88 @@
+package stitch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"jo-m.ch/go/trainbot/pkg/imutil"
+)
+
+func Test_SavedSequence_Restitch(t *testing.T) {
+	frames, ts := genVideo(150, 1000, 10, 10)
+	// Like camera frames, saved frames must be opaque, random alpha values do not survive the PNG round trip.
+	for i, f := range frames {
+		rgba := imutil.ToRGBA(f)
+		for j := 3; j < len(rgba.Pix); j += 4 {
+			rgba.Pix[j] = 0xff
+		}
+		frames[i] = rgba
+	}
+
+	for _, lowMem := range []bool{false, true} {
+		dir := t.TempDir()
+		c := Config{PixelsPerM: 10, MinSpeedKPH: 10, MaxSpeedKPH: 160, MinLengthM: 10, MaxFrameCountPerSeq: 1500, LowMemory: lowMem, Region: "north", SequenceDir: dir}
+		a := NewAutoStitcher(c)
+		var trains []*Train
+		for i := range frames {
+			trains = append(trains, a.Frame(frames[i], ts[i])...)
+		}
+		trains = append(trains, a.TryStitchAndReset()...)
+		a.Close()
+		require.Len(t, trains, 1)
+		orig := trains[0]
+		require.NotEmpty(t, orig.Sequence)
+
+		seq, err := LoadSequence(filepath.Join(dir, orig.Sequence))
+		require.NoError(t, err)
+		assert.Equal(t, orig.Sequence, seq.Name)
+		assert.Equal(t, orig.StartTS, seq.StartTS())
+		assert.Equal(t, "north", seq.Conf.Region)
+		assert.Equal(t, lowMem, seq.Conf.LowMemory)
+
+		// Same settings give the same train.
+		restitched, err := seq.Restitch(Config{PixelsPerM: 10, MinSpeedKPH: 10, MaxSpeedKPH: 160, MinLengthM: 10})
+		require.NoError(t, err)
+		require.Len(t, restitched, 1)
+		assert.Equal(t, orig.StartTS, restitched[0].StartTS)
+		assert.Equal(t, orig.LengthPx, restitched[0].LengthPx)
+		assert.Equal(t, orig.Image.Rect, restitched[0].Image.Rect)
+		assert.Equal(t, orig.Image.Pix, restitched[0].Image.Pix)
+		assert.Equal(t, orig.Cars, restitched[0].Cars)
+		assert.Equal(t, "north", restitched[0].Conf.Region)
+		assert.Equal(t, orig.Sequence, restitched[0].Sequence)
+
+		// Different settings.
+		restitched, err = seq.Restitch(Config{PixelsPerM: 20, MinSpeedKPH: 10, MaxSpeedKPH: 160, MinLengthM: 10})
+		require.NoError(t, err)
+		require.Len(t, restitched, 1)
+		assert.InDelta(t, orig.LengthM()/2, restitched[0].LengthM(), 0.01)
+	}
+}
+
+func Test_AutoStitcher_SequenceDeleted(t *testing.T) {
+	frames, ts := genVideo(150, 1000, 10, 10)
+
+	dir := t.TempDir()
+	// The train is shorter than MinLengthM, so the sequence is rejected.
+	c := Config{PixelsPerM: 10, MinSpeedKPH: 10, MaxSpeedKPH: 160, MinLengthM: 1000, MaxFrameCountPerSeq: 1500, SequenceDir: dir}
+	a := NewAutoStitcher(c)
+	var trains []*Train
+	for i := range frames {
+		trains = append(trains, a.Frame(frames[i], ts[i])...)
+	}
+	trains = append(trains, a.TryStitchAndReset()...)
+	a.Close()
+	require.Empty(t, trains)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func Test_LoadSequence_Missing(t *testing.T) {
+	_, err := LoadSequence(t.TempDir())
+	assert.Error(t, err)
+}
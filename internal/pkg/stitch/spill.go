@@ -0,0 +1,149 @@
+package stitch
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"os"
+
+	"github.com/rs/zerolog/log"
+)
+
+// spill is a temporary file to which the frames of a sequence are written in low memory mode (see Config.LowMemory),
+// so that they do not have to be kept in memory until the sequence is stitched.
+// All frames must have the same bounds. They are read back one at a time (see loadFrame()), so that the image can be
+// assembled without having all of them in memory at once.
+type spill struct {
+	f      *os.File
+	bounds image.Rectangle
+	n      int
+}
+
+// newSpill creates a new spill file in dir (the default directory for temporary files if empty).
+func newSpill(dir string, bounds image.Rectangle) (*spill, error) {
+	if dir != "" {
+		err := os.MkdirAll(dir, 0750)
+		if err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.CreateTemp(dir, "frames-*.rgba")
+	if err != nil {
+		return nil, err
+	}
+	return &spill{f: f, bounds: bounds}, nil
+}
+
+func (s *spill) frameSize() int64 {
+	return int64(s.bounds.Dx()) * int64(s.bounds.Dy()) * 4
+}
+
+// add writes a frame to the spill, and returns a reference to it.
+func (s *spill) add(frame *image.RGBA) (*spilledFrame, error) {
+	if frame.Rect != s.bounds {
+		return nil, errors.New("frame bounds do not match spill bounds")
+	}
+
+	off := int64(s.n) * s.frameSize()
+	rowLen := s.bounds.Dx() * 4
+	for y := s.bounds.Min.Y; y < s.bounds.Max.Y; y++ {
+		i := frame.PixOffset(s.bounds.Min.X, y)
+		_, err := s.f.WriteAt(frame.Pix[i:i+rowLen], off)
+		if err != nil {
+			return nil, err
+		}
+		off += int64(rowLen)
+	}
+
+	s.n++
+	return &spilledFrame{s: s, i: s.n - 1}, nil
+}
+
+// close closes and removes the spill file. Frames can no longer be loaded afterwards.
+func (s *spill) close() {
+	if s == nil {
+		return
+	}
+	err := s.f.Close()
+	if err != nil {
+		log.Err(err).Str("path", s.f.Name()).Msg("failed to close spill file")
+	}
+	err = os.Remove(s.f.Name())
+	if err != nil {
+		log.Err(err).Str("path", s.f.Name()).Msg("failed to remove spill file")
+	}
+}
+
+// spilledFrame is a frame which was written to a spill.
+// It implements image.Image, but reading single pixels is slow. Use loadFrame() instead.
+type spilledFrame struct {
+	s *spill
+	i int
+}
+
+func (f *spilledFrame) ColorModel() color.Model {
+	return color.RGBAModel
+}
+
+func (f *spilledFrame) Bounds() image.Rectangle {
+	return f.s.bounds
+}
+
+func (f *spilledFrame) At(x, y int) color.Color {
+	if !image.Pt(x, y).In(f.s.bounds) {
+		return color.RGBA{}
+	}
+	off := int64(f.i)*f.s.frameSize() + (int64(y-f.s.bounds.Min.Y)*int64(f.s.bounds.Dx())+int64(x-f.s.bounds.Min.X))*4
+	var px [4]uint8
+	_, err := f.s.f.ReadAt(px[:], off)
+	if err != nil {
+		log.Panic().Err(err).Msg("failed to read spilled frame")
+	}
+	return color.RGBA{px[0], px[1], px[2], px[3]}
+}
+
+// load reads the frame back into memory.
+func (f *spilledFrame) load() (*image.RGBA, error) {
+	ret := image.NewRGBA(f.s.bounds)
+	_, err := f.s.f.ReadAt(ret.Pix, int64(f.i)*f.s.frameSize())
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// loadFrame returns frame itself, or reads it back into memory if it was spilled to disk.
+func loadFrame(frame image.Image) image.Image {
+	sf, ok := frame.(*spilledFrame)
+	if !ok {
+		return frame
+	}
+	ret, err := sf.load()
+	if err != nil {
+		log.Panic().Err(err).Msg("failed to read spilled frame")
+	}
+	return ret
+}
+
+// spillFrame writes a frame to the spill of the sequence (which is created if needed, in dir), and returns the
+// spilled frame to be kept instead. If that fails, the frame itself is returned, and kept in memory.
+func (s *sequence) spillFrame(dir string, frame *image.RGBA) image.Image {
+	if s.spillErr != nil {
+		return frame
+	}
+	if s.spill == nil {
+		s.spill, s.spillErr = newSpill(dir, frame.Rect)
+		if s.spillErr != nil {
+			log.Err(s.spillErr).Msg("failed to create spill file, keeping frames in memory")
+			return frame
+		}
+	}
+
+	ret, err := s.spill.add(frame)
+	if err != nil {
+		s.spillErr = err
+		log.Err(err).Msg("failed to write spill file, keeping frames in memory")
+		return frame
+	}
+	return ret
+}
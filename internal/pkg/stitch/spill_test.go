@@ -0,0 +1,101 @@
+package stitch
+
+import (
+	"image"
+	"os"
+	"testing"
+
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"jo-m.ch/go/trainbot/pkg/imutil"
+)
+
+func Test_spill(t *testing.T) {
+	dir := t.TempDir()
+	bounds := image.Rect(10, 5, 30, 25)
+	s, err := newSpill(dir, bounds)
+	require.NoError(t, err)
+
+	var frames []*image.RGBA
+	var spilled []image.Image
+	for i := range 3 {
+		f := imutil.RandRGBA(int64(i), 40, 30)
+		f = imutil.CopyRect(f, bounds)
+		sf, err := s.add(f)
+		require.NoError(t, err)
+		frames = append(frames, f)
+		spilled = append(spilled, sf)
+	}
+
+	_, err = s.add(imutil.RandRGBA(123, 20, 20))
+	assert.Error(t, err)
+
+	for i, f := range frames {
+		loaded := loadFrame(spilled[i])
+		assert.Equal(t, f, loaded)
+		assert.Equal(t, bounds, spilled[i].Bounds())
+		assert.Equal(t, f.At(12, 7), spilled[i].At(12, 7))
+	}
+	// Frames in memory are returned as is.
+	assert.Same(t, frames[0], loadFrame(frames[0]))
+
+	s.close()
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func Test_stitch_Spilled(t *testing.T) {
+	const (
+		w  = 100
+		n  = 20
+		dx = 12
+	)
+	pano := imutil.RandRGBA(123, w+n*dx, 50)
+	fb := image.Rect(0, 0, w, 50)
+	c := Config{}
+	strip := c.stripRect(fb, dx)
+	frames, dxs := genFrames(pano, w, n, dx)
+
+	dir := t.TempDir()
+	seq := sequence{}
+	var spilled []image.Image
+	for _, f := range stripsOf(frames, strip) {
+		sf := seq.spillFrame(dir, f.(*image.RGBA))
+		require.IsType(t, &spilledFrame{}, sf)
+		spilled = append(spilled, sf)
+	}
+	defer seq.spill.close()
+
+	img, err := stitch(&log.Logger, spilled, fb, dxs, nil, nil, FusionLast, c.maxImageBytes())
+	require.NoError(t, err)
+	assertSubEqual(t, pano, strip.Min.X, img)
+}
+
+func Test_AutoStitcher_Spill(t *testing.T) {
+	carLens := []int{80, 60, 100, 70}
+	frames, ts := genCarsVideo(carLens, 8, 10)
+
+	dir := t.TempDir()
+	c := Config{PixelsPerM: 10, MinSpeedKPH: 10, MaxSpeedKPH: 160, MinLengthM: 10, MaxFrameCountPerSeq: 1500, LowMemory: true, SpillDir: dir}
+	a := NewAutoStitcher(c)
+	var trains []*Train
+	for i := range frames {
+		trains = append(trains, a.Frame(frames[i], ts[i])...)
+		if i == len(frames)/2 {
+			// Frames are spilled while the train passes.
+			require.IsType(t, &spilledFrame{}, a.seq.frames[0])
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			assert.Len(t, entries, 1)
+		}
+	}
+	trains = append(trains, a.TryStitchAndReset()...)
+	require.Len(t, trains, 1)
+
+	// The spill file is removed after stitching.
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -11,12 +11,13 @@ import (
 
 	"github.com/mccutchen/palettor"
 	"github.com/nfnt/resize"
-	"github.com/rs/zerolog/log"
+	"github.com/rs/zerolog"
 	"jo-m.ch/go/trainbot/internal/pkg/prometheus"
+	"jo-m.ch/go/trainbot/pkg/imutil"
 )
 
 const (
-	maxMemoryMB = 1024 * 1024 * 50
+	defaultMaxImageMB = 50
 )
 
 func isign(x int) int {
@@ -39,29 +40,35 @@ func sign(x float64) float64 {
 	return 0
 }
 
-func stitch(frames []image.Image, dx []int, mask image.Image) (*image.RGBA, error) {
+// stitch assembles the frames into a single image.
+// frameBounds are the bounds of the original frames. The frames might also only be strips (sub-rectangles) of the
+// original frames, in which case the resulting image is cropped to the area covered by the strips.
+// If shear is not nil, each frame (and the mask) is sheared by shear[i] before it is drawn (see rollingShutterShear()).
+// fusion (see Config.Fusion) selects how pixels which are covered by multiple frames are combined.
+func stitch(logger *zerolog.Logger, frames []image.Image, frameBounds image.Rectangle, dx []int, shear []float64, mask image.Image, fusion string, maxBytes int) (*image.RGBA, error) {
 	t0 := time.Now()
 	defer func() {
-		log.Trace().Dur("dur", time.Since(t0)).Msg("stitch() duration")
+		logger.Trace().Dur("dur", time.Since(t0)).Msg("stitch() duration")
 	}()
 
-	log.Info().Ints("dx", dx).Int("len(frames)", len(frames)).Msg("stitch()")
+	logger.Info().Ints("dx", dx).Int("len(frames)", len(frames)).Msg("stitch()")
 
 	// Sanity checks.
 	if len(dx) < 2 {
 		return nil, errors.New("sequence too short to stitch")
 	}
-	if len(frames) != len(dx) {
-		log.Panic().Msg("frames and dx do not have the same length, this should not happen")
+	if len(frames) != len(dx) || (shear != nil && len(shear) != len(dx)) {
+		logger.Panic().Msg("frames, dx and shear do not have the same length, this should not happen")
 	}
-	fb := frames[0].Bounds()
+	fb := frameBounds
+	sb := frames[0].Bounds()
 	for _, f := range frames {
-		if f.Bounds() != fb {
-			log.Panic().Msg("frame bounds or size not consistent, this should not happen")
+		if f.Bounds() != sb || !sb.In(fb) {
+			logger.Panic().Msg("frame bounds or size not consistent, this should not happen")
 		}
 	}
 	if mask != nil && fb != mask.Bounds() {
-		log.Panic().Interface("frame", fb).Interface("mask", mask.Bounds()).Msg("mask size and frame size do not match!")
+		logger.Panic().Interface("frame", fb).Interface("mask", mask.Bounds()).Msg("mask size and frame size do not match!")
 	}
 
 	// Calculate base width.
@@ -75,35 +82,93 @@ func stitch(frames []image.Image, dx []int, mask image.Image) (*image.RGBA, erro
 		w += x
 	}
 
-	// Memory alloc sanity check.
+	// Calculate frame positions.
+	pos := make([]int, len(frames))
+	p := 0
+	if w < 0 {
+		// Backwards.
+		p = -w - fb.Dx()
+	}
+	for i := range frames {
+		pos[i] = p
+		p += dx[i]
+	}
+
 	rect := image.Rect(0, 0, iabs(w), h)
-	if rect.Size().X*rect.Size().Y*4 > maxMemoryMB {
+	// Only strips were kept, crop to the area which they cover.
+	if sb != fb {
+		stripOff := sb.Min.Sub(fb.Min)
+		covered := image.Rectangle{}
+		for _, p := range pos {
+			covered = covered.Union(sb.Sub(sb.Min).Add(stripOff).Add(image.Pt(p, 0)))
+		}
+		rect = rect.Intersect(covered)
+	}
+
+	// Memory alloc sanity check.
+	if rect.Size().X*rect.Size().Y*4 > maxBytes {
 		return nil, fmt.Errorf("would allocate too much memory: size %dx%d", rect.Size().X, rect.Size().Y)
 	}
-	img := image.NewRGBA(rect)
+	img := image.NewRGBA(rect.Sub(rect.Min))
+
+	// Parts of the frames to use.
+	srcRects := make([]image.Rectangle, len(frames))
+	for i, f := range frames {
+		r := f.Bounds()
+		// Pixels at the left and right edges of sheared frames are clamped, do not draw them over the previous frame.
+		if shear != nil && shear[i] != 0 && i > 0 {
+			clamped := int(math.Ceil(math.Abs(shear[i]) * float64(r.Dy()) / 2))
+			if sign > 0 {
+				r.Min.X += clamped
+			} else {
+				r.Max.X -= clamped
+			}
+		}
+		srcRects[i] = r
+	}
+
+	if fusion == FusionMean || fusion == FusionMedian {
+		offX := make([]int, len(frames))
+		for i := range frames {
+			offX[i] = pos[i] - fb.Min.X - rect.Min.X
+			// Sheared frames have clamped pixels at both edges, which would be fused with the neighboring frames.
+			// Only keep them at the ends of the image.
+			if shear != nil && shear[i] != 0 && i < len(frames)-1 {
+				clamped := int(math.Ceil(math.Abs(shear[i]) * float64(srcRects[i].Dy()) / 2))
+				if sign > 0 {
+					srcRects[i].Max.X -= clamped
+				} else {
+					srcRects[i].Min.X += clamped
+				}
+			}
+		}
+		fuse(img, frames, srcRects, offX, -fb.Min.Y-rect.Min.Y, shear, mask, fusion)
+		return img, nil
+	}
 
 	mp := image.Point{}
 	op := draw.Src
 	if mask != nil {
-		log.Debug().Msg("Stitching using mask.")
+		logger.Debug().Msg("Stitching using mask.")
 		mp = mask.Bounds().Min
 		op = draw.Over
 	}
 
-	// Forward?
-	if w > 0 {
-		pos := 0
-		for i, f := range frames {
-			draw.DrawMask(img, img.Bounds().Add(image.Pt(pos, 0)), f, f.Bounds().Min, mask, mp, op)
-			pos += dx[i]
-		}
-	} else {
-		// Backwards.
-		pos := -w - fb.Dx()
-		for i, f := range frames {
-			draw.DrawMask(img, img.Bounds().Add(image.Pt(pos, 0)), f, f.Bounds().Min, mask, mp, op)
-			pos += dx[i]
+	for i := range frames {
+		// Only one frame at a time is loaded (if they were spilled).
+		f := loadFrame(frames[i])
+		src, srcMask, r := f, mask, srcRects[i]
+		if shear != nil && shear[i] != 0 {
+			src = imutil.Shear(f, shear[i])
+			if mask != nil {
+				srcMask = imutil.Shear(mask, shear[i])
+			}
 		}
+
+		off := r.Min.Sub(fb.Min)
+		dstMin := image.Pt(pos[i], 0).Add(off).Sub(rect.Min)
+		dst := image.Rectangle{Min: dstMin, Max: dstMin.Add(r.Size())}
+		draw.DrawMask(img, dst, src, r.Min, srcMask, mp.Add(off), op)
 	}
 
 	return img, nil
@@ -125,10 +190,68 @@ type Train struct {
 
 	Conf Config
 
+	// Model is the name of the motion model which was used to smooth the speed.
+	Model string
+	// Residuals contains the measured minus the fitted speed for each frame, in px/s.
+	// The sign is not corrected for direction.
+	Residuals []float64 `json:"-"`
+	// Quality describes how much the measurements of this train can be trusted.
+	Quality Quality
+	// TrackAngleDeg is the measured angle of the track (see Config.TrackAngleDeg), including the configured angle.
+	// Equal to Conf.TrackAngleDeg if it could not be measured.
+	TrackAngleDeg float64
+	// Cars are the cars found in Image, in image order. Nil if the train could not be segmented.
+	Cars []Car
+	// AxlesM are the positions of the axles found in Image, in m from its left edge, in image order.
+	// Nil if no axles were found.
+	AxlesM []float64
+	// Fingerprint describes the colors (livery) of the train, to find similar trains.
+	Fingerprint *Fingerprint
+	// Sequence is the name of the saved sequence this train was stitched from (see Config.SequenceDir),
+	// empty if it was not saved. It is saved in the background, and might be missing if that failed.
+	Sequence string
+
+	// Part is the part number (starting at 1) if the train was too long and had to be split into multiple parts.
+	// 0 if the train was not split.
+	Part int
+	// Group links the parts, if the train was split into parts. All parts of a train share the same Group.
+	// Nil if the train was not split.
+	Group *Group
+
 	Image *image.RGBA `json:"-"`
 	GIF   *gif.GIF    `json:"-"`
 }
 
+// Group links the parts of a train which was split into multiple parts.
+type Group struct {
+	// StartTS is the StartTS of the first part.
+	StartTS time.Time
+	// ID is the database id of the group (which is the id of its first part), 0 until the first part was stored.
+	// Set by db.InsertTrain().
+	ID int64
+}
+
+// Quality describes how well the motion model fits the measurements of a train.
+type Quality struct {
+	// Score is in [0, 1], higher is better.
+	// It is the product of InlierFraction and MeanCos.
+	Score float64
+	// InlierFraction is the fraction of frames whose measured speed is close to the fitted speed.
+	// The others were rejected as outliers.
+	InlierFraction float64
+	// ResidualRMSPxS is the root mean square of the residuals of the inliers, in px/s.
+	ResidualRMSPxS float64
+	// MeanCos is the mean cosine similarity of the matches between consecutive frames.
+	MeanCos float64
+
+	// Half widths of the 95% confidence intervals of LengthPx and SpeedPxS, NaN if they could not be estimated.
+	LengthCIPx float64
+	SpeedCIPxS float64
+
+	// LowConfidence is set if Score is below Config.MinQuality.
+	LowConfidence bool
+}
+
 // LengthM returns the absolute length in m.
 func (t *Train) LengthM() float64 {
 	return math.Abs(t.LengthPx) / t.Conf.PixelsPerM
@@ -139,6 +262,26 @@ func (t *Train) SpeedMpS() float64 {
 	return math.Abs(t.SpeedPxS) / t.Conf.PixelsPerM
 }
 
+// LengthCIM returns the half width of the 95% confidence interval of the length in m.
+func (t *Train) LengthCIM() float64 {
+	return t.Quality.LengthCIPx / t.Conf.PixelsPerM
+}
+
+// CarLengthM returns the length of a car in m.
+func (t *Train) CarLengthM(c Car) float64 {
+	return float64(c.LengthPx()) / t.Conf.PixelsPerM
+}
+
+// AxleSpacingsM returns the distances between consecutive axles in m, in image order.
+func (t *Train) AxleSpacingsM() []float64 {
+	return axleSpacings(t.AxlesM)
+}
+
+// SpeedCIMpS returns the half width of the 95% confidence interval of the speed in m/s.
+func (t *Train) SpeedCIMpS() float64 {
+	return t.Quality.SpeedCIPxS / t.Conf.PixelsPerM
+}
+
 // AccelMpS2 returns the acceleration in m/2^2, corrected for speed direction:
 // Positive means accelerating, negative means breaking.
 func (t *Train) AccelMpS2() float64 {
@@ -159,8 +302,9 @@ func (t *Train) DirectionS() string {
 	return "left"
 }
 
-func createGIF(seq sequence, stitched image.Image) (*gif.GIF, error) {
-	// Extract palette.
+// extractPalette extracts the dominant colors of a stitched image.
+// Also returns the thumbnail which was used for it.
+func extractPalette(stitched image.Image) (*palettor.Palette, image.Image, error) {
 	thumb := resize.Thumbnail(300, 300, stitched, resize.Lanczos3)
 	const (
 		paletteSize = 20
@@ -168,14 +312,29 @@ func createGIF(seq sequence, stitched image.Image) (*gif.GIF, error) {
 	)
 	pal, err := palettor.Extract(paletteSize, nIter, thumb)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	return pal, thumb, nil
+}
 
+func createGIF(seq sequence, pal *palettor.Palette) *gif.GIF {
 	g := gif.GIF{}
 
+	frames := seq.frames
+	rect := seq.frameBounds
+	if seq.full != nil {
+		// Low memory mode.
+		frames = seq.full
+		if len(frames) == 0 {
+			// Full frames are only kept for the start of a sequence, fall back to the strips.
+			frames = seq.frames
+			rect = seq.stripBounds
+		}
+	}
+
 	prevTS := *seq.startTS
-	rect := seq.frames[0].Bounds().Sub(seq.frames[0].Bounds().Min)
-	for i, ts := range seq.ts {
+	rect = rect.Sub(rect.Min)
+	for i, ts := range seq.ts[:len(frames)] {
 		dt := ts.Sub(prevTS)
 
 		// Skip every other frame.
@@ -184,7 +343,8 @@ func createGIF(seq sequence, stitched image.Image) (*gif.GIF, error) {
 		}
 
 		paletted := image.NewPaletted(rect, pal.Colors())
-		draw.Draw(paletted, paletted.Bounds(), seq.frames[i], seq.frames[i].Bounds().Min, draw.Src)
+		frame := loadFrame(frames[i])
+		draw.Draw(paletted, paletted.Bounds(), frame, frame.Bounds().Min, draw.Src)
 
 		g.Image = append(g.Image, paletted)
 		g.Delay = append(g.Delay, int(dt.Seconds()*100))
@@ -192,29 +352,93 @@ func createGIF(seq sequence, stitched image.Image) (*gif.GIF, error) {
 		prevTS = ts
 	}
 
-	return &g, nil
+	return &g
 }
 
-// fitAndStitch tries to stitch an image from a sequence.
-// Will first try to fit a constant acceleration speed model for smoothing.
+// rollingShutterShear returns the shear (see imutil.Shear()) which undoes the skew caused by a rolling shutter in each
+// frame, or nil if Config.LineReadoutS is 0.
+// Row y of a frame is read out LineReadoutS*(y-cy) after the center row cy, during which the train moved on by
+// speed*LineReadoutS*(y-cy).
+func rollingShutterShear(seq sequence, fit *fitResult, c Config) []float64 {
+	if c.LineReadoutS == 0 {
+		return nil
+	}
+
+	ret := make([]float64, len(seq.ts))
+	for i, ts := range seq.ts {
+		// The speed has the same sign as dx, i.e. it is positive if the train moves to the left. Then, lower rows
+		// show the train further left, and have to be shifted back to the right.
+		ret[i] = fit.speed(ts.Sub(*seq.startTS).Seconds()) * c.LineReadoutS
+	}
+	return ret
+}
+
+// reject creates the error for a failure in fitAndStitchOne().
+func reject(reason RejectReason, err error) *RejectError {
+	return &RejectError{Reason: reason, Err: err}
+}
+
+// fitAndStitch splits a sequence at gaps between trains, and tries to stitch an image from each part.
+// Returns all trains which were stitched successfully, and the errors (*RejectError) for all parts which failed.
+func fitAndStitch(seq sequence, c Config) ([]*Train, error) {
+	segs := findSegments(seq)
+	if len(segs) > 1 {
+		c.logger().Info().Int("n", len(segs)).Msg("found gaps in sequence, splitting")
+	}
+	seq.trace.add(time.Time{}, "fit", "%d frames, found %d segment(s) separated by gaps", len(seq.dx), len(segs))
+
+	var trains []*Train
+	var errs []error
+	for i, seg := range segs {
+		if seq.trace != nil {
+			seq.trace.segment = i
+		}
+		sub, ok := seq.sub(seg)
+		if !ok {
+			seq.trace.add(time.Time{}, "fit", "frames %d..%d: skipped, no movement", seg.start, seg.end)
+			continue
+		}
+		seq.trace.add(sub.ts[0], "fit", "frames %d..%d", seg.start, seg.end)
+
+		train, err := fitAndStitchOne(sub, c)
+		if err != nil {
+			summary := summarize(sub)
+			for _, rejectErr := range rejectErrors(err) {
+				prometheus.RecordFitAndStitchResult(c.Region, string(rejectErr.Reason))
+				rejectErr.Seq = summary
+				seq.trace.add(time.Time{}, "stitch", "rejected (%s): %s", rejectErr.Reason, rejectErr.Err)
+			}
+			errs = append(errs, err)
+			continue
+		}
+		seq.trace.add(time.Time{}, "stitch", "train: %.1f m, %.1f km/h %s, model %s, quality %.3f, %d cars, %d axles",
+			train.LengthM(), train.SpeedMpS()*3.6, train.DirectionS(), train.Model, train.Quality.Score, len(train.Cars), len(train.AxlesM))
+		trains = append(trains, train)
+	}
+
+	return trains, errors.Join(errs...)
+}
+
+// fitAndStitchOne tries to stitch an image from a sequence.
+// Will first try to fit a motion model (see Config.MotionModel) for smoothing.
 // Might modify seq (drops leading frames with no movement).
-func fitAndStitch(seq sequence, c Config) (*Train, error) {
+func fitAndStitchOne(seq sequence, c Config) (*Train, error) {
 	start := time.Now()
 	defer func() {
-		log.Trace().Dur("dur", time.Since(start)).Msg("fitAndStitch() duration")
+		c.logger().Trace().Dur("dur", time.Since(start)).Msg("fitAndStitchOne() duration")
 	}()
 
-	log.Info().Ints("dx", seq.dx).Int("len(frames)", len(seq.frames)).Msg("fitAndStitch()")
+	c.logger().Info().Ints("dx", seq.dx).Int("len(frames)", len(seq.frames)).Msg("fitAndStitchOne()")
 
 	// Sanity checks.
-	if len(seq.frames) != len(seq.dx) || len(seq.frames) != len(seq.ts) {
-		log.Panic().Msg("length of frames, dx, ts are not equal, this should not happen")
+	if len(seq.frames) != len(seq.dx) || len(seq.frames) != len(seq.ts) || len(seq.frames) != len(seq.cos) || len(seq.frames) != len(seq.bgCos) {
+		c.logger().Panic().Msg("length of frames, dx, ts, cos, bgCos are not equal, this should not happen")
 	}
 	if seq.startTS == nil {
-		log.Panic().Msg("startTS is nil, this should not happen")
+		c.logger().Panic().Msg("startTS is nil, this should not happen")
 	}
 	if len(seq.dx) == 0 || seq.dx[0] == 0 {
-		log.Panic().Int("len", len(seq.dx)).Msg("sequence is empty or first value is 0")
+		c.logger().Panic().Int("len", len(seq.dx)).Msg("sequence is empty or first value is 0")
 	}
 
 	// Remove trailing zeros.
@@ -222,50 +446,110 @@ func fitAndStitch(seq sequence, c Config) (*Train, error) {
 		seq.dx = seq.dx[:len(seq.dx)-1]
 		seq.ts = seq.ts[:len(seq.ts)-1]
 		seq.frames = seq.frames[:len(seq.frames)-1]
+		seq.cos = seq.cos[:len(seq.cos)-1]
+		seq.bgCos = seq.bgCos[:len(seq.bgCos)-1]
+	}
+	if len(seq.full) > len(seq.frames) {
+		seq.full = seq.full[:len(seq.frames)]
+	}
+	prometheus.RecordSequenceLength(c.Region, len(seq.frames))
+
+	models, err := motionModels(c.MotionModel, seq.ts[len(seq.ts)-1].Sub(*seq.startTS).Seconds())
+	if err != nil {
+		return nil, reject(RejectUnableToFit, err)
 	}
-	prometheus.RecordSequenceLength(len(seq.frames))
 
-	dxFit, ds, v0, a, err := fitDx(seq, float64(c.maxPxPerFrame(1)))
+	fit, err := fitDx(c.logger(), seq, float64(c.maxPxPerFrame(1)), models)
 	if err != nil {
-		prometheus.RecordFitAndStitchResult("unable_to_fit")
-		return nil, fmt.Errorf("was not able to fit the sequence: %w", err)
+		return nil, reject(RejectUnableToFit, fmt.Errorf("was not able to fit the sequence: %w", err))
+	}
+	c.logger().Info().Str("model", fit.model.Name()).Floats64("params", fit.params).Int("nInliers", fit.nInliers).Msg("selected motion model")
+	if fit.covErr != nil {
+		c.logger().Warn().Err(fit.covErr).Msg("unable to estimate the uncertainty of the fit")
 	}
 
-	if math.Abs(ds) < c.minLengthPx() {
-		prometheus.RecordFitAndStitchResult("too_short")
-		return nil, fmt.Errorf("discarded because too short, %f < %f", ds, c.minLengthPx())
+	if fit.ds < c.minLengthPx() {
+		return nil, reject(RejectTooShort, fmt.Errorf("discarded because too short, %f < %f", fit.ds, c.minLengthPx()))
 	}
 
 	// Estimate speed at halftime.
 	t0 := seq.ts[0]
-	tMid := seq.ts[len(seq.ts)/2]
-	speed := v0 + a*tMid.Sub(t0).Seconds()
+	tMid := seq.ts[len(seq.ts)/2].Sub(t0).Seconds()
+	speed := fit.speed(tMid)
 
 	if math.Abs(speed) < c.minSpeedPxPS() {
-		prometheus.RecordFitAndStitchResult("too_slow")
-		return nil, fmt.Errorf("discarded because too slow, %f < %f", speed, c.minSpeedPxPS())
+		return nil, reject(RejectTooSlow, fmt.Errorf("discarded because too slow, %f < %f", speed, c.minSpeedPxPS()))
 	}
 
-	img, err := stitch(seq.frames, dxFit, c.Mask)
+	shear := rollingShutterShear(seq, fit, c)
+	img, err := stitch(c.logger(), seq.frames, seq.frameBounds, fit.dx, shear, c.Mask, c.Fusion, c.maxImageBytes())
 	if err != nil {
-		prometheus.RecordFitAndStitchResult("unable_to_assemble_image")
-		return nil, fmt.Errorf("unable to assemble image: %w", err)
+		return nil, reject(RejectUnableToAssembleImage, fmt.Errorf("unable to assemble image: %w", err))
 	}
 
-	gif, err := createGIF(seq, img)
+	pal, thumb, err := extractPalette(img)
 	if err != nil {
 		panic(err)
 	}
+	gif := createGIF(seq, pal)
+
+	cars := segmentCars(seq, fit.dx, shear, img, c)
+	c.logger().Info().Int("nCars", len(cars)).Msg("segmented cars")
+
+	fingerprint := newFingerprint(thumb, img.Rect.Dx(), cars)
+
+	axles := findAxles(img, c.PixelsPerM)
+	c.logger().Info().Int("nAxles", len(axles)).Msg("found axles")
+
+	// Frames were already deskewed by the configured angle, this measures what is left.
+	trackAngle := c.TrackAngleDeg
+	angle, ok := measureAngle(seq.frames, fit.dx, c.goodCosScoreMove())
+	if ok {
+		trackAngle += angle
+	}
+	c.logger().Info().Float64("trackAngleDeg", trackAngle).Bool("measured", ok).Msg("track angle")
 
-	prometheus.RecordFitAndStitchResult("success")
+	var cosSum float64
+	for _, cos := range seq.cos {
+		cosSum += cos
+	}
+	q := Quality{
+		InlierFraction: float64(fit.nInliers) / float64(len(seq.dx)),
+		ResidualRMSPxS: fit.rmsInliers,
+		MeanCos:        cosSum / float64(len(seq.cos)),
+		LengthCIPx:     fit.dsCI,
+		SpeedCIPxS:     fit.speedCI(tMid),
+	}
+	q.Score = q.InlierFraction * math.Max(q.MeanCos, 0)
+	q.LowConfidence = q.Score < c.MinQuality
+	c.logger().Info().
+		Float64("score", q.Score).
+		Float64("inlierFraction", q.InlierFraction).
+		Float64("residualRMSPxS", q.ResidualRMSPxS).
+		Float64("meanCos", q.MeanCos).
+		Float64("lengthCIPx", q.LengthCIPx).
+		Float64("speedCIPxS", q.SpeedCIPxS).
+		Bool("lowConfidence", q.LowConfidence).
+		Msg("fit quality")
+
+	prometheus.RecordFitAndStitchResult(c.Region, "success")
 	return &Train{
-		t0,
-		len(seq.frames),
-		ds,
-		-speed, // Negate because when things move to the left we get positive dx values.
-		-a,
-		c,
-		img,
-		gif,
+		StartTS:   t0,
+		NFrames:   len(seq.frames),
+		LengthPx:  fit.ds,
+		SpeedPxS:  -speed, // Negate because when things move to the left we get positive dx values.
+		AccelPxS2: -fit.accel(tMid),
+		Conf:      c,
+		Model:     fit.model.Name(),
+		Residuals: fit.residuals,
+		Quality:   q,
+
+		TrackAngleDeg: trackAngle,
+		Cars:          cars,
+		AxlesM:        axles,
+		Fingerprint:   fingerprint,
+
+		Image: img,
+		GIF:   gif,
 	}, nil
 }
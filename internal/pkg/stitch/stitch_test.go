@@ -0,0 +1,307 @@
+package stitch
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"jo-m.ch/go/trainbot/pkg/imutil"
+	"jo-m.ch/go/trainbot/pkg/remap"
+)
+
+// genFrames cuts n frames of width w out of pano, moving by dx pixels per frame.
+func genFrames(pano *image.RGBA, w, n, dx int) ([]image.Image, []int) {
+	var frames []image.Image
+	var dxs []int
+	for i := range n {
+		x := i * dx
+		if dx < 0 {
+			x = (n - 1 - i) * -dx
+		}
+		f := imutil.CopyRect(pano, image.Rect(x, 0, x+w, pano.Rect.Dy()))
+		// Reset origin, all frames come from the same camera rect.
+		f.Rect = f.Rect.Sub(f.Rect.Min)
+		frames = append(frames, f)
+		dxs = append(dxs, dx)
+	}
+	return frames, dxs
+}
+
+func stripsOf(frames []image.Image, r image.Rectangle) []image.Image {
+	var ret []image.Image
+	for _, f := range frames {
+		ret = append(ret, imutil.CopyRect(f, r))
+	}
+	return ret
+}
+
+func assertSubEqual(t *testing.T, pano *image.RGBA, x0 int, img *image.RGBA) {
+	t.Helper()
+
+	sub, err := imutil.Sub(pano, image.Rect(x0, 0, x0+img.Rect.Dx(), img.Rect.Dy()))
+	require.NoError(t, err)
+	assert.Equal(t, imutil.ToRGBA(sub).Pix, img.Pix)
+}
+
+func Test_stitch_LowMemoryStrips(t *testing.T) {
+	const (
+		w  = 100
+		n  = 20
+		dx = 12
+	)
+	pano := imutil.RandRGBA(123, w+n*dx, 50)
+	fb := image.Rect(0, 0, w, 50)
+	c := Config{}
+	strip := c.stripRect(fb, dx)
+	assert.Equal(t, image.Rect(38, 0, 62, 50), strip)
+
+	for _, d := range []int{dx, -dx} {
+		frames, dxs := genFrames(pano, w, n, d)
+
+		full, err := stitch(&log.Logger, frames, fb, dxs, nil, nil, FusionLast, c.maxImageBytes())
+		require.NoError(t, err)
+		assert.Equal(t, w+(n-1)*dx, full.Rect.Dx())
+		assertSubEqual(t, pano, 0, full)
+
+		strips, err := stitch(&log.Logger, stripsOf(frames, strip), fb, dxs, nil, nil, FusionLast, c.maxImageBytes())
+		require.NoError(t, err)
+		assert.Equal(t, strip.Dx()+(n-1)*dx, strips.Rect.Dx())
+		assertSubEqual(t, pano, strip.Min.X, strips)
+	}
+}
+
+func Test_stitch_MaxImageSize(t *testing.T) {
+	pano := imutil.RandRGBA(123, 1000, 50)
+	frames, dxs := genFrames(pano, 100, 10, 10)
+
+	_, err := stitch(&log.Logger, frames, frames[0].Bounds(), dxs, nil, nil, FusionLast, 190*50*4)
+	assert.NoError(t, err)
+	_, err = stitch(&log.Logger, frames, frames[0].Bounds(), dxs, nil, nil, FusionLast, 190*50*4-1)
+	assert.Error(t, err)
+}
+
+func Test_stitch_Shear(t *testing.T) {
+	const (
+		w  = 60
+		h  = 11
+		n  = 10
+		dx = 10
+		// Shift of the top and bottom rows.
+		maxShift = 5
+	)
+	pano := imutil.RandRGBA(123, w+(n-1)*dx+2*maxShift, h)
+	fb := image.Rect(0, 0, w, h)
+
+	// Moving to the left, lower rows were read out later and show the train further left.
+	var frames []image.Image
+	var dxs []int
+	var shear []float64
+	for i := range n {
+		f := image.NewRGBA(fb)
+		for y := range h {
+			shift := y - h/2
+			for x := range w {
+				f.SetRGBA(x, y, pano.RGBAAt(maxShift+i*dx+x+shift, y))
+			}
+		}
+		frames = append(frames, f)
+		dxs = append(dxs, dx)
+		shear = append(shear, 1)
+	}
+
+	c := Config{}
+	skewed, err := stitch(&log.Logger, frames, fb, dxs, nil, nil, FusionLast, c.maxImageBytes())
+	require.NoError(t, err)
+	img, err := stitch(&log.Logger, frames, fb, dxs, shear, nil, FusionLast, c.maxImageBytes())
+	require.NoError(t, err)
+	assert.Equal(t, skewed.Rect, img.Rect)
+
+	// Except for the clamped left and right edges.
+	inner := image.Rect(maxShift, 0, img.Rect.Dx()-maxShift, h)
+	assertSubEqual(t, pano, 2*maxShift, imutil.ToRGBA(img.SubImage(inner)))
+	// The clamped edges of later frames are not used for fusion either.
+	fused, err := stitch(&log.Logger, frames, fb, dxs, shear, nil, FusionMedian, c.maxImageBytes())
+	require.NoError(t, err)
+	assert.Equal(t, img.Rect, fused.Rect)
+	fusedInner := imutil.ToRGBA(fused.SubImage(inner))
+	for y := range h {
+		for x := range inner.Dx() {
+			assert.Equal(t, pano.RGBAAt(2*maxShift+x, y).R, fusedInner.RGBAAt(x, y).R)
+		}
+	}
+	sub, err := imutil.Sub(pano, inner.Add(image.Pt(maxShift, 0)))
+	require.NoError(t, err)
+	assert.NotEqual(t, imutil.ToRGBA(sub).Pix, imutil.ToRGBA(skewed.SubImage(inner)).Pix)
+}
+
+func opaqueRandRGBA(seed int64, w, h int) *image.RGBA {
+	img := imutil.RandRGBA(seed, w, h)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 0xff
+	}
+	return img
+}
+
+func Test_stitch_Fusion(t *testing.T) {
+	const (
+		w  = 50
+		n  = 20
+		dx = 10
+	)
+	pano := opaqueRandRGBA(123, w+n*dx, 30)
+	fb := image.Rect(0, 0, w, 30)
+	c := Config{}
+	strip := c.stripRect(fb, dx)
+
+	// Without noise, all modes give the same result.
+	for _, fusion := range []string{FusionMean, FusionMedian} {
+		for _, d := range []int{dx, -dx} {
+			frames, dxs := genFrames(pano, w, n, d)
+
+			full, err := stitch(&log.Logger, frames, fb, dxs, nil, nil, fusion, c.maxImageBytes())
+			require.NoError(t, err)
+			assert.Equal(t, w+(n-1)*dx, full.Rect.Dx())
+			assertSubEqual(t, pano, 0, full)
+
+			strips, err := stitch(&log.Logger, stripsOf(frames, strip), fb, dxs, nil, nil, fusion, c.maxImageBytes())
+			require.NoError(t, err)
+			assertSubEqual(t, pano, strip.Min.X, strips)
+		}
+	}
+
+	// Masked pixels are not used.
+	frames, dxs := genFrames(pano, w, n, dx)
+	mask := image.NewAlpha(fb)
+	for y := range 30 {
+		for x := 10; x < 40; x++ {
+			mask.SetAlpha(x, y, color.Alpha{0xff})
+		}
+	}
+	last, err := stitch(&log.Logger, frames, fb, dxs, nil, mask, FusionLast, c.maxImageBytes())
+	require.NoError(t, err)
+	for _, fusion := range []string{FusionMean, FusionMedian} {
+		img, err := stitch(&log.Logger, frames, fb, dxs, nil, mask, fusion, c.maxImageBytes())
+		require.NoError(t, err)
+		assert.Equal(t, last.Pix, img.Pix)
+	}
+}
+
+func Test_stitch_RemappedCorners(t *testing.T) {
+	const (
+		w  = 50
+		h  = 30
+		n  = 20
+		dx = 10
+	)
+	pano := opaqueRandRGBA(123, w+n*dx, h)
+	fb := image.Rect(0, 0, w, h)
+	frames, dxs := genFrames(pano, w, n, dx)
+
+	// Rotated by 5 degrees around the center, so that the corners of each frame are empty.
+	s, co := math.Sincos(5 * math.Pi / 180)
+	cx, cy := float64(w)/2, float64(h)/2
+	rot := remap.Homography{co, -s, cx - co*cx + s*cy, s, co, cy - s*cx - co*cy, 0, 0, 1}
+	m, err := remap.New(fb, remap.Params{Homography: &rot})
+	require.NoError(t, err)
+	for i := range frames {
+		frames[i], err = m.Apply(frames[i])
+		require.NoError(t, err)
+	}
+	require.Zero(t, frames[1].(*image.RGBA).RGBAAt(0, 0).A)
+	mask, err := m.Mask(nil)
+	require.NoError(t, err)
+
+	// Except at both ends of the train, each pixel is covered by the inside of some frame.
+	c := Config{}
+	inner := image.Rect(w, 0, (n-1)*dx, h)
+	for _, fusion := range FusionNames {
+		img, err := stitch(&log.Logger, frames, fb, dxs, nil, mask, fusion, c.maxImageBytes())
+		require.NoError(t, err)
+		for y := inner.Min.Y; y < inner.Max.Y; y++ {
+			for x := inner.Min.X; x < inner.Max.X; x++ {
+				require.Equal(t, uint8(0xff), img.RGBAAt(x, y).A, "fusion=%s x=%d y=%d", fusion, x, y)
+				// Transparent pixels would be fused as black.
+				px := img.RGBAAt(x, y)
+				assert.Greater(t, int(px.R)+int(px.G)+int(px.B), 0, "fusion=%s x=%d y=%d", fusion, x, y)
+			}
+		}
+	}
+}
+
+func Test_stitch_FusionSnow(t *testing.T) {
+	const (
+		w  = 50
+		h  = 30
+		n  = 20
+		dx = 10
+	)
+	pano := opaqueRandRGBA(123, w+n*dx, h)
+	fb := image.Rect(0, 0, w, h)
+	frames, dxs := genFrames(pano, w, n, dx)
+
+	// Each frame has some white flakes at different places.
+	rnd := rand.New(rand.NewSource(1)) // #nosec G404
+	for _, f := range frames {
+		for range 20 {
+			f.(*image.RGBA).SetRGBA(rnd.Intn(w), rnd.Intn(h), color.RGBA{0xff, 0xff, 0xff, 0xff})
+		}
+	}
+
+	c := Config{}
+	// Only check the part which is covered by all w/dx frames.
+	inner := image.Rect(w, 0, (n-1)*dx, h)
+	diff := func(img *image.RGBA) int {
+		sum := 0
+		for y := inner.Min.Y; y < inner.Max.Y; y++ {
+			for x := inner.Min.X; x < inner.Max.X; x++ {
+				a, b := img.RGBAAt(x, y), pano.RGBAAt(x, y)
+				sum += iabs(int(a.R)-int(b.R)) + iabs(int(a.G)-int(b.G)) + iabs(int(a.B)-int(b.B))
+			}
+		}
+		return sum
+	}
+
+	last, err := stitch(&log.Logger, frames, fb, dxs, nil, nil, FusionLast, c.maxImageBytes())
+	require.NoError(t, err)
+	mean, err := stitch(&log.Logger, frames, fb, dxs, nil, nil, FusionMean, c.maxImageBytes())
+	require.NoError(t, err)
+	med, err := stitch(&log.Logger, frames, fb, dxs, nil, nil, FusionMedian, c.maxImageBytes())
+	require.NoError(t, err)
+
+	assert.Greater(t, diff(last), 0)
+	assert.Less(t, diff(mean), diff(last))
+	assert.Zero(t, diff(med))
+}
+
+func Test_median(t *testing.T) {
+	equal := func(values ...uint8) []observation {
+		var ret []observation
+		for _, v := range values {
+			ret = append(ret, observation{v, 0xff})
+		}
+		return ret
+	}
+	assert.Equal(t, uint8(3), median(equal(5, 1, 3)))
+	assert.Equal(t, uint8(4), median(equal(5, 1, 3, 9)))
+	assert.Equal(t, uint8(7), median(equal(7)))
+
+	// Weighted by the mask.
+	assert.Equal(t, uint8(5), median([]observation{{5, 0xff}, {1, 0x10}, {3, 0x10}}))
+	assert.Equal(t, uint8(1), median([]observation{{5, 0x10}, {1, 0xff}, {3, 0x80}}))
+	assert.Equal(t, uint8(2), median([]observation{{1, 0x80}, {3, 0x80}}))
+}
+
+func Test_rollingShutterShear(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	seq := sequence{ts: []time.Time{t0.Add(time.Second), t0.Add(2 * time.Second)}, startTS: &t0}
+	fit := &fitResult{model: constantAccel{}, params: []float64{1000, 100}}
+
+	assert.Nil(t, rollingShutterShear(seq, fit, Config{}))
+	assert.InDeltaSlice(t, []float64{1100 * 20e-6, 1200 * 20e-6}, rollingShutterShear(seq, fit, Config{LineReadoutS: 20e-6}), 1e-9)
+}
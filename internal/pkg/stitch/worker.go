@@ -0,0 +1,153 @@
+package stitch
+
+import (
+	"errors"
+	"time"
+
+	"jo-m.ch/go/trainbot/internal/pkg/prometheus"
+)
+
+// stitchJob is a sequence which is handed over to be fitted and stitched.
+// The job takes ownership of the sequence.
+type stitchJob struct {
+	seq sequence
+	// Timestamp of the frame which ended the sequence.
+	ts time.Time
+	// Whether the train continues in the next sequence.
+	continued bool
+	// Set if the sequence is being saved, which then owns its spill.
+	save *pendingSave
+
+	// Set when done.
+	trains []*Train
+	err    error
+	done   chan struct{}
+}
+
+// run fits and stitches the sequence. If saver is not nil, the sequence is saved in the background meanwhile, and
+// deleted again if no train was found.
+func (j *stitchJob) run(c Config, saver *sequenceSaver) {
+	t0 := time.Now()
+	defer func() {
+		prometheus.RecordStitchDuration(c.Region, time.Since(t0).Seconds())
+		close(j.done)
+	}()
+
+	if saver != nil {
+		j.save = saver.start(j.seq, c)
+	}
+
+	j.trains, j.err = fitAndStitch(j.seq, c)
+	if j.save != nil {
+		for _, t := range j.trains {
+			t.Sequence = j.save.name
+		}
+	}
+
+	if c.DebugDir != "" {
+		path, err := writeDebugBundle(c.DebugDir, j.seq, c, j.trains, j.err)
+		if err != nil {
+			c.logger().Err(err).Msg("failed to write diagnostic bundle")
+		} else {
+			c.logger().Info().Str("path", path).Msg("wrote diagnostic bundle")
+		}
+	}
+
+	if j.save != nil {
+		j.save.keep <- len(j.trains) > 0
+	}
+}
+
+// worker fits and stitches jobs, until jobs is closed.
+// r.c is never modified, so it is safe to read concurrently.
+func (r *AutoStitcher) worker(jobs <-chan *stitchJob) {
+	for j := range jobs {
+		j.run(r.c, r.saver)
+	}
+}
+
+// submit hands over the current sequence to be fitted and stitched, and starts a new one.
+// In synchronous mode (Config.StitchQueueSize is 0), the job is run immediately.
+// If the queue is full, the sequence is dropped, and rejected once the jobs before it are done.
+func (r *AutoStitcher) submit(ts time.Time, continued bool) {
+	j := &stitchJob{
+		seq:       r.seq,
+		ts:        ts,
+		continued: continued,
+		done:      make(chan struct{}),
+	}
+	r.seq = sequence{}
+	r.queue = append(r.queue, j)
+	prometheus.RecordStitchQueueLength(r.c.Region, len(r.queue))
+
+	if r.jobs == nil {
+		j.run(r.c, r.saver)
+		return
+	}
+
+	select {
+	case r.jobs <- j:
+	default:
+		r.c.logger().Warn().Int("size", cap(r.jobs)).Msg("stitch queue full, dropping sequence")
+		j.err = &RejectError{Reason: RejectQueueFull, Err: errors.New("stitch queue full"), Seq: summarize(j.seq)}
+		close(j.done)
+	}
+}
+
+// collect returns the trains from all jobs which are done, in the order they were submitted.
+// If wait is true, it waits for all jobs to complete.
+func (r *AutoStitcher) collect(wait bool) []*Train {
+	var trains []*Train
+	for len(r.queue) > 0 {
+		j := r.queue[0]
+		if wait {
+			<-j.done
+		} else {
+			select {
+			case <-j.done:
+			default:
+				return trains
+			}
+		}
+
+		r.queue = r.queue[1:]
+		prometheus.RecordStitchQueueLength(r.c.Region, len(r.queue))
+		trains = append(trains, r.finish(j)...)
+	}
+	return trains
+}
+
+// finish assigns part numbers to the trains of a completed job, and publishes events.
+func (r *AutoStitcher) finish(j *stitchJob) []*Train {
+	// Nothing needs the frames any more, except a pending save.
+	if j.save == nil {
+		defer j.seq.spill.close()
+	}
+
+	if j.err != nil {
+		r.c.logger().Err(j.err).Time("startTs", j.seq.ts[0]).Msg("unable to fit and stitch sequence")
+	}
+	for _, rejectErr := range rejectErrors(j.err) {
+		r.emit(&j.seq, Event{Type: EventSequenceRejected, TS: j.ts, Err: rejectErr})
+	}
+
+	r.assignParts(j.trains, j.continued)
+	if !j.continued {
+		r.part = 0
+		r.group = nil
+		r.emit(&j.seq, Event{Type: EventSequenceEnded, TS: j.ts, NTrains: len(j.trains)})
+	}
+
+	return j.trains
+}
+
+// Close stops the stitch worker, if any, and waits until all sequences have been saved.
+// Call TryStitchAndReset() before to get the remaining trains.
+// The AutoStitcher must not be used afterwards.
+func (r *AutoStitcher) Close() {
+	if r.jobs != nil {
+		close(r.jobs)
+		r.jobs = nil
+	}
+	r.saver.wait()
+}
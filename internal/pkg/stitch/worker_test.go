@@ -0,0 +1,67 @@
+package stitch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_AutoStitcher_Async(t *testing.T) {
+	for _, maxFrames := range []int{1500, 100} {
+		c := Config{PixelsPerM: 10, MinSpeedKPH: 10, MaxSpeedKPH: 160, MinLengthM: 10, MaxFrameCountPerSeq: maxFrames}
+		syncTrains, syncEvents := runEvents(t, c)
+		require.NotEmpty(t, syncTrains)
+
+		c.StitchQueueSize = 2
+		asyncTrains, asyncEvents := runEvents(t, c)
+		require.Len(t, asyncTrains, len(syncTrains))
+		for i := range syncTrains {
+			assert.Equal(t, syncTrains[i].StartTS, asyncTrains[i].StartTS)
+			assert.Equal(t, syncTrains[i].Part, asyncTrains[i].Part)
+			assert.Equal(t, syncTrains[i].Group, asyncTrains[i].Group)
+			assert.Equal(t, syncTrains[i].Image.Bounds(), asyncTrains[i].Image.Bounds())
+		}
+		assert.Equal(t, syncEvents[len(syncEvents)-1], asyncEvents[len(asyncEvents)-1])
+	}
+}
+
+func Test_AutoStitcher_QueueFull(t *testing.T) {
+	// Many short parts.
+	c := Config{PixelsPerM: 10, MinSpeedKPH: 10, MaxSpeedKPH: 160, MinLengthM: 10, MaxFrameCountPerSeq: 30}
+	syncTrains, _ := runEvents(t, c)
+	require.Greater(t, len(syncTrains), 3)
+
+	// The worker only starts after all frames, so that the queue holds the first part, and all others are dropped.
+	frames, ts := genVideo(300, 2000, 10, 20)
+	a := NewAutoStitcher(c)
+	a.jobs = make(chan *stitchJob, 1)
+	t.Cleanup(a.Close)
+	var events []Event
+	a.SetEventHandler(func(e Event) {
+		events = append(events, e)
+	})
+
+	var trains []*Train
+	for i := range frames {
+		trains = append(trains, a.Frame(frames[i], ts[i])...)
+	}
+	require.Empty(t, trains)
+	go a.worker(a.jobs)
+	trains = a.TryStitchAndReset()
+
+	require.Len(t, trains, 1)
+	assert.Equal(t, syncTrains[0].StartTS, trains[0].StartTS)
+	assert.Equal(t, 1, trains[0].Part)
+
+	nDropped := 0
+	for _, e := range events {
+		if e.Type == EventSequenceRejected && e.Err.Reason == RejectQueueFull {
+			nDropped++
+			require.NotNil(t, e.Err.Seq)
+			assert.NotZero(t, e.Err.Seq.NFrames)
+		}
+	}
+	assert.GreaterOrEqual(t, nDropped, len(syncTrains)-1)
+	assert.Equal(t, EventSequenceEnded, events[len(events)-1].Type)
+}
@@ -24,6 +24,8 @@ type FTPConfig struct {
 type FTP struct {
 	conf FTPConfig
 	conn *ftp.ServerConn
+	// Directories which are known to exist, so that they are not created again for every file (e.g. tiles).
+	dirs map[string]struct{}
 }
 
 // Compile time interface check.
@@ -51,6 +53,7 @@ func NewFTP(ctx context.Context, c FTPConfig) (*FTP, error) {
 	return &FTP{
 		conf: c,
 		conn: conn,
+		dirs: map[string]struct{}{},
 	}, nil
 }
 
@@ -71,13 +74,14 @@ func (f *FTP) createDirs(dirsPath string) error {
 
 	for i := range components {
 		dir := path.Join(components[:i+1]...)
+		if _, ok := f.dirs[dir]; ok {
+			continue
+		}
 		err := f.conn.MakeDir(dir)
-		if err != nil {
-			if isFTPErr(err, 550) {
-				continue
-			}
+		if err != nil && !isFTPErr(err, 550) {
 			return err
 		}
+		f.dirs[dir] = struct{}{}
 	}
 
 	return nil
@@ -122,7 +126,35 @@ func (f *FTP) ListFiles(_ context.Context, remotePath string) ([]string, error)
 	return ret, nil
 }
 
+// ListDirs implements Uploader.
+func (f *FTP) ListDirs(_ context.Context, remotePath string) ([]string, error) {
+	l, err := f.conn.List(remotePath)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []string{}
+	for _, e := range l {
+		if e.Type != ftp.EntryTypeFolder || e.Name == "." || e.Name == ".." {
+			continue
+		}
+		ret = append(ret, e.Name)
+	}
+
+	return ret, nil
+}
+
 // DeleteFile implements Uploader.
 func (f *FTP) DeleteFile(_ context.Context, remotePath string) error {
 	return f.conn.Delete(remotePath)
 }
+
+// DeleteDir implements Uploader.
+func (f *FTP) DeleteDir(_ context.Context, remotePath string) error {
+	for dir := range f.dirs {
+		if dir == remotePath || strings.HasPrefix(dir, remotePath+"/") {
+			delete(f.dirs, dir)
+		}
+	}
+	return f.conn.RemoveDirRecur(remotePath)
+}
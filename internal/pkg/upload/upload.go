@@ -10,10 +10,12 @@ import (
 	"os"
 	"path"
 	"sort"
+	"strings"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/rs/zerolog/log"
 	"jo-m.ch/go/trainbot/internal/pkg/db"
+	"jo-m.ch/go/trainbot/pkg/dzi"
 )
 
 const (
@@ -29,8 +31,12 @@ type Uploader interface {
 	// ListFiles lists all regular files in a remote directory.
 	// Any non-regular files (e.g. directories) are to be ignored.
 	ListFiles(ctx context.Context, remotePath string) ([]string, error)
+	// ListDirs lists all directories in a remote directory.
+	ListDirs(ctx context.Context, remotePath string) ([]string, error)
 	// DeleteFile deletes a regular file at the given remote path.
 	DeleteFile(ctx context.Context, remotePath string) error
+	// DeleteDir deletes a directory at the given remote path, including all its contents.
+	DeleteDir(ctx context.Context, remotePath string) error
 	// Close terminates the connection and frees any resources.
 	Close() error
 }
@@ -39,8 +45,17 @@ func serverBlobPath(blobName string) string {
 	return path.Join(blobsDir, blobName)
 }
 
+// isTile returns true if a remote path is a tile (see dzi.TileNames()), there are thousands of them per train.
+func isTile(remotePath string) bool {
+	return strings.Contains(remotePath, dzi.FilesDirSuffix+"/")
+}
+
 func uploadFile(ctx context.Context, uploader Uploader, localPath, remotePath string, atomic bool) error {
-	log.Info().Str("local", localPath).Str("remote", remotePath).Msg("uploading file")
+	l := log.Info()
+	if isTile(remotePath) {
+		l = log.Debug()
+	}
+	l.Str("local", localPath).Str("remote", remotePath).Msg("uploading file")
 	// #nosec G304
 	f, err := os.Open(localPath)
 	if err != nil {
@@ -72,13 +87,16 @@ func All(ctx context.Context, store DataStore, dbx *sqlx.DB, uploader Uploader)
 			return 0, err
 		}
 
-		log.Info().Str("img", toUpload.ImgFileName()).Str("gif", toUpload.GIFFileName()).Int64("id", toUpload.ID).Msg("uploading")
+		blobs := toUpload.Blobs()
+		log.Info().Str("img", toUpload.ImgFileName()).Str("gif", toUpload.GIFFileName()).Int("nBlobs", len(blobs)).Int64("id", toUpload.ID).Msg("uploading")
 
-		err = uploadFile(ctx, uploader, store.GetBlobPath(toUpload.ImgFileName()), serverBlobPath(toUpload.ImgFileName()), false)
-		if err != nil {
-			log.Err(err).Send()
-			if !errors.Is(err, fs.ErrNotExist) {
-				return 0, err
+		for _, blob := range blobs {
+			err = uploadFile(ctx, uploader, store.GetBlobPath(blob), serverBlobPath(blob), false)
+			if err != nil {
+				log.Err(err).Send()
+				if !errors.Is(err, fs.ErrNotExist) {
+					return 0, err
+				}
 			}
 		}
 
@@ -90,14 +108,6 @@ func All(ctx context.Context, store DataStore, dbx *sqlx.DB, uploader Uploader)
 			}
 		}
 
-		err = uploadFile(ctx, uploader, store.GetBlobPath(toUpload.GIFFileName()), serverBlobPath(toUpload.GIFFileName()), false)
-		if err != nil {
-			log.Err(err).Send()
-			if !errors.Is(err, fs.ErrNotExist) {
-				return 0, err
-			}
-		}
-
 		err = db.SetUploaded(dbx, toUpload.ID)
 		if err != nil {
 			log.Err(err).Send()
@@ -123,7 +133,34 @@ func All(ctx context.Context, store DataStore, dbx *sqlx.DB, uploader Uploader)
 	return nUploads, uploadFile(ctx, uploader, store.GetDataPath(dbBakFile), dbFile, true)
 }
 
-// CleanupOrphanedRemoteBlobs removes from the remote storage all blobs which are unknown to the database.
+// DeleteBlobs removes blobs from the remote storage, e.g. those a train no longer has after it was stitched again.
+// If a blob is a tiles descriptor, its tiles directory is removed as well. Blobs which cannot be deleted (e.g.
+// because they were never uploaded) are skipped. Returns the number of deleted blobs.
+func DeleteBlobs(ctx context.Context, uploader Uploader, blobs []string) int {
+	var nDeletions int
+	for _, blob := range blobs {
+		log.Info().Str("remoteBlob", blob).Msg("deleting blob")
+		err := uploader.DeleteFile(ctx, serverBlobPath(blob))
+		if err != nil {
+			log.Warn().Err(err).Str("remoteBlob", blob).Msg("failed to delete blob")
+		} else {
+			nDeletions++
+		}
+
+		if path.Ext(blob) == dzi.DescriptorExt {
+			tilesDir := serverBlobPath(dzi.FilesDir(blob))
+			err := uploader.DeleteDir(ctx, tilesDir)
+			if err != nil {
+				log.Warn().Err(err).Str("dir", tilesDir).Msg("failed to delete tiles")
+			}
+		}
+	}
+
+	return nDeletions
+}
+
+// CleanupOrphanedRemoteBlobs removes from the remote storage all blobs which are unknown to the database, as well as
+// tiles directories whose descriptor is unknown.
 func CleanupOrphanedRemoteBlobs(ctx context.Context, dbx *sqlx.DB, uploader Uploader) (int, error) {
 	// Get list of blobs from remote.
 	remoteBlobs, err := uploader.ListFiles(ctx, blobsDir)
@@ -131,6 +168,11 @@ func CleanupOrphanedRemoteBlobs(ctx context.Context, dbx *sqlx.DB, uploader Uplo
 		return 0, err
 	}
 	sort.Strings(remoteBlobs)
+	remoteDirs, err := uploader.ListDirs(ctx, blobsDir)
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(remoteDirs)
 
 	// Map of blobs existing in the database, for comparison.
 	knownBlobs, err := db.GetAllBlobs(dbx)
@@ -153,5 +195,24 @@ func CleanupOrphanedRemoteBlobs(ctx context.Context, dbx *sqlx.DB, uploader Uplo
 		}
 	}
 
+	// Tiles are in a directory next to the descriptor, which might be missing (e.g. if the upload was interrupted).
+	for _, remoteDir := range remoteDirs {
+		base, ok := strings.CutSuffix(remoteDir, dzi.FilesDirSuffix)
+		if !ok {
+			continue
+		}
+		if _, known := knownBlobs[base+dzi.DescriptorExt]; known {
+			continue
+		}
+
+		log.Info().Str("dir", remoteDir).Msg("orphaned tiles, deleting")
+		err := uploader.DeleteDir(ctx, serverBlobPath(remoteDir))
+		if err != nil {
+			log.Err(err).Send()
+			return 0, err
+		}
+		nDeletions++
+	}
+
 	return nDeletions, nil
 }
@@ -0,0 +1,93 @@
+package upload
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"jo-m.ch/go/trainbot/internal/pkg/db"
+	"jo-m.ch/go/trainbot/internal/pkg/stitch"
+)
+
+// fakeUploader records the remote files and directories in the blobs directory.
+type fakeUploader struct {
+	files, dirs map[string]bool
+}
+
+var _ Uploader = (*fakeUploader)(nil)
+
+func (f *fakeUploader) Upload(context.Context, string, io.Reader) error       { return nil }
+func (f *fakeUploader) AtomicUpload(context.Context, string, io.Reader) error { return nil }
+func (f *fakeUploader) Close() error                                          { return nil }
+
+func (f *fakeUploader) ListFiles(context.Context, string) ([]string, error) {
+	ret := []string{}
+	for name := range f.files {
+		ret = append(ret, name)
+	}
+	return ret, nil
+}
+
+func (f *fakeUploader) ListDirs(context.Context, string) ([]string, error) {
+	ret := []string{}
+	for name := range f.dirs {
+		ret = append(ret, name)
+	}
+	return ret, nil
+}
+
+func (f *fakeUploader) DeleteFile(_ context.Context, remotePath string) error {
+	delete(f.files, filepath.Base(remotePath))
+	return nil
+}
+
+func (f *fakeUploader) DeleteDir(_ context.Context, remotePath string) error {
+	delete(f.dirs, filepath.Base(remotePath))
+	return nil
+}
+
+func Test_CleanupOrphanedRemoteBlobs(t *testing.T) {
+	dbx, err := db.Open(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer dbx.Close()
+
+	ts := time.Date(2023, 6, 10, 16, 20, 58, 0, time.UTC)
+	id, err := db.InsertTrain(dbx, stitch.Train{StartTS: ts})
+	require.NoError(t, err)
+	w, h := 100, 50
+	known := db.Train{ID: id, StartTS: ts, TilesW: &w, TilesH: &h}
+	require.NoError(t, db.SetTrainBlobs(dbx, known))
+	orphan := db.Train{StartTS: ts.Add(time.Hour)}
+
+	uploader := &fakeUploader{
+		files: map[string]bool{
+			known.ImgFileName():  true,
+			known.DZIFileName():  true,
+			orphan.ImgFileName(): true,
+			orphan.DZIFileName(): true,
+		},
+		dirs: map[string]bool{
+			known.TilesDirName(): true,
+			// Descriptor was never uploaded.
+			(&db.Train{StartTS: ts.Add(2 * time.Hour)}).TilesDirName(): true,
+			orphan.TilesDirName(): true,
+			"other":               true,
+		},
+	}
+
+	n, err := CleanupOrphanedRemoteBlobs(context.Background(), dbx, uploader)
+	require.NoError(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, map[string]bool{known.ImgFileName(): true, known.DZIFileName(): true}, uploader.files)
+	assert.Equal(t, map[string]bool{known.TilesDirName(): true, "other": true}, uploader.dirs)
+}
+
+func Test_isTile(t *testing.T) {
+	assert.True(t, isTile("blobs/train_files/0/0_0.jpg"))
+	assert.False(t, isTile("blobs/train.jpg"))
+	assert.False(t, isTile("blobs/train.dzi"))
+}
@@ -0,0 +1,158 @@
+// Package dzi writes Deep Zoom images (DZI): a pyramid of an image at decreasing resolutions, cut into tiles, plus an
+// XML descriptor. This allows zoomable viewers (e.g. OpenSeadragon) to show very large images at full resolution,
+// loading only the visible tiles.
+//
+// The descriptor is stored as NAME.dzi, the tiles as NAME_files/LEVEL/COL_ROW.jpg, where the highest level is the image
+// at full resolution, and each level below has half the width and height, down to 1x1 pixels at level 0.
+package dzi
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"jo-m.ch/go/trainbot/pkg/imutil"
+)
+
+const (
+	// TileSize is the width and height of the tiles [px], without overlap.
+	TileSize = 254
+	// Overlap is the number of pixels by which tiles overlap their neighbors on each side.
+	Overlap = 1
+	// Format is the file format (extension) of the tiles.
+	Format = "jpg"
+
+	// DescriptorExt is the file extension of the descriptor.
+	DescriptorExt = ".dzi"
+	// FilesDirSuffix is appended to the name of the descriptor (without extension) to get the tiles directory.
+	FilesDirSuffix = "_files"
+)
+
+// FilesDir returns the name of the tiles directory of the descriptor descName, e.g. "x_files" for "x.dzi".
+func FilesDir(descName string) string {
+	return strings.TrimSuffix(descName, DescriptorExt) + FilesDirSuffix
+}
+
+// MaxLevel returns the highest level (the full resolution) of the pyramid of an image of size w x h.
+func MaxLevel(w, h int) int {
+	ret := 0
+	for s := max(w, h); s > 1; s = (s + 1) / 2 {
+		ret++
+	}
+	return ret
+}
+
+// LevelSize returns the size of the image at level.
+func LevelSize(w, h, level int) (int, int) {
+	for range MaxLevel(w, h) - level {
+		w, h = (w+1)/2, (h+1)/2
+	}
+	return w, h
+}
+
+// tileRect returns the part of the image at a level (of size w x h) which makes up a tile.
+func tileRect(w, h, col, row int) image.Rectangle {
+	r := image.Rect(col*TileSize, row*TileSize, (col+1)*TileSize, (row+1)*TileSize)
+	return image.Rect(r.Min.X-Overlap, r.Min.Y-Overlap, r.Max.X+Overlap, r.Max.Y+Overlap).Intersect(image.Rect(0, 0, w, h))
+}
+
+// tileCount returns the number of columns and rows of tiles at a level (of size w x h).
+func tileCount(w, h int) (int, int) {
+	return (w + TileSize - 1) / TileSize, (h + TileSize - 1) / TileSize
+}
+
+func tileName(level, col, row int) string {
+	return fmt.Sprintf("%d/%d_%d.%s", level, col, row, Format)
+}
+
+// TileNames returns the paths of all tiles of an image of size w x h, relative to the tiles directory.
+// Paths are separated by "/".
+func TileNames(w, h int) []string {
+	var ret []string
+	for level := range MaxLevel(w, h) + 1 {
+		lw, lh := LevelSize(w, h, level)
+		cols, rows := tileCount(lw, lh)
+		for col := range cols {
+			for row := range rows {
+				ret = append(ret, tileName(level, col, row))
+			}
+		}
+	}
+	return ret
+}
+
+// Descriptor returns the XML descriptor of an image of size w x h.
+func Descriptor(w, h int) []byte {
+	return fmt.Appendf(nil, `<?xml version="1.0" encoding="UTF-8"?>
+<Image xmlns="http://schemas.microsoft.com/deepzoom/2008" Format="%s" Overlap="%d" TileSize="%d">
+  <Size Width="%d" Height="%d"/>
+</Image>
+`, Format, Overlap, TileSize, w, h)
+}
+
+// halve returns img scaled to half its width and height (rounded up), each pixel being the mean of (up to) 2x2
+// pixels. The returned image starts at (0, 0).
+func halve(img *image.RGBA) *image.RGBA {
+	b := img.Rect
+	ret := image.NewRGBA(image.Rect(0, 0, (b.Dx()+1)/2, (b.Dy()+1)/2))
+	for y := range ret.Rect.Dy() {
+		for x := range ret.Rect.Dx() {
+			var sum [4]int
+			n := 0
+			for sy := 2 * y; sy < min(2*y+2, b.Dy()); sy++ {
+				for sx := 2 * x; sx < min(2*x+2, b.Dx()); sx++ {
+					i := img.PixOffset(b.Min.X+sx, b.Min.Y+sy)
+					for c := range sum {
+						sum[c] += int(img.Pix[i+c])
+					}
+					n++
+				}
+			}
+			o := ret.PixOffset(x, y)
+			for c := range sum {
+				ret.Pix[o+c] = uint8((sum[c] + n/2) / n)
+			}
+		}
+	}
+	return ret
+}
+
+// Write writes the descriptor of img to descPath, and its tiles (as JPEGs with the given quality) to filesDir, which
+// is created if needed.
+func Write(descPath, filesDir string, img image.Image, quality int) error {
+	b := img.Bounds()
+	level := MaxLevel(b.Dx(), b.Dy())
+
+	// Work on a copy which starts at (0, 0).
+	cur := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(cur, cur.Rect, img, b.Min, draw.Src)
+
+	for ; level >= 0; level-- {
+		dir := filepath.Join(filesDir, fmt.Sprint(level))
+		err := os.MkdirAll(dir, 0750)
+		if err != nil {
+			return err
+		}
+
+		w, h := cur.Rect.Dx(), cur.Rect.Dy()
+		cols, rows := tileCount(w, h)
+		for col := range cols {
+			for row := range rows {
+				tile := cur.SubImage(tileRect(w, h, col, row))
+				err := imutil.DumpJPEG(filepath.Join(filesDir, filepath.FromSlash(tileName(level, col, row))), tile, quality)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if level > 0 {
+			cur = halve(cur)
+		}
+	}
+
+	return os.WriteFile(descPath, Descriptor(b.Dx(), b.Dy()), 0600)
+}
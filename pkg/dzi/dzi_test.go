@@ -0,0 +1,95 @@
+package dzi
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"jo-m.ch/go/trainbot/pkg/imutil"
+)
+
+func Test_MaxLevel(t *testing.T) {
+	assert.Equal(t, 0, MaxLevel(1, 1))
+	assert.Equal(t, 1, MaxLevel(2, 1))
+	assert.Equal(t, 2, MaxLevel(3, 1))
+	assert.Equal(t, 10, MaxLevel(1024, 10))
+	assert.Equal(t, 11, MaxLevel(1025, 10))
+}
+
+func Test_LevelSize(t *testing.T) {
+	w, h := LevelSize(1000, 301, MaxLevel(1000, 301))
+	assert.Equal(t, [2]int{1000, 301}, [2]int{w, h})
+	w, h = LevelSize(1000, 301, MaxLevel(1000, 301)-1)
+	assert.Equal(t, [2]int{500, 151}, [2]int{w, h})
+	w, h = LevelSize(1000, 301, 0)
+	assert.Equal(t, [2]int{1, 1}, [2]int{w, h})
+}
+
+func Test_tileRect(t *testing.T) {
+	assert.Equal(t, image.Rect(0, 0, 255, 255), tileRect(1000, 301, 0, 0))
+	assert.Equal(t, image.Rect(253, 253, 509, 301), tileRect(1000, 301, 1, 1))
+	assert.Equal(t, image.Rect(761, 0, 1000, 255), tileRect(1000, 301, 3, 0))
+}
+
+func Test_FilesDir(t *testing.T) {
+	assert.Equal(t, "train_x_files", FilesDir("train_x.dzi"))
+}
+
+func Test_halve(t *testing.T) {
+	img := image.NewRGBA(image.Rect(5, 5, 8, 6))
+	img.SetRGBA(5, 5, color.RGBA{0, 0, 0, 0xff})
+	img.SetRGBA(6, 5, color.RGBA{100, 200, 0, 0xff})
+	img.SetRGBA(7, 5, color.RGBA{10, 20, 30, 0xff})
+
+	ret := halve(img)
+	assert.Equal(t, image.Rect(0, 0, 2, 1), ret.Rect)
+	assert.Equal(t, color.RGBA{50, 100, 0, 0xff}, ret.RGBAAt(0, 0))
+	assert.Equal(t, color.RGBA{10, 20, 30, 0xff}, ret.RGBAAt(1, 0))
+}
+
+func Test_Write(t *testing.T) {
+	dir := t.TempDir()
+	img := imutil.RandRGBA(1, 600, 300)
+	img.Rect = img.Rect.Add(image.Pt(10, 20))
+
+	desc := filepath.Join(dir, "x.dzi")
+	files := filepath.Join(dir, FilesDir("x.dzi"))
+	err := Write(desc, files, img, 90)
+	require.NoError(t, err)
+
+	buf, err := os.ReadFile(desc)
+	require.NoError(t, err)
+	assert.Contains(t, string(buf), `<Size Width="600" Height="300"/>`)
+	assert.Contains(t, string(buf), `TileSize="254"`)
+
+	// Exactly the expected tiles are written.
+	var written []string
+	err = filepath.WalkDir(files, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(files, path)
+		written = append(written, filepath.ToSlash(rel))
+		return err
+	})
+	require.NoError(t, err)
+	names := TileNames(600, 300)
+	assert.ElementsMatch(t, names, written)
+	assert.Contains(t, names, "10/2_1.jpg")
+	assert.Contains(t, names, "0/0_0.jpg")
+
+	// Tiles at full resolution are the respective parts of the image, with overlap.
+	tile, err := imutil.Load(filepath.Join(files, "10", "2_1.jpg"))
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 600-507, 300-253), tile.Bounds())
+	r, _, _, _ := tile.At(10, 10).RGBA()
+	assert.InDelta(t, img.RGBAAt(10+507+10, 20+253+10).R, r>>8, 40)
+
+	tile, err = imutil.Load(filepath.Join(files, "0", "0_0.jpg"))
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 1, 1), tile.Bounds())
+}
@@ -0,0 +1,277 @@
+// Package enhance improves the look of (stitched) images, e.g. dull and dark ones taken at night or in the rain.
+// Transparent pixels are ignored and left unchanged. Colors are alpha-premultiplied (as in image.RGBA), so they are
+// never made larger than alpha.
+package enhance
+
+import (
+	"image"
+	"math"
+	"slices"
+)
+
+const (
+	// Fraction of the darkest and brightest pixel values which are clipped by AutoLevels().
+	autoLevelsClip = 0.005
+	// Gains of WhiteBalance() are limited to this factor, so that images of a single color are not ruined.
+	whiteBalanceMaxGain = 2
+	// Standard deviation of the blur used by Sharpen() [px].
+	sharpenSigma = 1.5
+	// Sharpen() processes the image in vertical strips of this width [px], so that long images do not need a lot of
+	// memory for the blurred values.
+	sharpenStripPx = 256
+)
+
+// Config selects the enhancement steps, which are applied in the order of the fields.
+type Config struct {
+	// Denoise applies a 3x3 median filter.
+	Denoise bool
+	// WhiteBalance scales the color channels so that the image is gray on average (gray world assumption).
+	WhiteBalance bool
+	// AutoLevels stretches the pixel values to the full range.
+	AutoLevels bool
+	// Sharpen is the amount of unsharp masking, e.g. 0.5. Disabled if 0.
+	Sharpen float64
+}
+
+// Enabled returns true if at least one step is enabled.
+func (c Config) Enabled() bool {
+	return c.Denoise || c.WhiteBalance || c.AutoLevels || c.Sharpen != 0
+}
+
+// Apply returns an enhanced copy of img.
+func Apply(img *image.RGBA, c Config) *image.RGBA {
+	var ret *image.RGBA
+	if c.Denoise {
+		ret = Denoise(img)
+	} else {
+		ret = clone(img)
+	}
+	if c.WhiteBalance {
+		WhiteBalance(ret)
+	}
+	if c.AutoLevels {
+		AutoLevels(ret)
+	}
+	if c.Sharpen != 0 {
+		ret = Sharpen(ret, c.Sharpen)
+	}
+	return ret
+}
+
+func clone(img *image.RGBA) *image.RGBA {
+	ret := image.NewRGBA(img.Rect)
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		copy(ret.Pix[ret.PixOffset(img.Rect.Min.X, y):ret.PixOffset(img.Rect.Max.X, y)],
+			img.Pix[img.PixOffset(img.Rect.Min.X, y):img.PixOffset(img.Rect.Max.X, y)])
+	}
+	return ret
+}
+
+func clamp(v float64) uint8 {
+	return uint8(math.Round(math.Min(math.Max(v, 0), 0xff)))
+}
+
+// eachOpaque calls fn with the offset of each pixel in img which is not transparent.
+func eachOpaque(img *image.RGBA, fn func(i int)) {
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			i := img.PixOffset(x, y)
+			if img.Pix[i+3] != 0 {
+				fn(i)
+			}
+		}
+	}
+}
+
+// AutoLevels stretches the values of all color channels (together, so that colors are kept) linearly to the full
+// range, ignoring a few outliers. Modifies img in place.
+func AutoLevels(img *image.RGBA) {
+	var hist [256]int
+	n := 0
+	eachOpaque(img, func(i int) {
+		for c := range 3 {
+			hist[img.Pix[i+c]]++
+		}
+		n += 3
+	})
+	if n == 0 {
+		return
+	}
+
+	clip := int(float64(n) * autoLevelsClip)
+	lo, hi := 0, 0xff
+	for sum := 0; lo < 0xff; lo++ {
+		sum += hist[lo]
+		if sum > clip {
+			break
+		}
+	}
+	for sum := 0; hi > 0; hi-- {
+		sum += hist[hi]
+		if sum > clip {
+			break
+		}
+	}
+	if hi <= lo {
+		return
+	}
+
+	var lut [256]uint8
+	for v := range lut {
+		lut[v] = clamp(float64(v-lo) * 0xff / float64(hi-lo))
+	}
+	eachOpaque(img, func(i int) {
+		for c := range 3 {
+			img.Pix[i+c] = min(lut[img.Pix[i+c]], img.Pix[i+3])
+		}
+	})
+}
+
+// WhiteBalance scales the color channels so that their means are equal (gray world assumption).
+// Modifies img in place.
+func WhiteBalance(img *image.RGBA) {
+	var sums [3]float64
+	eachOpaque(img, func(i int) {
+		for c := range 3 {
+			sums[c] += float64(img.Pix[i+c])
+		}
+	})
+	gray := (sums[0] + sums[1] + sums[2]) / 3
+	if gray == 0 {
+		return
+	}
+
+	var luts [3][256]uint8
+	for c := range 3 {
+		gain := float64(whiteBalanceMaxGain)
+		if sums[c] > 0 {
+			gain = math.Min(math.Max(gray/sums[c], 1./whiteBalanceMaxGain), whiteBalanceMaxGain)
+		}
+		for v := range luts[c] {
+			luts[c][v] = clamp(float64(v) * gain)
+		}
+	}
+	eachOpaque(img, func(i int) {
+		for c := range 3 {
+			img.Pix[i+c] = min(luts[c][img.Pix[i+c]], img.Pix[i+3])
+		}
+	})
+}
+
+// Denoise returns a copy of img with a 3x3 median filter applied to each color channel.
+// Transparent pixels in the neighborhood are not taken into account.
+func Denoise(img *image.RGBA) *image.RGBA {
+	ret := clone(img)
+	b := img.Rect
+	var values [3][]uint8
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			o := ret.PixOffset(x, y)
+			if ret.Pix[o+3] == 0 {
+				continue
+			}
+
+			for c := range values {
+				values[c] = values[c][:0]
+			}
+			for ny := max(y-1, b.Min.Y); ny <= min(y+1, b.Max.Y-1); ny++ {
+				for nx := max(x-1, b.Min.X); nx <= min(x+1, b.Max.X-1); nx++ {
+					i := img.PixOffset(nx, ny)
+					if img.Pix[i+3] == 0 {
+						continue
+					}
+					for c := range values {
+						values[c] = append(values[c], img.Pix[i+c])
+					}
+				}
+			}
+			for c := range values {
+				slices.Sort(values[c])
+				ret.Pix[o+c] = values[c][len(values[c])/2]
+			}
+		}
+	}
+	return ret
+}
+
+// gaussianKernel returns a normalized 1D gaussian kernel, with a radius of 3 sigma.
+func gaussianKernel(sigma float64) []float64 {
+	r := int(math.Ceil(3 * sigma))
+	ret := make([]float64, 2*r+1)
+	sum := 0.
+	for i := range ret {
+		d := float64(i - r)
+		ret[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		sum += ret[i]
+	}
+	for i := range ret {
+		ret[i] /= sum
+	}
+	return ret
+}
+
+// blurStrip applies a gaussian blur with kernel k to the color channels of the columns [x0, x1) (relative to the
+// left edge) of img, with edges clamped.
+// Returns the values as floats, row by row, with 3 values per pixel.
+func blurStrip(img *image.RGBA, k []float64, x0, x1 int) []float64 {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	sw := x1 - x0
+	r := len(k) / 2
+	at := func(x, y int) int {
+		return img.PixOffset(img.Rect.Min.X+x, img.Rect.Min.Y+y)
+	}
+
+	// Horizontal pass, only the pixels of the strip are needed.
+	tmp := make([]float64, sw*h*3)
+	for y := range h {
+		for x := range sw {
+			for i, kv := range k {
+				p := at(min(max(x0+x+i-r, 0), w-1), y)
+				for c := range 3 {
+					tmp[(y*sw+x)*3+c] += kv * float64(img.Pix[p+c])
+				}
+			}
+		}
+	}
+
+	// Vertical pass.
+	ret := make([]float64, sw*h*3)
+	for y := range h {
+		for x := range sw {
+			for i, kv := range k {
+				p := (min(max(y+i-r, 0), h-1)*sw + x) * 3
+				for c := range 3 {
+					ret[(y*sw+x)*3+c] += kv * tmp[p+c]
+				}
+			}
+		}
+	}
+	return ret
+}
+
+// Sharpen returns a copy of img with an unsharp mask applied: the difference to a blurred copy is multiplied by
+// amount and added.
+func Sharpen(img *image.RGBA, amount float64) *image.RGBA {
+	ret := clone(img)
+	k := gaussianKernel(sharpenSigma)
+	w := img.Rect.Dx()
+	for x0 := 0; x0 < w; x0 += sharpenStripPx {
+		x1 := min(x0+sharpenStripPx, w)
+		blurred := blurStrip(img, k, x0, x1)
+		sw := x1 - x0
+		for y := range img.Rect.Dy() {
+			for x := range sw {
+				o := ret.PixOffset(ret.Rect.Min.X+x0+x, ret.Rect.Min.Y+y)
+				a := ret.Pix[o+3]
+				if a == 0 {
+					continue
+				}
+				for c := range 3 {
+					v := float64(ret.Pix[o+c])
+					ret.Pix[o+c] = min(clamp(v+amount*(v-blurred[(y*sw+x)*3+c])), a)
+				}
+			}
+		}
+	}
+	return ret
+}
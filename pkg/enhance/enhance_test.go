@@ -0,0 +1,137 @@
+package enhance
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func uniform(w, h int, c color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// dull returns a dark, low contrast gradient.
+func dull() *image.RGBA {
+	img := image.NewRGBA(image.Rect(10, 20, 110, 70))
+	for y := 20; y < 70; y++ {
+		for x := 10; x < 110; x++ {
+			v := uint8(40 + (x-10)*40/100)
+			img.SetRGBA(x, y, color.RGBA{v, v, v + 10, 0xff})
+		}
+	}
+	return img
+}
+
+func Test_AutoLevels(t *testing.T) {
+	img := dull()
+	// Transparent pixels are not changed.
+	img.SetRGBA(10, 20, color.RGBA{})
+	AutoLevels(img)
+
+	assert.Equal(t, color.RGBA{}, img.RGBAAt(10, 20))
+	assert.LessOrEqual(t, img.RGBAAt(11, 30).R, uint8(5))
+	assert.GreaterOrEqual(t, img.RGBAAt(109, 30).B, uint8(250))
+	// Monotonic.
+	assert.Less(t, img.RGBAAt(50, 30).R, img.RGBAAt(60, 30).R)
+
+	// No contrast at all.
+	flat := uniform(10, 10, color.RGBA{100, 100, 100, 0xff})
+	AutoLevels(flat)
+	assert.Equal(t, color.RGBA{100, 100, 100, 0xff}, flat.RGBAAt(5, 5))
+}
+
+func Test_WhiteBalance(t *testing.T) {
+	img := uniform(10, 10, color.RGBA{120, 100, 80, 0xff})
+	img.SetRGBA(0, 0, color.RGBA{})
+	WhiteBalance(img)
+	assert.Equal(t, color.RGBA{100, 100, 100, 0xff}, img.RGBAAt(5, 5))
+	assert.Equal(t, color.RGBA{}, img.RGBAAt(0, 0))
+
+	// Gains are limited.
+	red := uniform(10, 10, color.RGBA{200, 10, 10, 0xff})
+	WhiteBalance(red)
+	assert.Equal(t, color.RGBA{100, 20, 20, 0xff}, red.RGBAAt(5, 5))
+}
+
+func Test_Denoise(t *testing.T) {
+	img := uniform(10, 10, color.RGBA{100, 100, 100, 0xff})
+	img.SetRGBA(5, 5, color.RGBA{0xff, 0xff, 0xff, 0xff})
+	ret := Denoise(img)
+	assert.Equal(t, color.RGBA{100, 100, 100, 0xff}, ret.RGBAAt(5, 5))
+	// Original is not changed.
+	assert.Equal(t, color.RGBA{0xff, 0xff, 0xff, 0xff}, img.RGBAAt(5, 5))
+}
+
+func Test_Sharpen(t *testing.T) {
+	// Vertical edge.
+	img := uniform(40, 10, color.RGBA{100, 100, 100, 0xff})
+	for y := range 10 {
+		for x := 20; x < 40; x++ {
+			img.SetRGBA(x, y, color.RGBA{150, 150, 150, 0xff})
+		}
+	}
+
+	ret := Sharpen(img, 1)
+	// Overshoot at the edge, flat areas are unchanged.
+	assert.Less(t, ret.RGBAAt(19, 5).R, uint8(100))
+	assert.Greater(t, ret.RGBAAt(20, 5).R, uint8(150))
+	assert.Equal(t, uint8(100), ret.RGBAAt(2, 5).R)
+	assert.Equal(t, uint8(150), ret.RGBAAt(37, 5).R)
+}
+
+func Test_Sharpen_Strips(t *testing.T) {
+	// Vertical edges within a strip and at the border between two strips are sharpened the same way.
+	w := sharpenStripPx * 2
+	img := uniform(w, 10, color.RGBA{100, 100, 100, 0xff})
+	for y := range 10 {
+		for _, x0 := range []int{20, sharpenStripPx} {
+			for x := x0; x < x0+20; x++ {
+				img.SetRGBA(x, y, color.RGBA{150, 150, 150, 0xff})
+			}
+		}
+	}
+
+	ret := Sharpen(img, 1)
+	for x := -10; x < 30; x++ {
+		assert.Equal(t, ret.RGBAAt(20+x, 5), ret.RGBAAt(sharpenStripPx+x, 5), x)
+	}
+}
+
+func Test_Sharpen_Premultiplied(t *testing.T) {
+	// Half transparent, the color values must not exceed alpha.
+	img := uniform(40, 10, color.RGBA{50, 50, 50, 0x80})
+	for y := range 10 {
+		for x := 20; x < 40; x++ {
+			img.SetRGBA(x, y, color.RGBA{0x80, 0x80, 0x80, 0x80})
+		}
+	}
+
+	ret := Sharpen(img, 1)
+	for x := range 40 {
+		c := ret.RGBAAt(x, 5)
+		assert.LessOrEqual(t, c.R, c.A, x)
+	}
+	assert.Less(t, ret.RGBAAt(19, 5).R, uint8(50))
+}
+
+func Test_Apply(t *testing.T) {
+	img := dull()
+	assert.False(t, Config{}.Enabled())
+	assert.Equal(t, img.Pix, Apply(img, Config{}).Pix)
+
+	c := Config{Denoise: true, WhiteBalance: true, AutoLevels: true, Sharpen: 0.5}
+	assert.True(t, c.Enabled())
+	ret := Apply(img, c)
+	assert.Equal(t, img.Rect, ret.Rect)
+	assert.NotEqual(t, img.Pix, ret.Pix)
+	// Original is not changed.
+	assert.Equal(t, dull().Pix, img.Pix)
+}
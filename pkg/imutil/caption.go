@@ -0,0 +1,48 @@
+package imutil
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	// The font of Caption() is scaled up by 1 for every captionScalePx of image height.
+	captionScalePx = 300
+	// Padding around the text of Caption(), in unscaled font pixels.
+	captionPadding = 2
+)
+
+// Caption returns a copy of img with a strip below it, in which text is written in white on black.
+// The text is rendered with a built-in bitmap font (ASCII only, other characters are replaced), which is scaled up
+// by an integer factor for tall images. Text which does not fit into the width of img is cut off.
+func Caption(img image.Image, text string) *image.RGBA {
+	b := img.Bounds()
+	face := basicfont.Face7x13
+	scale := max(1, b.Dy()/captionScalePx)
+
+	// Render the text unscaled.
+	lineH := face.Height + 2*captionPadding
+	small := image.NewRGBA(image.Rect(0, 0, (b.Dx()+scale-1)/scale, lineH))
+	draw.Draw(small, small.Rect, image.NewUniform(color.Black), image.Point{}, draw.Src)
+	d := font.Drawer{
+		Dst:  small,
+		Src:  image.NewUniform(color.White),
+		Face: face,
+		Dot:  fixed.P(captionPadding, captionPadding+face.Ascent),
+	}
+	d.DrawString(text)
+
+	ret := image.NewRGBA(image.Rect(b.Min.X, b.Min.Y, b.Max.X, b.Max.Y+lineH*scale))
+	draw.Draw(ret, b, img, b.Min, draw.Src)
+	for y := b.Max.Y; y < ret.Rect.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			ret.SetRGBA(x, y, small.RGBAAt((x-b.Min.X)/scale, (y-b.Max.Y)/scale))
+		}
+	}
+	return ret
+}
@@ -0,0 +1,47 @@
+package imutil
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countWhite counts the white pixels in r.
+func countWhite(img *image.RGBA, r image.Rectangle) int {
+	n := 0
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if img.RGBAAt(x, y) == (color.RGBA{0xff, 0xff, 0xff, 0xff}) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func Test_Caption(t *testing.T) {
+	img := RandRGBA(1, 200, 100)
+	img.Rect = img.Rect.Add(image.Pt(10, 20))
+
+	ret := Caption(img, "2023-06-10 16:20:58  85 km/h")
+	strip := image.Rect(10, 120, 210, ret.Rect.Max.Y)
+	assert.Equal(t, image.Rect(10, 20, 210, 137), ret.Rect)
+	// Image is unchanged.
+	assert.Equal(t, img.RGBAAt(10, 20), ret.RGBAAt(10, 20))
+	assert.Equal(t, img.RGBAAt(209, 119), ret.RGBAAt(209, 119))
+	// Text is written.
+	assert.Greater(t, countWhite(ret, strip), 50)
+	assert.Equal(t, color.RGBA{0, 0, 0, 0xff}, ret.RGBAAt(209, 136))
+
+	// No text, just a black strip.
+	ret = Caption(img, "")
+	assert.Equal(t, 0, countWhite(ret, strip))
+
+	// Scaled up for tall images.
+	tall := RandRGBA(1, 200, 650)
+	ret = Caption(tall, "x")
+	assert.Equal(t, 650+17*2, ret.Rect.Dy())
+	assert.Equal(t, 4*countWhite(Caption(img, "x"), strip), countWhite(ret, image.Rect(0, 650, 200, ret.Rect.Max.Y)))
+}
@@ -2,6 +2,7 @@ package imutil
 
 import (
 	"image"
+	"image/draw"
 )
 
 // Copy creates a deep copy of an image (copies underlying buffer).
@@ -36,3 +37,13 @@ func Copy(in image.Image) (ret image.Image) {
 	}
 	return
 }
+
+// CopyRect creates a new RGBA image containing a copy of the pixels of in within r.
+// In contrast to Sub() followed by Copy(), only the pixels within r are copied.
+// The returned image keeps the coordinates of in, i.e. its bounds are r intersected with the bounds of in.
+func CopyRect(in image.Image, r image.Rectangle) *image.RGBA {
+	r = r.Intersect(in.Bounds())
+	ret := image.NewRGBA(r)
+	draw.Draw(ret, r, in, r.Min, draw.Src)
+	return ret
+}
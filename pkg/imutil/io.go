@@ -43,7 +43,7 @@ func Dump(path string, img image.Image) error {
 	}
 
 	if strings.HasSuffix(path, ".jpg") || strings.HasSuffix(path, ".jpeg") {
-		return jpeg.Encode(f, img, &jpeg.Options{Quality: 95})
+		return jpeg.Encode(f, img, &jpeg.Options{Quality: DefaultJPEGQuality})
 	}
 
 	return errors.New("unknown image suffix")
@@ -0,0 +1,271 @@
+package imutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DefaultJPEGQuality is the JPEG quality used by Dump().
+const DefaultJPEGQuality = 95
+
+// Property is a custom XMP property, see Metadata.
+type Property struct {
+	// Name must be a valid XML name, e.g. "speed_kph".
+	Name  string
+	Value string
+}
+
+// Metadata is embedded into JPEG files as EXIF and XMP, see EncodeJPEG().
+// Empty fields are omitted.
+type Metadata struct {
+	// Time is the capture time (EXIF DateTimeOriginal, OffsetTimeOriginal and SubSecTimeOriginal, xmp:CreateDate).
+	Time time.Time
+	// Description is a human readable description (EXIF ImageDescription, dc:description).
+	Description string
+	// Software is the name of the program which created the image (EXIF Software, xmp:CreatorTool).
+	Software string
+
+	// XMPNamespace is the namespace URI of Properties, and XMPPrefix its prefix.
+	XMPNamespace string
+	XMPPrefix    string
+	// Properties are written as XMP properties in XMPNamespace, in this order.
+	Properties []Property
+}
+
+// JPEG markers and segment identifiers.
+const (
+	jpegSOI  = 0xd8
+	jpegAPP1 = 0xe1
+	// Maximum payload size of a JPEG segment (its length field includes itself).
+	jpegMaxSegment = 0xffff - 2
+)
+
+var (
+	exifIdent = []byte("Exif\x00\x00")
+	xmpIdent  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+)
+
+// EXIF (TIFF) tags, types and formats.
+const (
+	exifTagImageDescription   = 0x010e
+	exifTagSoftware           = 0x0131
+	exifTagDateTime           = 0x0132
+	exifTagExifIFD            = 0x8769
+	exifTagExifVersion        = 0x9000
+	exifTagDateTimeOriginal   = 0x9003
+	exifTagOffsetTimeOriginal = 0x9011
+	exifTagSubSecTimeOriginal = 0x9291
+
+	exifTypeASCII     = 2
+	exifTypeLong      = 4
+	exifTypeUndefined = 7
+
+	exifTimeFormat   = "2006:01:02 15:04:05"
+	exifOffsetFormat = "-07:00"
+)
+
+// exifEntry is an entry of an image file directory (IFD).
+type exifEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	// Encoded value, stored inline if it fits into 4 bytes.
+	value []byte
+}
+
+func exifASCII(tag uint16, s string) exifEntry {
+	v := append([]byte(s), 0)
+	return exifEntry{tag: tag, typ: exifTypeASCII, count: uint32(len(v)), value: v} // #nosec G115
+}
+
+func exifLong(tag uint16, v uint32) exifEntry {
+	return exifEntry{tag: tag, typ: exifTypeLong, count: 1, value: binary.LittleEndian.AppendUint32(nil, v)}
+}
+
+// exifIFDSize returns the size of an IFD including the values which do not fit inline.
+func exifIFDSize(entries []exifEntry) int {
+	ret := 2 + 12*len(entries) + 4
+	for _, e := range entries {
+		if len(e.value) > 4 {
+			ret += len(e.value) + len(e.value)%2
+		}
+	}
+	return ret
+}
+
+// appendExifIFD appends an IFD to buf, which starts at the TIFF header. The values which do not fit inline follow
+// directly after the IFD.
+func appendExifIFD(buf []byte, entries []exifEntry) []byte {
+	slices.SortFunc(entries, func(a, b exifEntry) int { return int(a.tag) - int(b.tag) })
+	le := binary.LittleEndian
+	dataOff := len(buf) + 2 + 12*len(entries) + 4
+
+	buf = le.AppendUint16(buf, uint16(len(entries))) // #nosec G115
+	var data []byte
+	for _, e := range entries {
+		buf = le.AppendUint16(buf, e.tag)
+		buf = le.AppendUint16(buf, e.typ)
+		buf = le.AppendUint32(buf, e.count)
+		if len(e.value) <= 4 {
+			var inline [4]byte
+			copy(inline[:], e.value)
+			buf = append(buf, inline[:]...)
+			continue
+		}
+		buf = le.AppendUint32(buf, uint32(dataOff+len(data))) // #nosec G115
+		data = append(data, e.value...)
+		if len(e.value)%2 == 1 {
+			data = append(data, 0)
+		}
+	}
+	// No next IFD.
+	buf = le.AppendUint32(buf, 0)
+	return append(buf, data...)
+}
+
+// exif returns the EXIF payload (TIFF structure, without identifier) for m.
+func (m *Metadata) exif() []byte {
+	var ifd0, exifIFD []exifEntry
+	if m.Description != "" {
+		ifd0 = append(ifd0, exifASCII(exifTagImageDescription, m.Description))
+	}
+	if m.Software != "" {
+		ifd0 = append(ifd0, exifASCII(exifTagSoftware, m.Software))
+	}
+	if !m.Time.IsZero() {
+		ifd0 = append(ifd0, exifASCII(exifTagDateTime, m.Time.Format(exifTimeFormat)))
+		exifIFD = append(exifIFD,
+			exifEntry{tag: exifTagExifVersion, typ: exifTypeUndefined, count: 4, value: []byte("0232")},
+			exifASCII(exifTagDateTimeOriginal, m.Time.Format(exifTimeFormat)),
+			exifASCII(exifTagOffsetTimeOriginal, m.Time.Format(exifOffsetFormat)),
+			exifASCII(exifTagSubSecTimeOriginal, fmt.Sprintf("%03d", m.Time.Nanosecond()/int(time.Millisecond))),
+		)
+	}
+
+	// Little endian TIFF header, IFD0 follows directly.
+	const headerSize = 8
+	buf := []byte{'I', 'I', 42, 0, headerSize, 0, 0, 0}
+	if len(exifIFD) > 0 {
+		// The pointer entry itself adds 12 bytes to IFD0.
+		off := headerSize + exifIFDSize(ifd0) + 12
+		ifd0 = append(ifd0, exifLong(exifTagExifIFD, uint32(off))) // #nosec G115
+	}
+	buf = appendExifIFD(buf, ifd0)
+	if len(exifIFD) > 0 {
+		buf = appendExifIFD(buf, exifIFD)
+	}
+	return buf
+}
+
+func xmlEscape(s string) string {
+	var buf strings.Builder
+	// Never fails on a strings.Builder.
+	_ = xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// xmp returns the XMP packet for m.
+func (m *Metadata) xmp() []byte {
+	var buf strings.Builder
+	buf.WriteString("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	buf.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	buf.WriteString(" <rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n")
+	buf.WriteString("  <rdf:Description rdf:about=\"\"\n")
+	buf.WriteString("    xmlns:xmp=\"http://ns.adobe.com/xap/1.0/\"\n")
+	buf.WriteString("    xmlns:dc=\"http://purl.org/dc/elements/1.1/\"")
+	if m.XMPPrefix != "" {
+		fmt.Fprintf(&buf, "\n    xmlns:%s=\"%s\"", m.XMPPrefix, xmlEscape(m.XMPNamespace))
+	}
+	buf.WriteString(">\n")
+
+	if !m.Time.IsZero() {
+		fmt.Fprintf(&buf, "   <xmp:CreateDate>%s</xmp:CreateDate>\n", m.Time.Format("2006-01-02T15:04:05.000Z07:00"))
+	}
+	if m.Software != "" {
+		fmt.Fprintf(&buf, "   <xmp:CreatorTool>%s</xmp:CreatorTool>\n", xmlEscape(m.Software))
+	}
+	if m.Description != "" {
+		fmt.Fprintf(&buf, "   <dc:description><rdf:Alt><rdf:li xml:lang=\"x-default\">%s</rdf:li></rdf:Alt></dc:description>\n",
+			xmlEscape(m.Description))
+	}
+	if m.XMPPrefix != "" {
+		for _, p := range m.Properties {
+			fmt.Fprintf(&buf, "   <%s:%s>%s</%s:%s>\n", m.XMPPrefix, p.Name, xmlEscape(p.Value), m.XMPPrefix, p.Name)
+		}
+	}
+
+	buf.WriteString("  </rdf:Description>\n")
+	buf.WriteString(" </rdf:RDF>\n")
+	buf.WriteString("</x:xmpmeta>\n")
+	buf.WriteString("<?xpacket end=\"w\"?>")
+	return []byte(buf.String())
+}
+
+// appendSegment appends a JPEG APP1 segment with the given identifier and payload.
+func appendSegment(buf, ident, payload []byte) ([]byte, error) {
+	n := len(ident) + len(payload)
+	if n > jpegMaxSegment {
+		return nil, errors.New("metadata too large")
+	}
+	buf = append(buf, 0xff, jpegAPP1)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(n+2)) // #nosec G115
+	buf = append(buf, ident...)
+	return append(buf, payload...), nil
+}
+
+// EncodeJPEG encodes img as JPEG with the given quality, and embeds meta as EXIF and XMP (if not nil).
+func EncodeJPEG(w io.Writer, img image.Image, quality int, meta *Metadata) error {
+	if meta == nil {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	}
+
+	var enc bytes.Buffer
+	err := jpeg.Encode(&enc, img, &jpeg.Options{Quality: quality})
+	if err != nil {
+		return err
+	}
+	raw := enc.Bytes()
+	if len(raw) < 2 || raw[0] != 0xff || raw[1] != jpegSOI {
+		return errors.New("unexpected JPEG encoder output")
+	}
+
+	// The metadata segments go directly after the start of image marker.
+	head := []byte{0xff, jpegSOI}
+	head, err = appendSegment(head, exifIdent, meta.exif())
+	if err != nil {
+		return err
+	}
+	head, err = appendSegment(head, xmpIdent, meta.xmp())
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(head)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(raw[2:])
+	return err
+}
+
+// DumpJPEGMeta dumps a JPEG to a file with a given quality, and embeds meta as EXIF and XMP (if not nil).
+func DumpJPEGMeta(path string, img image.Image, quality int, meta *Metadata) error {
+	// #nosec 304
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return EncodeJPEG(f, img, quality, meta)
+}
@@ -0,0 +1,119 @@
+package imutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// app1Segments returns the payloads of all APP1 segments before the first non-APP segment of a JPEG.
+func app1Segments(t *testing.T, buf []byte) [][]byte {
+	t.Helper()
+
+	require.Equal(t, []byte{0xff, jpegSOI}, buf[:2])
+	var ret [][]byte
+	for i := 2; i+4 <= len(buf) && buf[i] == 0xff && buf[i+1]&0xf0 == 0xe0; {
+		n := int(binary.BigEndian.Uint16(buf[i+2:]))
+		if buf[i+1] == jpegAPP1 {
+			ret = append(ret, buf[i+4:i+2+n])
+		}
+		i += 2 + n
+	}
+	return ret
+}
+
+// exifASCIITags reads the ASCII values of an IFD (and the Exif IFD it points to) from a TIFF structure.
+func exifASCIITags(t *testing.T, tiff []byte, off uint32, ret map[uint16]string) {
+	t.Helper()
+
+	le := binary.LittleEndian
+	n := int(le.Uint16(tiff[off:]))
+	for i := range n {
+		e := tiff[int(off)+2+12*i:]
+		tag, typ, count := le.Uint16(e), le.Uint16(e[2:]), le.Uint32(e[4:])
+		switch typ {
+		case exifTypeASCII:
+			v := e[8:12]
+			if count > 4 {
+				p := le.Uint32(e[8:])
+				v = tiff[p : p+count]
+			}
+			ret[tag] = string(bytes.TrimRight(v[:count], "\x00"))
+		case exifTypeLong:
+			if tag == exifTagExifIFD {
+				exifASCIITags(t, tiff, le.Uint32(e[8:]), ret)
+			}
+		}
+	}
+}
+
+func Test_EncodeJPEG_Metadata(t *testing.T) {
+	img := RandRGBA(123, 100, 50)
+	ts := time.Date(2023, 6, 10, 16, 20, 58, 805e6, time.FixedZone("", 2*3600))
+	meta := Metadata{
+		Time:         ts,
+		Description:  "Train <north>",
+		Software:     "trainbot",
+		XMPNamespace: "http://example.com/ns/",
+		XMPPrefix:    "ex",
+		Properties:   []Property{{"speed_kph", "85.3"}, {"site", "A & B"}},
+	}
+
+	fname := filepath.Join(t.TempDir(), "out.jpg")
+	err := DumpJPEGMeta(fname, img, 90, &meta)
+	require.NoError(t, err)
+	buf, err := os.ReadFile(fname)
+	require.NoError(t, err)
+
+	// Still a valid JPEG.
+	decoded, err := jpeg.Decode(bytes.NewReader(buf))
+	require.NoError(t, err)
+	assert.Equal(t, img.Rect, decoded.Bounds())
+
+	segs := app1Segments(t, buf)
+	require.Len(t, segs, 2)
+
+	require.True(t, bytes.HasPrefix(segs[0], exifIdent))
+	tiff := segs[0][len(exifIdent):]
+	require.Equal(t, []byte("II*\x00"), tiff[:4])
+	tags := map[uint16]string{}
+	exifASCIITags(t, tiff, binary.LittleEndian.Uint32(tiff[4:]), tags)
+	assert.Equal(t, map[uint16]string{
+		exifTagImageDescription:   "Train <north>",
+		exifTagSoftware:           "trainbot",
+		exifTagDateTime:           "2023:06:10 16:20:58",
+		exifTagDateTimeOriginal:   "2023:06:10 16:20:58",
+		exifTagOffsetTimeOriginal: "+02:00",
+		exifTagSubSecTimeOriginal: "805",
+	}, tags)
+
+	require.True(t, bytes.HasPrefix(segs[1], xmpIdent))
+	xmp := string(segs[1][len(xmpIdent):])
+	assert.Contains(t, xmp, "<xmp:CreateDate>2023-06-10T16:20:58.805+02:00</xmp:CreateDate>")
+	assert.Contains(t, xmp, ">Train &lt;north&gt;</rdf:li>")
+	assert.Contains(t, xmp, `xmlns:ex="http://example.com/ns/"`)
+	assert.Contains(t, xmp, "<ex:speed_kph>85.3</ex:speed_kph>")
+	assert.Contains(t, xmp, "<ex:site>A &amp; B</ex:site>")
+}
+
+func Test_EncodeJPEG_NoMetadata(t *testing.T) {
+	img := RandRGBA(123, 100, 50)
+	var withNil, plain bytes.Buffer
+	require.NoError(t, EncodeJPEG(&withNil, img, 90, nil))
+	require.NoError(t, jpeg.Encode(&plain, img, &jpeg.Options{Quality: 90}))
+	assert.Equal(t, plain.Bytes(), withNil.Bytes())
+
+	// Empty metadata still results in valid segments.
+	var empty bytes.Buffer
+	require.NoError(t, EncodeJPEG(&empty, img, 90, &Metadata{}))
+	assert.Len(t, app1Segments(t, empty.Bytes()), 2)
+	_, err := jpeg.Decode(&empty)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,73 @@
+package imutil
+
+import (
+	"image"
+	"math"
+)
+
+// rotateCrop returns the largest rect centered in b, with the same aspect ratio, which still only contains pixels
+// from within b after a rotation by deg degrees around the center of b.
+func rotateCrop(b image.Rectangle, deg float64) image.Rectangle {
+	sin, cos := math.Sincos(deg * math.Pi / 180)
+	sin = math.Abs(sin)
+
+	// Half extents, between pixel centers.
+	cx, cy := float64(b.Dx()-1)/2, float64(b.Dy()-1)/2
+	if cx <= 0 || cy <= 0 {
+		return b
+	}
+	scale := math.Min(cx/(cx*cos+cy*sin), cy/(cx*sin+cy*cos))
+	// Tolerance for rounding errors.
+	const eps = 1e-9
+	hx, hy := cx*scale+eps, cy*scale+eps
+
+	return image.Rect(
+		int(math.Ceil(cx-hx)), int(math.Ceil(cy-hy)),
+		int(math.Floor(cx+hx))+1, int(math.Floor(cy+hy))+1,
+	).Add(b.Min)
+}
+
+// Rotate returns a copy of img, rotated clockwise by deg degrees around its center, with bilinear interpolation.
+// The corners which would come from outside of img are cropped: the bounds are the largest rect centered within
+// the bounds of img, with the same aspect ratio, which only contains valid pixels. Coordinates are kept.
+func Rotate(img image.Image, deg float64) *image.RGBA {
+	src := ToRGBA(img)
+	b := img.Bounds()
+	crop := rotateCrop(b, deg)
+	ret := image.NewRGBA(crop)
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+
+	sin, cos := math.Sincos(deg * math.Pi / 180)
+	cx, cy := float64(w-1)/2, float64(h-1)/2
+	x0, y0 := crop.Min.X-b.Min.X, crop.Min.Y-b.Min.Y
+	for y := y0; y < y0+crop.Dy(); y++ {
+		// Inverse rotation, to find the source pixel (y axis points down, so this is counterclockwise).
+		// The source position moves by (cos, -sin) per output pixel.
+		dx, dy := float64(x0)-cx, float64(y)-cy
+		sx, sy := cx+dx*cos+dy*sin, cy-dx*sin+dy*cos
+		o := ret.PixOffset(crop.Min.X, b.Min.Y+y)
+		for range crop.Dx() {
+			// Only rounding errors can lead outside.
+			px := math.Min(math.Max(sx, 0), float64(w-1))
+			py := math.Min(math.Max(sy, 0), float64(h-1))
+
+			ix, iy := int(px), int(py)
+			ix1, iy1 := min(ix+1, w-1), min(iy+1, h-1)
+			fx, fy := px-float64(ix), py-float64(iy)
+
+			i00, i01 := src.PixOffset(ix, iy), src.PixOffset(ix1, iy)
+			i10, i11 := src.PixOffset(ix, iy1), src.PixOffset(ix1, iy1)
+			for c := range 4 {
+				top := float64(src.Pix[i00+c])*(1-fx) + float64(src.Pix[i01+c])*fx
+				bottom := float64(src.Pix[i10+c])*(1-fx) + float64(src.Pix[i11+c])*fx
+				ret.Pix[o+c] = uint8(top*(1-fy) + bottom*fy + 0.5)
+			}
+
+			o += 4
+			sx += cos
+			sy -= sin
+		}
+	}
+
+	return ret
+}
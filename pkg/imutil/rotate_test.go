@@ -0,0 +1,72 @@
+package imutil
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Rotate_Identity(t *testing.T) {
+	img := RandRGBA(1, 40, 30)
+	sub, err := Sub(img, image.Rect(5, 5, 35, 25))
+	assert.NoError(t, err)
+
+	rot := Rotate(sub, 0)
+	assert.Equal(t, sub.Bounds(), rot.Bounds())
+	for y := 5; y < 25; y++ {
+		for x := 5; x < 35; x++ {
+			assert.Equal(t, img.RGBAAt(x, y), rot.RGBAAt(x, y))
+		}
+	}
+}
+
+func Test_Rotate_Clockwise(t *testing.T) {
+	// Horizontal line through the center.
+	img := image.NewRGBA(image.Rect(0, 0, 101, 101))
+	for x := range 101 {
+		img.SetRGBA(x, 50, color.RGBA{255, 255, 255, 255})
+	}
+
+	rot := Rotate(img, 10)
+	brightestY := func(x int) int {
+		best := 0
+		for y := range 101 {
+			if rot.RGBAAt(x, y).R > rot.RGBAAt(x, best).R {
+				best = y
+			}
+		}
+		return best
+	}
+
+	// Clockwise means the line descends to the right (the y axis points down).
+	offset := int(math.Round(40 * math.Tan(10*math.Pi/180)))
+	assert.InDelta(t, 50+offset, brightestY(90), 1)
+	assert.InDelta(t, 50-offset, brightestY(10), 1)
+	assert.Equal(t, 50, brightestY(50))
+}
+
+func Test_Rotate_Crop(t *testing.T) {
+	img := RandRGBA(1, 201, 101)
+	for _, deg := range []float64{-10, -1, 0.5, 3} {
+		rot := Rotate(img, deg)
+		b := rot.Bounds()
+		assert.True(t, b.In(img.Rect), deg)
+		assert.Equal(t, img.Rect.Max.X-b.Max.X, b.Min.X, deg)
+		assert.Equal(t, img.Rect.Max.Y-b.Max.Y, b.Min.Y, deg)
+		assert.InDelta(t, float64(b.Dx())/float64(b.Dy()), 2, 0.1, deg)
+
+		// The corners come from within img.
+		sin, cos := math.Sincos(deg * math.Pi / 180)
+		for _, p := range []image.Point{b.Min, {b.Max.X - 1, b.Min.Y}, {b.Min.X, b.Max.Y - 1}, b.Max.Sub(image.Pt(1, 1))} {
+			dx, dy := float64(p.X)-100, float64(p.Y)-50
+			sx, sy := 100+dx*cos+dy*sin, 50-dx*sin+dy*cos
+			assert.True(t, sx >= -1e-6 && sx <= 200+1e-6 && sy >= -1e-6 && sy <= 100+1e-6, "%f: %v -> %f, %f", deg, p, sx, sy)
+		}
+	}
+
+	// Small angles only crop a few pixels.
+	assert.Equal(t, image.Rect(2, 1, 199, 100), Rotate(img, 0.5).Bounds())
+}
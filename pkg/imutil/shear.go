@@ -0,0 +1,35 @@
+package imutil
+
+import (
+	"image"
+	"math"
+)
+
+// Shear returns a copy of img, in which each row y is shifted to the right by shear*(y-cy) pixels (cy is the
+// vertical center of img), with linear interpolation. The bounds are the same as those of img. Pixels which would
+// come from outside of img are filled with the nearest edge pixel.
+func Shear(img image.Image, shear float64) *image.RGBA {
+	src := ToRGBA(img)
+	b := img.Bounds()
+	ret := image.NewRGBA(b)
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+
+	cy := float64(h-1) / 2
+	for y := range h {
+		shift := shear * (float64(y) - cy)
+		for x := range w {
+			sx := math.Min(math.Max(float64(x)-shift, 0), float64(w-1))
+			x0 := int(sx)
+			x1 := min(x0+1, w-1)
+			fx := sx - float64(x0)
+
+			i0, i1 := src.PixOffset(x0, y), src.PixOffset(x1, y)
+			o := ret.PixOffset(b.Min.X+x, b.Min.Y+y)
+			for c := range 4 {
+				ret.Pix[o+c] = uint8(float64(src.Pix[i0+c])*(1-fx) + float64(src.Pix[i1+c])*fx + 0.5)
+			}
+		}
+	}
+
+	return ret
+}
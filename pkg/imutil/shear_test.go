@@ -0,0 +1,50 @@
+package imutil
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Shear_Identity(t *testing.T) {
+	img := RandRGBA(1, 40, 30)
+	sub, err := Sub(img, image.Rect(5, 5, 35, 25))
+	assert.NoError(t, err)
+
+	sheared := Shear(sub, 0)
+	assert.Equal(t, sub.Bounds(), sheared.Bounds())
+	for y := 5; y < 25; y++ {
+		for x := 5; x < 35; x++ {
+			assert.Equal(t, img.RGBAAt(x, y), sheared.RGBAAt(x, y))
+		}
+	}
+}
+
+func Test_Shear(t *testing.T) {
+	// Vertical line through the center.
+	img := image.NewRGBA(image.Rect(0, 0, 101, 101))
+	for y := range 101 {
+		img.SetRGBA(50, y, color.RGBA{255, 255, 255, 255})
+	}
+
+	sheared := Shear(img, 0.2)
+	brightestX := func(y int) int {
+		best := 0
+		for x := range 101 {
+			if sheared.RGBAAt(x, y).R > sheared.RGBAAt(best, y).R {
+				best = x
+			}
+		}
+		return best
+	}
+
+	// Rows below the center are shifted to the right.
+	assert.Equal(t, 50, brightestX(50))
+	assert.Equal(t, 58, brightestX(90))
+	assert.Equal(t, 42, brightestX(10))
+	// Edges are clamped.
+	assert.Equal(t, img.RGBAAt(0, 100), sheared.RGBAAt(0, 100))
+	assert.Equal(t, img.RGBAAt(100, 0), sheared.RGBAAt(100, 0))
+}
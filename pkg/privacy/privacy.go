@@ -0,0 +1,185 @@
+// Package privacy hides parts of images, e.g. the windows of passing trains in which passengers can be seen.
+package privacy
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"slices"
+)
+
+// Names of the available modes, see Config.Mode.
+const (
+	// ModePixelate replaces each block of pixels by its mean color.
+	ModePixelate = "pixelate"
+	// ModeBlur applies a strong box blur.
+	ModeBlur = "blur"
+)
+
+// ModeNames contains all valid values for Config.Mode.
+var ModeNames = []string{
+	ModePixelate,
+	ModeBlur,
+}
+
+// Block size [px] if Config.BlockPx is 0.
+const defaultBlockPx = 12
+
+// Band is a range of rows [Y0, Y1) of an image, over its full width.
+type Band struct {
+	Y0 int `json:"y0"`
+	Y1 int `json:"y1"`
+}
+
+// Rect is a rectangle in an image.
+type Rect struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+// Config describes which parts of an image to hide, and how.
+// Coordinates are relative to the top left of the image, regardless of its bounds.
+type Config struct {
+	Bands []Band `json:"bands"`
+	Rects []Rect `json:"rects"`
+	// Mode is one of ModeNames, defaults to ModePixelate if empty.
+	Mode string `json:"mode"`
+	// BlockPx is the size of the pixelation blocks, or the radius of the blur [px]. Defaults to 12 if 0.
+	BlockPx int `json:"block_px"`
+}
+
+// Enabled returns true if any part of an image is hidden.
+func (c *Config) Enabled() bool {
+	return len(c.Bands) > 0 || len(c.Rects) > 0
+}
+
+// Check returns an error if the configuration is invalid.
+func (c *Config) Check() error {
+	for _, b := range c.Bands {
+		if b.Y0 < 0 || b.Y1 <= b.Y0 {
+			return fmt.Errorf("invalid band %d-%d", b.Y0, b.Y1)
+		}
+	}
+	for _, r := range c.Rects {
+		if r.X < 0 || r.Y < 0 || r.W <= 0 || r.H <= 0 {
+			return fmt.Errorf("invalid rect %d,%d,%d,%d", r.X, r.Y, r.W, r.H)
+		}
+	}
+	if c.Mode != "" && !slices.Contains(ModeNames, c.Mode) {
+		return fmt.Errorf("invalid mode '%s'", c.Mode)
+	}
+	if c.BlockPx < 0 {
+		return errors.New("block size must not be negative")
+	}
+	return nil
+}
+
+func (c *Config) blockPx() int {
+	if c.BlockPx == 0 {
+		return defaultBlockPx
+	}
+	return c.BlockPx
+}
+
+// areas returns the parts of an image with bounds b to hide, in its coordinates.
+func (c *Config) areas(b image.Rectangle) []image.Rectangle {
+	var ret []image.Rectangle
+	for _, band := range c.Bands {
+		ret = append(ret, image.Rect(b.Min.X, b.Min.Y+band.Y0, b.Max.X, b.Min.Y+band.Y1).Intersect(b))
+	}
+	for _, r := range c.Rects {
+		ret = append(ret, image.Rect(r.X, r.Y, r.X+r.W, r.Y+r.H).Add(b.Min).Intersect(b))
+	}
+	return ret
+}
+
+// Apply returns a copy of img, with the configured parts hidden. The bounds are kept.
+func (c *Config) Apply(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	ret := image.NewRGBA(b)
+	if src, ok := img.(*image.RGBA); ok {
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			copy(ret.Pix[ret.PixOffset(b.Min.X, y):ret.PixOffset(b.Max.X, y)], src.Pix[src.PixOffset(b.Min.X, y):src.PixOffset(b.Max.X, y)])
+		}
+	} else {
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				ret.Set(x, y, img.At(x, y))
+			}
+		}
+	}
+
+	for _, a := range c.areas(b) {
+		if a.Empty() {
+			continue
+		}
+		if c.Mode == ModeBlur {
+			blur(ret, a, c.blockPx())
+		} else {
+			pixelate(ret, a, c.blockPx())
+		}
+	}
+	return ret
+}
+
+// pixelate replaces each block (aligned to the top left of area) in area of img by its mean color.
+func pixelate(img *image.RGBA, area image.Rectangle, block int) {
+	for by := area.Min.Y; by < area.Max.Y; by += block {
+		for bx := area.Min.X; bx < area.Max.X; bx += block {
+			r := image.Rect(bx, by, bx+block, by+block).Intersect(area)
+			var sum [4]int
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				for x := r.Min.X; x < r.Max.X; x++ {
+					i := img.PixOffset(x, y)
+					for c := range sum {
+						sum[c] += int(img.Pix[i+c])
+					}
+				}
+			}
+			n := r.Dx() * r.Dy()
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				for x := r.Min.X; x < r.Max.X; x++ {
+					i := img.PixOffset(x, y)
+					for c := range sum {
+						img.Pix[i+c] = uint8((sum[c] + n/2) / n)
+					}
+				}
+			}
+		}
+	}
+}
+
+// boxBlurLine blurs n values (4 channels each) starting at offset o, step apart, with a box of the given radius.
+// Values outside of the line are clamped, so that nothing from outside is used.
+func boxBlurLine(pix []uint8, o, step, n, radius int, buf []int) {
+	for c := range 4 {
+		for i := range n {
+			buf[i] = int(pix[o+i*step+c])
+		}
+		// Sliding window sum.
+		sum := 0
+		for i := -radius; i <= radius; i++ {
+			sum += buf[min(max(i, 0), n-1)]
+		}
+		for i := range n {
+			pix[o+i*step+c] = uint8((sum + radius) / (2*radius + 1))
+			sum += buf[min(i+radius+1, n-1)] - buf[max(i-radius, 0)]
+		}
+	}
+}
+
+// blur applies a box blur (3 passes, which is close to a gaussian) with the given radius to area of img.
+// Only pixels within area are used.
+func blur(img *image.RGBA, area image.Rectangle, radius int) {
+	buf := make([]int, max(area.Dx(), area.Dy()))
+	for range 3 {
+		for y := area.Min.Y; y < area.Max.Y; y++ {
+			boxBlurLine(img.Pix, img.PixOffset(area.Min.X, y), 4, area.Dx(), radius, buf)
+		}
+		for x := area.Min.X; x < area.Max.X; x++ {
+			boxBlurLine(img.Pix, img.PixOffset(x, area.Min.Y), img.Stride, area.Dy(), radius, buf)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package privacy
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// checkerboard returns an image with 1px black and white squares.
+func checkerboard(r image.Rectangle) *image.RGBA {
+	img := image.NewRGBA(r)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			v := uint8(0)
+			if (x+y)%2 == 0 {
+				v = 0xff
+			}
+			img.SetRGBA(x, y, color.RGBA{v, v, v, 0xff})
+		}
+	}
+	return img
+}
+
+func Test_Config_Check(t *testing.T) {
+	assert.NoError(t, (&Config{}).Check())
+	assert.NoError(t, (&Config{Bands: []Band{{0, 10}}, Rects: []Rect{{1, 2, 3, 4}}, Mode: ModeBlur}).Check())
+	assert.Error(t, (&Config{Bands: []Band{{10, 10}}}).Check())
+	assert.Error(t, (&Config{Rects: []Rect{{0, 0, 0, 4}}}).Check())
+	assert.Error(t, (&Config{Mode: "smudge"}).Check())
+	assert.Error(t, (&Config{BlockPx: -1}).Check())
+}
+
+func Test_Apply_Pixelate(t *testing.T) {
+	img := checkerboard(image.Rect(10, 20, 50, 60))
+	c := Config{Bands: []Band{{4, 8}}, Rects: []Rect{{X: 36, Y: 30, W: 100, H: 4}}, BlockPx: 4}
+	require.True(t, c.Enabled())
+
+	ret := c.Apply(img)
+	assert.Equal(t, img.Rect, ret.Rect)
+	// Original is not changed.
+	assert.Equal(t, checkerboard(img.Rect).Pix, img.Pix)
+
+	// Rows 4..7 relative to the top are flat gray.
+	for x := 10; x < 50; x++ {
+		for y := 24; y < 28; y++ {
+			assert.Equal(t, color.RGBA{0x80, 0x80, 0x80, 0xff}, ret.RGBAAt(x, y))
+		}
+	}
+	assert.Equal(t, img.RGBAAt(10, 23), ret.RGBAAt(10, 23))
+	assert.Equal(t, img.RGBAAt(10, 28), ret.RGBAAt(10, 28))
+
+	// Rect is clipped to the image.
+	assert.Equal(t, color.RGBA{0x80, 0x80, 0x80, 0xff}, ret.RGBAAt(49, 50))
+	assert.Equal(t, img.RGBAAt(45, 50), ret.RGBAAt(45, 50))
+	assert.Equal(t, img.RGBAAt(49, 54), ret.RGBAAt(49, 54))
+}
+
+func Test_Apply_Blur(t *testing.T) {
+	img := checkerboard(image.Rect(0, 0, 30, 30))
+	// Different color outside, which must not bleed in.
+	for x := range 30 {
+		img.SetRGBA(x, 9, color.RGBA{0xff, 0, 0, 0xff})
+	}
+	c := Config{Bands: []Band{{10, 20}}, Mode: ModeBlur, BlockPx: 3}
+
+	ret := c.Apply(img)
+	for y := 10; y < 20; y++ {
+		for x := range 30 {
+			px := ret.RGBAAt(x, y)
+			assert.Equal(t, px.R, px.G)
+			assert.InDelta(t, 0x80, int(px.R), 16)
+		}
+	}
+	assert.Equal(t, img.RGBAAt(3, 9), ret.RGBAAt(3, 9))
+}
+
+func Test_Apply_Disabled(t *testing.T) {
+	img := checkerboard(image.Rect(0, 0, 10, 10))
+	c := Config{}
+	assert.False(t, c.Enabled())
+	assert.Equal(t, img, c.Apply(img))
+	// Other image types are converted.
+	gray := image.NewGray(image.Rect(0, 0, 10, 10))
+	assert.IsType(t, &image.RGBA{}, c.Apply(gray))
+}
@@ -173,16 +173,16 @@ func Ransac(x, y []float64, model ModelFn, nParams int, p MetaParams) (*optimize
 }
 
 // Plot is a helper to plot the results of a RANSAC iteration.
-func Plot(path string, x, y []float64, ps []float64, fn ModelFn, labelX, labelY string) {
+// The data points (x, y) are plotted in blue, the model fn with params ps in red (if fn is not nil).
+// The axes are scaled to the data points. The format is determined by the file ending (e.g. .png, .svg).
+func Plot(path string, x, y []float64, ps []float64, fn ModelFn, labelX, labelY string) error {
+	if len(x) != len(y) {
+		return errors.New("x and y must have same length")
+	}
 	p := hplot.New()
 
 	p.X.Label.Text = labelX
-	p.X.Min = -0
-	p.X.Max = +10
-
 	p.Y.Label.Text = labelY
-	p.Y.Min = 0
-	p.Y.Max = 1200
 
 	s := hplot.NewS2D(hplot.ZipXY(x, y))
 	s.Color = color.RGBA{0, 0, 255, 255}
@@ -199,8 +199,5 @@ func Plot(path string, x, y []float64, ps []float64, fn ModelFn, labelX, labelY
 
 	p.Add(plotter.NewGrid())
 
-	err := p.Save(20*vg.Centimeter, -1, path)
-	if err != nil {
-		panic(err)
-	}
+	return p.Save(20*vg.Centimeter, -1, path)
 }
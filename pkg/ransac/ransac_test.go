@@ -2,10 +2,12 @@ package ransac
 
 import (
 	"math/rand"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"jo-m.ch/go/trainbot/pkg/imutil"
 )
 
 func Test_sample(t *testing.T) {
@@ -94,6 +96,24 @@ func Test_Ransac2(t *testing.T) {
 	require.InDelta(t, 0.2, fit.X[2], 0.015)
 }
 
+func Test_Plot(t *testing.T) {
+	x := []float64{100, 101, 102, 103, 104}
+	y := []float64{-5000, -4000, -3500, -3000, -1000}
+	model := func(x float64, params []float64) float64 {
+		return params[0] + params[1]*x
+	}
+
+	path := filepath.Join(t.TempDir(), "plot.png")
+	err := Plot(path, x, y, []float64{-100000, 950}, model, "x", "y")
+	require.NoError(t, err)
+	img, err := imutil.Load(path)
+	require.NoError(t, err)
+	assert.Greater(t, img.Bounds().Dx(), 100)
+
+	err = Plot(path, x, y[1:], nil, nil, "x", "y")
+	assert.Error(t, err)
+}
+
 func Benchmark_Ransac(b *testing.B) {
 	testData := []int{
 		34, 34, 34, 34, 34, 26, 0, 34, 1, 1, 0, 0, 20, 0, 34, 34, 34, 34, 25, 34, 34,
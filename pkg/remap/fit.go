@@ -0,0 +1,194 @@
+package remap
+
+import (
+	"errors"
+	"image"
+	"math"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+const (
+	// Range of K1 which is searched by FitDistortion().
+	fitK1Max = 0.5
+	// Number of steps of the coarse search, before refining.
+	fitK1Steps = 100
+	// Tolerance of the refined K1.
+	fitK1Tol = 1e-6
+)
+
+// straightness returns the variance of the points perpendicular to their best fitting line, relative to the variance
+// along it. It is 0 if the points are on a straight line.
+func straightness(pts []Point) float64 {
+	var mx, my float64
+	for _, p := range pts {
+		mx += p.X
+		my += p.Y
+	}
+	mx /= float64(len(pts))
+	my /= float64(len(pts))
+
+	var sxx, sxy, syy float64
+	for _, p := range pts {
+		dx, dy := p.X-mx, p.Y-my
+		sxx += dx * dx
+		sxy += dx * dy
+		syy += dy * dy
+	}
+	// Eigenvalues of the 2x2 covariance matrix.
+	mean := (sxx + syy) / 2
+	d := math.Sqrt(math.Max(mean*mean-(sxx*syy-sxy*sxy), 0))
+	if mean+d == 0 {
+		return 0
+	}
+	return (mean - d) / (mean + d)
+}
+
+// FitDistortion estimates K1 of a radial distortion with the given center and radius (see Distortion), from points
+// marked along lines which are straight in reality (e.g. rails, platform edges or the roof edge of a car).
+// Each line needs at least 3 points, lines far from the center are most useful. K2 is left at 0.
+func FitDistortion(lines [][]Point, cx, cy, radiusPx float64) (Distortion, error) {
+	if len(lines) == 0 {
+		return Distortion{}, errors.New("no lines")
+	}
+	for _, l := range lines {
+		if len(l) < 3 {
+			return Distortion{}, errors.New("need at least 3 points per line")
+		}
+	}
+	if radiusPx <= 0 {
+		return Distortion{}, errors.New("radius must be > 0")
+	}
+
+	d := Distortion{CX: cx, CY: cy, RadiusPx: radiusPx}
+	cost := func(k1 float64) float64 {
+		d.K1 = k1
+		sum := 0.
+		undist := []Point{}
+		for _, l := range lines {
+			undist = undist[:0]
+			for _, p := range l {
+				undist = append(undist, d.Undistort(p))
+			}
+			sum += straightness(undist)
+		}
+		return sum
+	}
+
+	// Coarse search, as the cost might have local minima.
+	step := 2 * fitK1Max / fitK1Steps
+	best, bestCost := 0., cost(0)
+	for i := range fitK1Steps + 1 {
+		k1 := -fitK1Max + float64(i)*step
+		if c := cost(k1); c < bestCost {
+			best, bestCost = k1, c
+		}
+	}
+
+	// Golden section search around the best step.
+	invPhi := (math.Sqrt(5) - 1) / 2
+	a, b := best-step, best+step
+	for b-a > fitK1Tol {
+		x1, x2 := b-invPhi*(b-a), a+invPhi*(b-a)
+		if cost(x1) < cost(x2) {
+			b = x2
+		} else {
+			a = x1
+		}
+	}
+
+	d.K1 = (a + b) / 2
+	return d, nil
+}
+
+// HomographyFromPoints returns the homography which maps each of the 4 points src to the corresponding point in dst.
+func HomographyFromPoints(src, dst [4]Point) (Homography, error) {
+	// Direct linear transform with h[8] = 1, 2 equations per point.
+	a := mat.NewDense(8, 8, nil)
+	b := mat.NewVecDense(8, nil)
+	for i := range 4 {
+		x, y := src[i].X, src[i].Y
+		u, v := dst[i].X, dst[i].Y
+		a.SetRow(2*i, []float64{x, y, 1, 0, 0, 0, -x * u, -y * u})
+		a.SetRow(2*i+1, []float64{0, 0, 0, x, y, 1, -x * v, -y * v})
+		b.SetVec(2*i, u)
+		b.SetVec(2*i+1, v)
+	}
+
+	var h mat.VecDense
+	err := h.SolveVec(a, b)
+	if err != nil {
+		return Homography{}, err
+	}
+
+	ret := Homography{}
+	for i := range 8 {
+		ret[i] = h.AtVec(i)
+	}
+	ret[8] = 1
+	return ret, nil
+}
+
+func dist(a, b Point) float64 {
+	return math.Hypot(a.X-b.X, a.Y-b.Y)
+}
+
+// RectifyQuad returns the homography which maps a quadrilateral to an axis aligned rectangle with the same center and
+// about the same size. The quadrilateral is given clockwise from the top left, and should be a rectangle in reality
+// (e.g. the side of a car), seen in perspective.
+func RectifyQuad(quad [4]Point) (Homography, error) {
+	var cx, cy float64
+	for _, p := range quad {
+		cx += p.X / 4
+		cy += p.Y / 4
+	}
+	w := (dist(quad[0], quad[1]) + dist(quad[3], quad[2])) / 2
+	h := (dist(quad[0], quad[3]) + dist(quad[1], quad[2])) / 2
+	if w == 0 || h == 0 {
+		return Homography{}, errors.New("degenerate quadrilateral")
+	}
+
+	rect := [4]Point{
+		{cx - w/2, cy - h/2},
+		{cx + w/2, cy - h/2},
+		{cx + w/2, cy + h/2},
+		{cx - w/2, cy + h/2},
+	}
+	return HomographyFromPoints(quad, rect)
+}
+
+// Fit computes the parameters to correct frames from points marked in the camera picture with the given bounds.
+// The distortion is estimated from lines (see FitDistortion(), centered in the picture), if there are any.
+// The perspective is corrected by rectifying quad (see RectifyQuad()), if it is not nil.
+func Fit(bounds image.Rectangle, lines [][]Point, quad *[4]Point) (Params, error) {
+	ret := Params{}
+
+	if len(lines) > 0 {
+		c := bounds.Min.Add(bounds.Max)
+		r := math.Hypot(float64(bounds.Dx()), float64(bounds.Dy())) / 2
+		d, err := FitDistortion(lines, float64(c.X)/2, float64(c.Y)/2, r)
+		if err != nil {
+			return Params{}, err
+		}
+		ret.Distortion = &d
+	}
+
+	if quad != nil {
+		q := *quad
+		if ret.Distortion != nil {
+			for i := range q {
+				q[i] = ret.Distortion.Undistort(q[i])
+			}
+		}
+		h, err := RectifyQuad(q)
+		if err != nil {
+			return Params{}, err
+		}
+		ret.Homography = &h
+	}
+
+	if ret.Distortion == nil && ret.Homography == nil {
+		return Params{}, errors.New("need lines or a quadrilateral")
+	}
+	return ret, nil
+}
@@ -0,0 +1,90 @@
+package remap
+
+import (
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func distortedLine(d Distortion, a, b Point, n int) []Point {
+	ret := []Point{}
+	for i := range n {
+		f := float64(i) / float64(n-1)
+		ret = append(ret, d.Distort(Point{a.X + f*(b.X-a.X), a.Y + f*(b.Y-a.Y)}))
+	}
+	return ret
+}
+
+func Test_FitDistortion(t *testing.T) {
+	for _, k1 := range []float64{-0.15, -0.03, 0, 0.08} {
+		d := Distortion{CX: 320, CY: 240, RadiusPx: 400, K1: k1}
+		lines := [][]Point{
+			distortedLine(d, Point{20, 30}, Point{620, 40}, 7),
+			distortedLine(d, Point{10, 450}, Point{630, 420}, 7),
+		}
+
+		fit, err := FitDistortion(lines, 320, 240, 400)
+		require.NoError(t, err)
+		assert.InDelta(t, k1, fit.K1, 1e-4)
+	}
+
+	_, err := FitDistortion([][]Point{{{0, 0}, {1, 1}}}, 320, 240, 400)
+	assert.Error(t, err)
+}
+
+func Test_HomographyFromPoints(t *testing.T) {
+	src := [4]Point{{10, 20}, {200, 10}, {220, 150}, {5, 130}}
+	dst := [4]Point{{0, 0}, {100, 0}, {100, 50}, {0, 50}}
+	h, err := HomographyFromPoints(src, dst)
+	require.NoError(t, err)
+	for i := range src {
+		p := h.Apply(src[i])
+		assert.InDelta(t, dst[i].X, p.X, 1e-6)
+		assert.InDelta(t, dst[i].Y, p.Y, 1e-6)
+	}
+}
+
+func Test_RectifyQuad(t *testing.T) {
+	quad := [4]Point{{100, 100}, {300, 80}, {300, 220}, {100, 200}}
+	h, err := RectifyQuad(quad)
+	require.NoError(t, err)
+
+	p := [4]Point{}
+	for i := range quad {
+		p[i] = h.Apply(quad[i])
+	}
+	assert.InDelta(t, p[0].Y, p[1].Y, 1e-6)
+	assert.InDelta(t, p[2].Y, p[3].Y, 1e-6)
+	assert.InDelta(t, p[0].X, p[3].X, 1e-6)
+	assert.InDelta(t, p[1].X, p[2].X, 1e-6)
+	assert.InDelta(t, 200, p[1].X-p[0].X, 1)
+	assert.InDelta(t, 120, p[3].Y-p[0].Y, 1)
+}
+
+func Test_Fit(t *testing.T) {
+	bounds := image.Rect(0, 0, 640, 480)
+	d := Distortion{CX: 320, CY: 240, RadiusPx: 400, K1: -0.1}
+	lines := [][]Point{
+		distortedLine(d, Point{20, 30}, Point{620, 40}, 7),
+		distortedLine(d, Point{10, 450}, Point{630, 420}, 7),
+	}
+	quad := [4]Point{}
+	for i, p := range []Point{{100, 100}, {500, 80}, {500, 400}, {100, 380}} {
+		quad[i] = d.Distort(p)
+	}
+
+	p, err := Fit(bounds, lines, &quad)
+	require.NoError(t, err)
+	require.NotNil(t, p.Distortion)
+	require.NotNil(t, p.Homography)
+	assert.InDelta(t, -0.1, p.Distortion.K1, 1e-4)
+	// Corners end up on a rectangle.
+	tl := p.Homography.Apply(p.Distortion.Undistort(quad[0]))
+	tr := p.Homography.Apply(p.Distortion.Undistort(quad[1]))
+	assert.InDelta(t, tl.Y, tr.Y, 1e-3)
+
+	_, err = Fit(bounds, nil, nil)
+	assert.Error(t, err)
+}
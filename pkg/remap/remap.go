@@ -0,0 +1,233 @@
+// Package remap corrects lens distortion and perspective of camera frames, using a precomputed lookup table.
+package remap
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+
+	"jo-m.ch/go/trainbot/pkg/imutil"
+)
+
+// Iterations to invert the distortion, see Distortion.Undistort().
+const undistortIterations = 20
+
+// Point is a point in image coordinates [px].
+type Point struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// Distortion is a radial lens distortion (the radial part of the Brown-Conrady model).
+// An undistorted point at normalized distance r from the center is moved to distance r*(1 + K1*r^2 + K2*r^4).
+// Barrel distortion (usual for wide angle lenses) has negative coefficients.
+type Distortion struct {
+	// Center of the distortion (optical center) [px].
+	CX float64 `json:"cx"`
+	CY float64 `json:"cy"`
+	// RadiusPx is the distance from the center at which the normalized distance is 1, e.g. half the diagonal of
+	// the camera picture [px].
+	RadiusPx float64 `json:"radius_px"`
+	K1       float64 `json:"k1"`
+	K2       float64 `json:"k2"`
+}
+
+func (d *Distortion) factor(dx, dy float64) float64 {
+	r2 := (dx*dx + dy*dy) / (d.RadiusPx * d.RadiusPx)
+	return 1 + d.K1*r2 + d.K2*r2*r2
+}
+
+// Distort returns where an undistorted point appears in the camera picture.
+func (d *Distortion) Distort(p Point) Point {
+	dx, dy := p.X-d.CX, p.Y-d.CY
+	f := d.factor(dx, dy)
+	return Point{d.CX + dx*f, d.CY + dy*f}
+}
+
+// Undistort returns the undistorted position of a point from the camera picture. This is the inverse of Distort(),
+// found iteratively.
+func (d *Distortion) Undistort(p Point) Point {
+	dx, dy := p.X-d.CX, p.Y-d.CY
+	ux, uy := dx, dy
+	for range undistortIterations {
+		f := d.factor(ux, uy)
+		ux, uy = dx/f, dy/f
+	}
+	return Point{d.CX + ux, d.CY + uy}
+}
+
+// Homography is a perspective transformation, as a 3x3 matrix in row-major order.
+type Homography [9]float64
+
+// Identity is the homography which does not change anything.
+var Identity = Homography{1, 0, 0, 0, 1, 0, 0, 0, 1}
+
+// Apply transforms a point.
+func (h *Homography) Apply(p Point) Point {
+	w := h[6]*p.X + h[7]*p.Y + h[8]
+	return Point{(h[0]*p.X + h[1]*p.Y + h[2]) / w, (h[3]*p.X + h[4]*p.Y + h[5]) / w}
+}
+
+// Inverse returns the inverse transformation. Returns false if h is singular.
+func (h *Homography) Inverse() (Homography, bool) {
+	// Adjugate matrix.
+	inv := Homography{
+		h[4]*h[8] - h[5]*h[7], h[2]*h[7] - h[1]*h[8], h[1]*h[5] - h[2]*h[4],
+		h[5]*h[6] - h[3]*h[8], h[0]*h[8] - h[2]*h[6], h[2]*h[3] - h[0]*h[5],
+		h[3]*h[7] - h[4]*h[6], h[1]*h[6] - h[0]*h[7], h[0]*h[4] - h[1]*h[3],
+	}
+	det := h[0]*inv[0] + h[1]*inv[3] + h[2]*inv[6]
+	if math.Abs(det) < 1e-12 {
+		return Homography{}, false
+	}
+	for i := range inv {
+		inv[i] /= det
+	}
+	return inv, true
+}
+
+// Params describe how to correct frames. Coordinates are those of the full camera picture, so that the same
+// parameters can be used for all regions.
+type Params struct {
+	// Distortion is undone first. Nil if there is none.
+	Distortion *Distortion `json:"distortion,omitempty"`
+	// Homography maps the undistorted picture to the corrected one, e.g. to make the side of a train rectangular.
+	// Nil if there is none.
+	Homography *Homography `json:"homography,omitempty"`
+}
+
+// Check returns an error if the parameters cannot be used.
+func (p *Params) Check() error {
+	if p.Distortion != nil && p.Distortion.RadiusPx <= 0 {
+		return errors.New("distortion radius must be > 0")
+	}
+	if p.Homography != nil {
+		if _, ok := p.Homography.Inverse(); !ok {
+			return errors.New("homography is singular")
+		}
+	}
+	return nil
+}
+
+// Map is a lookup table to remap frames which were cropped from the camera picture.
+// For each pixel of the corrected frame, it holds the top left of the 4 source pixels and the weights for
+// bilinear interpolation (in 1/256). Pixels which would come from outside of the frame are left transparent, so that
+// the edge pixels are not smeared into the corners (see Mask()).
+type Map struct {
+	size image.Point
+	// x0 is -1 for pixels which come from outside of the frame.
+	x0, y0 []int32
+	fx, fy []uint16
+}
+
+// New precomputes the lookup table for frames cropped to rect (in the coordinates of the full camera picture).
+func New(rect image.Rectangle, p Params) (*Map, error) {
+	w, h := rect.Dx(), rect.Dy()
+	if w < 2 || h < 2 {
+		return nil, errors.New("rect too small")
+	}
+	err := p.Check()
+	if err != nil {
+		return nil, err
+	}
+
+	m := Map{
+		size: rect.Size(),
+		x0:   make([]int32, w*h),
+		y0:   make([]int32, w*h),
+		fx:   make([]uint16, w*h),
+		fy:   make([]uint16, w*h),
+	}
+	// Split a source coordinate into the first pixel and the weight of the second one.
+	// Returns false if it is outside of the frame.
+	split := func(s float64, n int) (int32, uint16, bool) {
+		// Tolerance for rounding errors.
+		const eps = 1e-6
+		if s < -eps || s > float64(n-1)+eps {
+			return 0, 0, false
+		}
+		s = math.Min(math.Max(s, 0), float64(n-1))
+		i := min(int(s), n-2)
+		return int32(i), uint16(math.Round((s - float64(i)) * 256)), true
+	}
+	// Position in the camera picture which ends up at q in the corrected picture.
+	inv := Identity
+	if p.Homography != nil {
+		inv, _ = p.Homography.Inverse()
+	}
+	source := func(q Point) Point {
+		q = inv.Apply(q)
+		if p.Distortion != nil {
+			q = p.Distortion.Distort(q)
+		}
+		return q
+	}
+	for y := range h {
+		for x := range w {
+			s := source(Point{float64(rect.Min.X + x), float64(rect.Min.Y + y)})
+			i := y*w + x
+			var okX, okY bool
+			m.x0[i], m.fx[i], okX = split(s.X-float64(rect.Min.X), w)
+			m.y0[i], m.fy[i], okY = split(s.Y-float64(rect.Min.Y), h)
+			if !okX || !okY {
+				m.x0[i] = -1
+			}
+		}
+	}
+
+	return &m, nil
+}
+
+// Apply remaps a frame. The frame must have the size of the rect passed to New(), its origin is ignored.
+// The result has the same bounds as the frame.
+func (m *Map) Apply(img image.Image) (*image.RGBA, error) {
+	src, ok := img.(*image.RGBA)
+	if !ok {
+		src = imutil.ToRGBA(img)
+	}
+	if src.Rect.Size() != m.size {
+		return nil, fmt.Errorf("frame size %v does not match map size %v", src.Rect.Size(), m.size)
+	}
+
+	ret := image.NewRGBA(img.Bounds())
+	for i := range m.x0 {
+		if m.x0[i] < 0 {
+			continue
+		}
+		o00 := src.PixOffset(src.Rect.Min.X+int(m.x0[i]), src.Rect.Min.Y+int(m.y0[i]))
+		o01, o10 := o00+4, o00+src.Stride
+		o11 := o10 + 4
+		fx, fy := uint32(m.fx[i]), uint32(m.fy[i])
+		for c := range 4 {
+			top := uint32(src.Pix[o00+c])*(256-fx) + uint32(src.Pix[o01+c])*fx
+			bottom := uint32(src.Pix[o10+c])*(256-fx) + uint32(src.Pix[o11+c])*fx
+			ret.Pix[i*4+c] = uint8((top*(256-fy) + bottom*fy + 1<<15) >> 16)
+		}
+	}
+
+	return ret, nil
+}
+
+// Mask restricts mask to the pixels which come from inside of the frame, i.e. which are not left transparent by
+// Apply(). The result has the size of the rect passed to New(), with its origin at (0, 0). mask must have the same
+// size (its origin is ignored), or be nil to only get the pixels from inside of the frame.
+func (m *Map) Mask(mask image.Image) (*image.Alpha, error) {
+	if mask != nil && mask.Bounds().Size() != m.size {
+		return nil, fmt.Errorf("mask size %v does not match map size %v", mask.Bounds().Size(), m.size)
+	}
+
+	ret := image.NewAlpha(image.Rectangle{Max: m.size})
+	for i := range m.x0 {
+		if m.x0[i] < 0 {
+			continue
+		}
+		ret.Pix[i] = 0xff
+		if mask != nil {
+			x, y := i%m.size.X, i/m.size.X
+			_, _, _, a := mask.At(mask.Bounds().Min.X+x, mask.Bounds().Min.Y+y).RGBA()
+			ret.Pix[i] = uint8(a >> 8)
+		}
+	}
+	return ret, nil
+}
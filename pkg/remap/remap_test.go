@@ -0,0 +1,133 @@
+package remap
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"jo-m.ch/go/trainbot/pkg/imutil"
+)
+
+func Test_Distortion_Roundtrip(t *testing.T) {
+	d := Distortion{CX: 320, CY: 240, RadiusPx: 400, K1: -0.2, K2: 0.05}
+	for _, p := range []Point{{0, 0}, {320, 240}, {600, 50}, {100, 400}} {
+		u := d.Undistort(p)
+		assert.InDelta(t, p.X, d.Distort(u).X, 1e-6)
+		assert.InDelta(t, p.Y, d.Distort(u).Y, 1e-6)
+	}
+	// Barrel distortion moves points towards the center.
+	assert.Less(t, d.Distort(Point{620, 240}).X, 620.)
+}
+
+func Test_Homography_Inverse(t *testing.T) {
+	h := Homography{1.1, 0.2, 5, -0.1, 0.9, -3, 0.0001, 0.0002, 1}
+	inv, ok := h.Inverse()
+	require.True(t, ok)
+	p := Point{123, 45}
+	q := inv.Apply(h.Apply(p))
+	assert.InDelta(t, p.X, q.X, 1e-9)
+	assert.InDelta(t, p.Y, q.Y, 1e-9)
+
+	_, ok = (&Homography{}).Inverse()
+	assert.False(t, ok)
+}
+
+func Test_Map_Identity(t *testing.T) {
+	img := imutil.RandRGBA(1, 40, 30)
+	sub, err := imutil.Sub(img, image.Rect(5, 5, 35, 25))
+	require.NoError(t, err)
+
+	m, err := New(image.Rect(105, 205, 135, 225), Params{Homography: &Identity})
+	require.NoError(t, err)
+	ret, err := m.Apply(sub)
+	require.NoError(t, err)
+	assert.Equal(t, sub.Bounds(), ret.Bounds())
+	for y := 5; y < 25; y++ {
+		for x := 5; x < 35; x++ {
+			assert.Equal(t, img.RGBAAt(x, y), ret.RGBAAt(x, y))
+		}
+	}
+}
+
+func Test_Map_Translation(t *testing.T) {
+	img := imutil.RandRGBA(1, 40, 30)
+	// Moves the picture 3px to the right, so that each pixel comes from 3px further left.
+	h := Homography{1, 0, 3, 0, 1, 0, 0, 0, 1}
+	m, err := New(img.Bounds(), Params{Homography: &h})
+	require.NoError(t, err)
+	ret, err := m.Apply(img)
+	require.NoError(t, err)
+	for y := range 30 {
+		for x := range 40 {
+			if x < 3 {
+				// Outside of the frame.
+				assert.Equal(t, color.RGBA{}, ret.RGBAAt(x, y))
+			} else {
+				assert.Equal(t, img.RGBAAt(x-3, y), ret.RGBAAt(x, y))
+			}
+		}
+	}
+
+	_, err = m.Apply(image.NewRGBA(image.Rect(0, 0, 40, 31)))
+	assert.Error(t, err)
+}
+
+func Test_Map_Mask(t *testing.T) {
+	h := Homography{1, 0, 3, 0, 1, 0, 0, 0, 1}
+	m, err := New(image.Rect(0, 0, 40, 30), Params{Homography: &h})
+	require.NoError(t, err)
+
+	valid, err := m.Mask(nil)
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 40, 30), valid.Rect)
+	assert.Zero(t, valid.AlphaAt(2, 10).A)
+	assert.Equal(t, uint8(0xff), valid.AlphaAt(3, 10).A)
+
+	// Only the pixels which are in the mask and inside of the frame are kept.
+	mask := image.NewAlpha(image.Rect(10, 10, 50, 40))
+	for y := 10; y < 40; y++ {
+		for x := 10; x < 50; x++ {
+			if x < 30 {
+				mask.SetAlpha(x, y, color.Alpha{0x80})
+			}
+		}
+	}
+	ret, err := m.Mask(mask)
+	require.NoError(t, err)
+	assert.Zero(t, ret.AlphaAt(2, 10).A)
+	assert.Equal(t, uint8(0x80), ret.AlphaAt(3, 10).A)
+	assert.Zero(t, ret.AlphaAt(20, 10).A)
+
+	_, err = m.Mask(image.NewAlpha(image.Rect(0, 0, 40, 31)))
+	assert.Error(t, err)
+}
+
+func Test_Map_Distortion(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	d := Distortion{CX: 100, CY: 50, RadiusPx: 112, K1: -0.1}
+	// A distorted line, which should be straight (y = 10).
+	for x := range 200 {
+		p := d.Distort(Point{float64(x), 10})
+		img.Pix[img.PixOffset(x, int(p.Y+0.5))+3] = 255
+	}
+
+	m, err := New(img.Bounds(), Params{Distortion: &d})
+	require.NoError(t, err)
+	ret, err := m.Apply(img)
+	require.NoError(t, err)
+	for _, x := range []int{20, 100, 180} {
+		assert.Greater(t, ret.RGBAAt(x, 10).A, uint8(100), x)
+		assert.Zero(t, ret.RGBAAt(x, 14).A, x)
+	}
+}
+
+func Test_New_Invalid(t *testing.T) {
+	_, err := New(image.Rect(0, 0, 1, 10), Params{})
+	assert.Error(t, err)
+	_, err = New(image.Rect(0, 0, 10, 10), Params{Homography: &Homography{}})
+	assert.Error(t, err)
+	_, err = New(image.Rect(0, 0, 10, 10), Params{Distortion: &Distortion{K1: 1}})
+	assert.Error(t, err)
+}